@@ -2,19 +2,42 @@ package backup
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
 	"time"
 
+	apiv1 "github.com/cloudnative-pg/cloudnative-pg/api/v1"
 	"github.com/cloudnative-pg/cnpg-i-machinery/pkg/logging"
 	"github.com/cloudnative-pg/cnpg-i-machinery/pkg/pluginhelper"
 	"github.com/cloudnative-pg/cnpg-i/pkg/backup"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
-	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/storage"
-
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/catalog"
 	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/executor"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/hooks"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/lock"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/manifest"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/pagechecksum"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/progress"
 	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/repository"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/storage"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/objectstore"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/throttling"
 	"github.com/dougkirkley/plugin-objstore-backup/pkg/metadata"
 )
 
+// onlineParameter is the backup parameter choosing between an
+// online backup and an offline backup of a stopped instance
+const onlineParameter = "online"
+
+// abortedBackupRecordTimeout is the maximum time spent recording
+// an aborted backup in the catalog, or removing a failed one
+const abortedBackupRecordTimeout = 30 * time.Second
+
 // BackupServer is the implementation of the identity service
 type BackupServer struct {
 	backup.BackupServer
@@ -42,7 +65,7 @@ func (BackupServer) GetCapabilities(
 func (BackupServer) Backup(
 	ctx context.Context,
 	request *backup.BackupRequest,
-) (*backup.BackupResult, error) {
+) (_ *backup.BackupResult, err error) {
 	contextLogger := logging.FromContext(ctx)
 
 	helper, err := pluginhelper.NewDataBuilder(metadata.Data.Name, request.ClusterDefinition).Build()
@@ -57,41 +80,496 @@ func (BackupServer) Backup(
 		return nil, err
 	}
 
+	target, err := storage.NewBackupTargetFromParameters(helper.Parameters)
+	if err != nil {
+		contextLogger.Error(err, "Error while reading the backup destination configuration")
+		return nil, err
+	}
+
 	cluster := helper.GetCluster()
+	store := target.Store
+
+	lease, err := lock.Acquire(
+		ctx,
+		store,
+		cluster.Name,
+		cluster.Namespace,
+		lock.BackupLockName,
+		getInstanceID(),
+		backupObject.Name,
+	)
+	if errors.Is(err, lock.ErrLockHeld) {
+		return nil, status.Errorf(codes.FailedPrecondition, "backup already in progress: %v", err)
+	}
+	if err != nil {
+		contextLogger.Error(err, "Error while acquiring the backup lock")
+		return nil, err
+	}
+	defer lease.Release(ctx)
+
+	// The backup is aborted if the lease is lost, as
+	// another backup may be started in the meantime
+	ctx, cancelLease := lease.Context(ctx)
+	defer cancelLease()
+
+	// The status file is only written while holding the backup
+	// lock, so that it always reports the backup being taken
+	tracker := progress.NewTracker(backupObject.Name, storage.GetBackupProgressPath(cluster.Name))
+	stopReporting := tracker.Start(ctx)
+	defer func() {
+		stopReporting()
+		tracker.Finish(ctx, err)
+	}()
+
+	if target.ObjectStore != nil {
+		if err := writeKopiaStorageConfig(ctx, cluster.Name, cluster.Namespace, target.ObjectStore, store); err != nil {
+			contextLogger.Error(err, "Error while writing the Kopia storage configuration")
+			return nil, err
+		}
+	}
+
+	policies, err := repository.NewPolicyConfigurationFromParameters(helper.Parameters)
+	if err != nil {
+		contextLogger.Error(err, "Error while reading the Kopia policy configuration")
+		return nil, err
+	}
+
+	throttlingConfiguration, err := throttling.NewConfigurationFromParameters(helper.Parameters)
+	if err != nil {
+		contextLogger.Error(err, "Error while reading the throttling configuration")
+		return nil, err
+	}
+
 	rep, err := repository.NewRepository(
 		ctx,
-		"s3",
-		storage.GetBasePath(cluster.Name),
+		target.GetRepositoryProvider(),
+		target.GetRepositoryPath(cluster.Name),
 		storage.GetKopiaConfigFilePath(cluster.Name),
 		storage.GetKopiaCacheDirectory(cluster.Name),
+		target.ObjectStore,
+		policies,
+		throttlingConfiguration,
 	)
 	if err != nil {
 		return nil, err
 	}
+	defer func() {
+		_ = rep.Close(ctx)
+	}()
+
+	online, err := isOnline(backupObject, request.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	pinned, keepUntil, err := getKeepPolicy(backupObject, request.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	// Offline backups already contain the WAL files they need
+	selfContained, err := isSelfContained(request.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	selfContained = selfContained && online
+
+	backupHooks, err := hooks.NewFromParameters(helper.Parameters)
+	if err != nil {
+		contextLogger.Error(err, "Error while reading the backup hooks")
+		return nil, err
+	}
+
+	exclusions, err := executor.GetExclusionsFromParameters(helper.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	parallelism, err := executor.GetParallelismFromParameters(helper.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	pageChecksums, err := pagechecksum.NewOptionsFromParameters(helper.Parameters)
+	if err != nil {
+		return nil, err
+	}
 
 	exec := executor.NewLocalExecutor(
 		cluster,
 		backupObject,
 		rep,
+		executor.Options{
+			Online:        online,
+			Hooks:         backupHooks,
+			Exclusions:    exclusions,
+			Parallelism:   parallelism,
+			PageChecksums: pageChecksums,
+			Progress:      tracker,
+		},
 	)
 
 	startedAt := time.Now()
 	backupInfo, err := exec.Backup(ctx)
+	if cause := context.Cause(ctx); err != nil && errors.Is(cause, lock.ErrLeaseLost) {
+		err = fmt.Errorf("%w: %w", cause, err)
+	}
+	if errors.Is(err, executor.ErrBackupAborted) {
+		contextLogger.Info("Backup aborted", "backupName", backupObject.Name, "reason", err.Error())
+		recordAbortedBackup(ctx, catalog.New(cluster.Name, cluster.Namespace, store), &catalog.BackupInfo{
+			BackupName:  backupObject.Name,
+			Phase:       catalog.PhaseAborted,
+			ClusterName: cluster.Name,
+			Namespace:   cluster.Namespace,
+			InstanceID:  getInstanceID(),
+			Online:      online,
+			StartedAt:   startedAt,
+			StoppedAt:   time.Now(),
+			Hooks:       exec.GetHookResults(),
+		})
+		return nil, status.Errorf(codes.Aborted, "backup %s aborted: %v", backupObject.Name, err)
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	// Until the backup is recorded in the catalog and replicated, its
+	// snapshots are not referenced by anything, and are removed when
+	// the backup fails
+	backupSnapshots := exec.GetSnapshots()
+	recorded := false
+	defer func() {
+		if !recorded {
+			discardBackup(ctx, cluster.Name, backupInfo.BackupName, store, rep, backupSnapshots)
+		}
+	}()
+
+	tracker.SetPhase(ctx, progress.PhaseArchivingWAL)
+	if exec.IsOnline() && (exec.IsStandby() || selfContained) {
+		if err := waitForWALArchived(ctx, cluster.Name, helper.Parameters, exec.GetEndWal()); err != nil {
+			contextLogger.Error(err, "Error while waiting for the end WAL to be archived", "walName", exec.GetEndWal())
+			return nil, err
+		}
+	}
+
+	backupManifest := exec.GetManifest()
+	if selfContained {
+		walSnapshot, err := bundleWAL(
+			ctx,
+			cluster.Name,
+			helper.Parameters,
+			rep,
+			exec.GetBeginWal(),
+			exec.GetEndWal(),
+			exec.GetWALSegmentSize(),
+		)
+		if err != nil {
+			contextLogger.Error(err, "Error while bundling the WAL files in the backup")
+			return nil, err
+		}
+		backupSnapshots = append(backupSnapshots, *walSnapshot)
+		executor.AddSnapshotToManifest(backupManifest, walSnapshot)
+	}
+
+	tracker.SetPhase(ctx, progress.PhaseFinalizing)
+	if err := manifest.Put(ctx, backupManifest, cluster.Name, cluster.Namespace, backupInfo.BackupName, store); err != nil {
+		contextLogger.Error(err, "Error while writing the backup manifest")
+		return nil, err
+	}
+
+	// The snapshots are pinned before being recorded in the catalog,
+	// so that a pinned backup is never removed by the retention
+	if pinned {
+		ids := make([]string, 0, len(backupSnapshots))
+		for i := range backupSnapshots {
+			ids = append(ids, backupSnapshots[i].ID)
+		}
+		if err := rep.UpdatePins(ctx, ids, []string{keepPin}, nil); err != nil {
+			contextLogger.Error(err, "Error while pinning the backup snapshots")
+			return nil, err
+		}
+	}
+
+	stoppedAt := time.Now()
+
+	var storageClasses map[objectstore.ObjectType]string
+	if target.ObjectStore != nil {
+		storageClasses = target.ObjectStore.StorageClasses
+	}
+
+	snapshots := newCatalogSnapshots(backupSnapshots)
+	if len(snapshots) == 0 {
+		err := fmt.Errorf("backup %s has no snapshots", backupObject.Name)
+		contextLogger.Error(err, "Error while recording the backup in the catalog")
+		return nil, err
+	}
+	backupCatalog := catalog.New(cluster.Name, cluster.Namespace, store)
+	catalogEntry := &catalog.BackupInfo{
+		BackupName: backupInfo.BackupName,
+		// The ID of the data directory snapshot identifies the
+		// backup, so that it can be traced back to Kopia
+		BackupID:            snapshots[0].ID,
+		Phase:               catalog.PhaseCompleted,
+		ClusterName:         cluster.Name,
+		Namespace:           cluster.Namespace,
+		InstanceID:          getInstanceID(),
+		Standby:             exec.IsStandby(),
+		Online:              exec.IsOnline(),
+		SelfContained:       selfContained,
+		StartedAt:           startedAt,
+		StoppedAt:           stoppedAt,
+		BeginWal:            exec.GetBeginWal(),
+		EndWal:              exec.GetEndWal(),
+		BeginLSN:            string(backupInfo.BeginLSN),
+		EndLSN:              string(backupInfo.EndLSN),
+		Snapshots:           snapshots,
+		SnapshotParallelism: parallelism,
+		Manifest:            storage.GetBackupManifestKey(cluster.Name, backupInfo.BackupName),
+		StorageClasses:      storageClasses,
+		Tags: storage.NewPutOptions(cluster.Name, cluster.Namespace, objectstore.ObjectTypeBase).
+			WithBackupName(backupInfo.BackupName).Tags,
+		Tier:          catalog.TierStandard,
+		Hooks:         exec.GetHookResults(),
+		PageChecksums: exec.GetPageChecksumResult(),
+		Pinned:        pinned,
+		KeepUntil:     keepUntil,
+	}
+	for i := range snapshots {
+		catalogEntry.Stats.Add(snapshots[i].Stats)
+	}
+	contextLogger.Info(
+		"Backup taken",
+		"backupID", catalogEntry.BackupID,
+		"totalBytes", catalogEntry.Stats.TotalBytes,
+		"uploadedBytes", catalogEntry.Stats.UploadedBytes,
+		"dedupRatio", catalogEntry.Stats.GetDedupRatio(),
+	)
+	if err := backupCatalog.Put(ctx, catalogEntry); err != nil {
+		contextLogger.Error(err, "Error while writing the backup catalog")
+		return nil, err
+	}
+
+	if target.ObjectStore != nil {
+		if err := archiveOldObjects(ctx, cluster.Name, target.ObjectStore, store, backupCatalog); err != nil {
+			// The backup has been taken, and archiving will be
+			// retried after the next one
+			contextLogger.Error(err, "Error while moving old objects to the archive tier")
+		}
+	}
+
+	if err := releaseExpiredPins(ctx, backupCatalog, rep); err != nil {
+		// The pins will be released after the next backup
+		contextLogger.Error(err, "Error while releasing the expired backup pins")
+	}
+
+	if err := replicateBackups(ctx, cluster.Name, cluster.Namespace, helper.Parameters, target); err != nil {
+		return nil, err
+	}
+	recorded = true
+
 	return &backup.BackupResult{
-		BackupId:          backupInfo.BackupName,
-		BackupName:        backupInfo.BackupName,
+		BackupId:          catalogEntry.BackupID,
+		BackupName:        catalogEntry.BackupName,
 		StartedAt:         startedAt.Unix(),
-		StoppedAt:         time.Now().Unix(),
-		BeginWal:          exec.GetBeginWal(),
-		EndWal:            exec.GetEndWal(),
-		BeginLsn:          string(backupInfo.BeginLSN),
-		EndLsn:            string(backupInfo.EndLSN),
+		StoppedAt:         stoppedAt.Unix(),
+		BeginWal:          catalogEntry.BeginWal,
+		EndWal:            catalogEntry.EndWal,
+		BeginLsn:          catalogEntry.BeginLSN,
+		EndLsn:            catalogEntry.EndLSN,
 		BackupLabelFile:   backupInfo.LabelFile,
 		TablespaceMapFile: backupInfo.SpcmapFile,
-		Online:            true,
+		InstanceId:        catalogEntry.InstanceID,
+		Online:            catalogEntry.Online,
 	}, nil
 }
+
+// recordAbortedBackup records an aborted backup in the catalog. The
+// context of the backup has been cancelled, so it is not used
+func recordAbortedBackup(ctx context.Context, backupCatalog *catalog.Catalog, info *catalog.BackupInfo) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), abortedBackupRecordTimeout)
+	defer cancel()
+
+	if err := backupCatalog.Put(ctx, info); err != nil {
+		logging.FromContext(ctx).Error(err, "Error while recording the aborted backup in the catalog")
+	}
+}
+
+// discardBackup removes the snapshots, the manifest and the catalog
+// entry of a backup which failed after its data has been copied. The
+// context of the backup may have been cancelled, so it is not used
+func discardBackup(
+	ctx context.Context,
+	clusterName string,
+	backupName string,
+	store storage.Store,
+	rep *repository.Repository,
+	snapshots []repository.SnapshotInfo,
+) {
+	contextLogger := logging.FromContext(ctx).WithValues("backupName", backupName)
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), abortedBackupRecordTimeout)
+	defer cancel()
+
+	// The catalog entry is removed first, so that
+	// it never refers to missing snapshots
+	if err := catalog.New(clusterName, "", store).Delete(ctx, backupName); err != nil {
+		contextLogger.Error(err, "Error while removing the catalog entry of the failed backup")
+	}
+
+	if err := manifest.Delete(ctx, clusterName, backupName, store); err != nil {
+		contextLogger.Error(err, "Error while removing the manifest of the failed backup")
+	}
+
+	for i := range snapshots {
+		contextLogger.Info("Removing snapshot of the failed backup", "snapshotID", snapshots[i].ID)
+		if err := rep.DeleteSnapshot(ctx, snapshots[i].ID); err != nil {
+			contextLogger.Error(err, "Error while removing snapshot of the failed backup",
+				"snapshotID", snapshots[i].ID)
+		}
+	}
+}
+
+// isOnline checks if a backup needs to be taken while PostgreSQL
+// is running. The "online" backup parameter takes precedence over
+// the online setting of the Backup object
+func isOnline(backupObject *apiv1.Backup, parameters map[string]string) (bool, error) {
+	if value, ok := parameters[onlineParameter]; ok {
+		result, err := strconv.ParseBool(value)
+		if err != nil {
+			return false, &objectstore.ParameterError{Name: onlineParameter, Message: "must be true or false"}
+		}
+		return result, nil
+	}
+
+	if backupObject.Spec.Online != nil {
+		return *backupObject.Spec.Online, nil
+	}
+
+	return true, nil
+}
+
+// newCatalogSnapshots converts the Kopia snapshots taken
+// by a backup into their catalog representation
+func newCatalogSnapshots(snapshots []repository.SnapshotInfo) []catalog.SnapshotInfo {
+	result := make([]catalog.SnapshotInfo, len(snapshots))
+	for i := range snapshots {
+		result[i] = catalog.SnapshotInfo{
+			ID:        snapshots[i].ID,
+			Path:      snapshots[i].Path,
+			Tags:      snapshots[i].Tags,
+			StartedAt: snapshots[i].StartTime,
+			StoppedAt: snapshots[i].EndTime,
+			Stats: catalog.Stats{
+				TotalBytes:         snapshots[i].Stats.TotalFileSize,
+				UploadedBytes:      snapshots[i].UploadedBytes,
+				FileCount:          int64(snapshots[i].Stats.TotalFileCount),
+				DirectoryCount:     int64(snapshots[i].Stats.TotalDirectoryCount),
+				CachedFileCount:    int64(snapshots[i].Stats.CachedFiles),
+				NonCachedFileCount: int64(snapshots[i].Stats.NonCachedFiles),
+				ExcludedFileCount:  int64(snapshots[i].Stats.ExcludedFileCount),
+				ErrorCount:         int64(snapshots[i].Stats.ErrorCount),
+			},
+			Exclusions: snapshots[i].Exclusions,
+		}
+	}
+
+	return result
+}
+
+// replicateBackups copies the backups into every destination other
+// than the one where they are kept, so that each of them can be used
+// on its own. When the destination policy is "any", the destinations
+// which failed to receive the backups are caught up in background
+func replicateBackups(
+	ctx context.Context,
+	clusterName string,
+	namespace string,
+	parameters map[string]string,
+	target *storage.BackupTarget,
+) error {
+	contextLogger := logging.FromContext(ctx)
+
+	_, policy, err := storage.GetDestinationsFromParameters(parameters)
+	if err != nil {
+		return err
+	}
+
+	replicas, err := storage.NewBackupReplicasFromParameters(parameters)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, replica := range replicas {
+		replicate := func(ctx context.Context) error {
+			return replicateBackupsInto(ctx, clusterName, namespace, target, replica)
+		}
+
+		contextLogger.Info("Replicating backups", "destination", replica.Destination)
+		err := replicate(ctx)
+		if err == nil {
+			continue
+		}
+
+		if policy == storage.DestinationPolicyAll {
+			errs = append(errs, fmt.Errorf("while replicating backups into %s: %w", replica.Destination, err))
+			continue
+		}
+
+		contextLogger.Error(err, "Error while replicating backups, scheduling catch up",
+			"destination", replica.Destination)
+		storage.RequestCatchUp(ctx, path.Join(storage.GetBaseKey(clusterName), string(replica.Destination)), replicate)
+	}
+
+	return errors.Join(errs...)
+}
+
+// replicateBackupsInto copies the Kopia repository, the manifests and
+// the catalog of the backups of a cluster into a replica, removing the
+// ones which have been deleted. The locks are only kept in the backup
+// target. The repository is opened again, as the replication may be
+// retried in background after the backup has closed it
+func replicateBackupsInto(
+	ctx context.Context,
+	clusterName string,
+	namespace string,
+	target *storage.BackupTarget,
+	replica *storage.BackupTarget,
+) error {
+	rep, err := repository.NewRepository(
+		ctx,
+		target.GetRepositoryProvider(),
+		target.GetRepositoryPath(clusterName),
+		storage.GetKopiaConfigFilePath(clusterName),
+		storage.GetKopiaCacheDirectory(clusterName),
+		target.ObjectStore,
+		nil,
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = rep.Close(ctx)
+	}()
+
+	if err := rep.SyncTo(ctx, replica.GetRepositoryPath(clusterName), replica.ObjectStore); err != nil {
+		return err
+	}
+
+	// The manifests are copied before the catalog
+	// entries referring to them
+	putOptions := storage.NewPutOptions(clusterName, namespace, objectstore.ObjectTypeManifest)
+	err = storage.Mirror(ctx, target.Store, replica.Store, storage.GetManifestsKey(clusterName),
+		func(key string) storage.PutOptions {
+			return putOptions.WithBackupName(path.Base(path.Dir(key)))
+		})
+	if err != nil {
+		return err
+	}
+
+	return storage.Mirror(ctx, target.Store, replica.Store, storage.GetCatalogKey(clusterName),
+		func(key string) storage.PutOptions {
+			return putOptions.WithBackupName(strings.TrimSuffix(path.Base(key), ".json"))
+		})
+}
@@ -0,0 +1,98 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/catalog"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/manifest"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/provider"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/repository"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/storage"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/storage/s3test"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/objectstore"
+)
+
+// newTestS3Store creates a store kept inside an in-memory
+// bucket, configured by a set of additional parameters
+func newTestS3Store(
+	t *testing.T,
+	parameters map[string]string,
+) (storage.Store, *objectstore.Configuration, *s3test.Server) {
+	t.Helper()
+
+	// Requests are not signed without credentials
+	for _, name := range []string{"AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY", "AWS_SECRET_ACCESS_KEY", "AWS_SECRET_KEY"} {
+		t.Setenv(name, "")
+	}
+
+	server := s3test.NewServer()
+	t.Cleanup(server.Close)
+
+	configuration, err := objectstore.NewConfigurationFromParameters(server.Parameters(parameters))
+	if err != nil {
+		t.Fatalf("unexpected error reading the configuration: %v", err)
+	}
+	store, err := storage.NewS3Store(string(storage.DestinationS3), configuration)
+	if err != nil {
+		t.Fatalf("unexpected error creating the store: %v", err)
+	}
+
+	return store, configuration, server
+}
+
+func TestDiscardBackup(t *testing.T) {
+	t.Setenv("KOPIA_PASSWORD", "password")
+	ctx := context.Background()
+	store, _, server := newTestS3Store(t, nil)
+
+	directory := t.TempDir()
+	rep, err := repository.NewRepository(
+		ctx,
+		provider.Filesystem.String(),
+		path.Join(directory, "repository"),
+		path.Join(directory, "kopia.config"),
+		path.Join(directory, "cache"),
+		nil,
+		nil,
+		nil,
+	)
+	if err != nil {
+		t.Fatalf("unexpected error opening the repository: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = rep.Close(ctx)
+	})
+
+	source := t.TempDir()
+	if err := os.WriteFile(path.Join(source, "PG_VERSION"), []byte("16"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	snapshotInfo, err := rep.Snapshot(ctx, source, repository.SnapshotOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error taking the snapshot: %v", err)
+	}
+
+	if err := manifest.Put(ctx, &manifest.Manifest{}, "cluster", "default", "backup", store); err != nil {
+		t.Fatalf("unexpected error writing the manifest: %v", err)
+	}
+	backupCatalog := catalog.New("cluster", "default", store)
+	if err := backupCatalog.Put(ctx, &catalog.BackupInfo{BackupName: "backup"}); err != nil {
+		t.Fatalf("unexpected error writing the catalog: %v", err)
+	}
+
+	discardBackup(ctx, "cluster", "backup", store, rep, []repository.SnapshotInfo{*snapshotInfo})
+
+	if keys := server.Keys(); len(keys) != 0 {
+		t.Fatalf("expected the manifest and the catalog entry to be removed, found %v", keys)
+	}
+	if _, err := backupCatalog.Get(ctx, "backup"); !errors.Is(err, storage.ErrObjectNotFound) {
+		t.Fatalf("expected the catalog entry to be missing, got %v", err)
+	}
+	if _, err := rep.ChecksumSnapshot(ctx, snapshotInfo.ID); err == nil {
+		t.Fatal("expected the snapshot to be removed")
+	}
+}
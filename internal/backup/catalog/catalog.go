@@ -0,0 +1,388 @@
+// Package catalog contains the catalog of the backups taken by this
+// plugin, which is kept in the object store together with the backups
+package catalog
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/hooks"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/pagechecksum"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/storage"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/objectstore"
+)
+
+// Tier is the storage tier where the WAL files needed by a backup
+// to reach consistency are kept. The snapshots are always readable
+type Tier string
+
+const (
+	// TierStandard is the storage tier where WAL files are written
+	TierStandard Tier = "standard"
+
+	// TierArchive is the storage tier where old WAL files are moved.
+	// Objects in this tier need to be rehydrated before being read
+	TierArchive Tier = "archive"
+)
+
+// Phase is the outcome of a backup
+type Phase string
+
+const (
+	// PhaseCompleted is the phase of a backup that can be restored
+	PhaseCompleted Phase = "completed"
+
+	// PhaseAborted is the phase of a backup which has been cancelled
+	// before completing. Its snapshots have been removed
+	PhaseAborted Phase = "aborted"
+)
+
+// BackupInfo is the information about a backup kept in the catalog
+type BackupInfo struct {
+	// BackupName is the name of the Backup object
+	BackupName string `json:"backupName"`
+
+	// BackupID is the ID of the backup
+	BackupID string `json:"backupId"`
+
+	// Phase is the outcome of the backup
+	Phase Phase `json:"phase"`
+
+	// ClusterName is the name of the backed up cluster
+	ClusterName string `json:"clusterName"`
+
+	// Namespace is the namespace of the backed up cluster
+	Namespace string `json:"namespace"`
+
+	// InstanceID is the name of the instance the backup has been taken from
+	InstanceID string `json:"instanceId"`
+
+	// Standby is true when the backup has been taken from a standby
+	Standby bool `json:"standby"`
+
+	// Online is true when the backup has been taken while PostgreSQL
+	// was running, and false for backups of a stopped instance
+	Online bool `json:"online"`
+
+	// SelfContained is true when the WAL files needed to reach
+	// consistency are bundled in the backup
+	SelfContained bool `json:"selfContained,omitempty"`
+
+	// StartedAt is when the backup started
+	StartedAt time.Time `json:"startedAt"`
+
+	// StoppedAt is when the backup ended
+	StoppedAt time.Time `json:"stoppedAt"`
+
+	// BeginWal is the first WAL required by the backup
+	BeginWal string `json:"beginWal"`
+
+	// EndWal is the last WAL required by the backup
+	EndWal string `json:"endWal"`
+
+	// BeginLSN is the LSN where the backup started
+	BeginLSN string `json:"beginLsn"`
+
+	// EndLSN is the LSN where the backup ended
+	EndLSN string `json:"endLsn"`
+
+	// Snapshots are the Kopia snapshots composing the
+	// backup, the data directory first
+	Snapshots []SnapshotInfo `json:"snapshots,omitempty"`
+
+	// SnapshotParallelism is the number of snapshots taken in
+	// parallel, whose timings may overlap
+	SnapshotParallelism int `json:"snapshotParallelism,omitempty"`
+
+	// Manifest is the key of the backup manifest, which can be
+	// used to verify the content of the snapshots
+	Manifest string `json:"manifest,omitempty"`
+
+	// Stats are the statistics of the whole backup
+	Stats Stats `json:"stats"`
+
+	// StorageClasses are the storage classes of the objects
+	// written by the backup, by object type
+	StorageClasses map[objectstore.ObjectType]string `json:"storageClasses,omitempty"`
+
+	// Tags are the tags applied to the objects written by the backup
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// Hooks are the outcomes of the hooks run around the backup
+	Hooks []hooks.Result `json:"hooks,omitempty"`
+
+	// PageChecksums is the outcome of the verification of the page
+	// checksums, missing when the cluster has no data checksums
+	PageChecksums *pagechecksum.Result `json:"pageChecksums,omitempty"`
+
+	// Pinned is true when the backup is exempt from the retention,
+	// together with the WAL files it needs to reach consistency
+	Pinned bool `json:"pinned,omitempty"`
+
+	// KeepUntil is when a pinned backup stops being exempt
+	// from the retention, missing when it is kept forever
+	KeepUntil *time.Time `json:"keepUntil,omitempty"`
+
+	// Tier is the storage tier where the WAL files needed
+	// by the backup to reach consistency are kept
+	Tier Tier `json:"tier"`
+
+	// ArchivedAt is when the WAL files needed by the backup
+	// have been moved to the archive tier
+	ArchivedAt *time.Time `json:"archivedAt,omitempty"`
+}
+
+// SnapshotInfo is the information about a Kopia snapshot
+type SnapshotInfo struct {
+	// ID is the ID of the Kopia snapshot manifest
+	ID string `json:"id"`
+
+	// Path is the path that has been backed up
+	Path string `json:"path"`
+
+	// Tags are the tags of the snapshot, whose names have the
+	// Kopia "tag:" prefix except for older backups
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// StartedAt is when the snapshot started
+	StartedAt time.Time `json:"startedAt"`
+
+	// StoppedAt is when the snapshot ended
+	StoppedAt time.Time `json:"stoppedAt"`
+
+	// Stats are the statistics of the snapshot
+	Stats Stats `json:"stats"`
+
+	// Exclusions are the rules of the files which have
+	// not been included in the snapshot
+	Exclusions []string `json:"exclusions,omitempty"`
+}
+
+// Stats are the statistics of a snapshot, or of a whole backup
+type Stats struct {
+	// TotalBytes is the size of the backed up files
+	TotalBytes int64 `json:"totalBytes"`
+
+	// UploadedBytes is the number of bytes written to the
+	// repository, after deduplication and compression
+	UploadedBytes int64 `json:"uploadedBytes"`
+
+	// FileCount is the number of backed up files
+	FileCount int64 `json:"fileCount"`
+
+	// DirectoryCount is the number of backed up directories
+	DirectoryCount int64 `json:"directoryCount"`
+
+	// CachedFileCount is the number of files that have not been
+	// read because they didn't change since the previous snapshot
+	CachedFileCount int64 `json:"cachedFileCount"`
+
+	// NonCachedFileCount is the number of files that have been read
+	NonCachedFileCount int64 `json:"nonCachedFileCount"`
+
+	// ExcludedFileCount is the number of files excluded by the policy
+	ExcludedFileCount int64 `json:"excludedFileCount"`
+
+	// ErrorCount is the number of files that couldn't be read
+	ErrorCount int64 `json:"errorCount"`
+}
+
+// Add adds the statistics of another snapshot to these ones
+func (stats *Stats) Add(other Stats) {
+	stats.TotalBytes += other.TotalBytes
+	stats.UploadedBytes += other.UploadedBytes
+	stats.FileCount += other.FileCount
+	stats.DirectoryCount += other.DirectoryCount
+	stats.CachedFileCount += other.CachedFileCount
+	stats.NonCachedFileCount += other.NonCachedFileCount
+	stats.ExcludedFileCount += other.ExcludedFileCount
+	stats.ErrorCount += other.ErrorCount
+}
+
+// GetDedupRatio gets the ratio between the size of the backed up
+// files and the bytes written to the repository. The ratio is zero
+// when nothing has been written
+func (stats *Stats) GetDedupRatio() float64 {
+	if stats.UploadedBytes == 0 {
+		return 0
+	}
+
+	return float64(stats.TotalBytes) / float64(stats.UploadedBytes)
+}
+
+// MarshalJSON implements the json.Marshaler interface,
+// adding the dedup ratio to the statistics
+func (stats Stats) MarshalJSON() ([]byte, error) {
+	type plainStats Stats
+	return json.Marshal(struct {
+		plainStats
+		DedupRatio float64 `json:"dedupRatio"`
+	}{
+		plainStats: plainStats(stats),
+		DedupRatio: stats.GetDedupRatio(),
+	})
+}
+
+// IsPinned checks if the backup is exempt from the retention
+// at a certain time
+func (info *BackupInfo) IsPinned(now time.Time) bool {
+	return info.Pinned && (info.KeepUntil == nil || now.Before(*info.KeepUntil))
+}
+
+// NeedsRehydration checks if the WAL files needed by the backup to
+// reach consistency need to be rehydrated from the archive tier before
+// a restore. Offline and self-contained backups need no WAL file
+func (info *BackupInfo) NeedsRehydration() bool {
+	return info.Tier == TierArchive && info.Online && !info.SelfContained
+}
+
+// Catalog is the catalog of the backups of a cluster
+type Catalog struct {
+	clusterName string
+	namespace   string
+
+	// stores are the stores where the catalog is written.
+	// The catalog is read from the first one
+	stores []storage.Store
+}
+
+// New creates a catalog for the backups of a cluster, kept
+// in a set of stores
+func New(clusterName string, namespace string, stores ...storage.Store) *Catalog {
+	return &Catalog{
+		clusterName: clusterName,
+		namespace:   namespace,
+		stores:      stores,
+	}
+}
+
+// Put adds or replaces the entry of a backup in the catalog
+func (catalog *Catalog) Put(ctx context.Context, info *BackupInfo) error {
+	content, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	temporaryDirectory, err := os.MkdirTemp("", "catalog")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.RemoveAll(temporaryDirectory)
+	}()
+
+	temporaryFile := path.Join(temporaryDirectory, info.BackupName+".json")
+	if err := os.WriteFile(temporaryFile, content, 0o600); err != nil {
+		return err
+	}
+
+	putOptions := storage.NewPutOptions(catalog.clusterName, catalog.namespace, objectstore.ObjectTypeManifest).
+		WithBackupName(info.BackupName)
+	key := storage.GetCatalogEntryKey(catalog.clusterName, info.BackupName)
+	for _, store := range catalog.stores {
+		if err := store.Put(ctx, key, temporaryFile, putOptions); err != nil {
+			return fmt.Errorf("while writing the catalog entry of %s to %s: %w", info.BackupName, store.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+// Get gets the entry of a backup from the catalog
+func (catalog *Catalog) Get(ctx context.Context, backupName string) (*BackupInfo, error) {
+	if len(catalog.stores) == 0 {
+		return nil, storage.ErrObjectNotFound
+	}
+
+	temporaryDirectory, err := os.MkdirTemp("", "catalog")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = os.RemoveAll(temporaryDirectory)
+	}()
+
+	temporaryFile := path.Join(temporaryDirectory, backupName+".json")
+	key := storage.GetCatalogEntryKey(catalog.clusterName, backupName)
+	if err := catalog.stores[0].Get(ctx, key, temporaryFile); err != nil {
+		return nil, err
+	}
+
+	content, err := os.ReadFile(temporaryFile) // nolint:gosec
+	if err != nil {
+		return nil, err
+	}
+
+	var result BackupInfo
+	if err := json.Unmarshal(content, &result); err != nil {
+		return nil, fmt.Errorf("while decoding the catalog entry of %s: %w", backupName, err)
+	}
+
+	return &result, nil
+}
+
+// Delete removes the entry of a backup from every store
+// of the catalog
+func (catalog *Catalog) Delete(ctx context.Context, backupName string) error {
+	key := storage.GetCatalogEntryKey(catalog.clusterName, backupName)
+	for _, store := range catalog.stores {
+		if err := store.Delete(ctx, key); err != nil {
+			return fmt.Errorf("while deleting the catalog entry of %s from %s: %w", backupName, store.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+// List gets every entry of the catalog, sorted by start time
+func (catalog *Catalog) List(ctx context.Context) ([]BackupInfo, error) {
+	if len(catalog.stores) == 0 {
+		return nil, nil
+	}
+
+	objects, err := catalog.stores[0].List(ctx, storage.GetCatalogKey(catalog.clusterName))
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]BackupInfo, 0, len(objects))
+	for _, object := range objects {
+		backupName, ok := getBackupName(object.Key)
+		if !ok {
+			continue
+		}
+
+		info, err := catalog.Get(ctx, backupName)
+		if errors.Is(err, storage.ErrObjectNotFound) {
+			// The entry has been removed while listing
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, *info)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].StartedAt.Before(result[j].StartedAt)
+	})
+	return result, nil
+}
+
+// getBackupName gets the name of the backup from the
+// key of its catalog entry
+func getBackupName(key string) (string, bool) {
+	fileName := path.Base(key)
+	if path.Ext(fileName) != ".json" {
+		return "", false
+	}
+
+	return fileName[:len(fileName)-len(".json")], true
+}
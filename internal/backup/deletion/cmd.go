@@ -0,0 +1,71 @@
+package deletion
+
+import (
+	"errors"
+
+	"github.com/spf13/cobra"
+)
+
+// NewCmd creates the command deleting a backup. CNPG-I has no backup
+// deletion RPC, so it is run by the backup finalizer inside the sidecar,
+// where the Kopia password is available, when a Backup object is deleted
+func NewCmd() *cobra.Command {
+	var (
+		clusterName    string
+		namespace      string
+		backupName     string
+		parameters     map[string]string
+		recoveryWindow string
+		force          bool
+		ignoreNotFound bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "delete",
+		Short: "Delete a backup and the WAL files not needed anymore",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			window, err := ParseRecoveryWindow(recoveryWindow)
+			if err != nil {
+				return err
+			}
+
+			result, err := Backup(cmd.Context(), clusterName, namespace, backupName, parameters, Options{
+				RecoveryWindow: window,
+				Force:          force,
+			})
+			if ignoreNotFound && errors.Is(err, ErrBackupNotFound) {
+				cmd.Printf("backup %s is not in the catalog, nothing to delete\n", backupName)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			cmd.Printf("backup %s successfully deleted, %d snapshots removed\n",
+				backupName, len(result.DeletedSnapshots))
+			if len(result.FirstRequiredWAL) > 0 {
+				cmd.Printf("WAL files preceding %s removed\n", result.FirstRequiredWAL)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&clusterName, "cluster-name", "", "The name of the cluster")
+	cmd.Flags().StringVar(&namespace, "namespace", "", "The namespace of the cluster")
+	cmd.Flags().StringVar(&backupName, "backup-name", "", "The name of the backup to be deleted")
+	cmd.Flags().StringToStringVar(&parameters, "parameters", nil,
+		"The plugin parameters configuring the object store, i.e. bucket=backups,region=us-east-1")
+	cmd.Flags().StringVar(&recoveryWindow, "recovery-window", "",
+		"The retention policy of the cluster, i.e. 30d. The backup needed to recover "+
+			"the beginning of the window is not deleted")
+	cmd.Flags().BoolVar(&force, "force", false,
+		"Delete the backup even when it is pinned or required by the recovery window")
+	cmd.Flags().BoolVar(&ignoreNotFound, "ignore-not-found", false,
+		"Succeed when the backup is not in the catalog, i.e. when it failed before being recorded")
+	for _, name := range []string{"cluster-name", "namespace", "backup-name", "parameters"} {
+		_ = cmd.MarkFlagRequired(name)
+	}
+
+	return cmd
+}
@@ -0,0 +1,335 @@
+// Package deletion removes a backup from the object store, together
+// with the WAL files which are not needed anymore
+package deletion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/cloudnative-pg/cnpg-i-machinery/pkg/logging"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/catalog"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/lock"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/manifest"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/repository"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/storage"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/wal"
+)
+
+// ErrBackupRequired is raised when deleting a backup which
+// is needed to recover the cluster inside the recovery window
+var ErrBackupRequired = errors.New("backup required by the recovery window")
+
+// ErrBackupPinned is raised when deleting a pinned backup
+var ErrBackupPinned = errors.New("backup pinned")
+
+// ErrBackupNotFound is raised when deleting a backup
+// which is not in the catalog
+var ErrBackupNotFound = errors.New("backup not in the catalog")
+
+// recoveryWindowRegex matches a recovery window in the format of the
+// retention policy of CloudNativePG, i.e. "30d", "4w" or "3m"
+var recoveryWindowRegex = regexp.MustCompile(`^([1-9][0-9]*)([dwm])$`)
+
+// Options are the options of the deletion of a backup
+type Options struct {
+	// RecoveryWindow is how far back in time the cluster needs to
+	// be recoverable. The backup needed to recover the beginning of
+	// the window can't be deleted. When zero, only the last
+	// completed backup is protected
+	RecoveryWindow time.Duration
+
+	// Force deletes the backup even when it is pinned, or
+	// required by the recovery window
+	Force bool
+}
+
+// Result is the outcome of the deletion of a backup
+type Result struct {
+	// DeletedSnapshots are the IDs of the Kopia snapshots
+	// which have been deleted
+	DeletedSnapshots []string
+
+	// FirstRequiredWAL is the first WAL file required by the
+	// remaining backups, empty when the WAL files have not been pruned
+	FirstRequiredWAL string
+}
+
+// ParseRecoveryWindow parses a recovery window in the format of the
+// retention policy of CloudNativePG, where a month is 30 days
+func ParseRecoveryWindow(value string) (time.Duration, error) {
+	if len(value) == 0 {
+		return 0, nil
+	}
+
+	matches := recoveryWindowRegex.FindStringSubmatch(value)
+	if matches == nil {
+		return 0, fmt.Errorf("%q is not a valid recovery window, i.e. \"30d\", \"4w\" or \"3m\"", value)
+	}
+
+	count, err := strconv.Atoi(matches[1])
+	if err != nil {
+		return 0, err
+	}
+
+	day := 24 * time.Hour
+	switch matches[2] {
+	case "w":
+		return time.Duration(count) * 7 * day, nil
+	case "m":
+		return time.Duration(count) * 30 * day, nil
+	default:
+		return time.Duration(count) * day, nil
+	}
+}
+
+// Backup deletes a backup, removing its Kopia snapshots, its manifest and
+// its catalog entry. When it was the oldest backup, the WAL files which
+// are not needed by the new oldest backup are removed too. The data
+// of the snapshots is released by the next repository maintenance
+func Backup(
+	ctx context.Context,
+	clusterName string,
+	namespace string,
+	backupName string,
+	parameters map[string]string,
+	options Options,
+) (*Result, error) {
+	contextLogger := logging.FromContext(ctx).WithValues("backupName", backupName)
+
+	target, err := storage.NewBackupTargetFromParameters(parameters)
+	if err != nil {
+		return nil, err
+	}
+	store := target.Store
+
+	// Deleting a backup while another one is being taken
+	// could prune the WAL files needed by the new backup
+	hostname, _ := os.Hostname()
+	lease, err := lock.Acquire(
+		ctx,
+		store,
+		clusterName,
+		namespace,
+		lock.BackupLockName,
+		hostname,
+		"delete "+backupName,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer lease.Release(ctx)
+
+	ctx, cancelLease := lease.Context(ctx)
+	defer cancelLease()
+
+	backupCatalog := catalog.New(clusterName, namespace, store)
+	backups, err := backupCatalog.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("while reading the catalog: %w", err)
+	}
+
+	index := -1
+	for i := range backups {
+		if backups[i].BackupName == backupName {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("%w: %s", ErrBackupNotFound, backupName)
+	}
+	backupInfo := &backups[index]
+
+	if err := checkRequired(backups, backupInfo, options, time.Now()); err != nil {
+		if !options.Force {
+			return nil, err
+		}
+		contextLogger.Info("Deleting a protected backup", "reason", err.Error())
+	}
+
+	rep, err := repository.NewRepository(
+		ctx,
+		target.GetRepositoryProvider(),
+		target.GetRepositoryPath(clusterName),
+		storage.GetKopiaConfigFilePath(clusterName),
+		storage.GetKopiaCacheDirectory(clusterName),
+		target.ObjectStore,
+		nil,
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rep.Close(ctx)
+	}()
+
+	// The catalog entry is removed last, so that a failed
+	// deletion can be retried
+	result := &Result{}
+	for _, snapshotInfo := range backupInfo.Snapshots {
+		contextLogger.Info("Deleting snapshot", "snapshotID", snapshotInfo.ID, "path", snapshotInfo.Path)
+		if err := rep.DeleteSnapshot(ctx, snapshotInfo.ID); err != nil {
+			return nil, fmt.Errorf("while deleting snapshot %s: %w", snapshotInfo.ID, err)
+		}
+		result.DeletedSnapshots = append(result.DeletedSnapshots, snapshotInfo.ID)
+	}
+
+	if err := manifest.Delete(ctx, clusterName, backupName, store); err != nil {
+		return nil, err
+	}
+
+	if err := backupCatalog.Delete(ctx, backupName); err != nil {
+		return nil, err
+	}
+	contextLogger.Info("Backup deleted", "snapshots", len(result.DeletedSnapshots))
+
+	deleteFromReplicas(ctx, clusterName, namespace, backupName, parameters)
+
+	if result.FirstRequiredWAL, err = pruneWALs(ctx, clusterName, parameters, backups, backupInfo); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// deleteFromReplicas removes the manifest and the catalog entry of a
+// deleted backup from the destinations where the backups are replicated.
+// The ones left behind are removed by the next replication, together
+// with the data of the snapshots
+func deleteFromReplicas(
+	ctx context.Context,
+	clusterName string,
+	namespace string,
+	backupName string,
+	parameters map[string]string,
+) {
+	contextLogger := logging.FromContext(ctx).WithValues("backupName", backupName)
+
+	replicas, err := storage.NewBackupReplicasFromParameters(parameters)
+	if err != nil {
+		contextLogger.Error(err, "Error while reading the destinations where the backups are replicated")
+		return
+	}
+
+	for _, replica := range replicas {
+		if err := manifest.Delete(ctx, clusterName, backupName, replica.Store); err != nil {
+			contextLogger.Error(err, "Error while deleting the replicated manifest")
+			continue
+		}
+		if err := catalog.New(clusterName, namespace, replica.Store).Delete(ctx, backupName); err != nil {
+			contextLogger.Error(err, "Error while deleting the replicated catalog entry")
+		}
+	}
+}
+
+// checkRequired checks if a backup can be deleted without losing
+// the ability of recovering the cluster inside the recovery window.
+// Pinned backups can't be deleted either
+func checkRequired(
+	backups []catalog.BackupInfo,
+	backupInfo *catalog.BackupInfo,
+	options Options,
+	now time.Time,
+) error {
+	if !isCompleted(backupInfo) {
+		return nil
+	}
+
+	if backupInfo.IsPinned(now) {
+		return fmt.Errorf("%w: %s is pinned", ErrBackupPinned, backupInfo.BackupName)
+	}
+
+	var completed []*catalog.BackupInfo
+	for i := range backups {
+		if isCompleted(&backups[i]) {
+			completed = append(completed, &backups[i])
+		}
+	}
+
+	if len(completed) == 1 {
+		return fmt.Errorf("%w: %s is the only completed backup", ErrBackupRequired, backupInfo.BackupName)
+	}
+	if options.RecoveryWindow == 0 {
+		return nil
+	}
+
+	// The beginning of the window is recovered from the last backup
+	// completed before it, or from the oldest one when the window
+	// reaches back before every backup
+	windowStart := now.Add(-options.RecoveryWindow)
+	required := completed[0]
+	for _, candidate := range completed {
+		if candidate.StoppedAt.After(windowStart) {
+			break
+		}
+		required = candidate
+	}
+
+	if required.BackupName == backupInfo.BackupName {
+		return fmt.Errorf("%w: %s is needed to recover the cluster to %s",
+			ErrBackupRequired, backupInfo.BackupName, windowStart.UTC().Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// pruneWALs removes the WAL files preceding the first one required by
+// the new oldest backup, keeping the ones needed by the pinned backups.
+// WAL files are only pruned when the deleted backup was the oldest
+// one, as they are needed by the older ones
+func pruneWALs(
+	ctx context.Context,
+	clusterName string,
+	parameters map[string]string,
+	backups []catalog.BackupInfo,
+	deleted *catalog.BackupInfo,
+) (string, error) {
+	var (
+		oldest    *catalog.BackupInfo
+		remaining []catalog.BackupInfo
+	)
+	for i := range backups {
+		if backups[i].BackupName != deleted.BackupName {
+			remaining = append(remaining, backups[i])
+		}
+	}
+	for i := range backups {
+		if backups[i].BackupName != deleted.BackupName && isCompleted(&backups[i]) && len(backups[i].BeginWal) > 0 {
+			oldest = &backups[i]
+			break
+		}
+	}
+
+	if oldest == nil || !isCompleted(deleted) || oldest.BeginWal <= deleted.BeginWal {
+		return "", nil
+	}
+
+	destinations, err := storage.NewDestinationsFromParameters(parameters)
+	if err != nil {
+		return "", err
+	}
+
+	logging.FromContext(ctx).Info("Removing the WAL files preceding the oldest backup",
+		"oldestBackup", oldest.BackupName,
+		"firstRequiredWal", oldest.BeginWal)
+	pinnedRanges := wal.GetPinnedWALRanges(remaining, time.Now())
+	if err := wal.PruneWALs(ctx, destinations.Stores, clusterName, oldest.BeginWal, pinnedRanges); err != nil {
+		return "", err
+	}
+
+	return oldest.BeginWal, nil
+}
+
+// isCompleted is true for the backups which can be restored. Backups
+// in any other phase, including the ones written by newer versions,
+// are never protected nor used to prune the WAL files
+func isCompleted(backupInfo *catalog.BackupInfo) bool {
+	return backupInfo.Phase == catalog.PhaseCompleted
+}
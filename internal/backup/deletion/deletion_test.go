@@ -0,0 +1,98 @@
+package deletion
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/catalog"
+)
+
+func newTestBackups(now time.Time, phases ...catalog.Phase) []catalog.BackupInfo {
+	result := make([]catalog.BackupInfo, 0, len(phases))
+	for i, phase := range phases {
+		stoppedAt := now.Add(time.Duration(i-len(phases)) * 24 * time.Hour)
+		result = append(result, catalog.BackupInfo{
+			BackupName: "backup-" + string(rune('a'+i)),
+			Phase:      phase,
+			StartedAt:  stoppedAt.Add(-time.Hour),
+			StoppedAt:  stoppedAt,
+		})
+	}
+	return result
+}
+
+func TestCheckRequired(t *testing.T) {
+	now := time.Now()
+
+	for _, test := range []struct {
+		name     string
+		phases   []catalog.Phase
+		index    int
+		window   time.Duration
+		expected error
+	}{
+		{
+			name:     "only completed backup",
+			phases:   []catalog.Phase{catalog.PhaseAborted, catalog.PhaseCompleted},
+			index:    1,
+			expected: ErrBackupRequired,
+		},
+		{
+			// Backups in an unknown phase can't be restored
+			name:     "only completed backup beside an unknown phase",
+			phases:   []catalog.Phase{catalog.PhaseCompleted, "running"},
+			index:    0,
+			expected: ErrBackupRequired,
+		},
+		{
+			name:   "unknown phase",
+			phases: []catalog.Phase{catalog.PhaseCompleted, "running"},
+			index:  1,
+		},
+		{
+			name:   "aborted backup",
+			phases: []catalog.Phase{catalog.PhaseAborted},
+			index:  0,
+		},
+		{
+			name:   "older backup",
+			phases: []catalog.Phase{catalog.PhaseCompleted, catalog.PhaseCompleted},
+			index:  0,
+		},
+		{
+			name:     "backup recovering the beginning of the window",
+			phases:   []catalog.Phase{catalog.PhaseCompleted, catalog.PhaseCompleted, catalog.PhaseCompleted},
+			index:    1,
+			window:   36 * time.Hour,
+			expected: ErrBackupRequired,
+		},
+		{
+			name:   "backup preceding the window",
+			phases: []catalog.Phase{catalog.PhaseCompleted, catalog.PhaseCompleted, catalog.PhaseCompleted},
+			index:  0,
+			window: 36 * time.Hour,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			backups := newTestBackups(now, test.phases...)
+			err := checkRequired(backups, &backups[test.index], Options{RecoveryWindow: test.window}, now)
+			if test.expected == nil && err != nil || test.expected != nil && !errors.Is(err, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, err)
+			}
+		})
+	}
+}
+
+func TestIsCompleted(t *testing.T) {
+	for phase, expected := range map[catalog.Phase]bool{
+		catalog.PhaseCompleted: true,
+		catalog.PhaseAborted:   false,
+		"":                     false,
+		"failed":               false,
+	} {
+		if result := isCompleted(&catalog.BackupInfo{Phase: phase}); result != expected {
+			t.Errorf("isCompleted(%q) = %v, expected %v", phase, result, expected)
+		}
+	}
+}
@@ -1,12 +1,16 @@
 package executor
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"os"
+	"os/exec"
+	"strings"
 	"time"
 
 	"github.com/cloudnative-pg/cloudnative-pg/pkg/management/url"
@@ -14,8 +18,40 @@ import (
 	"github.com/cloudnative-pg/cnpg-i-machinery/pkg/logging"
 )
 
-// getPgControlData obtains the pg_controldata from the instance HTTP endpoint
-func getPgControlData(
+// pgControlDataName is the name of the pg_controldata executable
+const pgControlDataName = "pg_controldata"
+
+// getPgControlData obtains the pg_controldata. The instance manager
+// only serves it while PostgreSQL is running, so for offline backups
+// pg_controldata is run on the data directory
+func (executor *Executor) getPgControlData(
+	ctx context.Context,
+) (map[string]string, error) {
+	if !executor.online {
+		return executor.runPgControlData(ctx)
+	}
+
+	return executor.queryPgControlData(ctx)
+}
+
+// runPgControlData obtains the pg_controldata running it
+// on the data directory of the stopped instance
+func (executor *Executor) runPgControlData(ctx context.Context) (map[string]string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, executor.pgControlDataCommand, "-D", executor.dataDirectory) // #nosec G204
+	// The output is parsed by its English labels
+	cmd.Env = append(os.Environ(), "LC_ALL=C")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("while running %s: %w: %s", pgControlDataName, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return utils.ParsePgControldataOutput(stdout.String()), nil
+}
+
+// queryPgControlData obtains the pg_controldata from the instance HTTP endpoint
+func (executor *Executor) queryPgControlData(
 	ctx context.Context,
 ) (map[string]string, error) {
 	contextLogger := logging.FromContext(ctx)
@@ -36,7 +72,7 @@ func getPgControlData(
 		Timeout: requestTimeout,
 	}
 
-	httpURL := url.Build(podIP, url.PathPGControlData, url.StatusPort)
+	httpURL := url.Build(executor.backupClientEndpoint, url.PathPGControlData, executor.statusPort)
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, httpURL, nil)
 	if err != nil {
 		return nil, err
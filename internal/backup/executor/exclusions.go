@@ -0,0 +1,159 @@
+package executor
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	repository2 "github.com/dougkirkley/plugin-objstore-backup/internal/backup/repository"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/objectstore"
+)
+
+// ExclusionsParameter is the comma separated list of the gitignore-style
+// patterns of the files which are not backed up, in addition to the
+// ones skipped by pg_basebackup
+const ExclusionsParameter = "backupExclusions"
+
+// baseExclusions are the files of the data directory that pg_basebackup
+// doesn't include in the backup, as they are not needed or are
+// recreated by PostgreSQL when it starts
+var baseExclusions = []string{
+	"/postmaster.pid",
+	"/postmaster.opts",
+	"/postgresql.auto.conf.tmp",
+	"/current_logfiles.tmp",
+	"/backup_label",
+	"/tablespace_map",
+
+	// The content of these directories is reset at startup,
+	// while the directories need to exist
+	"/pg_replslot/*",
+	"/pg_dynshmem/*",
+	"/pg_notify/*",
+	"/pg_serial/*",
+	"/pg_snapshots/*",
+	"/pg_stat_tmp/*",
+	"/pg_subtrans/*",
+}
+
+// anywhereExclusions are the files that pg_basebackup doesn't include
+// in the backup, wherever they are in the data directory or in a
+// tablespace
+var anywhereExclusions = []string{
+	"pg_internal.init",
+	"pgsql_tmp*",
+}
+
+// initForkRegex matches the init fork of an unlogged relation
+var initForkRegex = regexp.MustCompile(`^(\d+)_init$`)
+
+// GetExclusionsFromParameters gets the user-defined exclusion
+// patterns from the plugin parameters
+func GetExclusionsFromParameters(parameters map[string]string) ([]string, error) {
+	value := parameters[ExclusionsParameter]
+	if len(value) == 0 {
+		return nil, nil
+	}
+
+	var result []string
+	for _, item := range strings.Split(value, ",") {
+		pattern := strings.TrimSpace(item)
+		if len(pattern) == 0 {
+			return nil, &objectstore.ParameterError{Name: ExclusionsParameter, Message: "cannot contain empty patterns"}
+		}
+
+		// A negated pattern could include files that
+		// are excluded to keep the backup consistent
+		if strings.HasPrefix(pattern, "!") {
+			return nil, &objectstore.ParameterError{
+				Name:    ExclusionsParameter,
+				Message: "cannot contain negated patterns",
+			}
+		}
+
+		result = append(result, pattern)
+	}
+
+	return result, nil
+}
+
+// getDataDirectoryExclusions gets the files of the data directory which
+// are not included in the backup. Tablespaces are backed up separately.
+// WAL files are restored from the archive when the backup is online,
+// and included in offline backups to make them self-consistent
+func (executor *Executor) getDataDirectoryExclusions() ([]string, error) {
+	result := []string{"/" + repository2.TablespacesFolder + "/*"}
+	if executor.online {
+		result = append(result, "/"+repository2.WALFolder+"/*")
+	}
+	result = append(result, baseExclusions...)
+
+	return executor.completeExclusions(result, path.Join(executor.dataDirectory, "base"), "/base")
+}
+
+// getTablespaceExclusions gets the files of a tablespace
+// which are not included in the backup
+func (executor *Executor) getTablespaceExclusions(tablespacePath string) ([]string, error) {
+	return executor.completeExclusions(nil, tablespacePath, "")
+}
+
+// completeExclusions adds to a set of exclusions the ones that apply
+// to every directory, the unlogged relations contained in a directory
+// and the user-defined ones
+func (executor *Executor) completeExclusions(exclusions []string, directory, prefix string) ([]string, error) {
+	result := append(exclusions, anywhereExclusions...)
+
+	// Unlogged relations are reset to their init fork at the end of
+	// the recovery. An offline backup is not recovered when it is
+	// restored, so it needs the content of unlogged relations
+	if executor.online {
+		unloggedExclusions, err := getUnloggedRelationExclusions(directory, prefix)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, unloggedExclusions...)
+	}
+
+	return append(result, executor.exclusions...), nil
+}
+
+// getUnloggedRelationExclusions gets the files of the unlogged relations
+// contained in a directory, except their init fork. The patterns are
+// relative to the root of the snapshot, which is the directory itself
+// when the prefix is empty
+func getUnloggedRelationExclusions(directory, prefix string) ([]string, error) {
+	var result []string
+	err := filepath.WalkDir(directory, func(filePath string, entry fs.DirEntry, err error) error {
+		// Relations can be dropped while the backup is running
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		matches := initForkRegex.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || matches == nil {
+			return nil
+		}
+
+		relativeDirectory, err := filepath.Rel(directory, filepath.Dir(filePath))
+		if err != nil {
+			return err
+		}
+
+		relation := path.Join(prefix, "/", filepath.ToSlash(relativeDirectory), matches[1])
+		result = append(result,
+			relation,
+			relation+".*",
+			relation+"_fsm*",
+			relation+"_vm*",
+		)
+		return nil
+	})
+
+	return result, err
+}
@@ -2,26 +2,69 @@ package executor
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/fs"
 	"os"
 	"path"
+	"strconv"
 	"time"
 
 	apiv1 "github.com/cloudnative-pg/cloudnative-pg/api/v1"
 	"github.com/cloudnative-pg/cloudnative-pg/pkg/management/postgres/webserver"
+	"github.com/cloudnative-pg/cloudnative-pg/pkg/management/url"
+	"github.com/cloudnative-pg/cloudnative-pg/pkg/postgres"
 	"github.com/cloudnative-pg/cnpg-i-machinery/pkg/logging"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/util/retry"
 
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/hooks"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/manifest"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/pagechecksum"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/progress"
 	repository2 "github.com/dougkirkley/plugin-objstore-backup/internal/backup/repository"
 )
 
 const podIP = "127.0.0.1"
 
+const (
+	// backupLabelDirectory is where the backup_label and tablespace_map
+	// files are written before being stored in the repository
+	backupLabelDirectory = "/controller/backup-label"
+
+	backupLabelFileName   = "backup_label"
+	tablespaceMapFileName = "tablespace_map"
+)
+
 var (
 	errBackupNotStarted = fmt.Errorf("backup not started")
 	errBackupNotStopped = fmt.Errorf("backup not stopped")
+
+	// ErrBackupAborted is raised when the backup has been cancelled
+	// before completing. PostgreSQL has been taken out of backup mode
+	// and the snapshots already taken have been removed
+	ErrBackupAborted = errors.New("backup aborted")
+)
+
+// cleanupTimeout is the maximum time spent cleaning up after a
+// failed or cancelled backup
+const cleanupTimeout = 2 * time.Minute
+
+const (
+	// clusterStateControlFile is the pg_controldata entry
+	// containing the state of the database cluster
+	clusterStateControlFile = "Database cluster state"
+
+	// clusterStateInArchiveRecovery is the state of a standby
+	clusterStateInArchiveRecovery = "in archive recovery"
+
+	// clusterStateShutDown is the state of a primary which
+	// has been cleanly shut down
+	clusterStateShutDown = "shut down"
+
+	// clusterStateShutDownInRecovery is the state of a standby
+	// which has been cleanly shut down
+	clusterStateShutDownInRecovery = "shut down in recovery"
 )
 
 var backupModeBackoff = wait.Backoff{
@@ -38,11 +81,73 @@ type Executor struct {
 	beginWal string
 	endWal   string
 
+	// beginLSN is the LSN where the backup mode has been started
+	beginLSN postgres.LSN
+
+	// timeline is the timeline of the WAL needed by the backup
+	timeline int64
+
+	// walSegmentSize is the size of the WAL segments
+	walSegmentSize int64
+
+	// manifest is the backup manifest, describing the
+	// files contained in the snapshots
+	manifest *manifest.Manifest
+
+	snapshots []repository2.SnapshotInfo
+
+	// standby is true when the backup is taken from a standby
+	standby bool
+
+	// online is true for hot backups, taken while PostgreSQL is
+	// running, and false for cold backups of a stopped instance
+	online bool
+
 	cluster              *apiv1.Cluster
 	backup               *apiv1.Backup
 	repository           *repository2.Repository
 	backupClientEndpoint string
 
+	// statusPort is the port of the status webserver
+	// of the instance manager, serving pg_controldata
+	statusPort int
+
+	// pgControlDataCommand is the pg_controldata executable,
+	// run when PostgreSQL is stopped
+	pgControlDataCommand string
+
+	// dataDirectory is the PostgreSQL data directory
+	dataDirectory string
+
+	// hooks are the commands run before and after the backup
+	hooks []hooks.Hook
+
+	// hookResults are the outcomes of the hooks which have been run
+	hookResults []hooks.Result
+
+	// exclusions are the user-defined patterns of the files
+	// which are not backed up
+	exclusions []string
+
+	// parallelism is the number of paths snapshotted in parallel
+	parallelism int
+
+	// state is the state file where the progress of the
+	// snapshots is recorded, to resume an interrupted backup
+	state *stateFile
+
+	// pageChecksums are the options of the verification
+	// of the page checksums
+	pageChecksums pagechecksum.Options
+
+	// pageChecksumResult is the outcome of the verification of
+	// the page checksums, nil when it has been skipped
+	pageChecksumResult *pagechecksum.Result
+
+	// progress tracks the progress of the backup,
+	// nil when it is not tracked
+	progress *progress.Tracker
+
 	executed bool
 }
 
@@ -62,6 +167,60 @@ func (executor *Executor) GetEndWal() string {
 	return executor.endWal
 }
 
+// GetSnapshots returns the Kopia snapshots taken by the backup, the
+// data directory first, panics if the executor was not executed
+func (executor *Executor) GetSnapshots() []repository2.SnapshotInfo {
+	if !executor.executed {
+		panic("snapshots: please run take backup before trying to access this value")
+	}
+	return executor.snapshots
+}
+
+// GetWALSegmentSize returns the size of the WAL segments of an
+// online backup, panics if the executor was not executed
+func (executor *Executor) GetWALSegmentSize() int64 {
+	if !executor.executed {
+		panic("walSegmentSize: please run take backup before trying to access this value")
+	}
+	return executor.walSegmentSize
+}
+
+// GetManifest returns the backup manifest, panics
+// if the executor was not executed
+func (executor *Executor) GetManifest() *manifest.Manifest {
+	if !executor.executed {
+		panic("manifest: please run take backup before trying to access this value")
+	}
+	return executor.manifest
+}
+
+// IsOnline returns true for backups taken while PostgreSQL is running
+func (executor *Executor) IsOnline() bool {
+	return executor.online
+}
+
+// IsStandby returns true when the backup has been taken from a
+// standby, panics if the executor was not executed
+func (executor *Executor) IsStandby() bool {
+	if !executor.executed {
+		panic("standby: please run take backup before trying to access this value")
+	}
+	return executor.standby
+}
+
+// GetHookResults returns the outcomes of the backup hooks which have
+// been run, even when the backup failed
+func (executor *Executor) GetHookResults() []hooks.Result {
+	return executor.hookResults
+}
+
+// GetPageChecksumResult returns the outcome of the verification of the
+// page checksums, which is nil when it has been skipped because
+// the cluster has no data checksums or the verification is disabled
+func (executor *Executor) GetPageChecksumResult() *pagechecksum.Result {
+	return executor.pageChecksumResult
+}
+
 // tablespace represent a tablespace location
 type tablespace struct {
 	// path is the path where the tablespaces data is stored
@@ -71,58 +230,282 @@ type tablespace struct {
 	oid string
 }
 
+// Options are the options of a backup
+type Options struct {
+	// Online is true for backups taken while PostgreSQL is running,
+	// and false for backups of a cleanly shut down instance
+	Online bool
+
+	// Hooks are the commands run before and after the backup
+	Hooks []hooks.Hook
+
+	// Exclusions are the patterns of the files which are not backed
+	// up, in addition to the ones skipped by pg_basebackup
+	Exclusions []string
+
+	// Parallelism is the number of paths, between the data directory
+	// and the tablespaces, which are snapshotted in parallel
+	Parallelism int
+
+	// PageChecksums are the options of the verification
+	// of the page checksums
+	PageChecksums pagechecksum.Options
+
+	// Progress tracks the phases of the backup and the progress
+	// of the copy, nil when it is not tracked
+	Progress *progress.Tracker
+}
+
 // newExecutor creates a new backup Executor
-func newExecutor(cluster *apiv1.Cluster, backup *apiv1.Backup, repo *repository2.Repository, endpoint string) *Executor {
+func newExecutor(
+	cluster *apiv1.Cluster,
+	backup *apiv1.Backup,
+	repo *repository2.Repository,
+	endpoint string,
+	options Options,
+) *Executor {
 	return &Executor{
 		backupClient:         webserver.NewBackupClient(),
 		cluster:              cluster,
 		backup:               backup,
 		repository:           repo,
 		backupClientEndpoint: endpoint,
+		statusPort:           url.StatusPort,
+		pgControlDataCommand: pgControlDataName,
+		dataDirectory:        repository2.PGDataLocation,
+		online:               options.Online,
+		hooks:                options.Hooks,
+		exclusions:           options.Exclusions,
+		parallelism:          options.Parallelism,
+		pageChecksums:        options.PageChecksums,
+		progress:             options.Progress,
 	}
 }
 
-// NewLocalExecutor creates a new backup Executor
-func NewLocalExecutor(cluster *apiv1.Cluster, backup *apiv1.Backup, repo *repository2.Repository) *Executor {
-	return newExecutor(cluster, backup, repo, podIP)
+// NewLocalExecutor creates a new backup Executor. Online backups are
+// taken while PostgreSQL is running, offline ones require it to be
+// cleanly shut down
+func NewLocalExecutor(
+	cluster *apiv1.Cluster,
+	backup *apiv1.Backup,
+	repo *repository2.Repository,
+	options Options,
+) *Executor {
+	return newExecutor(cluster, backup, repo, podIP, options)
 }
 
-// Backup executes a backup. Returns the result and any error encountered
+// Backup executes a backup. Returns the result and any error encountered.
+// A backup interrupted by a sidecar restart is resumed when retried with
+// the same name, using the progress recorded in its state file
 func (executor *Executor) Backup(ctx context.Context) (*webserver.BackupResultData, error) {
 	defer func() {
 		executor.executed = true
 	}()
 
+	var (
+		result *webserver.BackupResultData
+		err    error
+	)
+	if executor.state, err = loadState(executor.cluster.GetName(), executor.backup.GetName()); err != nil {
+		return nil, err
+	}
+	if executor.state.isResumed() {
+		logging.FromContext(ctx).Info("Resuming the backup from its last checkpoint")
+	}
+
+	if executor.online {
+		result, err = executor.onlineBackup(ctx)
+	} else {
+		result, err = executor.offlineBackup(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if executor.manifest, err = executor.newManifest(result); err != nil {
+		return nil, err
+	}
+
+	// PostgreSQL is already out of backup mode, so only
+	// the snapshots are removed when the backup fails
+	executor.pageChecksumResult = executor.collectPageChecksums(ctx)
+	if err := executor.getPageChecksumError(executor.pageChecksumResult); err != nil {
+		executor.removeSnapshots(ctx)
+		return nil, err
+	}
+
+	// A failing post hook makes the backup fail, so its
+	// snapshots are removed like the ones of any failed backup
+	executor.progress.SetPhase(ctx, progress.PhasePostHooks)
+	if err := executor.runHooks(ctx, hooks.PhasePost, result); err != nil {
+		executor.removeSnapshots(ctx)
+		return nil, executor.getBackupError(ctx, err)
+	}
+
+	removeStates(ctx, executor.cluster.GetName())
+
+	return result, nil
+}
+
+// onlineBackup takes a backup of a running instance, using the
+// PostgreSQL backup mode
+func (executor *Executor) onlineBackup(ctx context.Context) (*webserver.BackupResultData, error) {
 	contextLogger := logging.FromContext(ctx)
-	contextLogger.Info("Preparing physical backup")
-	if err := executor.setBackupMode(ctx); err != nil {
+	if err := executor.checkBackupTarget(ctx); err != nil {
 		return nil, err
 	}
 
+	executor.progress.SetPhase(ctx, progress.PhasePreHooks)
+	if err := executor.runHooks(ctx, hooks.PhasePre, nil); err != nil {
+		return nil, executor.getBackupError(ctx, err)
+	}
+
+	contextLogger.Info("Preparing physical backup", "standby", executor.standby)
+	executor.progress.SetPhase(ctx, progress.PhaseBackupMode)
+	if err := executor.setBackupMode(ctx); err != nil {
+		// PostgreSQL may be in backup mode even if we
+		// failed while waiting for it to be started
+		executor.cleanup(ctx)
+		return nil, executor.getBackupError(ctx, err)
+	}
+
 	contextLogger.Info("Copying files")
 	if err := executor.execSnapshot(ctx); err != nil {
-		return nil, err
+		executor.cleanup(ctx)
+		return nil, executor.getBackupError(ctx, err)
 	}
 
 	contextLogger.Info("Finishing backup")
-	return executor.unsetBackupMode(ctx)
+	executor.progress.SetPhase(ctx, progress.PhaseFinishing)
+	result, err := executor.unsetBackupMode(ctx)
+	if err != nil {
+		executor.cleanup(ctx)
+		return nil, executor.getBackupError(ctx, err)
+	}
+
+	if err := executor.snapshotBackupLabel(ctx, result); err != nil {
+		executor.cleanup(ctx)
+		return nil, executor.getBackupError(ctx, err)
+	}
+
+	return result, nil
+}
+
+// cleanup takes PostgreSQL out of backup mode and removes the snapshots
+// taken by a backup which didn't complete. The context of the backup
+// may have been cancelled, so it is not used to cancel the cleanup
+func (executor *Executor) cleanup(ctx context.Context) {
+	contextLogger := logging.FromContext(ctx)
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+	defer cancel()
+
+	if executor.online {
+		contextLogger.Info("Stopping PostgreSQL Backup mode of the failed backup")
+		if _, err := executor.stopBackupMode(ctx); err != nil {
+			contextLogger.Error(err, "Error while stopping PostgreSQL Backup mode of the failed backup")
+		}
+	}
+
+	executor.removeSnapshots(ctx)
+}
+
+// removeSnapshots removes the snapshots taken by a backup
+// which didn't complete, without using its context
+func (executor *Executor) removeSnapshots(ctx context.Context) {
+	contextLogger := logging.FromContext(ctx)
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), cleanupTimeout)
+	defer cancel()
+
+	for i := range executor.snapshots {
+		contextLogger.Info("Removing snapshot of the failed backup", "snapshotID", executor.snapshots[i].ID)
+		if err := executor.repository.DeleteSnapshot(ctx, executor.snapshots[i].ID); err != nil {
+			contextLogger.Error(err, "Error while removing snapshot of the failed backup",
+				"snapshotID", executor.snapshots[i].ID)
+		}
+	}
+	executor.snapshots = nil
+}
+
+// runHooks runs the backup hooks of a certain phase, passing them
+// the backup metadata. The result is nil for the pre hooks
+func (executor *Executor) runHooks(
+	ctx context.Context,
+	phase hooks.Phase,
+	result *webserver.BackupResultData,
+) error {
+	environment := hooks.Environment{
+		hooks.EnvironmentBackupName:  executor.backup.GetName(),
+		hooks.EnvironmentClusterName: executor.cluster.GetName(),
+		hooks.EnvironmentNamespace:   executor.cluster.GetNamespace(),
+		hooks.EnvironmentPhase:       string(phase),
+		hooks.EnvironmentOnline:      strconv.FormatBool(executor.online),
+		hooks.EnvironmentStandby:     strconv.FormatBool(executor.standby),
+	}
+	if result != nil {
+		environment[hooks.EnvironmentBeginWAL] = executor.beginWal
+		environment[hooks.EnvironmentEndWAL] = executor.endWal
+		environment[hooks.EnvironmentBeginLSN] = string(result.BeginLSN)
+		environment[hooks.EnvironmentEndLSN] = string(result.EndLSN)
+	}
+
+	results, err := hooks.Run(ctx, executor.hooks, phase, environment)
+	executor.hookResults = append(executor.hookResults, results...)
+	return err
+}
+
+// getBackupError gets the error of a backup which didn't complete,
+// marking it as aborted when the backup has been cancelled
+func (*Executor) getBackupError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("%w: %w", ErrBackupAborted, err)
+	}
+
+	return err
+}
+
+// checkBackupTarget detects if the local instance is a standby, and
+// checks if the backup can be taken from it
+func (executor *Executor) checkBackupTarget(ctx context.Context) error {
+	controlData, err := executor.getPgControlData(ctx)
+	if err != nil {
+		return err
+	}
+	executor.standby = controlData[clusterStateControlFile] == clusterStateInArchiveRecovery
+
+	return executor.validateBackupTarget()
+}
+
+// validateBackupTarget checks if the backup can be taken from the local
+// instance according to the backup target of the Backup, or of the
+// Cluster when the Backup has none
+func (executor *Executor) validateBackupTarget() error {
+	target := executor.backup.Spec.Target
+	if len(target) == 0 && executor.cluster.Spec.Backup != nil {
+		target = executor.cluster.Spec.Backup.Target
+	}
+
+	if target == apiv1.BackupTargetPrimary && executor.standby {
+		return fmt.Errorf("the backup target is %s, but this instance is a standby", target)
+	}
+
+	return nil
 }
 
 // setBackupMode starts a backup by setting PostgreSQL in backup mode
 func (executor *Executor) setBackupMode(ctx context.Context) error {
 	logger := logging.FromContext(ctx)
 
-	var currentWALErr error
-	executor.beginWal, currentWALErr = executor.getCurrentWALFile(ctx)
-	if currentWALErr != nil {
-		return currentWALErr
-	}
-
+	// A standby can't archive its WAL files, so pg_backup_stop must
+	// not wait for them. The primary archives the end WAL, and the
+	// caller needs to wait for it.
+	// A backup still running in the instance manager is never replaced,
+	// as it may belong to a backup whose lease has been taken over
 	if err := executor.backupClient.Start(ctx, executor.backupClientEndpoint, webserver.StartBackupRequest{
 		ImmediateCheckpoint: true,
-		WaitForArchive:      true,
+		WaitForArchive:      !executor.standby,
 		BackupName:          executor.backup.GetName(),
-		Force:               true,
 	}); err != nil {
 		logger.Error(err, "while requesting new backup on PostgreSQL")
 		return err
@@ -140,6 +523,8 @@ func (executor *Executor) setBackupMode(ctx context.Context) error {
 			return errBackupNotStarted
 		}
 
+		executor.beginLSN = response.Data.BeginLSN
+
 		return nil
 	}); err != nil {
 		return err
@@ -149,50 +534,192 @@ func (executor *Executor) setBackupMode(ctx context.Context) error {
 	return nil
 }
 
-// execSnapshot takes the snapshot of the data directory and the tablespace folder
-func (executor *Executor) execSnapshot(ctx context.Context) error {
-	const snapshotTablespaceOidName = "oid"
+// offlineBackup takes a backup of a cleanly shut down instance.
+// PostgreSQL is not running, so the backup mode is not needed and
+// the WAL files are included in the backup, which is consistent
+// without the archive
+func (executor *Executor) offlineBackup(ctx context.Context) (*webserver.BackupResultData, error) {
+	contextLogger := logging.FromContext(ctx)
+
+	controlData, err := executor.checkShutDown(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := executor.validateBackupTarget(); err != nil {
+		return nil, err
+	}
+
+	executor.progress.SetPhase(ctx, progress.PhasePreHooks)
+	if err := executor.runHooks(ctx, hooks.PhasePre, nil); err != nil {
+		return nil, executor.getBackupError(ctx, err)
+	}
+
+	contextLogger.Info("Copying files of the stopped instance", "standby", executor.standby)
+	if err := executor.execSnapshot(ctx); err != nil {
+		executor.cleanup(ctx)
+		return nil, executor.getBackupError(ctx, err)
+	}
+
+	// The files are consistent only if PostgreSQL has
+	// not been started while they were being copied
+	if _, err := executor.checkShutDown(ctx); err != nil {
+		executor.cleanup(ctx)
+		return nil, executor.getBackupError(ctx, fmt.Errorf("instance state changed while taking the backup: %w", err))
+	}
 
 	const (
-		snapshotTypeName       = "type"
-		snapshotTypeBase       = "base"
-		snapshotTypeTablespace = "tablespace"
+		checkpointLocationControlFile = "Latest checkpoint location"
+		checkpointWALFileControlFile  = "Latest checkpoint's REDO WAL file"
+		checkpointTimelineControlFile = "Latest checkpoint's TimeLineID"
 	)
 
-	logger := logging.FromContext(ctx)
+	timeline, err := strconv.ParseInt(controlData[checkpointTimelineControlFile], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed %s in pg_controldata: %w", checkpointTimelineControlFile, err)
+	}
 
+	// The backup starts and ends at the shutdown checkpoint
+	executor.timeline = timeline
+	executor.beginWal = controlData[checkpointWALFileControlFile]
+	executor.endWal = executor.beginWal
+	return &webserver.BackupResultData{
+		BackupName: executor.backup.GetName(),
+		BeginLSN:   postgres.LSN(controlData[checkpointLocationControlFile]),
+		EndLSN:     postgres.LSN(controlData[checkpointLocationControlFile]),
+		Phase:      webserver.Completed,
+	}, nil
+}
+
+// checkShutDown checks that PostgreSQL has been cleanly
+// shut down, returning the content of pg_controldata
+func (executor *Executor) checkShutDown(ctx context.Context) (map[string]string, error) {
+	controlData, err := executor.getPgControlData(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	switch state := controlData[clusterStateControlFile]; state {
+	case clusterStateShutDown:
+		executor.standby = false
+	case clusterStateShutDownInRecovery:
+		executor.standby = true
+	default:
+		return nil, fmt.Errorf("an offline backup requires PostgreSQL to be cleanly shut down, but its state is %q", state)
+	}
+
+	return controlData, nil
+}
+
+// execSnapshot takes the snapshots of the data directory and of
+// the tablespaces, running up to the configured number in parallel
+func (executor *Executor) execSnapshot(ctx context.Context) error {
 	tablespaces, err := executor.getTablespaces(ctx)
 	if err != nil {
 		return err
 	}
 
-	logger.Info("Taking snapshot of data directory")
-	err = executor.repository.Snapshot(ctx, repository2.PGDataLocation, map[string]string{
-		snapshotTypeName: snapshotTypeBase,
-	})
+	pageChecksums, err := executor.newPageChecksumVerifier(ctx)
 	if err != nil {
 		return err
 	}
 
+	exclusions, err := executor.getDataDirectoryExclusions()
+	if err != nil {
+		return err
+	}
+
+	jobs := []snapshotJob{
+		{
+			description: "data directory",
+			path:        executor.dataDirectory,
+			options: repository2.SnapshotOptions{
+				Tags: map[string]string{
+					SnapshotTypeTag: SnapshotTypeBase,
+				},
+				Exclusions:    exclusions,
+				Checkpoint:    executor.state.getCheckpointOptions(executor.dataDirectory),
+				Progress:      executor.progress,
+				PageChecksums: pageChecksums,
+			},
+		},
+	}
+
 	for i := range tablespaces {
-		logger.Info("Taking snapshot of tablespace", "tablespace", tablespaces[i])
-		err := executor.repository.Snapshot(ctx, tablespaces[i].path, map[string]string{
-			snapshotTypeName:          snapshotTypeTablespace,
-			snapshotTablespaceOidName: tablespaces[i].oid,
-		})
+		tablespaceExclusions, err := executor.getTablespaceExclusions(tablespaces[i].path)
 		if err != nil {
 			return err
 		}
+
+		jobs = append(jobs, snapshotJob{
+			description: "tablespace " + tablespaces[i].oid,
+			path:        tablespaces[i].path,
+			options: repository2.SnapshotOptions{
+				Tags: map[string]string{
+					SnapshotTypeTag:          SnapshotTypeTablespace,
+					SnapshotTablespaceOIDTag: tablespaces[i].oid,
+				},
+				Exclusions:    tablespaceExclusions,
+				Checkpoint:    executor.state.getCheckpointOptions(tablespaces[i].path),
+				Progress:      executor.progress,
+				PageChecksums: pageChecksums,
+			},
+		})
+	}
+
+	executor.progress.StartCopy(ctx, len(jobs))
+	return executor.runSnapshots(ctx, jobs, executor.parallelism)
+}
+
+// snapshotBackupLabel stores the backup_label and tablespace_map files
+// returned by pg_backup_stop in a snapshot, so that the backup can be
+// restored from the repository alone. The files are written in a
+// fixed directory, so that every backup uses the same Kopia source
+func (executor *Executor) snapshotBackupLabel(ctx context.Context, result *webserver.BackupResultData) error {
+	logger := logging.FromContext(ctx)
+
+	if err := os.RemoveAll(backupLabelDirectory); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(backupLabelDirectory, 0o700); err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.RemoveAll(backupLabelDirectory)
+	}()
+
+	for name, content := range map[string][]byte{
+		backupLabelFileName:   result.LabelFile,
+		tablespaceMapFileName: result.SpcmapFile,
+	} {
+		if len(content) == 0 {
+			continue
+		}
+		if err := os.WriteFile(path.Join(backupLabelDirectory, name), content, 0o600); err != nil {
+			return err
+		}
+	}
+
+	logger.Info("Taking snapshot of backup_label and tablespace_map")
+	snapshotInfo, err := executor.repository.Snapshot(ctx, backupLabelDirectory, repository2.SnapshotOptions{
+		Tags: map[string]string{
+			SnapshotTypeTag: SnapshotTypeLabel,
+		},
+	})
+	if err != nil {
+		return err
 	}
+	logger.Info("Snapshot of backup_label and tablespace_map taken", "snapshotID", snapshotInfo.ID)
+	executor.snapshots = append(executor.snapshots, *snapshotInfo)
 
 	return nil
 }
 
 // GetTablespaces read the list of tablespaces
-func (*Executor) getTablespaces(ctx context.Context) ([]tablespace, error) {
+func (executor *Executor) getTablespaces(ctx context.Context) ([]tablespace, error) {
 	logger := logging.FromContext(ctx)
 
-	tblFolder := path.Join(repository2.PGDataLocation, repository2.TablespacesFolder)
+	tblFolder := path.Join(executor.dataDirectory, repository2.TablespacesFolder)
 	entries, err := os.ReadDir(tblFolder)
 	if err != nil {
 		return nil, err
@@ -219,6 +746,20 @@ func (*Executor) getTablespaces(ctx context.Context) ([]tablespace, error) {
 
 // unsetBackupMode stops a backup and resume PostgreSQL normal operation
 func (executor *Executor) unsetBackupMode(ctx context.Context) (*webserver.BackupResultData, error) {
+	backupStatus, err := executor.stopBackupMode(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := executor.setWALRange(ctx, backupStatus); err != nil {
+		return nil, err
+	}
+
+	return backupStatus, nil
+}
+
+// stopBackupMode takes PostgreSQL out of backup mode
+func (executor *Executor) stopBackupMode(ctx context.Context) (*webserver.BackupResultData, error) {
 	logger := logging.FromContext(ctx)
 
 	if err := executor.backupClient.Stop(ctx, executor.backupClientEndpoint, webserver.StopBackupRequest{
@@ -249,13 +790,31 @@ func (executor *Executor) unsetBackupMode(ctx context.Context) (*webserver.Backu
 	}
 	logger.Info("PostgreSQL Backup mode stopped")
 
-	var err error
-	executor.endWal, err = executor.getCurrentWALFile(ctx)
+	return &backupStatus, nil
+}
+
+// setWALRange sets the first and the last WAL file required by the
+// backup. They are read from the backup label and the end LSN rather
+// than from the current WAL file, which on a standby is not on the
+// timeline where the backup has been taken
+func (executor *Executor) setWALRange(ctx context.Context, backupStatus *webserver.BackupResultData) error {
+	label, err := parseBackupLabel(backupStatus.LabelFile)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return &backupStatus, nil
+	controlData, err := executor.getPgControlData(ctx)
+	if err != nil {
+		return err
+	}
+
+	// pg_backup_stop fails if a standby is promoted during the
+	// backup, so the backup ends on the timeline where it started
+	executor.timeline = label.startTimeline
+	executor.walSegmentSize = getWALSegmentSize(controlData)
+	executor.beginWal = label.startWAL
+	executor.endWal, err = getWALFileName(label.startTimeline, backupStatus.EndLSN, executor.walSegmentSize)
+	return err
 }
 
 func retryOnBackupNotStarted(e error) bool {
@@ -265,14 +824,3 @@ func retryOnBackupNotStarted(e error) bool {
 func retryOnBackupNotStopped(e error) bool {
 	return e == errBackupNotStopped
 }
-
-func (executor *Executor) getCurrentWALFile(ctx context.Context) (string, error) {
-	const currentWALFileControlFile = "Latest checkpoint's REDO WAL file"
-
-	controlDataOutput, err := getPgControlData(ctx)
-	if err != nil {
-		return "", err
-	}
-
-	return controlDataOutput[currentWALFileControlFile], nil
-}
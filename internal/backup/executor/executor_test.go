@@ -0,0 +1,397 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	apiv1 "github.com/cloudnative-pg/cloudnative-pg/api/v1"
+	"github.com/cloudnative-pg/cloudnative-pg/pkg/management/postgres/webserver"
+	"github.com/cloudnative-pg/cloudnative-pg/pkg/management/url"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/hooks"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/provider"
+	repository2 "github.com/dougkirkley/plugin-objstore-backup/internal/backup/repository"
+)
+
+// fakeInstance is a stand-in for the webserver of the instance manager,
+// serving the backup mode and the pg_controldata endpoints
+type fakeInstance struct {
+	mutex sync.Mutex
+	phase webserver.BackupConnectionPhase
+
+	stops int
+
+	// forced is set when a start request replaces a running backup
+	forced bool
+
+	// onStart is called when the backup mode is started
+	onStart func()
+
+	// stopErrors is the number of stop requests which fail
+	stopErrors int
+
+	// result is the outcome of the backup reported
+	// together with its phase
+	result webserver.BackupResultData
+}
+
+func (instance *fakeInstance) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+
+	switch {
+	case r.URL.Path == url.PathPGControlData && r.Method == http.MethodGet:
+		writeJSON(w, map[string]string{"data": "Database cluster state: in production\n"})
+
+	case r.URL.Path == url.PathPgModeBackup && r.Method == http.MethodPost:
+		var request webserver.StartBackupRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		instance.forced = instance.forced || request.Force
+		instance.phase = webserver.Started
+		if instance.onStart != nil {
+			instance.onStart()
+		}
+		writeJSON(w, webserver.Response[webserver.BackupResultData]{})
+
+	case r.URL.Path == url.PathPgModeBackup && r.Method == http.MethodGet:
+		result := instance.result
+		result.Phase = instance.phase
+		writeJSON(w, webserver.Response[webserver.BackupResultData]{Data: &result})
+
+	case r.URL.Path == url.PathPgModeBackup && r.Method == http.MethodPut:
+		instance.stops++
+		if instance.stopErrors > 0 {
+			instance.stopErrors--
+			http.Error(w, "pg_backup_stop failed", http.StatusInternalServerError)
+			return
+		}
+		instance.phase = webserver.Completed
+		writeJSON(w, webserver.Response[webserver.BackupResultData]{})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// getStops gets the number of stop requests received
+func (instance *fakeInstance) getStops() int {
+	instance.mutex.Lock()
+	defer instance.mutex.Unlock()
+
+	return instance.stops
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(value)
+}
+
+// fakeBackupClient is a webserver.BackupClient reaching
+// the fake instance on the port of the test server
+type fakeBackupClient struct {
+	port int
+
+	// onStop is called after every successful stop request
+	onStop func()
+}
+
+func (client *fakeBackupClient) do(ctx context.Context, method string, podIP string, body interface{}) (*http.Response, error) {
+	var content bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&content).Encode(body); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url.Build(podIP, url.PathPgModeBackup, client.port), &content)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return resp, nil
+}
+
+func (client *fakeBackupClient) StatusWithErrors(
+	ctx context.Context,
+	podIP string,
+) (*webserver.Response[webserver.BackupResultData], error) {
+	resp, err := client.do(ctx, http.MethodGet, podIP, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	var result webserver.Response[webserver.BackupResultData]
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return &result, result.EnsureDataIsPresent()
+}
+
+func (client *fakeBackupClient) Start(ctx context.Context, podIP string, sbq webserver.StartBackupRequest) error {
+	resp, err := client.do(ctx, http.MethodPost, podIP, sbq)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+func (client *fakeBackupClient) Stop(ctx context.Context, podIP string, sbq webserver.StopBackupRequest) error {
+	resp, err := client.do(ctx, http.MethodPut, podIP, sbq)
+	if err != nil {
+		return err
+	}
+	if client.onStop != nil {
+		client.onStop()
+	}
+
+	return resp.Body.Close()
+}
+
+// newTestExecutor creates an executor taking an online backup of a
+// temporary data directory, talking with a fake instance webserver
+func newTestExecutor(t *testing.T, instance *fakeInstance) (*Executor, *fakeBackupClient) {
+	t.Helper()
+	t.Setenv("KOPIA_PASSWORD", "password")
+	ctx := context.Background()
+
+	server := httptest.NewServer(instance)
+	t.Cleanup(server.Close)
+
+	_, portValue, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(portValue)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	directory := t.TempDir()
+	rep, err := repository2.NewRepository(
+		ctx,
+		provider.Filesystem.String(),
+		path.Join(directory, "repository"),
+		path.Join(directory, "kopia.config"),
+		path.Join(directory, "cache"),
+		nil,
+		nil,
+		nil,
+	)
+	if err != nil {
+		t.Fatalf("unexpected error opening the repository: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = rep.Close(ctx)
+	})
+
+	dataDirectory := path.Join(directory, "pgdata")
+	if err := os.MkdirAll(path.Join(dataDirectory, repository2.TablespacesFolder), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path.Join(dataDirectory, "PG_VERSION"), []byte("16\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cluster := &apiv1.Cluster{ObjectMeta: metav1.ObjectMeta{Name: "cluster", Namespace: "default"}}
+	backup := &apiv1.Backup{ObjectMeta: metav1.ObjectMeta{Name: "backup", Namespace: "default"}}
+
+	client := &fakeBackupClient{port: port}
+	result := newExecutor(cluster, backup, rep, "127.0.0.1", Options{Online: true, Parallelism: 1})
+	result.backupClient = client
+	result.statusPort = port
+	result.dataDirectory = dataDirectory
+
+	return result, client
+}
+
+// checkSnapshotsRemoved checks that the snapshots
+// don't exist anymore in the repository
+func checkSnapshotsRemoved(t *testing.T, executor *Executor, snapshots []repository2.SnapshotInfo) {
+	t.Helper()
+
+	if len(executor.GetSnapshots()) != 0 {
+		t.Errorf("unexpected snapshots %v left in the executor", executor.GetSnapshots())
+	}
+	for i := range snapshots {
+		if _, err := executor.repository.ChecksumSnapshot(context.Background(), snapshots[i].ID); err == nil {
+			t.Errorf("snapshot %s of the failed backup has not been removed", snapshots[i].ID)
+		}
+	}
+}
+
+func TestBackupCancelledWhileStartingBackupMode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	instance := &fakeInstance{onStart: cancel}
+	executor, _ := newTestExecutor(t, instance)
+
+	_, err := executor.Backup(ctx)
+	if !errors.Is(err, ErrBackupAborted) {
+		t.Fatalf("expected the backup to be aborted, got %v", err)
+	}
+	if instance.getStops() != 1 {
+		t.Fatalf("expected the backup mode to be stopped once, got %d stop requests", instance.getStops())
+	}
+	if instance.forced {
+		t.Fatal("expected the backup not to replace a running one")
+	}
+	checkSnapshotsRemoved(t, executor, nil)
+}
+
+func TestBackupAbortedWhileStoppingBackupMode(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	instance := &fakeInstance{}
+	executor, client := newTestExecutor(t, instance)
+
+	// The backup is cancelled after the data directory has been
+	// copied, while waiting for PostgreSQL to leave backup mode
+	var snapshots []repository2.SnapshotInfo
+	client.onStop = func() {
+		if snapshots == nil {
+			snapshots = append([]repository2.SnapshotInfo{}, executor.snapshots...)
+			cancel()
+		}
+	}
+
+	_, err := executor.Backup(ctx)
+	if !errors.Is(err, ErrBackupAborted) {
+		t.Fatalf("expected the backup to be aborted, got %v", err)
+	}
+	if len(snapshots) != 1 {
+		t.Fatalf("expected the data directory to be snapshotted, got %v", snapshots)
+	}
+	if instance.getStops() != 2 {
+		t.Fatalf("expected the cleanup to stop the backup mode again, got %d stop requests", instance.getStops())
+	}
+	checkSnapshotsRemoved(t, executor, snapshots)
+}
+
+func TestBackupFailingToStopBackupMode(t *testing.T) {
+	instance := &fakeInstance{stopErrors: 1}
+	executor, client := newTestExecutor(t, instance)
+
+	var snapshots []repository2.SnapshotInfo
+	client.onStop = func() {
+		snapshots = append([]repository2.SnapshotInfo{}, executor.snapshots...)
+	}
+
+	_, err := executor.Backup(context.Background())
+	if err == nil || errors.Is(err, ErrBackupAborted) {
+		t.Fatalf("expected the backup to fail without being aborted, got %v", err)
+	}
+
+	// The stop request failing the backup is retried by the cleanup
+	if instance.getStops() != 2 {
+		t.Fatalf("expected the cleanup to stop the backup mode, got %d stop requests", instance.getStops())
+	}
+	if len(snapshots) != 1 {
+		t.Fatalf("expected the data directory to be snapshotted, got %v", snapshots)
+	}
+	checkSnapshotsRemoved(t, executor, snapshots)
+}
+
+func TestOfflineBackupControlData(t *testing.T) {
+	executor, _ := newTestExecutor(t, &fakeInstance{})
+	executor.online = false
+
+	// The instance manager doesn't serve pg_controldata
+	// while PostgreSQL is stopped
+	executor.statusPort = 0
+
+	script := path.Join(t.TempDir(), pgControlDataName)
+	content := "#!/bin/sh\n" +
+		"test \"$1\" = -D && test \"$2\" = \"" + executor.dataDirectory + "\" || exit 1\n" +
+		"echo 'Database cluster state:               shut down in recovery'\n"
+	if err := os.WriteFile(script, []byte(content), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	executor.pgControlDataCommand = script
+
+	controlData, err := executor.checkShutDown(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error reading pg_controldata: %v", err)
+	}
+	if controlData[clusterStateControlFile] != clusterStateShutDownInRecovery || !executor.standby {
+		t.Fatalf("unexpected pg_controldata %v", controlData)
+	}
+
+	executor.pgControlDataCommand = path.Join(t.TempDir(), pgControlDataName)
+	if _, err := executor.checkShutDown(context.Background()); err == nil {
+		t.Fatal("expected the missing pg_controldata to be reported")
+	}
+}
+
+func TestBackupFailingPostHook(t *testing.T) {
+	instance := &fakeInstance{
+		result: webserver.BackupResultData{
+			LabelFile: []byte("START WAL LOCATION: 0/3000028 (file 000000010000000000000003)\n" +
+				"START TIMELINE: 1\n"),
+			BeginLSN: "0/3000028",
+			EndLSN:   "0/3000100",
+		},
+	}
+	executor, client := newTestExecutor(t, instance)
+	executor.hooks = []hooks.Hook{
+		{
+			Name:      "post",
+			Phase:     hooks.PhasePost,
+			Command:   []string{"sh", "-c", "env; exit 1"},
+			Timeout:   time.Minute,
+			OnFailure: hooks.FailurePolicyFail,
+		},
+	}
+
+	var snapshots []repository2.SnapshotInfo
+	client.onStop = func() {
+		snapshots = append([]repository2.SnapshotInfo{}, executor.snapshots...)
+	}
+
+	if _, err := executor.Backup(context.Background()); err == nil {
+		t.Fatal("expected the failing post hook to make the backup fail")
+	}
+	if len(snapshots) != 1 || len(executor.hookResults) != 1 {
+		t.Fatalf("unexpected snapshots %v and hook results %+v", snapshots, executor.hookResults)
+	}
+	checkSnapshotsRemoved(t, executor, snapshots)
+
+	// The hooks only get the backup metadata, and not
+	// the credentials set in the environment of the sidecar
+	output := executor.hookResults[0].Output
+	if !strings.Contains(output, hooks.EnvironmentBackupName+"=backup") || strings.Contains(output, "KOPIA_PASSWORD") {
+		t.Fatalf("unexpected environment of the hook:\n%s", output)
+	}
+}
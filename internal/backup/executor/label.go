@@ -0,0 +1,107 @@
+package executor
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/cloudnative-pg/cloudnative-pg/pkg/postgres"
+)
+
+const (
+	// walSegmentsPerLogID is the number of 32 bit halves of an LSN
+	// addressed by the WAL segments having the same log ID
+	walSegmentsPerLogID = 0x100000000
+
+	// defaultWALSegmentSize is the default size of a WAL segment
+	defaultWALSegmentSize = 16 * 1024 * 1024
+)
+
+// backupLabel is the content of the backup_label file
+// returned by pg_backup_stop
+type backupLabel struct {
+	// startWAL is the name of the WAL file containing
+	// the start of the backup
+	startWAL string
+
+	// startTimeline is the timeline where the backup started
+	startTimeline int64
+}
+
+// parseBackupLabel parses the content of a backup_label file
+func parseBackupLabel(content []byte) (*backupLabel, error) {
+	const (
+		startWALLocationKey = "START WAL LOCATION"
+		startTimelineKey    = "START TIMELINE"
+	)
+
+	result := &backupLabel{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		key, value, found := strings.Cut(scanner.Text(), ": ")
+		if !found {
+			continue
+		}
+
+		switch key {
+		case startWALLocationKey:
+			// i.e. "0/2000028 (file 000000010000000000000002)"
+			_, fileName, found := strings.Cut(value, "(file ")
+			if !found {
+				return nil, fmt.Errorf("malformed %s in backup_label: %q", startWALLocationKey, value)
+			}
+			result.startWAL = strings.TrimSuffix(fileName, ")")
+
+		case startTimelineKey:
+			timeline, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("malformed %s in backup_label: %w", startTimelineKey, err)
+			}
+			result.startTimeline = timeline
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(result.startWAL) == 0 || result.startTimeline == 0 {
+		return nil, fmt.Errorf("backup_label doesn't contain the start WAL location and timeline")
+	}
+
+	return result, nil
+}
+
+// getWALFileName gets the name of the WAL file containing the record
+// ending at a certain LSN, like pg_walfile_name does. On a standby
+// pg_walfile_name can't be used, so the name is computed here
+func getWALFileName(timeline int64, lsn postgres.LSN, walSegmentSize int64) (string, error) {
+	position, err := lsn.Parse()
+	if err != nil {
+		return "", err
+	}
+
+	// An LSN on a segment boundary belongs to the previous segment
+	segmentNumber := (position - 1) / walSegmentSize
+	segmentsPerLogID := walSegmentsPerLogID / walSegmentSize
+	return fmt.Sprintf(
+		"%08X%08X%08X",
+		timeline,
+		segmentNumber/segmentsPerLogID,
+		segmentNumber%segmentsPerLogID,
+	), nil
+}
+
+// getWALSegmentSize gets the WAL segment size from the
+// output of pg_controldata
+func getWALSegmentSize(controlData map[string]string) int64 {
+	const walSegmentSizeControlFile = "Bytes per WAL segment"
+
+	value, err := strconv.ParseInt(controlData[walSegmentSizeControlFile], 10, 64)
+	if err != nil || value <= 0 {
+		return defaultWALSegmentSize
+	}
+
+	return value
+}
@@ -0,0 +1,95 @@
+package executor
+
+import (
+	"path"
+	"strings"
+
+	"github.com/cloudnative-pg/cloudnative-pg/pkg/management/postgres/webserver"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/manifest"
+	repository2 "github.com/dougkirkley/plugin-objstore-backup/internal/backup/repository"
+)
+
+const (
+	// SnapshotTypeTag is the tag containing the type of a snapshot
+	SnapshotTypeTag = repository2.KopiaTagPrefix + "type"
+
+	// SnapshotTypeBase is the type of the snapshot of the data directory
+	SnapshotTypeBase = "base"
+
+	// SnapshotTypeTablespace is the type of the snapshot of a tablespace
+	SnapshotTypeTablespace = "tablespace"
+
+	// SnapshotTypeLabel is the type of the snapshot containing the
+	// backup_label and tablespace_map files of an online backup
+	SnapshotTypeLabel = "label"
+
+	// SnapshotTypeWAL is the type of the snapshot containing the
+	// WAL files bundled in a self-contained backup
+	SnapshotTypeWAL = "wal"
+
+	// SnapshotTablespaceOIDTag is the tag containing the OID
+	// of the tablespace contained in a snapshot
+	SnapshotTablespaceOIDTag = repository2.KopiaTagPrefix + "oid"
+)
+
+// GetSnapshotTag gets the value of a tag of a snapshot. The snapshots
+// taken by older versions have tags without the Kopia prefix
+func GetSnapshotTag(tags map[string]string, name string) string {
+	if value, ok := tags[name]; ok {
+		return value
+	}
+
+	return tags[strings.TrimPrefix(name, repository2.KopiaTagPrefix)]
+}
+
+// GetSnapshotPathPrefix gets the path, relative to the data directory,
+// where the content of a snapshot is restored. Tablespaces are
+// reached via their link in pg_tblspc
+func GetSnapshotPathPrefix(tags map[string]string) string {
+	switch GetSnapshotTag(tags, SnapshotTypeTag) {
+	case SnapshotTypeTablespace:
+		return path.Join(repository2.TablespacesFolder, GetSnapshotTag(tags, SnapshotTablespaceOIDTag))
+	case SnapshotTypeWAL:
+		return repository2.WALFolder
+	default:
+		return ""
+	}
+}
+
+// newManifest creates the manifest of the backup, from the
+// checksums computed while taking the snapshots. The excluded files
+// are not listed, and the exclusions are only recorded with the
+// snapshots in the catalog: pg_verifybackup rejects the manifests
+// having fields which are not written by pg_basebackup
+func (executor *Executor) newManifest(result *webserver.BackupResultData) (*manifest.Manifest, error) {
+	backupManifest := &manifest.Manifest{
+		WALRanges: []manifest.WALRange{
+			{
+				Timeline: executor.timeline,
+				StartLSN: result.BeginLSN,
+				EndLSN:   result.EndLSN,
+			},
+		},
+	}
+
+	for i := range executor.snapshots {
+		AddSnapshotToManifest(backupManifest, &executor.snapshots[i])
+	}
+
+	return backupManifest, nil
+}
+
+// AddSnapshotToManifest adds the files contained in a snapshot
+// to a backup manifest
+func AddSnapshotToManifest(backupManifest *manifest.Manifest, snapshotInfo *repository2.SnapshotInfo) {
+	prefix := GetSnapshotPathPrefix(snapshotInfo.Tags)
+	for relativePath, file := range snapshotInfo.Files {
+		backupManifest.AddFile(manifest.File{
+			Path:         path.Join(prefix, relativePath),
+			Size:         file.Size,
+			LastModified: file.ModTime,
+			Checksum:     file.Checksum,
+		})
+	}
+}
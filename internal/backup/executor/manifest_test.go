@@ -0,0 +1,29 @@
+package executor
+
+import (
+	"testing"
+)
+
+func TestGetSnapshotPathPrefix(t *testing.T) {
+	tests := []struct {
+		tags     map[string]string
+		expected string
+	}{
+		{tags: map[string]string{SnapshotTypeTag: SnapshotTypeBase}, expected: ""},
+		{tags: map[string]string{SnapshotTypeTag: SnapshotTypeWAL}, expected: "pg_wal"},
+		{
+			tags:     map[string]string{SnapshotTypeTag: SnapshotTypeTablespace, SnapshotTablespaceOIDTag: "16384"},
+			expected: "pg_tblspc/16384",
+		},
+		// Snapshots taken by older versions have tags without the Kopia prefix
+		{tags: map[string]string{"type": SnapshotTypeTablespace, "oid": "16385"}, expected: "pg_tblspc/16385"},
+		{tags: map[string]string{"type": SnapshotTypeWAL}, expected: "pg_wal"},
+		{tags: nil, expected: ""},
+	}
+
+	for _, test := range tests {
+		if result := GetSnapshotPathPrefix(test.tags); result != test.expected {
+			t.Errorf("GetSnapshotPathPrefix(%v) = %q, expected %q", test.tags, result, test.expected)
+		}
+	}
+}
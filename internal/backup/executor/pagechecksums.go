@@ -0,0 +1,133 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"path"
+	"strconv"
+
+	"github.com/cloudnative-pg/cnpg-i-machinery/pkg/logging"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/pagechecksum"
+)
+
+const (
+	// dataChecksumVersionControlFile is the pg_controldata entry
+	// which is zero when data checksums are disabled
+	dataChecksumVersionControlFile = "Data page checksum version"
+
+	// blockSizeControlFile is the pg_controldata
+	// entry containing the size of the pages
+	blockSizeControlFile = "Database block size"
+
+	// segmentBlocksControlFile is the pg_controldata entry containing
+	// the number of pages in a segment of a relation
+	segmentBlocksControlFile = "Blocks per segment of large relation"
+)
+
+// maxLoggedCorruptions is the number of corrupted
+// pages described in the error of a failed backup
+const maxLoggedCorruptions = 10
+
+// newPageChecksumVerifier creates the verifier of the page checksums
+// of the relation files, which are verified while they are copied
+// in the snapshots of the data directory and of the tablespaces, like
+// pg_basebackup does. The result is nil when the verification is
+// disabled, or the cluster doesn't have data checksums
+func (executor *Executor) newPageChecksumVerifier(ctx context.Context) (*pagechecksum.Verifier, error) {
+	contextLogger := logging.FromContext(ctx)
+
+	if !executor.pageChecksums.Verify {
+		return nil, nil
+	}
+
+	controlData, err := executor.getPgControlData(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if version := controlData[dataChecksumVersionControlFile]; len(version) == 0 || version == "0" {
+		contextLogger.Info("Data checksums are disabled, skipping the verification of the page checksums")
+		return nil, nil
+	}
+
+	result := &pagechecksum.Verifier{
+		BlockSize:     pagechecksum.DefaultBlockSize,
+		SegmentBlocks: pagechecksum.DefaultSegmentBlocks,
+		// Offline backups have no torn pages
+		StartLSN: math.MaxUint64,
+	}
+	if value, err := strconv.Atoi(controlData[blockSizeControlFile]); err == nil && value > 0 {
+		result.BlockSize = value
+	}
+	if value, err := strconv.ParseInt(controlData[segmentBlocksControlFile], 10, 64); err == nil && value > 0 {
+		result.SegmentBlocks = value
+	}
+	if executor.online {
+		startLSN, err := executor.beginLSN.Parse()
+		if err != nil {
+			return nil, fmt.Errorf("malformed begin LSN %q: %w", executor.beginLSN, err)
+		}
+		result.StartLSN = uint64(startLSN)
+	}
+
+	contextLogger.Info("Verifying the page checksums while copying the files")
+	return result, nil
+}
+
+// collectPageChecksums collects the outcome of the verification of
+// the page checksums from the snapshots of the data directory and of
+// the tablespaces. The result is nil when the verification is skipped
+func (executor *Executor) collectPageChecksums(ctx context.Context) *pagechecksum.Result {
+	contextLogger := logging.FromContext(ctx)
+
+	var verification *pagechecksum.Result
+	for i := range executor.snapshots {
+		if executor.snapshots[i].PageChecksums == nil {
+			continue
+		}
+		if verification == nil {
+			verification = &pagechecksum.Result{}
+		}
+
+		// The corrupted pages are reported with their
+		// path relative to the data directory
+		snapshotResult := *executor.snapshots[i].PageChecksums
+		prefix := GetSnapshotPathPrefix(executor.snapshots[i].Tags)
+		snapshotResult.Corruptions = make([]pagechecksum.Corruption, len(executor.snapshots[i].PageChecksums.Corruptions))
+		for j, corruption := range executor.snapshots[i].PageChecksums.Corruptions {
+			corruption.Path = path.Join(prefix, corruption.Path)
+			snapshotResult.Corruptions[j] = corruption
+		}
+		verification.Add(&snapshotResult)
+	}
+	if verification == nil {
+		return nil
+	}
+
+	contextLogger.Info("Page checksums verified",
+		"verifiedFiles", verification.VerifiedFiles,
+		"verifiedPages", verification.VerifiedPages,
+		"skippedPages", verification.SkippedPages,
+		"corruptedPages", verification.CorruptedPages)
+	for _, corruption := range verification.Corruptions {
+		contextLogger.Info("Page checksum verification failed",
+			"path", corruption.Path,
+			"block", corruption.Block,
+			"checksum", corruption.Checksum,
+			"expected", corruption.Expected)
+	}
+
+	return verification
+}
+
+// getPageChecksumError gets the error of a backup containing
+// corrupted pages, which is nil when they are tolerated
+func (executor *Executor) getPageChecksumError(verification *pagechecksum.Result) error {
+	if verification == nil || verification.Succeeded() || !executor.pageChecksums.FailOnCorruption {
+		return nil
+	}
+
+	return fmt.Errorf("found %d pages with a checksum failure: %s",
+		verification.CorruptedPages, verification.FormatCorruptions(maxLoggedCorruptions))
+}
@@ -0,0 +1,112 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/cloudnative-pg/cnpg-i-machinery/pkg/logging"
+
+	repository2 "github.com/dougkirkley/plugin-objstore-backup/internal/backup/repository"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/objectstore"
+)
+
+// ParallelismParameter is the number of paths, between the data
+// directory and the tablespaces, which are snapshotted in parallel
+const ParallelismParameter = "snapshotParallelism"
+
+// snapshotJob is a path to be snapshotted
+type snapshotJob struct {
+	// description is how the path is reported in logs
+	description string
+
+	path    string
+	options repository2.SnapshotOptions
+}
+
+// GetParallelismFromParameters gets the number of paths snapshotted
+// in parallel from the plugin parameters, which is 1 by default
+func GetParallelismFromParameters(parameters map[string]string) (int, error) {
+	value := parameters[ParallelismParameter]
+	if len(value) == 0 {
+		return 1, nil
+	}
+
+	result, err := strconv.Atoi(value)
+	if err != nil || result < 1 {
+		return 0, &objectstore.ParameterError{Name: ParallelismParameter, Message: "must be a positive integer"}
+	}
+
+	return result, nil
+}
+
+// runSnapshots takes the snapshots of a set of paths, running up to
+// parallelism of them at the same time. The first failure cancels the
+// snapshots in flight, and the errors of every path are returned
+// together. The snapshots taken are added to the executor in the
+// order of the jobs, even when another one fails, so that they are
+// removed by the cleanup
+func (executor *Executor) runSnapshots(ctx context.Context, jobs []snapshotJob, parallelism int) error {
+	logger := logging.FromContext(ctx)
+
+	snapshotsCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]*repository2.SnapshotInfo, len(jobs))
+	errs := make([]error, len(jobs))
+	slots := make(chan struct{}, max(parallelism, 1))
+
+	var wg sync.WaitGroup
+	for i := range jobs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			select {
+			case slots <- struct{}{}:
+				defer func() {
+					<-slots
+				}()
+			case <-snapshotsCtx.Done():
+				return
+			}
+			if snapshotsCtx.Err() != nil {
+				return
+			}
+
+			logger.Info("Taking snapshot of "+jobs[i].description, "path", jobs[i].path)
+			snapshotInfo, err := executor.repository.Snapshot(snapshotsCtx, jobs[i].path, jobs[i].options)
+			if err != nil {
+				// The snapshots cancelled because another one failed, or
+				// because the backup has been cancelled, are not reported
+				if !errors.Is(err, context.Canceled) {
+					errs[i] = fmt.Errorf("while taking snapshot of %s: %w", jobs[i].path, err)
+				}
+				cancel()
+				return
+			}
+
+			logger.Info("Snapshot of "+jobs[i].description+" taken",
+				"path", jobs[i].path,
+				"snapshotID", snapshotInfo.ID,
+				"duration", snapshotInfo.EndTime.Sub(snapshotInfo.StartTime).String(),
+				"stats", snapshotInfo.Stats)
+			results[i] = snapshotInfo
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range results {
+		if results[i] != nil {
+			executor.snapshots = append(executor.snapshots, *results[i])
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	return ctx.Err()
+}
@@ -0,0 +1,135 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/cloudnative-pg/cnpg-i-machinery/pkg/logging"
+
+	repository2 "github.com/dougkirkley/plugin-objstore-backup/internal/backup/repository"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/storage"
+)
+
+// checkpointInterval is how often the progress of the snapshots of
+// the data directory and of the tablespaces is checkpointed
+const checkpointInterval = 5 * time.Minute
+
+// backupState is the partial progress of a backup, recorded in
+// a state file so that a retried backup with the same name resumes
+// from the last checkpoint of its snapshots
+type backupState struct {
+	// BackupName is the name of the backup
+	BackupName string `json:"backupName"`
+
+	// UpdatedAt is when the progress has been recorded
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	// Checksums are the checksums of the files read by the
+	// snapshots, by snapshot path and relative file path
+	Checksums map[string]map[string]repository2.FileChecksum `json:"checksums"`
+}
+
+// stateFile is the state file of a backup, kept in the PVC
+// under the cluster path so that it survives sidecar restarts
+type stateFile struct {
+	mutex sync.Mutex
+	path  string
+	state backupState
+}
+
+// loadState reads the state file of a backup, which
+// is empty when the backup is not being resumed
+func loadState(clusterName string, backupName string) (*stateFile, error) {
+	result := &stateFile{
+		path: storage.GetBackupStatePath(clusterName, backupName),
+		state: backupState{
+			BackupName: backupName,
+			Checksums:  make(map[string]map[string]repository2.FileChecksum),
+		},
+	}
+
+	content, err := os.ReadFile(result.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(content, &result.state); err != nil {
+		return nil, fmt.Errorf("while decoding the state file of backup %s: %w", backupName, err)
+	}
+	if result.state.Checksums == nil {
+		result.state.Checksums = make(map[string]map[string]repository2.FileChecksum)
+	}
+
+	return result, nil
+}
+
+// isResumed is true when the state file contains
+// the progress of a previous attempt
+func (file *stateFile) isResumed() bool {
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+
+	return !file.state.UpdatedAt.IsZero()
+}
+
+// getCheckpointOptions gets the checkpoint options of the snapshot
+// of a path, recording its progress in the state file
+func (file *stateFile) getCheckpointOptions(snapshotPath string) *repository2.CheckpointOptions {
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+
+	return &repository2.CheckpointOptions{
+		Name:      file.state.BackupName,
+		Interval:  checkpointInterval,
+		Checksums: file.state.Checksums[snapshotPath],
+		Save: func(_ context.Context, checksums map[string]repository2.FileChecksum) error {
+			return file.save(snapshotPath, checksums)
+		},
+	}
+}
+
+// save records the checksums of the files read by the snapshot of
+// a path. The file is replaced atomically, so that a restart while
+// it is being written doesn't lose the previous progress
+func (file *stateFile) save(snapshotPath string, checksums map[string]repository2.FileChecksum) error {
+	file.mutex.Lock()
+	defer file.mutex.Unlock()
+
+	file.state.Checksums[snapshotPath] = checksums
+	file.state.UpdatedAt = time.Now()
+
+	content, err := json.Marshal(&file.state)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(path.Dir(file.path), 0o700); err != nil {
+		return err
+	}
+
+	temporaryPath := file.path + ".tmp"
+	if err := os.WriteFile(temporaryPath, content, 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(temporaryPath, file.path)
+}
+
+// removeStates removes the state files of the backups of a cluster,
+// including the ones of backups which have never been resumed. The
+// backup lock guarantees no other backup is being taken
+func removeStates(ctx context.Context, clusterName string) {
+	if err := os.RemoveAll(storage.GetBackupStateDirectory(clusterName)); err != nil {
+		logging.FromContext(ctx).Error(err, "Error while removing the backup state files")
+	}
+}
@@ -0,0 +1,415 @@
+// Package hooks contains the commands which are run by the sidecar
+// before and after taking a backup
+package hooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"time"
+
+	"github.com/cloudnative-pg/cnpg-i-machinery/pkg/logging"
+	"sigs.k8s.io/yaml"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/objectstore"
+)
+
+// Phase is when a hook is run
+type Phase string
+
+const (
+	// PhasePre hooks are run before PostgreSQL enters backup mode
+	PhasePre Phase = "pre"
+
+	// PhasePost hooks are run after PostgreSQL leaves backup mode
+	PhasePost Phase = "post"
+)
+
+// FailurePolicy is what happens to the backup when a hook fails
+type FailurePolicy string
+
+const (
+	// FailurePolicyFail makes the backup fail
+	FailurePolicyFail FailurePolicy = "fail"
+
+	// FailurePolicyContinue ignores the failure of the hook
+	FailurePolicyContinue FailurePolicy = "continue"
+)
+
+const (
+	// PreBackupHookParameter is the shell command run before the backup
+	PreBackupHookParameter = "preBackupHook"
+
+	// PostBackupHookParameter is the shell command run after the backup
+	PostBackupHookParameter = "postBackupHook"
+
+	// hookTimeoutParameterSuffix is the suffix of the parameters setting
+	// the timeout of a hook, i.e. "preBackupHookTimeout"
+	hookTimeoutParameterSuffix = "Timeout"
+
+	// hookOnFailureParameterSuffix is the suffix of the parameters setting
+	// the failure policy of a hook, i.e. "preBackupHookOnFailure"
+	hookOnFailureParameterSuffix = "OnFailure"
+
+	// ConfigMapParameter is the name of the ConfigMap containing
+	// the hook definitions
+	ConfigMapParameter = "hooksConfigMap"
+)
+
+const (
+	// ConfigMapVolumeName is the name of the volume containing
+	// the ConfigMap with the hook definitions
+	ConfigMapVolumeName = "objstore-backup-hooks"
+
+	// ConfigMapDirectory is the directory where the ConfigMap with
+	// the hook definitions is mounted inside the sidecar
+	ConfigMapDirectory = "/etc/objstore-backup/hooks"
+
+	// ConfigMapKey is the key of the ConfigMap containing
+	// the list of hook definitions, in YAML format
+	ConfigMapKey = "hooks.yaml"
+)
+
+const (
+	defaultTimeout = 5 * time.Minute
+
+	// maxOutputLength is the maximum length of the output
+	// of a hook which is recorded in the catalog
+	maxOutputLength = 4096
+)
+
+// Hook is a command run around a backup
+type Hook struct {
+	// Name is the name of the hook, used in logs and in the catalog
+	Name string `json:"name"`
+
+	// Phase is when the hook is run
+	Phase Phase `json:"phase"`
+
+	// Command is the command to be run, with its arguments
+	Command []string `json:"command"`
+
+	// Timeout is the maximum time the hook can run
+	Timeout time.Duration `json:"-"`
+
+	// OnFailure is what happens to the backup when the hook fails
+	OnFailure FailurePolicy `json:"onFailure,omitempty"`
+}
+
+// hookDefinition is a hook as written in the ConfigMap
+type hookDefinition struct {
+	Hook `json:",inline"`
+
+	// Timeout is the timeout of the hook, in the Go duration format
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// Result is the outcome of a hook, as recorded in the catalog
+type Result struct {
+	// Name is the name of the hook
+	Name string `json:"name"`
+
+	// Phase is when the hook has been run
+	Phase Phase `json:"phase"`
+
+	// StartedAt is when the hook has been started
+	StartedAt time.Time `json:"startedAt"`
+
+	// StoppedAt is when the hook has finished
+	StoppedAt time.Time `json:"stoppedAt"`
+
+	// ExitCode is the exit code of the command, -1 when
+	// the command could not be started or has been killed
+	ExitCode int `json:"exitCode"`
+
+	// Error is the reason why the hook failed, if it did
+	Error string `json:"error,omitempty"`
+
+	// Output is the tail of the combined output of the command
+	Output string `json:"output,omitempty"`
+}
+
+// Succeeded is true when the hook completed successfully
+func (result *Result) Succeeded() bool {
+	return len(result.Error) == 0
+}
+
+// Environment contains the backup metadata passed
+// to the hooks as environment variables
+type Environment map[string]string
+
+const (
+	// EnvironmentBackupName is the name of the Backup object
+	EnvironmentBackupName = "BACKUP_NAME"
+
+	// EnvironmentClusterName is the name of the cluster
+	EnvironmentClusterName = "CLUSTER_NAME"
+
+	// EnvironmentNamespace is the namespace of the cluster
+	EnvironmentNamespace = "CLUSTER_NAMESPACE"
+
+	// EnvironmentPhase is the phase of the hook, "pre" or "post"
+	EnvironmentPhase = "BACKUP_HOOK_PHASE"
+
+	// EnvironmentOnline is "true" for online backups
+	EnvironmentOnline = "BACKUP_ONLINE"
+
+	// EnvironmentStandby is "true" when the backup is taken from a standby
+	EnvironmentStandby = "BACKUP_STANDBY"
+
+	// EnvironmentBeginWAL is the first WAL file needed by the backup,
+	// only available to post hooks
+	EnvironmentBeginWAL = "BACKUP_BEGIN_WAL"
+
+	// EnvironmentEndWAL is the last WAL file needed by the backup,
+	// only available to post hooks
+	EnvironmentEndWAL = "BACKUP_END_WAL"
+
+	// EnvironmentBeginLSN is the LSN where the backup starts,
+	// only available to post hooks
+	EnvironmentBeginLSN = "BACKUP_BEGIN_LSN"
+
+	// EnvironmentEndLSN is the LSN where the backup ends,
+	// only available to post hooks
+	EnvironmentEndLSN = "BACKUP_END_LSN"
+)
+
+// NewFromParameters gets the hooks configured in the plugin parameters
+// and in the mounted ConfigMap, in the order they need to be run
+func NewFromParameters(parameters map[string]string) ([]Hook, error) {
+	result, err := getParameterHooks(parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(parameters[ConfigMapParameter]) == 0 {
+		return result, nil
+	}
+
+	configMapHooks, err := readConfigMapHooks(path.Join(ConfigMapDirectory, ConfigMapKey))
+	if err != nil {
+		return nil, err
+	}
+
+	return append(result, configMapHooks...), nil
+}
+
+// ValidateParameters checks the hook configuration contained in the
+// plugin parameters. The content of the ConfigMap is checked by the
+// sidecar when the backup is taken
+func ValidateParameters(parameters map[string]string) error {
+	_, err := getParameterHooks(parameters)
+	return err
+}
+
+// getParameterHooks gets the hooks defined by the plugin parameters
+func getParameterHooks(parameters map[string]string) ([]Hook, error) {
+	var result []Hook
+
+	for _, item := range []struct {
+		parameter string
+		phase     Phase
+	}{
+		{parameter: PreBackupHookParameter, phase: PhasePre},
+		{parameter: PostBackupHookParameter, phase: PhasePost},
+	} {
+		timeoutParameter := item.parameter + hookTimeoutParameterSuffix
+		onFailureParameter := item.parameter + hookOnFailureParameterSuffix
+
+		command := parameters[item.parameter]
+		if len(command) == 0 {
+			for _, name := range []string{timeoutParameter, onFailureParameter} {
+				if len(parameters[name]) > 0 {
+					return nil, &objectstore.ParameterError{Name: name, Message: "requires " + item.parameter}
+				}
+			}
+			continue
+		}
+
+		hook := Hook{
+			Name:      item.parameter,
+			Phase:     item.phase,
+			Command:   []string{"/bin/sh", "-c", command},
+			Timeout:   defaultTimeout,
+			OnFailure: FailurePolicy(parameters[onFailureParameter]),
+		}
+
+		if value := parameters[timeoutParameter]; len(value) > 0 {
+			timeout, err := time.ParseDuration(value)
+			if err != nil || timeout <= 0 {
+				return nil, &objectstore.ParameterError{
+					Name:    timeoutParameter,
+					Message: "must be a positive duration",
+				}
+			}
+			hook.Timeout = timeout
+		}
+
+		if err := hook.validateOnFailure(); err != nil {
+			return nil, &objectstore.ParameterError{Name: onFailureParameter, Message: err.Error()}
+		}
+
+		result = append(result, hook)
+	}
+
+	return result, nil
+}
+
+// readConfigMapHooks reads the hook definitions from the
+// file where the ConfigMap key is mounted
+func readConfigMapHooks(fileName string) ([]Hook, error) {
+	content, err := os.ReadFile(fileName) // #nosec G304
+	if err != nil {
+		return nil, fmt.Errorf("while reading the hooks ConfigMap: %w", err)
+	}
+
+	var definitions []hookDefinition
+	if err := yaml.UnmarshalStrict(content, &definitions); err != nil {
+		return nil, fmt.Errorf("while parsing the hooks ConfigMap: %w", err)
+	}
+
+	result := make([]Hook, 0, len(definitions))
+	for i := range definitions {
+		hook := definitions[i].Hook
+		if len(hook.Name) == 0 {
+			hook.Name = fmt.Sprintf("hook-%d", i)
+		}
+
+		if hook.Phase != PhasePre && hook.Phase != PhasePost {
+			return nil, fmt.Errorf("hook %s: phase must be %s or %s", hook.Name, PhasePre, PhasePost)
+		}
+
+		if len(hook.Command) == 0 {
+			return nil, fmt.Errorf("hook %s: command cannot be empty", hook.Name)
+		}
+
+		hook.Timeout = defaultTimeout
+		if len(definitions[i].Timeout) > 0 {
+			hook.Timeout, err = time.ParseDuration(definitions[i].Timeout)
+			if err != nil || hook.Timeout <= 0 {
+				return nil, fmt.Errorf("hook %s: timeout must be a positive duration", hook.Name)
+			}
+		}
+
+		if err := hook.validateOnFailure(); err != nil {
+			return nil, fmt.Errorf("hook %s: onFailure %w", hook.Name, err)
+		}
+
+		result = append(result, hook)
+	}
+
+	return result, nil
+}
+
+// validateOnFailure checks the failure policy, defaulting it
+func (hook *Hook) validateOnFailure() error {
+	switch hook.OnFailure {
+	case "":
+		hook.OnFailure = FailurePolicyFail
+	case FailurePolicyFail, FailurePolicyContinue:
+	default:
+		return fmt.Errorf("must be %s or %s", FailurePolicyFail, FailurePolicyContinue)
+	}
+
+	return nil
+}
+
+// Run runs the hooks of a certain phase, in order, returning their
+// results. The error is not nil when a hook whose failure policy is
+// "fail" didn't succeed, and no further hooks are run
+func Run(ctx context.Context, hooks []Hook, phase Phase, environment Environment) ([]Result, error) {
+	contextLogger := logging.FromContext(ctx)
+
+	var results []Result
+	for i := range hooks {
+		if hooks[i].Phase != phase {
+			continue
+		}
+
+		contextLogger.Info("Running backup hook", "name", hooks[i].Name, "phase", phase)
+		result := hooks[i].run(ctx, environment)
+		results = append(results, result)
+
+		if result.Succeeded() {
+			contextLogger.Info("Backup hook completed", "name", hooks[i].Name, "phase", phase)
+			continue
+		}
+
+		contextLogger.Info("Backup hook failed",
+			"name", hooks[i].Name,
+			"phase", phase,
+			"onFailure", hooks[i].OnFailure,
+			"exitCode", result.ExitCode,
+			"error", result.Error,
+			"output", result.Output)
+		if hooks[i].OnFailure == FailurePolicyFail {
+			return results, fmt.Errorf("%s backup hook %s failed: %s", phase, hooks[i].Name, result.Error)
+		}
+	}
+
+	return results, nil
+}
+
+// run runs the hook, waiting for it to complete
+func (hook *Hook) run(ctx context.Context, environment Environment) Result {
+	ctx, cancel := context.WithTimeout(ctx, hook.Timeout)
+	defer cancel()
+
+	result := Result{
+		Name:      hook.Name,
+		Phase:     hook.Phase,
+		StartedAt: time.Now().UTC(),
+		ExitCode:  -1,
+	}
+
+	cmd := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...) // #nosec G204
+	cmd.Env = getBaseEnvironment()
+	for name, value := range environment {
+		cmd.Env = append(cmd.Env, name+"="+value)
+	}
+
+	output, err := cmd.CombinedOutput()
+	result.StoppedAt = time.Now().UTC()
+	result.Output = truncateOutput(output)
+	if cmd.ProcessState != nil {
+		result.ExitCode = cmd.ProcessState.ExitCode()
+	}
+
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		result.Error = fmt.Sprintf("timed out after %s", hook.Timeout)
+	case err != nil:
+		result.Error = err.Error()
+	}
+
+	return result
+}
+
+// getBaseEnvironment gets the variables of the sidecar which are
+// passed to the hooks together with the backup metadata. The others
+// are not passed, as they contain the credentials of the object
+// store and the Kopia password, which the output of the hooks
+// recorded in the catalog could expose
+func getBaseEnvironment() []string {
+	var result []string
+	for _, name := range []string{"PATH", "HOME"} {
+		if value, ok := os.LookupEnv(name); ok {
+			result = append(result, name+"="+value)
+		}
+	}
+
+	return result
+}
+
+// truncateOutput keeps the tail of the output of a hook, where
+// the reason of a failure is usually written
+func truncateOutput(output []byte) string {
+	if len(output) > maxOutputLength {
+		output = output[len(output)-maxOutputLength:]
+	}
+
+	return string(output)
+}
@@ -0,0 +1,102 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	apiv1 "github.com/cloudnative-pg/cloudnative-pg/api/v1"
+	"github.com/cloudnative-pg/cnpg-i-machinery/pkg/logging"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/catalog"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/repository"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/objectstore"
+	"github.com/dougkirkley/plugin-objstore-backup/pkg/metadata"
+)
+
+const (
+	// keepParameter is the backup parameter pinning a backup, exempting
+	// it from the retention. It is "true" to keep the backup forever,
+	// or the date until which it is kept, i.e. "2030-01-31"
+	keepParameter = "keep"
+
+	// keepPin is the Kopia pin of the snapshots of a pinned backup
+	keepPin = "keep"
+)
+
+// keepAnnotation is the annotation of the Backup object pinning
+// a backup, with the same format as the keep parameter
+var keepAnnotation = metadata.Data.Name + "/" + keepParameter
+
+// getKeepPolicy checks if a backup needs to be pinned, and until
+// when. The keep parameter takes precedence over the annotation
+// of the Backup object. The time is nil when it is kept forever
+func getKeepPolicy(backupObject *apiv1.Backup, parameters map[string]string) (bool, *time.Time, error) {
+	value, ok := parameters[keepParameter]
+	if !ok {
+		value, ok = backupObject.GetAnnotations()[keepAnnotation]
+	}
+	if !ok || len(value) == 0 {
+		return false, nil, nil
+	}
+
+	if value == "forever" {
+		return true, nil, nil
+	}
+	if pinned, err := strconv.ParseBool(value); err == nil {
+		return pinned, nil, nil
+	}
+
+	for _, layout := range []string{time.DateOnly, time.RFC3339} {
+		keepUntil, err := time.Parse(layout, value)
+		if err == nil {
+			return true, &keepUntil, nil
+		}
+	}
+
+	return false, nil, &objectstore.ParameterError{
+		Name:    keepParameter,
+		Message: fmt.Sprintf("must be true, forever, or a date like 2030-01-31, but is %q", value),
+	}
+}
+
+// releaseExpiredPins unpins the snapshots of the backups whose keep
+// date has passed, so that the retention can remove them
+func releaseExpiredPins(
+	ctx context.Context,
+	backupCatalog *catalog.Catalog,
+	rep *repository.Repository,
+) error {
+	contextLogger := logging.FromContext(ctx)
+
+	backups, err := backupCatalog.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for i := range backups {
+		if !backups[i].Pinned || backups[i].IsPinned(now) {
+			continue
+		}
+
+		contextLogger.Info("Releasing expired backup pin",
+			"backupName", backups[i].BackupName,
+			"keepUntil", backups[i].KeepUntil)
+		ids := make([]string, 0, len(backups[i].Snapshots))
+		for _, snapshotInfo := range backups[i].Snapshots {
+			ids = append(ids, snapshotInfo.ID)
+		}
+		if err := rep.UpdatePins(ctx, ids, nil, []string{keepPin}); err != nil {
+			return err
+		}
+
+		backups[i].Pinned = false
+		if err := backupCatalog.Put(ctx, &backups[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
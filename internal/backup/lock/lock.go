@@ -0,0 +1,313 @@
+// Package lock contains the leases used to prevent concurrent
+// operations on the archive of the same cluster
+package lock
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/cloudnative-pg/cnpg-i-machinery/pkg/logging"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/storage"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/objectstore"
+)
+
+const (
+	// BackupLockName is the name of the lock held while
+	// taking a backup of a cluster
+	BackupLockName = "backup"
+
+	// releaseTimeout is the maximum time spent releasing a lease
+	releaseTimeout = 30 * time.Second
+)
+
+var (
+	// leaseDuration is how long a lease is valid without being
+	// renewed. Leases of crashed holders are taken over after it
+	leaseDuration = 5 * time.Minute
+
+	// renewInterval is how often a lease is renewed
+	renewInterval = 1 * time.Minute
+)
+
+var (
+	// ErrLockHeld is raised when acquiring a lock which is held by
+	// somebody else and is not expired
+	ErrLockHeld = errors.New("lock held")
+
+	// ErrLeaseLost is the cause of the cancellation of the context of
+	// a lease which has been taken over, or couldn't be renewed before
+	// expiring
+	ErrLeaseLost = errors.New("lease lost")
+)
+
+// leaseRecord is the content of the lock object
+type leaseRecord struct {
+	// Holder is the identity of the holder of the lease
+	Holder string `json:"holder"`
+
+	// Operation is what the holder is doing, i.e. the backup name
+	Operation string `json:"operation"`
+
+	// Token identifies the lease, telling apart two
+	// leases having the same holder
+	Token string `json:"token"`
+
+	// AcquiredAt is when the lease has been acquired
+	AcquiredAt time.Time `json:"acquiredAt"`
+
+	// ExpiresAt is when the lease expires if not renewed
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Lease is an acquired lock
+type Lease struct {
+	store       storage.Store
+	clusterName string
+	namespace   string
+	lockName    string
+	record      leaseRecord
+	cancelRenew context.CancelFunc
+	renewDone   chan struct{}
+
+	// version is the version of the lock object written by the
+	// lease. It is only replaced if it still has this version
+	version string
+
+	// lost is cancelled when the lease is lost
+	lost     context.Context
+	markLost context.CancelFunc
+}
+
+// Acquire acquires a lock on the archive of a cluster, taking over the
+// lease of the previous holder when it expired. A lease which has not
+// expired is taken over too when it has the same holder and operation,
+// as it has been left by an interrupted run of the operation being
+// resumed. The lease is renewed in background until released
+func Acquire(
+	ctx context.Context,
+	store storage.Store,
+	clusterName string,
+	namespace string,
+	lockName string,
+	holder string,
+	operation string,
+) (*Lease, error) {
+	contextLogger := logging.FromContext(ctx)
+
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Lease{
+		store:       store,
+		clusterName: clusterName,
+		namespace:   namespace,
+		lockName:    lockName,
+		record: leaseRecord{
+			Holder:     holder,
+			Operation:  operation,
+			Token:      token,
+			AcquiredAt: time.Now(),
+		},
+	}
+
+	current, version, err := result.read(ctx)
+	switch {
+	case errors.Is(err, storage.ErrObjectNotFound):
+	case err != nil:
+		return nil, err
+	case current.Holder == holder && current.Operation == operation:
+		contextLogger.Info("Taking over lock of the resumed operation",
+			"lockName", lockName, "holder", holder, "operation", operation)
+	case time.Now().Before(current.ExpiresAt):
+		return nil, fmt.Errorf(
+			"%w by %s for %s until %s",
+			ErrLockHeld, current.Holder, current.Operation, current.ExpiresAt.Format(time.RFC3339))
+	default:
+		contextLogger.Info("Taking over expired lock",
+			"lockName", lockName, "previousHolder", current.Holder, "previousOperation", current.Operation)
+	}
+
+	// The lock object is created if it doesn't exist, or replaced if it
+	// has not changed since it has been read, so that only one of two
+	// concurrent holders acquires it
+	result.version = version
+	err = result.write(ctx, time.Now().Add(leaseDuration))
+	if errors.Is(err, storage.ErrPreconditionFailed) {
+		return nil, fmt.Errorf("%w, acquired concurrently by another holder", ErrLockHeld)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result.lost, result.markLost = context.WithCancel(context.Background())
+	renewContext, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	result.cancelRenew = cancel
+	result.renewDone = make(chan struct{})
+	go result.renew(renewContext)
+
+	return result, nil
+}
+
+// Context returns a context derived from ctx which is cancelled,
+// with ErrLeaseLost as cause, when the lease is lost. The operation
+// protected by the lock must use it, so that it is stopped before
+// a new holder acquires the lock
+func (lease *Lease) Context(ctx context.Context) (context.Context, context.CancelFunc) {
+	result, cancel := context.WithCancelCause(ctx)
+	stop := context.AfterFunc(lease.lost, func() {
+		cancel(ErrLeaseLost)
+	})
+
+	return result, func() {
+		stop()
+		cancel(context.Canceled)
+	}
+}
+
+// Release releases the lease. The lock object is not deleted, as it
+// may be protected by object lock, but it is written as expired
+func (lease *Lease) Release(ctx context.Context) {
+	contextLogger := logging.FromContext(ctx)
+
+	lease.cancelRenew()
+	<-lease.renewDone
+
+	// A lost lease belongs to another holder
+	if lease.lost.Err() != nil {
+		return
+	}
+	defer lease.markLost()
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), releaseTimeout)
+	defer cancel()
+
+	if err := lease.write(ctx, time.Now()); err != nil {
+		contextLogger.Error(err, "Error while releasing lock, it will expire", "lockName", lease.lockName)
+	}
+}
+
+// renew renews the lease until the context is cancelled. The lease is
+// lost when the lock object has been replaced by another holder, or
+// when it expires because it couldn't be renewed
+func (lease *Lease) renew(ctx context.Context) {
+	defer close(lease.renewDone)
+
+	contextLogger := logging.FromContext(ctx)
+	ticker := time.NewTicker(renewInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			expiresAt := lease.record.ExpiresAt
+			err := lease.write(ctx, time.Now().Add(leaseDuration))
+			switch {
+			case err == nil || ctx.Err() != nil:
+				continue
+			case errors.Is(err, storage.ErrPreconditionFailed):
+				contextLogger.Error(err, "Lock taken over by another holder", "lockName", lease.lockName)
+			case time.Now().Add(renewInterval).Before(expiresAt):
+				// The lease is still valid, and will be renewed later
+				lease.record.ExpiresAt = expiresAt
+				contextLogger.Error(err, "Error while renewing lock", "lockName", lease.lockName)
+				continue
+			default:
+				contextLogger.Error(err, "Error while renewing lock, the lease is expiring", "lockName", lease.lockName)
+			}
+
+			lease.markLost()
+			return
+		}
+	}
+}
+
+// read reads the lease currently stored in the lock
+// object, together with the version of the object
+func (lease *Lease) read(ctx context.Context) (*leaseRecord, string, error) {
+	temporaryDirectory, err := os.MkdirTemp("", "lock")
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() {
+		_ = os.RemoveAll(temporaryDirectory)
+	}()
+
+	temporaryFile := path.Join(temporaryDirectory, lease.lockName+".json")
+	version, err := lease.store.GetVersion(ctx, storage.GetLockKey(lease.clusterName, lease.lockName), temporaryFile)
+	if err != nil {
+		return nil, "", err
+	}
+
+	content, err := os.ReadFile(temporaryFile) // nolint:gosec
+	if err != nil {
+		return nil, "", err
+	}
+
+	var result leaseRecord
+	if err := json.Unmarshal(content, &result); err != nil {
+		return nil, "", fmt.Errorf("while decoding lock %s: %w", lease.lockName, err)
+	}
+
+	return &result, version, nil
+}
+
+// write writes the lease in the lock object, with a certain expiry,
+// only if the lock object has not been changed since the lease wrote
+// it. Raises storage.ErrPreconditionFailed otherwise
+func (lease *Lease) write(ctx context.Context, expiresAt time.Time) error {
+	lease.record.ExpiresAt = expiresAt
+
+	content, err := json.Marshal(lease.record)
+	if err != nil {
+		return err
+	}
+
+	temporaryDirectory, err := os.MkdirTemp("", "lock")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.RemoveAll(temporaryDirectory)
+	}()
+
+	temporaryFile := path.Join(temporaryDirectory, lease.lockName+".json")
+	if err := os.WriteFile(temporaryFile, content, 0o600); err != nil {
+		return err
+	}
+
+	version, err := lease.store.PutIfVersion(
+		ctx,
+		storage.GetLockKey(lease.clusterName, lease.lockName),
+		temporaryFile,
+		lease.version,
+		storage.NewPutOptions(lease.clusterName, lease.namespace, objectstore.ObjectTypeManifest),
+	)
+	if err != nil {
+		return err
+	}
+
+	lease.version = version
+	return nil
+}
+
+// newToken generates a random token identifying a lease
+func newToken() (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(token), nil
+}
@@ -0,0 +1,225 @@
+package lock
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/storage"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/storage/s3test"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/objectstore"
+)
+
+// newTestStore creates a store kept inside an in-memory bucket
+func newTestStore(t *testing.T) (storage.Store, *s3test.Server) {
+	t.Helper()
+
+	// The conditional writes are presigned, which needs credentials
+	t.Setenv("AWS_ACCESS_KEY_ID", "access-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret-key")
+
+	server := s3test.NewServer()
+	t.Cleanup(server.Close)
+
+	configuration, err := objectstore.NewConfigurationFromParameters(server.Parameters(nil))
+	if err != nil {
+		t.Fatalf("unexpected error reading the configuration: %v", err)
+	}
+
+	store, err := storage.NewS3Store(string(storage.DestinationS3), configuration)
+	if err != nil {
+		t.Fatalf("unexpected error creating the store: %v", err)
+	}
+
+	return store, server
+}
+
+// setRenewal shortens the renewal of the leases
+func setRenewal(t *testing.T, duration time.Duration, interval time.Duration) {
+	previousDuration, previousInterval := leaseDuration, renewInterval
+	leaseDuration, renewInterval = duration, interval
+	t.Cleanup(func() {
+		leaseDuration, renewInterval = previousDuration, previousInterval
+	})
+}
+
+func acquireTestLock(ctx context.Context, store storage.Store, holder string) (*Lease, error) {
+	return Acquire(ctx, store, "cluster", "default", BackupLockName, holder, "backup-"+holder)
+}
+
+func TestAcquire(t *testing.T) {
+	store, _ := newTestStore(t)
+	ctx := context.Background()
+
+	lease, err := acquireTestLock(ctx, store, "first")
+	if err != nil {
+		t.Fatalf("unexpected error acquiring the lock: %v", err)
+	}
+	if _, err := acquireTestLock(ctx, store, "second"); !errors.Is(err, ErrLockHeld) {
+		t.Fatalf("expected the lock to be held, got %v", err)
+	}
+
+	// A released lease is expired, and is taken over
+	lease.Release(ctx)
+	lease, err = acquireTestLock(ctx, store, "second")
+	if err != nil {
+		t.Fatalf("unexpected error acquiring the released lock: %v", err)
+	}
+	lease.Release(ctx)
+}
+
+func TestAcquireResumed(t *testing.T) {
+	setRenewal(t, time.Minute, 10*time.Millisecond)
+	store, _ := newTestStore(t)
+	ctx := context.Background()
+
+	interrupted, err := acquireTestLock(ctx, store, "first")
+	if err != nil {
+		t.Fatalf("unexpected error acquiring the lock: %v", err)
+	}
+	interruptedContext, cancel := interrupted.Context(ctx)
+	defer cancel()
+
+	// The same operation of the same holder, resumed
+	// after being interrupted, takes over the lease
+	resumed, err := acquireTestLock(ctx, store, "first")
+	if err != nil {
+		t.Fatalf("unexpected error taking over the lock: %v", err)
+	}
+	defer resumed.Release(ctx)
+
+	_, err = Acquire(ctx, store, "cluster", "default", BackupLockName, "first", "another-backup")
+	if !errors.Is(err, ErrLockHeld) {
+		t.Fatalf("expected the lock to be held for another operation, got %v", err)
+	}
+
+	// The interrupted run loses the lease when renewing it
+	select {
+	case <-interruptedContext.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the context of the interrupted run to be cancelled")
+	}
+	interrupted.Release(ctx)
+
+	current, _, err := resumed.read(ctx)
+	if err != nil || current.Token != resumed.record.Token {
+		t.Fatalf("unexpected lock %+v: %v", current, err)
+	}
+}
+
+func TestAcquireConcurrently(t *testing.T) {
+	store, _ := newTestStore(t)
+	ctx := context.Background()
+
+	lease, err := acquireTestLock(ctx, store, "first")
+	if err != nil {
+		t.Fatalf("unexpected error acquiring the lock: %v", err)
+	}
+	lease.Release(ctx)
+
+	// Two holders read the expired lease, and only
+	// the first one replacing it acquires the lock
+	_, version, err := lease.read(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error reading the lock: %v", err)
+	}
+	winner, err := acquireTestLock(ctx, store, "second")
+	if err != nil {
+		t.Fatalf("unexpected error taking over the lock: %v", err)
+	}
+	defer winner.Release(ctx)
+
+	loser := &Lease{
+		store:       store,
+		clusterName: "cluster",
+		namespace:   "default",
+		lockName:    BackupLockName,
+		record:      leaseRecord{Holder: "third"},
+		version:     version,
+	}
+	if err := loser.write(ctx, time.Now().Add(leaseDuration)); !errors.Is(err, storage.ErrPreconditionFailed) {
+		t.Fatalf("expected the stale lease not to be written, got %v", err)
+	}
+
+	current, _, err := winner.read(ctx)
+	if err != nil || current.Holder != "second" {
+		t.Fatalf("unexpected lock %+v: %v", current, err)
+	}
+}
+
+func TestLeaseTakenOver(t *testing.T) {
+	setRenewal(t, time.Minute, 10*time.Millisecond)
+	store, server := newTestStore(t)
+
+	lease, err := acquireTestLock(context.Background(), store, "first")
+	if err != nil {
+		t.Fatalf("unexpected error acquiring the lock: %v", err)
+	}
+	ctx, cancel := lease.Context(context.Background())
+	defer cancel()
+
+	// Another holder replaces the lock object
+	key := storage.GetLockKey("cluster", BackupLockName)
+	server.SetObject(key, s3test.Object{Content: []byte(`{"holder":"second"}`)})
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the context of the lost lease to be cancelled")
+	}
+	if cause := context.Cause(ctx); !errors.Is(cause, ErrLeaseLost) {
+		t.Fatalf("expected the lease to be lost, got %v", cause)
+	}
+
+	// The lock of the new holder is not released
+	lease.Release(context.Background())
+	if object, _ := server.GetObject(key); string(object.Content) != `{"holder":"second"}` {
+		t.Fatalf("unexpected lock %s", object.Content)
+	}
+}
+
+func TestLeaseExpiring(t *testing.T) {
+	setRenewal(t, 100*time.Millisecond, 10*time.Millisecond)
+	store, server := newTestStore(t)
+
+	lease, err := acquireTestLock(context.Background(), store, "first")
+	if err != nil {
+		t.Fatalf("unexpected error acquiring the lock: %v", err)
+	}
+	ctx, cancel := lease.Context(context.Background())
+	defer cancel()
+
+	// The lease can't be renewed anymore, and
+	// is lost before it expires
+	server.Close()
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the context of the expired lease to be cancelled")
+	}
+	if cause := context.Cause(ctx); !errors.Is(cause, ErrLeaseLost) {
+		t.Fatalf("expected the lease to be lost, got %v", cause)
+	}
+	if time.Now().After(lease.record.ExpiresAt) {
+		t.Fatal("expected the lease to be lost before expiring")
+	}
+	lease.Release(context.Background())
+}
+
+func TestLeaseReleased(t *testing.T) {
+	store, _ := newTestStore(t)
+
+	lease, err := acquireTestLock(context.Background(), store, "first")
+	if err != nil {
+		t.Fatalf("unexpected error acquiring the lock: %v", err)
+	}
+	ctx, cancel := lease.Context(context.Background())
+	cancel()
+
+	if cause := context.Cause(ctx); !errors.Is(cause, context.Canceled) {
+		t.Fatalf("expected the context to be cancelled, got %v", cause)
+	}
+	lease.Release(context.Background())
+}
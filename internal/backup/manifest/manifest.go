@@ -0,0 +1,342 @@
+// Package manifest contains the backup manifests in the format
+// written by pg_basebackup, which can be checked by pg_verifybackup
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/cloudnative-pg/cloudnative-pg/pkg/postgres"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/storage"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/objectstore"
+)
+
+const (
+	// FileName is the name of the backup manifest
+	FileName = "backup_manifest"
+
+	// version is the version of the manifest format
+	version = 1
+
+	// checksumAlgorithm is the algorithm used for the
+	// checksums of the files
+	checksumAlgorithm = "CRC32C"
+
+	// lastModifiedLayout is the layout of the modification
+	// time of the files, which is always in GMT
+	lastModifiedLayout = "2006-01-02 15:04:05 GMT"
+)
+
+// Manifest is a backup manifest
+type Manifest struct {
+	// Files are the files contained in the backup
+	Files []File
+
+	// WALRanges are the WAL needed to recover the backup
+	WALRanges []WALRange
+}
+
+// File is a file contained in a backup
+type File struct {
+	// Path is the path of the file, relative to the data directory
+	Path string
+
+	// Size is the size of the file
+	Size int64
+
+	// LastModified is the modification time of the file
+	LastModified time.Time
+
+	// Checksum is the CRC-32C checksum of the content of the file
+	Checksum uint32
+}
+
+// WALRange is a range of WAL records needed to recover a backup
+type WALRange struct {
+	// Timeline is the timeline of the WAL records
+	Timeline int64
+
+	// StartLSN is the LSN of the first WAL record
+	StartLSN postgres.LSN
+
+	// EndLSN is the LSN of the last WAL record
+	EndLSN postgres.LSN
+}
+
+// document is the JSON representation of a manifest
+type document struct {
+	Version          int                `json:"PostgreSQL-Backup-Manifest-Version"`
+	Files            []fileDocument     `json:"Files"`
+	WALRanges        []walRangeDocument `json:"WAL-Ranges"`
+	ManifestChecksum string             `json:"Manifest-Checksum"`
+}
+
+type fileDocument struct {
+	Path              string `json:"Path"`
+	EncodedPath       string `json:"Encoded-Path"`
+	Size              int64  `json:"Size"`
+	LastModified      string `json:"Last-Modified"`
+	ChecksumAlgorithm string `json:"Checksum-Algorithm"`
+	Checksum          string `json:"Checksum"`
+}
+
+type walRangeDocument struct {
+	Timeline int64  `json:"Timeline"`
+	StartLSN string `json:"Start-LSN"`
+	EndLSN   string `json:"End-LSN"`
+}
+
+// AddFile adds a file to the manifest
+func (manifest *Manifest) AddFile(file File) {
+	manifest.Files = append(manifest.Files, file)
+}
+
+// Marshal writes the manifest in the format of pg_basebackup,
+// line by line, as the checksum of the manifest depends on it
+func (manifest *Manifest) Marshal() ([]byte, error) {
+	files := make([]File, len(manifest.Files))
+	copy(files, manifest.Files)
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "{ \"PostgreSQL-Backup-Manifest-Version\": %d,\n\"Files\": [", version)
+	for i := range files {
+		if i == 0 {
+			buffer.WriteString("\n")
+		} else {
+			buffer.WriteString(",\n")
+		}
+
+		pathField := "\"Path\": " + quote(files[i].Path)
+		if !utf8.ValidString(files[i].Path) {
+			pathField = "\"Encoded-Path\": " + quote(hex.EncodeToString([]byte(files[i].Path)))
+		}
+
+		fmt.Fprintf(&buffer,
+			"{ %s, \"Size\": %d, \"Last-Modified\": %s, \"Checksum-Algorithm\": %s, \"Checksum\": %s }",
+			pathField,
+			files[i].Size,
+			quote(files[i].LastModified.UTC().Format(lastModifiedLayout)),
+			quote(checksumAlgorithm),
+			quote(formatChecksum(files[i].Checksum)))
+	}
+
+	buffer.WriteString("\n],\n\"WAL-Ranges\": [\n")
+	for i := range manifest.WALRanges {
+		if i > 0 {
+			buffer.WriteString(",\n")
+		}
+
+		startLSN, err := formatLSN(manifest.WALRanges[i].StartLSN)
+		if err != nil {
+			return nil, err
+		}
+		endLSN, err := formatLSN(manifest.WALRanges[i].EndLSN)
+		if err != nil {
+			return nil, err
+		}
+
+		fmt.Fprintf(&buffer, "{ \"Timeline\": %d, \"Start-LSN\": %s, \"End-LSN\": %s }",
+			manifest.WALRanges[i].Timeline, quote(startLSN), quote(endLSN))
+	}
+	buffer.WriteString("\n],\n")
+
+	// The checksum covers everything before its own line
+	checksum := sha256.Sum256(buffer.Bytes())
+	fmt.Fprintf(&buffer, "\"Manifest-Checksum\": %s}\n", quote(hex.EncodeToString(checksum[:])))
+
+	return buffer.Bytes(), nil
+}
+
+// Parse reads a manifest, checking its checksum
+func Parse(content []byte) (*Manifest, error) {
+	var manifestDocument document
+	if err := json.Unmarshal(content, &manifestDocument); err != nil {
+		return nil, fmt.Errorf("while decoding the backup manifest: %w", err)
+	}
+
+	if manifestDocument.Version != version {
+		return nil, fmt.Errorf("unsupported backup manifest version %d", manifestDocument.Version)
+	}
+
+	// The checksum line is the last one, and the checksum
+	// covers everything up to the preceding newline
+	checksumLineStart := bytes.LastIndexByte(bytes.TrimSuffix(content, []byte("\n")), '\n')
+	if checksumLineStart < 0 {
+		return nil, fmt.Errorf("the backup manifest doesn't contain its checksum")
+	}
+	checksum := sha256.Sum256(content[:checksumLineStart+1])
+	if hex.EncodeToString(checksum[:]) != strings.ToLower(manifestDocument.ManifestChecksum) {
+		return nil, fmt.Errorf("the checksum of the backup manifest doesn't match its content")
+	}
+
+	result := &Manifest{}
+	for _, entry := range manifestDocument.Files {
+		file := File{
+			Path: entry.Path,
+			Size: entry.Size,
+		}
+
+		if len(entry.EncodedPath) > 0 {
+			decodedPath, err := hex.DecodeString(entry.EncodedPath)
+			if err != nil {
+				return nil, fmt.Errorf("malformed encoded path %q in the backup manifest", entry.EncodedPath)
+			}
+			file.Path = string(decodedPath)
+		}
+
+		if entry.ChecksumAlgorithm != checksumAlgorithm {
+			return nil, fmt.Errorf("unsupported checksum algorithm %q for %s", entry.ChecksumAlgorithm, file.Path)
+		}
+
+		var err error
+		if file.Checksum, err = parseChecksum(entry.Checksum); err != nil {
+			return nil, fmt.Errorf("malformed checksum for %s: %w", file.Path, err)
+		}
+
+		if file.LastModified, err = time.Parse(lastModifiedLayout, entry.LastModified); err != nil {
+			return nil, fmt.Errorf("malformed modification time for %s: %w", file.Path, err)
+		}
+
+		result.Files = append(result.Files, file)
+	}
+
+	for _, entry := range manifestDocument.WALRanges {
+		result.WALRanges = append(result.WALRanges, WALRange{
+			Timeline: entry.Timeline,
+			StartLSN: postgres.LSN(entry.StartLSN),
+			EndLSN:   postgres.LSN(entry.EndLSN),
+		})
+	}
+
+	return result, nil
+}
+
+// Put writes the manifest of a backup into a set of stores
+func Put(
+	ctx context.Context,
+	manifest *Manifest,
+	clusterName string,
+	namespace string,
+	backupName string,
+	stores ...storage.Store,
+) error {
+	content, err := manifest.Marshal()
+	if err != nil {
+		return err
+	}
+
+	temporaryDirectory, err := os.MkdirTemp("", "manifest")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.RemoveAll(temporaryDirectory)
+	}()
+
+	temporaryFile := path.Join(temporaryDirectory, FileName)
+	if err := os.WriteFile(temporaryFile, content, 0o600); err != nil {
+		return err
+	}
+
+	putOptions := storage.NewPutOptions(clusterName, namespace, objectstore.ObjectTypeManifest).
+		WithBackupName(backupName)
+	key := storage.GetBackupManifestKey(clusterName, backupName)
+	for _, store := range stores {
+		if err := store.Put(ctx, key, temporaryFile, putOptions); err != nil {
+			return fmt.Errorf("while writing the manifest of %s to %s: %w", backupName, store.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+// Get reads the manifest of a backup from a store, checking its checksum
+func Get(ctx context.Context, store storage.Store, clusterName string, backupName string) (*Manifest, error) {
+	temporaryDirectory, err := os.MkdirTemp("", "manifest")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = os.RemoveAll(temporaryDirectory)
+	}()
+
+	temporaryFile := path.Join(temporaryDirectory, FileName)
+	if err := store.Get(ctx, storage.GetBackupManifestKey(clusterName, backupName), temporaryFile); err != nil {
+		return nil, err
+	}
+
+	content, err := os.ReadFile(temporaryFile) // nolint:gosec
+	if err != nil {
+		return nil, err
+	}
+
+	return Parse(content)
+}
+
+// Delete removes the manifest of a backup from a set of stores
+func Delete(ctx context.Context, clusterName string, backupName string, stores ...storage.Store) error {
+	key := storage.GetBackupManifestKey(clusterName, backupName)
+	for _, store := range stores {
+		if err := store.Delete(ctx, key); err != nil {
+			return fmt.Errorf("while deleting the manifest of %s from %s: %w", backupName, store.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+// quote writes a JSON string, without escaping the HTML
+// characters as pg_basebackup doesn't
+func quote(value string) string {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	_ = encoder.Encode(value)
+	return strings.TrimSuffix(buffer.String(), "\n")
+}
+
+// formatChecksum writes a CRC-32C checksum like PostgreSQL does,
+// which hex-encodes its bytes in little-endian order
+func formatChecksum(checksum uint32) string {
+	var result [4]byte
+	binary.LittleEndian.PutUint32(result[:], checksum)
+	return hex.EncodeToString(result[:])
+}
+
+// parseChecksum reads a CRC-32C checksum written by formatChecksum
+func parseChecksum(value string) (uint32, error) {
+	content, err := hex.DecodeString(value)
+	if err != nil {
+		return 0, err
+	}
+	if len(content) != 4 {
+		return 0, fmt.Errorf("expected 4 bytes, got %d", len(content))
+	}
+
+	return binary.LittleEndian.Uint32(content), nil
+}
+
+// formatLSN writes an LSN in the format used by PostgreSQL
+func formatLSN(lsn postgres.LSN) (string, error) {
+	position, err := lsn.Parse()
+	if err != nil {
+		return "", fmt.Errorf("malformed LSN %q: %w", lsn, err)
+	}
+
+	return fmt.Sprintf("%X/%X", uint64(position)>>32, uint32(position)), nil
+}
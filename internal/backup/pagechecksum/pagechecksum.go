@@ -0,0 +1,429 @@
+// Package pagechecksum verifies the checksums of the data pages of
+// the relation files, like pg_basebackup does while copying them
+package pagechecksum
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/objectstore"
+)
+
+const (
+	// VerifyParameter enables the verification of the page checksums,
+	// which is done by default when the cluster has data checksums
+	VerifyParameter = "verifyPageChecksums"
+
+	// FailOnCorruptionParameter makes the backup fail
+	// when a corrupted page is found
+	FailOnCorruptionParameter = "failOnPageCorruption"
+)
+
+const (
+	// DefaultBlockSize is the default size of the PostgreSQL pages
+	DefaultBlockSize = 8192
+
+	// DefaultSegmentBlocks is the default number of
+	// pages contained in a segment of a relation
+	DefaultSegmentBlocks = 131072
+
+	// maxReportedCorruptions is the maximum number of corrupted pages
+	// which are reported individually. The other ones are only counted
+	maxReportedCorruptions = 100
+
+	// nSums is the number of parallel checksums computed on a page
+	nSums = 32
+
+	// fnvPrime is the FNV-1a prime used by the checksum algorithm
+	fnvPrime = 16777619
+
+	// checksumOffset is the offset of pd_checksum in the page header
+	checksumOffset = 8
+
+	// upperOffset is the offset of pd_upper in the page header
+	upperOffset = 14
+)
+
+// checksumBaseOffsets are the initial values of the parallel
+// checksums, as defined in PostgreSQL's checksum_impl.h
+var checksumBaseOffsets = [nSums]uint32{
+	0x5B1F36E9, 0xB8525960, 0x02AB50AA, 0x1DE66D2A,
+	0x79FF467A, 0x9BB9F8A3, 0x217E7CD2, 0x83E13D2C,
+	0xF8D4474F, 0xE39EB970, 0x42C6AE16, 0x993216FA,
+	0x7B093B5D, 0x98DAFF3C, 0xF718902A, 0x0B1C9CDB,
+	0xE58F764B, 0x187636BC, 0x5D7B3BB1, 0xE73DE7DE,
+	0x92BEC979, 0xCCA6C0B2, 0x304A0979, 0x85AA43D4,
+	0x783125BB, 0x6CA8EAA2, 0xE407EAC6, 0x4B5CFC3E,
+	0x9FBF8C76, 0x15CA20BE, 0xF2CA9FFF, 0x3ED55BFE,
+}
+
+var (
+	// relationFileRegex matches the name of the files of a relation,
+	// i.e. "16384", "16384_fsm" or "16384.1"
+	relationFileRegex = regexp.MustCompile(`^\d+(_(fsm|vm|init))?(\.(\d+))?$`)
+
+	// relationDirectoryRegex matches the directories containing relation
+	// files, relative to the data directory or to a tablespace
+	relationDirectoryRegex = regexp.MustCompile(`^(global|base/\d+|PG_[^/]+/\d+)$`)
+)
+
+// Options are the options of the verification
+type Options struct {
+	// Verify enables the verification
+	Verify bool
+
+	// FailOnCorruption makes the backup fail when
+	// a corrupted page is found
+	FailOnCorruption bool
+}
+
+// Corruption is a page whose checksum doesn't match its content
+type Corruption struct {
+	// Path is the path of the relation file
+	Path string `json:"path"`
+
+	// Block is the number of the page inside the relation
+	Block int64 `json:"block"`
+
+	// Checksum is the checksum stored in the page
+	Checksum uint16 `json:"checksum"`
+
+	// Expected is the checksum computed from the content of the page
+	Expected uint16 `json:"expected"`
+}
+
+// String implements fmt.Stringer
+func (corruption Corruption) String() string {
+	return fmt.Sprintf("%s block %d: checksum %d, expected %d",
+		corruption.Path, corruption.Block, corruption.Checksum, corruption.Expected)
+}
+
+// Result is the outcome of the verification of the page checksums
+type Result struct {
+	// VerifiedFiles is the number of relation files verified
+	VerifiedFiles int64 `json:"verifiedFiles"`
+
+	// VerifiedPages is the number of pages whose checksum matches
+	VerifiedPages int64 `json:"verifiedPages"`
+
+	// SkippedPages is the number of pages which are new, or have been
+	// changed during the backup and will be restored from the WAL
+	SkippedPages int64 `json:"skippedPages"`
+
+	// CorruptedPages is the number of pages whose checksum doesn't match
+	CorruptedPages int64 `json:"corruptedPages"`
+
+	// Corruptions are the first corrupted pages found
+	Corruptions []Corruption `json:"corruptions,omitempty"`
+}
+
+// Succeeded is true when no corrupted page has been found
+func (result *Result) Succeeded() bool {
+	return result.CorruptedPages == 0
+}
+
+// Add adds the outcome of another verification to the result
+func (result *Result) Add(other *Result) {
+	result.VerifiedFiles += other.VerifiedFiles
+	result.VerifiedPages += other.VerifiedPages
+	result.SkippedPages += other.SkippedPages
+	result.CorruptedPages += other.CorruptedPages
+	for i := 0; i < len(other.Corruptions) && len(result.Corruptions) < maxReportedCorruptions; i++ {
+		result.Corruptions = append(result.Corruptions, other.Corruptions[i])
+	}
+}
+
+// Verifier verifies the page checksums of the relation files
+type Verifier struct {
+	// BlockSize is the size of the pages
+	BlockSize int
+
+	// SegmentBlocks is the number of pages in a relation segment
+	SegmentBlocks int64
+
+	// StartLSN is the LSN where the backup started. The pages changed
+	// after it may be torn, and will be restored from the WAL
+	StartLSN uint64
+}
+
+// NewOptionsFromParameters reads the verification
+// options from the plugin parameters
+func NewOptionsFromParameters(parameters map[string]string) (Options, error) {
+	result := Options{Verify: true}
+
+	for name, target := range map[string]*bool{
+		VerifyParameter:           &result.Verify,
+		FailOnCorruptionParameter: &result.FailOnCorruption,
+	} {
+		value, ok := parameters[name]
+		if !ok {
+			continue
+		}
+
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return Options{}, &objectstore.ParameterError{Name: name, Message: "must be true or false"}
+		}
+		*target = parsed
+	}
+
+	return result, nil
+}
+
+// IsRelationFile checks if a file, whose path is relative to the data
+// directory or to a tablespace, contains the pages of a relation
+func IsRelationFile(relativePath string) bool {
+	return relationFileRegex.MatchString(path.Base(relativePath)) &&
+		relationDirectoryRegex.MatchString(path.Dir(relativePath))
+}
+
+// VerifyFile verifies the pages of a relation file, adding the
+// outcome to the result. The path reported for the corrupted
+// pages is the relative one
+func (verifier *Verifier) VerifyFile(
+	ctx context.Context,
+	filePath string,
+	relativePath string,
+	result *Result,
+) error {
+	fileVerifier, err := verifier.NewFileVerifier(filePath, relativePath)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(filePath) // nolint:gosec
+	if errors.Is(err, os.ErrNotExist) {
+		// The relation has been dropped during the backup
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	buffer := make([]byte, verifier.BlockSize)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		n, err := file.Read(buffer)
+		if _, err := fileVerifier.Write(buffer[:n]); err != nil {
+			return err
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("while reading %s: %w", relativePath, err)
+		}
+	}
+
+	result.Add(fileVerifier.Result())
+	return nil
+}
+
+// FileVerifier verifies the pages of a relation file while its
+// content is written to it, so that the pages verified are the
+// ones being copied
+type FileVerifier struct {
+	verifier *Verifier
+
+	// filePath is the path where the pages failing the verification
+	// are read again, empty when they are reported immediately
+	filePath     string
+	relativePath string
+	segment      int64
+
+	// page is the page being written, of which filled bytes are known
+	page   []byte
+	filled int
+	block  int64
+
+	result Result
+}
+
+// NewFileVerifier creates the verifier of a relation file. A partial
+// page at the end of the file is being written, and is restored from
+// the WAL, so it is not verified
+func (verifier *Verifier) NewFileVerifier(filePath string, relativePath string) (*FileVerifier, error) {
+	segment := int64(0)
+	if matches := relationFileRegex.FindStringSubmatch(path.Base(relativePath)); len(matches) > 0 && len(matches[4]) > 0 {
+		var err error
+		if segment, err = strconv.ParseInt(matches[4], 10, 64); err != nil {
+			return nil, fmt.Errorf("malformed segment number in %s: %w", relativePath, err)
+		}
+	}
+
+	return &FileVerifier{
+		verifier:     verifier,
+		filePath:     filePath,
+		relativePath: relativePath,
+		segment:      segment,
+		page:         make([]byte, verifier.BlockSize),
+		result:       Result{VerifiedFiles: 1},
+	}, nil
+}
+
+// Write implements io.Writer, verifying every page which is complete
+func (file *FileVerifier) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		n := copy(file.page[file.filled:], p)
+		file.filled += n
+		p = p[n:]
+		if file.filled < len(file.page) {
+			break
+		}
+
+		if err := file.verifyPage(); err != nil {
+			return written - len(p), err
+		}
+		file.filled = 0
+		file.block++
+	}
+
+	return written, nil
+}
+
+// Result gets the outcome of the verification of the pages written so far
+func (file *FileVerifier) Result() *Result {
+	return &file.result
+}
+
+// verifyPage verifies the page which has been written
+func (file *FileVerifier) verifyPage() error {
+	blockNumber := file.segment*file.verifier.SegmentBlocks + file.block
+	corruption, skipped := file.verifier.verifyPage(file.page, blockNumber)
+	if corruption != nil && len(file.filePath) > 0 {
+		// The page may have been read while being written,
+		// so it is read again before reporting it
+		page, err := file.readPage()
+		switch {
+		case errors.Is(err, os.ErrNotExist) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+			// The relation has been dropped or truncated
+			// during the backup, which is replayed from the WAL
+			corruption, skipped = nil, true
+		case err != nil:
+			return fmt.Errorf("while reading %s again: %w", file.relativePath, err)
+		default:
+			corruption, skipped = file.verifier.verifyPage(page, blockNumber)
+		}
+	}
+
+	switch {
+	case skipped:
+		file.result.SkippedPages++
+	case corruption != nil:
+		corruption.Path = file.relativePath
+		file.result.CorruptedPages++
+		if len(file.result.Corruptions) < maxReportedCorruptions {
+			file.result.Corruptions = append(file.result.Corruptions, *corruption)
+		}
+	default:
+		file.result.VerifiedPages++
+	}
+
+	return nil
+}
+
+// readPage reads again from the file the page which has been written
+func (file *FileVerifier) readPage() ([]byte, error) {
+	source, err := os.Open(file.filePath) // nolint:gosec
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = source.Close()
+	}()
+
+	page := make([]byte, len(file.page))
+	if _, err := source.ReadAt(page, file.block*int64(len(page))); err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
+
+// verifyPage verifies the checksum of a page. New pages and pages
+// changed after the start of the backup are skipped
+func (verifier *Verifier) verifyPage(page []byte, blockNumber int64) (*Corruption, bool) {
+	// Pages are stored in the byte order of the server,
+	// which is little endian on the supported platforms
+	if binary.LittleEndian.Uint16(page[upperOffset:]) == 0 {
+		return nil, true
+	}
+
+	lsn := uint64(binary.LittleEndian.Uint32(page[0:]))<<32 | uint64(binary.LittleEndian.Uint32(page[4:]))
+	if lsn >= verifier.StartLSN {
+		return nil, true
+	}
+
+	stored := binary.LittleEndian.Uint16(page[checksumOffset:])
+	expected := Checksum(page, uint32(blockNumber))
+	if stored == expected {
+		return nil, false
+	}
+
+	return &Corruption{Block: blockNumber, Checksum: stored, Expected: expected}, false
+}
+
+// Checksum computes the checksum of a page like pg_checksum_page
+// does. The checksum stored in the page header is not considered
+func Checksum(page []byte, blockNumber uint32) uint16 {
+	sums := checksumBaseOffsets
+	stored := binary.LittleEndian.Uint16(page[checksumOffset:])
+	binary.LittleEndian.PutUint16(page[checksumOffset:], 0)
+	defer binary.LittleEndian.PutUint16(page[checksumOffset:], stored)
+
+	mix := func(checksum *uint32, value uint32) {
+		tmp := *checksum ^ value
+		*checksum = tmp*fnvPrime ^ (tmp >> 17)
+	}
+
+	// The page is processed as rows of nSums 32-bit words
+	for offset := 0; offset+4*nSums <= len(page); offset += 4 * nSums {
+		for j := 0; j < nSums; j++ {
+			mix(&sums[j], binary.LittleEndian.Uint32(page[offset+4*j:]))
+		}
+	}
+
+	// Two rounds of zeroes for additional mixing
+	for i := 0; i < 2; i++ {
+		for j := 0; j < nSums; j++ {
+			mix(&sums[j], 0)
+		}
+	}
+
+	var result uint32
+	for j := 0; j < nSums; j++ {
+		result ^= sums[j]
+	}
+
+	result ^= blockNumber
+	return uint16(result%65535 + 1)
+}
+
+// FormatCorruptions describes the first corrupted pages of a result
+func (result *Result) FormatCorruptions(limit int) string {
+	corruptions := make([]string, 0, min(limit, len(result.Corruptions)))
+	for i := 0; i < len(result.Corruptions) && i < limit; i++ {
+		corruptions = append(corruptions, result.Corruptions[i].String())
+	}
+
+	if int64(len(corruptions)) < result.CorruptedPages {
+		corruptions = append(corruptions, fmt.Sprintf("and %d more", result.CorruptedPages-int64(len(corruptions))))
+	}
+
+	return strings.Join(corruptions, "; ")
+}
@@ -0,0 +1,202 @@
+package pagechecksum
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path"
+	"testing"
+)
+
+// startLSN is the LSN where the test backups start
+const startLSN = uint64(1) << 32
+
+// newPage creates a page with a certain LSN, whose checksum
+// is computed for a block. The content depends on the seed
+func newPage(lsn uint64, seed byte, blockNumber uint32) []byte {
+	page := make([]byte, DefaultBlockSize)
+	for i := range page {
+		page[i] = byte(i) ^ seed
+	}
+	binary.LittleEndian.PutUint32(page[0:], uint32(lsn>>32))
+	binary.LittleEndian.PutUint32(page[4:], uint32(lsn))
+	binary.LittleEndian.PutUint16(page[upperOffset:], 1024)
+	binary.LittleEndian.PutUint16(page[checksumOffset:], Checksum(page, blockNumber))
+	return page
+}
+
+// writeFile writes a relation file made of a set of pages
+func writeFile(t *testing.T, filePath string, pages ...[]byte) {
+	t.Helper()
+
+	if err := os.WriteFile(filePath, bytes.Join(pages, nil), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestVerifier() *Verifier {
+	return &Verifier{
+		BlockSize:     DefaultBlockSize,
+		SegmentBlocks: DefaultSegmentBlocks,
+		StartLSN:      startLSN,
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	page := make([]byte, DefaultBlockSize)
+	for i := range page {
+		page[i] = byte(i * 7)
+	}
+
+	// The expected values are computed by pg_checksum_page
+	for blockNumber, expected := range map[uint32]uint16{0: 218, 5: 213, 131077: 211} {
+		if result := Checksum(page, blockNumber); result != expected {
+			t.Errorf("Checksum(page, %d) = %d, expected %d", blockNumber, result, expected)
+		}
+	}
+	if result := Checksum(make([]byte, DefaultBlockSize), 0); result != 62966 {
+		t.Errorf("Checksum(zero page, 0) = %d, expected 62966", result)
+	}
+
+	// The checksum stored in the page is not part of the
+	// computation, and is left untouched
+	binary.LittleEndian.PutUint16(page[checksumOffset:], 0xffff)
+	if result := Checksum(page, 0); result != 218 {
+		t.Errorf("expected the stored checksum to be ignored, got %d", result)
+	}
+	if stored := binary.LittleEndian.Uint16(page[checksumOffset:]); stored != 0xffff {
+		t.Errorf("expected the stored checksum to be kept, got %d", stored)
+	}
+}
+
+func TestVerifyFile(t *testing.T) {
+	directory := t.TempDir()
+	filePath := path.Join(directory, "16384")
+
+	corrupted := newPage(startLSN-1, 2, 1)
+	corrupted[4000] ^= 0x01
+	changed := newPage(startLSN, 4, 0)
+	changed[4000] ^= 0x01
+	writeFile(t, filePath,
+		newPage(startLSN-1, 1, 0),
+		corrupted,
+		make([]byte, DefaultBlockSize),
+		changed,
+		// A partial page is being written
+		newPage(startLSN-1, 5, 4)[:DefaultBlockSize/2],
+	)
+
+	var result Result
+	if err := newTestVerifier().VerifyFile(context.Background(), filePath, "base/1/16384", &result); err != nil {
+		t.Fatalf("unexpected error verifying the file: %v", err)
+	}
+
+	if result.VerifiedFiles != 1 || result.VerifiedPages != 1 || result.SkippedPages != 2 || result.CorruptedPages != 1 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if result.Succeeded() {
+		t.Fatal("expected the verification to fail")
+	}
+	expected := Corruption{
+		Path:     "base/1/16384",
+		Block:    1,
+		Checksum: binary.LittleEndian.Uint16(corrupted[checksumOffset:]),
+		Expected: Checksum(corrupted, 1),
+	}
+	if len(result.Corruptions) != 1 || result.Corruptions[0] != expected {
+		t.Fatalf("unexpected corruptions %v", result.Corruptions)
+	}
+}
+
+func TestVerifyFileSegment(t *testing.T) {
+	directory := t.TempDir()
+	filePath := path.Join(directory, "16384.1")
+
+	verifier := newTestVerifier()
+	verifier.SegmentBlocks = 4
+
+	// The block numbers of the second segment start from SegmentBlocks
+	writeFile(t, filePath, newPage(startLSN-1, 1, 4), newPage(startLSN-1, 2, 1))
+
+	var result Result
+	if err := verifier.VerifyFile(context.Background(), filePath, "base/1/16384.1", &result); err != nil {
+		t.Fatalf("unexpected error verifying the file: %v", err)
+	}
+	if result.VerifiedPages != 1 || result.CorruptedPages != 1 || result.Corruptions[0].Block != 5 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+}
+
+func TestVerifyFileDropped(t *testing.T) {
+	var result Result
+	err := newTestVerifier().VerifyFile(
+		context.Background(), path.Join(t.TempDir(), "16384"), "base/1/16384", &result)
+	if err != nil {
+		t.Fatalf("expected a dropped relation to be skipped, got %v", err)
+	}
+	if result.VerifiedFiles != 0 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+}
+
+func TestFileVerifierReadsPagesAgain(t *testing.T) {
+	directory := t.TempDir()
+	filePath := path.Join(directory, "16384")
+
+	// The page is torn while being copied, and has already
+	// been rewritten when it is read again
+	torn := newPage(startLSN-1, 1, 0)
+	torn[4000] ^= 0x01
+	writeFile(t, filePath, newPage(startLSN, 1, 0))
+
+	for _, test := range []struct {
+		filePath      string
+		skipped       int64
+		corruptedPage int64
+	}{
+		{filePath: filePath, skipped: 1},
+		// Without the file, the page is reported immediately
+		{filePath: "", corruptedPage: 1},
+	} {
+		fileVerifier, err := newTestVerifier().NewFileVerifier(test.filePath, "base/1/16384")
+		if err != nil {
+			t.Fatalf("unexpected error creating the verifier: %v", err)
+		}
+
+		// The content is written in chunks not aligned to the pages
+		for offset := 0; offset < len(torn); offset += 1000 {
+			if _, err := fileVerifier.Write(torn[offset:min(offset+1000, len(torn))]); err != nil {
+				t.Fatalf("unexpected error verifying the page: %v", err)
+			}
+		}
+
+		result := fileVerifier.Result()
+		if result.SkippedPages != test.skipped || result.CorruptedPages != test.corruptedPage {
+			t.Errorf("unexpected result %+v reading again from %q", result, test.filePath)
+		}
+	}
+}
+
+func TestResultAdd(t *testing.T) {
+	result := Result{
+		VerifiedFiles:  1,
+		CorruptedPages: maxReportedCorruptions,
+		Corruptions:    make([]Corruption, maxReportedCorruptions-1),
+	}
+	result.Add(&Result{
+		VerifiedFiles:  2,
+		VerifiedPages:  3,
+		SkippedPages:   4,
+		CorruptedPages: 2,
+		Corruptions:    []Corruption{{Block: 1}, {Block: 2}},
+	})
+
+	if result.VerifiedFiles != 3 || result.VerifiedPages != 3 || result.SkippedPages != 4 ||
+		result.CorruptedPages != maxReportedCorruptions+2 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if len(result.Corruptions) != maxReportedCorruptions || result.Corruptions[maxReportedCorruptions-1].Block != 1 {
+		t.Fatalf("expected the corruptions to be capped, got %d", len(result.Corruptions))
+	}
+}
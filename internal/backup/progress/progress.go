@@ -0,0 +1,375 @@
+// Package progress tracks the progress of the backup being taken,
+// reporting it in periodic log lines and in a status file
+package progress
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/cloudnative-pg/cnpg-i-machinery/pkg/logging"
+)
+
+// reportInterval is how often the progress is logged
+// and written to the status file
+const reportInterval = 30 * time.Second
+
+// Phase is a phase of a backup
+type Phase string
+
+const (
+	// PhaseStarting is the phase where the backup is being prepared
+	PhaseStarting Phase = "starting"
+
+	// PhasePreHooks is the phase where the pre hooks are run
+	PhasePreHooks Phase = "preHooks"
+
+	// PhaseBackupMode is the phase where PostgreSQL
+	// is being put in backup mode
+	PhaseBackupMode Phase = "backupMode"
+
+	// PhaseCopying is the phase where the data directory and the
+	// tablespaces are being copied, verifying their page checksums
+	PhaseCopying Phase = "copying"
+
+	// PhaseFinishing is the phase where PostgreSQL is being
+	// taken out of backup mode, and the backup label is stored
+	PhaseFinishing Phase = "finishing"
+
+	// PhasePostHooks is the phase where the post hooks are run
+	PhasePostHooks Phase = "postHooks"
+
+	// PhaseArchivingWAL is the phase where the WAL files
+	// needed by the backup are archived or bundled
+	PhaseArchivingWAL Phase = "archivingWAL"
+
+	// PhaseFinalizing is the phase where the manifest
+	// and the catalog entry are written
+	PhaseFinalizing Phase = "finalizing"
+
+	// PhaseCompleted is the phase of a backup which has been taken
+	PhaseCompleted Phase = "completed"
+
+	// PhaseFailed is the phase of a backup which didn't complete
+	PhaseFailed Phase = "failed"
+)
+
+// Status is the progress of a backup
+type Status struct {
+	// BackupName is the name of the backup
+	BackupName string `json:"backupName"`
+
+	// Phase is the current phase of the backup
+	Phase Phase `json:"phase"`
+
+	// StartedAt is when the backup started
+	StartedAt time.Time `json:"startedAt"`
+
+	// PhaseStartedAt is when the current phase started
+	PhaseStartedAt time.Time `json:"phaseStartedAt"`
+
+	// UpdatedAt is when the status has been computed
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	// EstimatedFiles is the estimated number of files to be copied.
+	// It is zero until the size of every path has been estimated
+	EstimatedFiles int64 `json:"estimatedFiles"`
+
+	// EstimatedBytes is the estimated size of the files to be copied
+	EstimatedBytes int64 `json:"estimatedBytes"`
+
+	// ProcessedFiles is the number of files copied so far
+	ProcessedFiles int64 `json:"processedFiles"`
+
+	// HashedBytes is the number of bytes read and hashed so far
+	HashedBytes int64 `json:"hashedBytes"`
+
+	// CachedBytes is the size of the files which have not been
+	// read again, being unchanged since the last checkpoint
+	CachedBytes int64 `json:"cachedBytes"`
+
+	// UploadedBytes is the number of bytes written to the
+	// repository so far, after deduplication and compression
+	UploadedBytes int64 `json:"uploadedBytes"`
+
+	// PercentDone is the percentage of the estimated
+	// bytes which have been processed
+	PercentDone float64 `json:"percentDone"`
+
+	// EstimatedCompletion is when the copy is expected to be
+	// completed, missing when it can't be estimated yet
+	EstimatedCompletion *time.Time `json:"estimatedCompletion,omitempty"`
+
+	// Error is the error of a failed backup
+	Error string `json:"error,omitempty"`
+}
+
+// estimate is the estimated size of a path being copied
+type estimate struct {
+	files int64
+	bytes int64
+}
+
+// Tracker tracks the progress of a backup. The snapshots
+// of the paths being copied in parallel share the same tracker
+type Tracker struct {
+	mutex sync.Mutex
+
+	// statusPath is the path of the status file,
+	// empty when the status is only logged
+	statusPath string
+
+	status Status
+
+	// copyStartedAt is when the copy started, and is
+	// used to compute the estimated completion
+	copyStartedAt time.Time
+
+	// paths is the number of paths being copied
+	paths int
+
+	// estimates are the estimated sizes of the paths being copied
+	estimates map[string]estimate
+}
+
+// NewTracker creates the tracker of the progress of a backup,
+// which writes it in a status file when its path is not empty
+func NewTracker(backupName string, statusPath string) *Tracker {
+	now := time.Now()
+	return &Tracker{
+		statusPath: statusPath,
+		status: Status{
+			BackupName:     backupName,
+			Phase:          PhaseStarting,
+			StartedAt:      now,
+			PhaseStartedAt: now,
+			UpdatedAt:      now,
+		},
+		estimates: make(map[string]estimate),
+	}
+}
+
+// Start reports the progress at every interval, until
+// the returned function is called
+func (tracker *Tracker) Start(ctx context.Context) func() {
+	if tracker == nil {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(reportInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				tracker.report(ctx)
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// SetPhase moves the backup to a new phase, reporting it
+func (tracker *Tracker) SetPhase(ctx context.Context, phase Phase) {
+	if tracker == nil {
+		return
+	}
+
+	tracker.mutex.Lock()
+	tracker.status.Phase = phase
+	tracker.status.PhaseStartedAt = time.Now()
+	tracker.mutex.Unlock()
+
+	tracker.report(ctx)
+}
+
+// StartCopy sets the number of paths being copied, whose
+// size needs to be estimated before computing the completion
+func (tracker *Tracker) StartCopy(ctx context.Context, paths int) {
+	if tracker == nil {
+		return
+	}
+
+	tracker.mutex.Lock()
+	tracker.paths = paths
+	tracker.copyStartedAt = time.Now()
+	tracker.mutex.Unlock()
+
+	tracker.SetPhase(ctx, PhaseCopying)
+}
+
+// Finish reports the outcome of the backup
+func (tracker *Tracker) Finish(ctx context.Context, err error) {
+	if tracker == nil {
+		return
+	}
+
+	tracker.mutex.Lock()
+	if err != nil {
+		tracker.status.Error = err.Error()
+	}
+	tracker.mutex.Unlock()
+
+	if err != nil {
+		tracker.SetPhase(ctx, PhaseFailed)
+		return
+	}
+	tracker.SetPhase(ctx, PhaseCompleted)
+}
+
+// SetEstimate sets the estimated size of a path being copied
+func (tracker *Tracker) SetEstimate(snapshotPath string, files int64, bytes int64) {
+	if tracker == nil {
+		return
+	}
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.estimates[snapshotPath] = estimate{files: files, bytes: bytes}
+}
+
+// AddHashedBytes adds the bytes read and hashed
+func (tracker *Tracker) AddHashedBytes(bytes int64) {
+	tracker.update(func(status *Status) {
+		status.HashedBytes += bytes
+	})
+}
+
+// AddCachedBytes adds the size of a file which has not been read again
+func (tracker *Tracker) AddCachedBytes(bytes int64) {
+	tracker.update(func(status *Status) {
+		status.CachedBytes += bytes
+	})
+}
+
+// AddUploadedBytes adds the bytes written to the repository
+func (tracker *Tracker) AddUploadedBytes(bytes int64) {
+	tracker.update(func(status *Status) {
+		status.UploadedBytes += bytes
+	})
+}
+
+// AddProcessedFile counts a file which has been copied
+func (tracker *Tracker) AddProcessedFile() {
+	tracker.update(func(status *Status) {
+		status.ProcessedFiles++
+	})
+}
+
+// update updates the counters of the status
+func (tracker *Tracker) update(updateFunc func(status *Status)) {
+	if tracker == nil {
+		return
+	}
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	updateFunc(&tracker.status)
+}
+
+// GetStatus gets the current progress of the backup
+func (tracker *Tracker) GetStatus() Status {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	now := time.Now()
+	result := tracker.status
+	result.UpdatedAt = now
+
+	// The size is only known when every path has been estimated
+	if tracker.paths == 0 || len(tracker.estimates) < tracker.paths {
+		return result
+	}
+	for _, pathEstimate := range tracker.estimates {
+		result.EstimatedFiles += pathEstimate.files
+		result.EstimatedBytes += pathEstimate.bytes
+	}
+	if result.EstimatedBytes == 0 {
+		return result
+	}
+
+	processedBytes := result.HashedBytes + result.CachedBytes
+	result.PercentDone = min(100, 100*float64(processedBytes)/float64(result.EstimatedBytes))
+	if result.Phase != PhaseCopying || processedBytes == 0 {
+		return result
+	}
+
+	// The completion is estimated from the average speed of the
+	// copy, as the remaining bytes are not known in advance
+	elapsed := now.Sub(tracker.copyStartedAt)
+	remainingBytes := max(0, result.EstimatedBytes-processedBytes)
+	remaining := time.Duration(float64(elapsed) * float64(remainingBytes) / float64(processedBytes))
+	estimatedCompletion := now.Add(remaining).Truncate(time.Second)
+	result.EstimatedCompletion = &estimatedCompletion
+
+	return result
+}
+
+// report logs the progress and writes it to the status file
+func (tracker *Tracker) report(ctx context.Context) {
+	contextLogger := logging.FromContext(ctx)
+
+	status := tracker.GetStatus()
+	values := []interface{}{
+		"backupName", status.BackupName,
+		"phase", status.Phase,
+		"elapsed", status.UpdatedAt.Sub(status.StartedAt).Truncate(time.Second).String(),
+		"processedFiles", status.ProcessedFiles,
+		"hashedBytes", status.HashedBytes,
+		"uploadedBytes", status.UploadedBytes,
+	}
+	if status.EstimatedBytes > 0 {
+		values = append(values,
+			"estimatedFiles", status.EstimatedFiles,
+			"estimatedBytes", status.EstimatedBytes,
+			"percentDone", int(status.PercentDone))
+	}
+	if status.EstimatedCompletion != nil {
+		values = append(values, "eta", status.EstimatedCompletion.Sub(status.UpdatedAt).String())
+	}
+	contextLogger.Info("Backup progress", values...)
+
+	if err := tracker.writeStatus(&status); err != nil {
+		contextLogger.Error(err, "Error while writing the backup status file")
+	}
+}
+
+// writeStatus writes the progress to the status file. The file is
+// replaced atomically, so that its readers never see a partial one
+func (tracker *Tracker) writeStatus(status *Status) error {
+	if len(tracker.statusPath) == 0 {
+		return nil
+	}
+
+	content, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(path.Dir(tracker.statusPath), 0o700); err != nil {
+		return err
+	}
+
+	temporaryPath := tracker.statusPath + ".tmp"
+	if err := os.WriteFile(temporaryPath, content, 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(temporaryPath, tracker.statusPath)
+}
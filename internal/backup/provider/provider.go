@@ -3,7 +3,8 @@ package provider
 type Provider string
 
 const (
-	S3 Provider = "s3"
+	S3         Provider = "s3"
+	Filesystem Provider = "filesystem"
 )
 
 func (p Provider) String() string {
@@ -11,7 +12,7 @@ func (p Provider) String() string {
 }
 
 var (
-	providers = []Provider{S3}
+	providers = []Provider{S3, Filesystem}
 )
 
 func Validate(provider string) bool {
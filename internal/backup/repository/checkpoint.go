@@ -0,0 +1,150 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cloudnative-pg/cnpg-i-machinery/pkg/logging"
+	kopia "github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/snapshot"
+	"github.com/kopia/kopia/snapshot/snapshotfs"
+)
+
+// checkpointTag is the tag of the Kopia checkpoints
+// containing the name of the checkpointed snapshot
+const checkpointTag = "checkpoint"
+
+// CheckpointOptions are the options of a snapshot which is
+// periodically checkpointed, so that it can be resumed after
+// the sidecar is restarted
+type CheckpointOptions struct {
+	// Name identifies the snapshot across restarts, i.e.
+	// the name of the backup it belongs to
+	Name string
+
+	// Interval is how often the progress is checkpointed
+	Interval time.Duration
+
+	// Checksums are the checksums of the files read by the
+	// previous attempt, as passed to Save
+	Checksums map[string]FileChecksum
+
+	// Save is called at every interval with the checksums of
+	// the files read so far, which need to be passed back
+	// when the snapshot is resumed
+	Save func(ctx context.Context, checksums map[string]FileChecksum) error
+}
+
+// getCheckpoint gets the latest Kopia checkpoint of a
+// snapshot, which is nil when there is none
+func (repo *Repository) getCheckpoint(
+	ctx context.Context,
+	sourceInfo snapshot.SourceInfo,
+	name string,
+) (*snapshot.Manifest, error) {
+	checkpoints, err := repo.listCheckpoints(ctx, sourceInfo, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var result *snapshot.Manifest
+	for _, checkpoint := range checkpoints {
+		if result == nil || checkpoint.StartTime.After(result.StartTime) {
+			result = checkpoint
+		}
+	}
+
+	return result, nil
+}
+
+// listCheckpoints lists the Kopia checkpoints of a source. When the name
+// is empty, the checkpoints of every snapshot are listed
+func (repo *Repository) listCheckpoints(
+	ctx context.Context,
+	sourceInfo snapshot.SourceInfo,
+	name string,
+) ([]*snapshot.Manifest, error) {
+	manifests, err := snapshot.ListSnapshots(ctx, repo.repository, sourceInfo)
+	if err != nil {
+		return nil, fmt.Errorf("while listing checkpoints: %w", err)
+	}
+
+	var result []*snapshot.Manifest
+	for _, snapshotManifest := range manifests {
+		if snapshotManifest.IncompleteReason != snapshotfs.IncompleteReasonCheckpoint {
+			continue
+		}
+		if len(name) > 0 && snapshotManifest.Tags[checkpointTag] != name {
+			continue
+		}
+		result = append(result, snapshotManifest)
+	}
+
+	return result, nil
+}
+
+// deleteCheckpoints removes the Kopia checkpoints of a source, which
+// are not needed once a snapshot of the source has been completed
+func (repo *Repository) deleteCheckpoints(ctx context.Context, w kopia.RepositoryWriter, sourceInfo snapshot.SourceInfo) error {
+	checkpoints, err := repo.listCheckpoints(ctx, sourceInfo, "")
+	if err != nil {
+		return err
+	}
+
+	for _, checkpoint := range checkpoints {
+		if err := w.DeleteManifest(ctx, checkpoint.ID); err != nil {
+			return fmt.Errorf("while deleting checkpoint %s: %w", checkpoint.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// saveCheckpoints calls the Save function of the checkpoint options
+// at every interval, until the returned function is called
+func saveCheckpoints(ctx context.Context, options *CheckpointOptions, checksums *checksumCollector) func() {
+	if options == nil || options.Save == nil {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		ticker := time.NewTicker(options.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := options.Save(ctx, checksums.get()); err != nil {
+					logging.FromContext(ctx).Error(err, "Error while saving the snapshot progress")
+				}
+			}
+		}
+	}()
+
+	return cancel
+}
+
+// getResumedChecksums gets the checksums of the files of a snapshot
+// resumed from a checkpoint. The files which have not been read again
+// use the checksums recorded by the interrupted attempt, and the few
+// files read after its last save are read back from the repository
+func (repo *Repository) getResumedChecksums(
+	ctx context.Context,
+	snapshotManifest *snapshot.Manifest,
+	previous map[string]FileChecksum,
+	collected map[string]FileChecksum,
+) (map[string]FileChecksum, error) {
+	known := make(map[string]FileChecksum, len(previous)+len(collected))
+	for relativePath, checksum := range previous {
+		known[relativePath] = checksum
+	}
+	for relativePath, checksum := range collected {
+		known[relativePath] = checksum
+	}
+
+	return repo.checksumSnapshotManifest(ctx, snapshotManifest, known)
+}
@@ -0,0 +1,326 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/kopia/kopia/fs"
+	"github.com/kopia/kopia/repo/manifest"
+	"github.com/kopia/kopia/snapshot"
+	"github.com/kopia/kopia/snapshot/snapshotfs"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/pagechecksum"
+)
+
+// crc32cTable is the table of the CRC-32C checksum,
+// used by PostgreSQL in the backup manifests
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// FileChecksum is the size and checksum of a file
+// contained in a snapshot
+type FileChecksum struct {
+	// Size is the size of the file
+	Size int64 `json:"size"`
+
+	// ModTime is the modification time of the file
+	ModTime time.Time `json:"modTime"`
+
+	// Checksum is the CRC-32C checksum of the content of the file
+	Checksum uint32 `json:"checksum"`
+}
+
+// checksumCollector collects the checksums of the files read
+// by the Kopia uploader, keyed by their path relative to the
+// root of the snapshot, and the outcome of the verification
+// of the page checksums of the relation files
+type checksumCollector struct {
+	mutex  sync.Mutex
+	result map[string]FileChecksum
+
+	// pageChecksums verifies the page checksums of the
+	// relation files, nil when they are not verified
+	pageChecksums      *pagechecksum.Verifier
+	pageChecksumResult pagechecksum.Result
+}
+
+func newChecksumCollector(pageChecksums *pagechecksum.Verifier) *checksumCollector {
+	return &checksumCollector{
+		result:        make(map[string]FileChecksum),
+		pageChecksums: pageChecksums,
+	}
+}
+
+func (collector *checksumCollector) add(relativePath string, checksum FileChecksum) {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	collector.result[relativePath] = checksum
+}
+
+func (collector *checksumCollector) addPageChecksums(result *pagechecksum.Result) {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	collector.pageChecksumResult.Add(result)
+}
+
+// getPageChecksums gets the outcome of the verification of the
+// page checksums, nil when they have not been verified
+func (collector *checksumCollector) getPageChecksums() *pagechecksum.Result {
+	if collector.pageChecksums == nil {
+		return nil
+	}
+
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	result := collector.pageChecksumResult
+	return &result
+}
+
+// get gets a copy of the checksums collected so far
+func (collector *checksumCollector) get() map[string]FileChecksum {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	result := make(map[string]FileChecksum, len(collector.result))
+	for relativePath, checksum := range collector.result {
+		result[relativePath] = checksum
+	}
+	return result
+}
+
+// checksumDirectory is a directory whose files are checksummed
+// while the Kopia uploader reads them
+type checksumDirectory struct {
+	fs.Directory
+
+	relativePath string
+	collector    *checksumCollector
+}
+
+// Child implements fs.Directory
+func (directory *checksumDirectory) Child(ctx context.Context, name string) (fs.Entry, error) {
+	entry, err := directory.Directory.Child(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return directory.wrap(entry), nil
+}
+
+// Iterate implements fs.Directory
+func (directory *checksumDirectory) Iterate(ctx context.Context) (fs.DirectoryIterator, error) {
+	iterator, err := directory.Directory.Iterate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &checksumDirectoryIterator{DirectoryIterator: iterator, directory: directory}, nil
+}
+
+// wrap wraps a child of the directory, leaving
+// untouched the entries which are not files or directories
+func (directory *checksumDirectory) wrap(entry fs.Entry) fs.Entry {
+	relativePath := path.Join(directory.relativePath, entry.Name())
+
+	switch typedEntry := entry.(type) {
+	case fs.Directory:
+		return &checksumDirectory{Directory: typedEntry, relativePath: relativePath, collector: directory.collector}
+	case fs.File:
+		return &checksumFile{File: typedEntry, relativePath: relativePath, collector: directory.collector}
+	default:
+		return entry
+	}
+}
+
+type checksumDirectoryIterator struct {
+	fs.DirectoryIterator
+
+	directory *checksumDirectory
+}
+
+// Next implements fs.DirectoryIterator
+func (iterator *checksumDirectoryIterator) Next(ctx context.Context) (fs.Entry, error) {
+	entry, err := iterator.DirectoryIterator.Next(ctx)
+	if entry == nil || err != nil {
+		return entry, err
+	}
+
+	return iterator.directory.wrap(entry), nil
+}
+
+// checksumFile is a file whose content is checksummed while read
+type checksumFile struct {
+	fs.File
+
+	relativePath string
+	collector    *checksumCollector
+}
+
+// Open implements fs.File
+func (file *checksumFile) Open(ctx context.Context) (fs.Reader, error) {
+	reader, err := file.File.Open(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &checksumReader{Reader: reader, file: file, hash: crc32.New(crc32cTable)}
+	if verifier := file.collector.pageChecksums; verifier != nil && pagechecksum.IsRelationFile(file.relativePath) {
+		if result.pages, err = verifier.NewFileVerifier(file.LocalFilesystemPath(), file.relativePath); err != nil {
+			_ = reader.Close()
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// checksumReader computes the checksum of the content of a
+// file, which is recorded when the file is closed. The uploader
+// reads files sequentially, as parallel uploads are disabled
+type checksumReader struct {
+	fs.Reader
+
+	file   *checksumFile
+	hash   hash.Hash32
+	size   int64
+	seeked bool
+
+	// pages verifies the page checksums of a relation
+	// file, nil when they are not verified
+	pages *pagechecksum.FileVerifier
+}
+
+// Read implements io.Reader
+func (reader *checksumReader) Read(p []byte) (int, error) {
+	n, err := reader.Reader.Read(p)
+	_, _ = reader.hash.Write(p[:n])
+	reader.size += int64(n)
+	if reader.pages != nil {
+		if _, pagesErr := reader.pages.Write(p[:n]); pagesErr != nil {
+			return n, pagesErr
+		}
+	}
+	return n, err
+}
+
+// Seek implements io.Seeker
+func (reader *checksumReader) Seek(offset int64, whence int) (int64, error) {
+	reader.seeked = true
+	return reader.Reader.Seek(offset, whence)
+}
+
+// Close implements io.Closer
+func (reader *checksumReader) Close() error {
+	if !reader.seeked {
+		reader.file.collector.add(reader.file.relativePath, FileChecksum{
+			Size:     reader.size,
+			ModTime:  reader.file.ModTime(),
+			Checksum: reader.hash.Sum32(),
+		})
+		if reader.pages != nil {
+			reader.file.collector.addPageChecksums(reader.pages.Result())
+		}
+	}
+
+	return reader.Reader.Close()
+}
+
+// ChecksumSnapshot reads the content of every file contained in a
+// snapshot, computing its checksum. The result is keyed by the path
+// of the files relative to the root of the snapshot
+func (repo *Repository) ChecksumSnapshot(ctx context.Context, id string) (map[string]FileChecksum, error) {
+	snapshotManifest, err := snapshot.LoadSnapshot(ctx, repo.repository, manifest.ID(id))
+	if err != nil {
+		return nil, fmt.Errorf("while loading snapshot %s: %w", id, err)
+	}
+
+	return repo.checksumSnapshotManifest(ctx, snapshotManifest, nil)
+}
+
+// checksumSnapshotManifest computes the checksum of every file contained
+// in a snapshot. The known checksums are used for the files having the
+// same size and modification time, which are not read
+func (repo *Repository) checksumSnapshotManifest(
+	ctx context.Context,
+	snapshotManifest *snapshot.Manifest,
+	known map[string]FileChecksum,
+) (map[string]FileChecksum, error) {
+	id := snapshotManifest.ID
+	root, err := snapshotfs.SnapshotRoot(repo.repository, snapshotManifest)
+	if err != nil {
+		return nil, fmt.Errorf("while reading snapshot %s: %w", id, err)
+	}
+
+	directory, ok := root.(fs.Directory)
+	if !ok {
+		return nil, fmt.Errorf("the root of snapshot %s is not a directory", id)
+	}
+
+	result := make(map[string]FileChecksum)
+	if err := checksumSnapshotDirectory(ctx, directory, "", known, result); err != nil {
+		return nil, fmt.Errorf("while reading snapshot %s: %w", id, err)
+	}
+
+	return result, nil
+}
+
+// checksumSnapshotDirectory computes the checksum of the files
+// contained in a directory of a snapshot, and in its subdirectories
+func checksumSnapshotDirectory(
+	ctx context.Context,
+	directory fs.Directory,
+	relativePath string,
+	known map[string]FileChecksum,
+	result map[string]FileChecksum,
+) error {
+	return fs.IterateEntries(ctx, directory, func(ctx context.Context, entry fs.Entry) error {
+		entryPath := path.Join(relativePath, entry.Name())
+
+		switch typedEntry := entry.(type) {
+		case fs.Directory:
+			return checksumSnapshotDirectory(ctx, typedEntry, entryPath, known, result)
+
+		case fs.File:
+			if checksum, ok := known[entryPath]; ok &&
+				checksum.Size == typedEntry.Size() && checksum.ModTime.Equal(typedEntry.ModTime()) {
+				result[entryPath] = checksum
+				return nil
+			}
+
+			reader, err := typedEntry.Open(ctx)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				_ = reader.Close()
+			}()
+
+			checksum := crc32.New(crc32cTable)
+			size, err := io.Copy(checksum, reader)
+			if err != nil {
+				return fmt.Errorf("while reading %s: %w", entryPath, err)
+			}
+
+			result[entryPath] = FileChecksum{
+				Size:     size,
+				ModTime:  typedEntry.ModTime(),
+				Checksum: checksum.Sum32(),
+			}
+		}
+
+		return nil
+	})
+}
+
+// GetChecksum gets the CRC-32C checksum of some content
+func GetChecksum(content []byte) uint32 {
+	return crc32.Checksum(content, crc32cTable)
+}
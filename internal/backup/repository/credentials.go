@@ -0,0 +1,191 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/kopia/kopia/repo/blob"
+	"github.com/kopia/kopia/repo/blob/s3"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/objectstore"
+)
+
+// webIdentityStorageType is the Kopia storage type of the S3 storage
+// whose credentials are obtained via web identity. The temporary
+// credentials are not written in the Kopia configuration file, and
+// are refreshed by the storage before they expire
+const webIdentityStorageType = "objstore-s3-web-identity"
+
+// webIdentityStorageOptions are the options of the S3 storage using
+// web identity, as written in the Kopia configuration file
+type webIdentityStorageOptions struct {
+	s3.Options
+
+	// RoleARN is the ARN of the role to be assumed
+	RoleARN string `json:"roleARN"`
+
+	// STSEndpoint is the URL of the STS service
+	STSEndpoint string `json:"stsEndpoint,omitempty"`
+}
+
+func init() {
+	blob.AddSupportedStorage(webIdentityStorageType, webIdentityStorageOptions{}, newWebIdentityStorage)
+}
+
+// webIdentityStorage is a Kopia S3 storage which is created again
+// with the new credentials every time they are refreshed
+type webIdentityStorage struct {
+	blob.DefaultProviderImplementation
+
+	options webIdentityStorageOptions
+
+	mutex       sync.Mutex
+	current     blob.Storage
+	accessKeyID string
+}
+
+// newWebIdentityStorage creates the S3 storage using web identity
+func newWebIdentityStorage(ctx context.Context, options *webIdentityStorageOptions, _ bool) (blob.Storage, error) {
+	result := &webIdentityStorage{options: *options}
+
+	// The storage is created immediately, so that
+	// configuration errors are reported when connecting
+	if _, err := result.get(ctx); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// get gets the S3 storage with valid credentials, creating it
+// again when they have been refreshed. The storages created
+// with the previous credentials are not closed, as Kopia may
+// still be using them, and S3 storages hold no resources
+func (storage *webIdentityStorage) get(ctx context.Context) (blob.Storage, error) {
+	configuration := &objectstore.Configuration{
+		WebIdentity: &objectstore.WebIdentityConfiguration{
+			RoleARN:     storage.options.RoleARN,
+			STSEndpoint: storage.options.STSEndpoint,
+		},
+	}
+
+	value, err := configuration.GetCredentials().Get()
+	if err != nil {
+		return nil, fmt.Errorf("while getting object store credentials: %w", err)
+	}
+
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	if storage.current != nil && storage.accessKeyID == value.AccessKeyID {
+		return storage.current, nil
+	}
+
+	options := storage.options.Options
+	options.AccessKeyID = value.AccessKeyID
+	options.SecretAccessKey = value.SecretAccessKey
+	options.SessionToken = value.SessionToken
+
+	current, err := s3.New(ctx, &options, false)
+	if err != nil {
+		return nil, err
+	}
+
+	storage.current = current
+	storage.accessKeyID = value.AccessKeyID
+	return current, nil
+}
+
+// GetBlob implements the blob.Storage interface
+func (storage *webIdentityStorage) GetBlob(
+	ctx context.Context,
+	id blob.ID,
+	offset int64,
+	length int64,
+	output blob.OutputBuffer,
+) error {
+	current, err := storage.get(ctx)
+	if err != nil {
+		return err
+	}
+
+	return current.GetBlob(ctx, id, offset, length, output)
+}
+
+// GetMetadata implements the blob.Storage interface
+func (storage *webIdentityStorage) GetMetadata(ctx context.Context, id blob.ID) (blob.Metadata, error) {
+	current, err := storage.get(ctx)
+	if err != nil {
+		return blob.Metadata{}, err
+	}
+
+	return current.GetMetadata(ctx, id)
+}
+
+// ListBlobs implements the blob.Storage interface
+func (storage *webIdentityStorage) ListBlobs(
+	ctx context.Context,
+	prefix blob.ID,
+	callback func(blob.Metadata) error,
+) error {
+	current, err := storage.get(ctx)
+	if err != nil {
+		return err
+	}
+
+	return current.ListBlobs(ctx, prefix, callback)
+}
+
+// PutBlob implements the blob.Storage interface
+func (storage *webIdentityStorage) PutBlob(
+	ctx context.Context,
+	id blob.ID,
+	data blob.Bytes,
+	options blob.PutOptions,
+) error {
+	current, err := storage.get(ctx)
+	if err != nil {
+		return err
+	}
+
+	return current.PutBlob(ctx, id, data, options)
+}
+
+// DeleteBlob implements the blob.Storage interface
+func (storage *webIdentityStorage) DeleteBlob(ctx context.Context, id blob.ID) error {
+	current, err := storage.get(ctx)
+	if err != nil {
+		return err
+	}
+
+	return current.DeleteBlob(ctx, id)
+}
+
+// ExtendBlobRetention implements the blob.Storage interface
+func (storage *webIdentityStorage) ExtendBlobRetention(
+	ctx context.Context,
+	id blob.ID,
+	options blob.ExtendOptions,
+) error {
+	current, err := storage.get(ctx)
+	if err != nil {
+		return err
+	}
+
+	return current.ExtendBlobRetention(ctx, id, options)
+}
+
+// ConnectionInfo implements the blob.Storage interface. The
+// credentials are never part of the connection information
+func (storage *webIdentityStorage) ConnectionInfo() blob.ConnectionInfo {
+	return blob.ConnectionInfo{
+		Type:   webIdentityStorageType,
+		Config: &storage.options,
+	}
+}
+
+// DisplayName implements the blob.Storage interface
+func (storage *webIdentityStorage) DisplayName() string {
+	return fmt.Sprintf("S3: %v %v (web identity)", storage.options.Endpoint, storage.options.BucketName)
+}
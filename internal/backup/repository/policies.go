@@ -0,0 +1,400 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/cloudnative-pg/cnpg-i-machinery/pkg/logging"
+	kopia "github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/repo/compression"
+	"github.com/kopia/kopia/repo/splitter"
+	"github.com/kopia/kopia/snapshot"
+	"github.com/kopia/kopia/snapshot/policy"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/metrics"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/objectstore"
+)
+
+const (
+	// compressionParameter is the compression algorithm
+	// of the global policy, i.e. "zstd"
+	compressionParameter = "kopiaCompression"
+
+	// compressionMinSizeParameter is the minimum size of the
+	// files which are compressed, in the global policy
+	compressionMinSizeParameter = "kopiaCompressionMinSize"
+
+	// parallelFileReadsParameter is the number of files
+	// read in parallel, in the global policy
+	parallelFileReadsParameter = "kopiaParallelFileReads"
+
+	// keepLatestParameter and the following ones are the number of
+	// snapshots kept by the retention of the global policy. Kopia
+	// removes the snapshots exceeding the retention after taking a
+	// new one, even if they are still used by a backup
+	keepLatestParameter  = "kopiaKeepLatest"
+	keepHourlyParameter  = "kopiaKeepHourly"
+	keepDailyParameter   = "kopiaKeepDaily"
+	keepWeeklyParameter  = "kopiaKeepWeekly"
+	keepMonthlyParameter = "kopiaKeepMonthly"
+	keepAnnualParameter  = "kopiaKeepAnnual"
+
+	// pathPoliciesParameter contains the policies of specific paths,
+	// as a JSON object keyed by path whose values have the same
+	// settings of the global policy, i.e.
+	// {"/var/lib/postgresql/data/pgdata": {"compression": "zstd"}}
+	pathPoliciesParameter = "kopiaPathPolicies"
+
+	// splitterParameter is the algorithm splitting files into
+	// chunks. It is only used when the repository is initialized
+	splitterParameter = "kopiaSplitter"
+)
+
+// globalPolicySource is how the global policy is
+// reported in logs and metrics
+const globalPolicySource = "(global)"
+
+// PolicySettings are the Kopia policy settings managed by the plugin.
+// The settings which are not set are left untouched
+type PolicySettings struct {
+	// Compression is the compression algorithm
+	Compression string `json:"compression,omitempty"`
+
+	// CompressionMinSize is the minimum size of the compressed files
+	CompressionMinSize *int64 `json:"compressionMinSize,omitempty"`
+
+	// ParallelFileReads is the number of files read in parallel
+	ParallelFileReads *int `json:"parallelFileReads,omitempty"`
+
+	// KeepLatest is the number of latest snapshots to keep
+	KeepLatest *int `json:"keepLatest,omitempty"`
+
+	// KeepHourly is the number of hourly snapshots to keep
+	KeepHourly *int `json:"keepHourly,omitempty"`
+
+	// KeepDaily is the number of daily snapshots to keep
+	KeepDaily *int `json:"keepDaily,omitempty"`
+
+	// KeepWeekly is the number of weekly snapshots to keep
+	KeepWeekly *int `json:"keepWeekly,omitempty"`
+
+	// KeepMonthly is the number of monthly snapshots to keep
+	KeepMonthly *int `json:"keepMonthly,omitempty"`
+
+	// KeepAnnual is the number of annual snapshots to keep
+	KeepAnnual *int `json:"keepAnnual,omitempty"`
+}
+
+// PolicyConfiguration is the configuration of the
+// Kopia policies, as read from the plugin parameters
+type PolicyConfiguration struct {
+	// Global are the settings of the global policy
+	Global PolicySettings
+
+	// Paths are the settings of the policies of specific paths
+	Paths map[string]PolicySettings
+
+	// Splitter is the splitter used when initializing
+	// the repository, empty for the Kopia default
+	Splitter string
+}
+
+// PolicyDrift is a difference between the policy
+// stored in the repository and the configured one
+type PolicyDrift struct {
+	// Source is the source of the policy
+	Source string
+
+	// Field is the setting that differs
+	Field string
+
+	// Actual is the value stored in the repository
+	Actual string
+
+	// Desired is the configured value
+	Desired string
+}
+
+// NewPolicyConfigurationFromParameters reads the configuration
+// of the Kopia policies from the plugin parameters
+func NewPolicyConfigurationFromParameters(parameters map[string]string) (*PolicyConfiguration, error) {
+	result := &PolicyConfiguration{
+		Global: PolicySettings{
+			Compression: parameters[compressionParameter],
+		},
+		Splitter: parameters[splitterParameter],
+	}
+
+	if len(result.Splitter) > 0 && !slices.Contains(splitter.SupportedAlgorithms(), result.Splitter) {
+		return nil, &objectstore.ParameterError{Name: splitterParameter, Message: "is not a supported splitter"}
+	}
+
+	if value := parameters[compressionMinSizeParameter]; len(value) > 0 {
+		minSize, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || minSize < 0 {
+			return nil, &objectstore.ParameterError{
+				Name:    compressionMinSizeParameter,
+				Message: "must be a non negative integer",
+			}
+		}
+		result.Global.CompressionMinSize = &minSize
+	}
+
+	for name, field := range map[string]**int{
+		parallelFileReadsParameter: &result.Global.ParallelFileReads,
+		keepLatestParameter:        &result.Global.KeepLatest,
+		keepHourlyParameter:        &result.Global.KeepHourly,
+		keepDailyParameter:         &result.Global.KeepDaily,
+		keepWeeklyParameter:        &result.Global.KeepWeekly,
+		keepMonthlyParameter:       &result.Global.KeepMonthly,
+		keepAnnualParameter:        &result.Global.KeepAnnual,
+	} {
+		value := parameters[name]
+		if len(value) == 0 {
+			continue
+		}
+
+		count, err := strconv.Atoi(value)
+		if err != nil || count < 0 {
+			return nil, &objectstore.ParameterError{Name: name, Message: "must be a non negative integer"}
+		}
+		*field = &count
+	}
+
+	if err := result.Global.validate(); err != nil {
+		return nil, &objectstore.ParameterError{Name: compressionParameter, Message: err.Error()}
+	}
+
+	if value := parameters[pathPoliciesParameter]; len(value) > 0 {
+		decoder := json.NewDecoder(strings.NewReader(value))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&result.Paths); err != nil {
+			return nil, &objectstore.ParameterError{
+				Name:    pathPoliciesParameter,
+				Message: fmt.Sprintf("is not a valid JSON object of path policies: %v", err),
+			}
+		}
+
+		for path, settings := range result.Paths {
+			if err := settings.validate(); err != nil {
+				return nil, &objectstore.ParameterError{
+					Name:    pathPoliciesParameter,
+					Message: fmt.Sprintf("contains an invalid policy for %s: %v", path, err),
+				}
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// validate checks the settings which are not
+// validated while being parsed
+func (settings *PolicySettings) validate() error {
+	if len(settings.Compression) > 0 && compression.ByName[compression.Name(settings.Compression)] == nil {
+		return fmt.Errorf("%q is not a supported compression algorithm", settings.Compression)
+	}
+
+	for _, count := range []*int{
+		settings.ParallelFileReads,
+		settings.KeepLatest,
+		settings.KeepHourly,
+		settings.KeepDaily,
+		settings.KeepWeekly,
+		settings.KeepMonthly,
+		settings.KeepAnnual,
+	} {
+		if count != nil && *count < 0 {
+			return fmt.Errorf("counts cannot be negative")
+		}
+	}
+
+	return nil
+}
+
+// hasRetention is true when the settings contain a retention
+func (settings *PolicySettings) hasRetention() bool {
+	return settings.KeepLatest != nil ||
+		settings.KeepHourly != nil ||
+		settings.KeepDaily != nil ||
+		settings.KeepWeekly != nil ||
+		settings.KeepMonthly != nil ||
+		settings.KeepAnnual != nil
+}
+
+// apply applies the settings to a policy, returning the
+// differences between the original policy and the settings
+func (settings *PolicySettings) apply(target *policy.Policy, source string) []PolicyDrift {
+	var result []PolicyDrift
+
+	if len(settings.Compression) > 0 && target.CompressionPolicy.CompressorName != compression.Name(settings.Compression) {
+		result = append(result, PolicyDrift{
+			Source:  source,
+			Field:   "compression",
+			Actual:  string(target.CompressionPolicy.CompressorName),
+			Desired: settings.Compression,
+		})
+		target.CompressionPolicy.CompressorName = compression.Name(settings.Compression)
+	}
+
+	if settings.CompressionMinSize != nil && target.CompressionPolicy.MinSize != *settings.CompressionMinSize {
+		result = append(result, PolicyDrift{
+			Source:  source,
+			Field:   "compressionMinSize",
+			Actual:  strconv.FormatInt(target.CompressionPolicy.MinSize, 10),
+			Desired: strconv.FormatInt(*settings.CompressionMinSize, 10),
+		})
+		target.CompressionPolicy.MinSize = *settings.CompressionMinSize
+	}
+
+	for _, item := range []struct {
+		field   string
+		current **policy.OptionalInt
+		desired *int
+	}{
+		{field: "parallelFileReads", current: &target.UploadPolicy.MaxParallelFileReads, desired: settings.ParallelFileReads},
+		{field: "keepLatest", current: &target.RetentionPolicy.KeepLatest, desired: settings.KeepLatest},
+		{field: "keepHourly", current: &target.RetentionPolicy.KeepHourly, desired: settings.KeepHourly},
+		{field: "keepDaily", current: &target.RetentionPolicy.KeepDaily, desired: settings.KeepDaily},
+		{field: "keepWeekly", current: &target.RetentionPolicy.KeepWeekly, desired: settings.KeepWeekly},
+		{field: "keepMonthly", current: &target.RetentionPolicy.KeepMonthly, desired: settings.KeepMonthly},
+		{field: "keepAnnual", current: &target.RetentionPolicy.KeepAnnual, desired: settings.KeepAnnual},
+	} {
+		if item.desired == nil {
+			continue
+		}
+
+		actual := "unset"
+		if *item.current != nil {
+			if int(**item.current) == *item.desired {
+				continue
+			}
+			actual = strconv.Itoa(int(**item.current))
+		}
+
+		result = append(result, PolicyDrift{
+			Source:  source,
+			Field:   item.field,
+			Actual:  actual,
+			Desired: strconv.Itoa(*item.desired),
+		})
+		desired := policy.OptionalInt(*item.desired)
+		*item.current = &desired
+	}
+
+	return result
+}
+
+// reconcilePolicies makes the global policy and the policy of a
+// source match the configuration, only writing the policies which
+// drifted from it. The drifts are logged and counted
+func (repo *Repository) reconcilePolicies(ctx context.Context, sourceInfo snapshot.SourceInfo) error {
+	if repo.policies == nil {
+		return nil
+	}
+
+	logger := logging.FromContext(ctx)
+
+	var drifts []PolicyDrift
+	options := kopia.WriteSessionOptions{Purpose: "ReconcilePolicies"}
+	err := kopia.WriteSession(ctx, repo.repository, options, func(ctx context.Context, w kopia.RepositoryWriter) error {
+		globalDrifts, err := reconcilePolicy(ctx, w, policy.GlobalPolicySourceInfo, globalPolicySource, repo.policies.Global)
+		if err != nil {
+			return err
+		}
+		drifts = append(drifts, globalDrifts...)
+
+		settings, ok := repo.policies.Paths[sourceInfo.Path]
+		if !ok {
+			return nil
+		}
+
+		pathDrifts, err := reconcilePolicy(ctx, w, sourceInfo, sourceInfo.Path, settings)
+		if err != nil {
+			return err
+		}
+		drifts = append(drifts, pathDrifts...)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("while reconciling the Kopia policies: %w", err)
+	}
+
+	for _, drift := range drifts {
+		logger.Info("Kopia policy drifted from the configuration, fixed",
+			"source", drift.Source,
+			"field", drift.Field,
+			"actual", drift.Actual,
+			"desired", drift.Desired)
+		metrics.KopiaPolicyDriftTotal.WithLabelValues(drift.Source, drift.Field).Inc()
+	}
+
+	return nil
+}
+
+// reconcilePolicy applies a set of settings to the policy of a
+// source, writing it only when it drifted from them
+func reconcilePolicy(
+	ctx context.Context,
+	w kopia.RepositoryWriter,
+	sourceInfo snapshot.SourceInfo,
+	source string,
+	settings PolicySettings,
+) ([]PolicyDrift, error) {
+	definedPolicy, err := policy.GetDefinedPolicy(ctx, w, sourceInfo)
+	if errors.Is(err, policy.ErrPolicyNotFound) {
+		definedPolicy = &policy.Policy{}
+	} else if err != nil {
+		return nil, fmt.Errorf("while reading the policy of %s: %w", source, err)
+	}
+
+	drifts := settings.apply(definedPolicy, source)
+	if len(drifts) == 0 {
+		return nil, nil
+	}
+
+	if err := policy.SetPolicy(ctx, w, sourceInfo, definedPolicy); err != nil {
+		return nil, fmt.Errorf("while writing the policy of %s: %w", source, err)
+	}
+
+	return drifts, nil
+}
+
+// hasRetention is true when a retention is configured for a source
+func (repo *Repository) hasRetention(sourceInfo snapshot.SourceInfo) bool {
+	if repo.policies == nil {
+		return false
+	}
+
+	settings := repo.policies.Paths[sourceInfo.Path]
+	return repo.policies.Global.hasRetention() || settings.hasRetention()
+}
+
+// checkSplitter reports when the splitter of the repository differs
+// from the configured one. The splitter is chosen when the repository
+// is initialized and cannot be changed afterwards
+func (repo *Repository) checkSplitter(ctx context.Context) {
+	if repo.policies == nil || len(repo.policies.Splitter) == 0 {
+		return
+	}
+
+	directRepository, ok := repo.repository.(kopia.DirectRepository)
+	if !ok {
+		return
+	}
+
+	actual := directRepository.ObjectFormat().Splitter
+	if actual == repo.policies.Splitter {
+		return
+	}
+
+	logging.FromContext(ctx).Info("Kopia repository splitter differs from the configuration and cannot be changed",
+		"actual", actual,
+		"desired", repo.policies.Splitter)
+	metrics.KopiaPolicyDriftTotal.WithLabelValues(globalPolicySource, "splitter").Inc()
+}
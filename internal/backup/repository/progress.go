@@ -0,0 +1,67 @@
+package repository
+
+import (
+	"sync/atomic"
+
+	"github.com/go-logr/logr"
+	"github.com/kopia/kopia/snapshot/snapshotfs"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/progress"
+)
+
+// snapshotProgress receives the progress of a Kopia snapshot
+type snapshotProgress struct {
+	snapshotfs.NullUploadProgress
+
+	logger logr.Logger
+
+	// path is the path being snapshotted
+	path string
+
+	// tracker receives the progress of the snapshot,
+	// nil when it is not tracked
+	tracker *progress.Tracker
+
+	// uploadedBytes is the number of bytes written to
+	// the storage, after deduplication and compression
+	uploadedBytes atomic.Int64
+}
+
+// UploadedBytes implements the UploadProgress interface
+func (progress *snapshotProgress) UploadedBytes(numBytes int64) {
+	progress.uploadedBytes.Add(numBytes)
+	progress.tracker.AddUploadedBytes(numBytes)
+}
+
+// HashedBytes implements the UploadProgress interface
+func (progress *snapshotProgress) HashedBytes(numBytes int64) {
+	progress.tracker.AddHashedBytes(numBytes)
+}
+
+// CachedFile implements the UploadProgress interface
+func (progress *snapshotProgress) CachedFile(_ string, numBytes int64) {
+	progress.tracker.AddCachedBytes(numBytes)
+}
+
+// FinishedFile implements the UploadProgress interface
+func (progress *snapshotProgress) FinishedFile(_ string, err error) {
+	if err == nil {
+		progress.tracker.AddProcessedFile()
+	}
+}
+
+// EstimatedDataSize implements the UploadProgress interface
+func (progress *snapshotProgress) EstimatedDataSize(fileCount int, totalBytes int64) {
+	progress.logger.V(4).Info("Estimated snapshot size", "fileCount", fileCount, "totalBytes", totalBytes)
+	progress.tracker.SetEstimate(progress.path, int64(fileCount), totalBytes)
+}
+
+// Error implements the UploadProgress interface
+func (progress *snapshotProgress) Error(path string, err error, isIgnored bool) {
+	if isIgnored {
+		progress.logger.Info("Ignored error while taking snapshot", "file", path, "error", err.Error())
+		return
+	}
+
+	progress.logger.Error(err, "Error while taking snapshot", "file", path)
+}
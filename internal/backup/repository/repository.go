@@ -2,13 +2,34 @@ package repository
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"os/exec"
+	"net/url"
+	"os"
 	"path"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/cloudnative-pg/cnpg-i-machinery/pkg/logging"
+	"github.com/kopia/kopia/fs"
+	"github.com/kopia/kopia/fs/localfs"
+	kopia "github.com/kopia/kopia/repo"
+	"github.com/kopia/kopia/repo/blob"
+	"github.com/kopia/kopia/repo/blob/filesystem"
+	"github.com/kopia/kopia/repo/blob/s3"
+	"github.com/kopia/kopia/repo/content"
+	"github.com/kopia/kopia/repo/format"
+	"github.com/kopia/kopia/repo/manifest"
+	"github.com/kopia/kopia/snapshot"
+	"github.com/kopia/kopia/snapshot/policy"
+	"github.com/kopia/kopia/snapshot/snapshotfs"
 
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/pagechecksum"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/progress"
 	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/provider"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/objectstore"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/throttling"
 )
 
 const (
@@ -17,135 +38,710 @@ const (
 	WALFolder         = "pg_wal"
 )
 
+const (
+	// passwordEnvironmentVariable is the environment variable
+	// containing the password of the Kopia repository
+	passwordEnvironmentVariable = "KOPIA_PASSWORD"
+
+	// snapshotUserName is the user name Kopia associates
+	// to the snapshots, together with the cluster name
+	snapshotUserName = "postgres"
+
+	// KopiaTagPrefix is the prefix Kopia requires for
+	// the names of the tags of the snapshots
+	KopiaTagPrefix = "tag:"
+)
+
+var (
+	// openRepositories are the open Kopia repositories, by
+	// configuration file. Repositories are opened once and
+	// reused by every backup of the same cluster
+	openRepositories      = make(map[string]*openRepository)
+	openRepositoriesMutex sync.Mutex
+)
+
+// openRepository is an open Kopia repository
+type openRepository struct {
+	kopia.Repository
+
+	// storageType is the Kopia storage type the repository has been
+	// opened with. When it changes, i.e. because web identity has been
+	// configured, the repository is opened again
+	storageType string
+
+	// references is the number of Repository using the repository
+	references int
+
+	// replaced is true when the repository has been removed from
+	// the cache. It is closed when it is not used anymore
+	replaced bool
+}
+
 // Repository represents a backup repository where
 // base directories are stored
 type Repository struct {
 	provider       string
 	path           string
+	hostname       string
 	cacheDirectory string
 	configFile     string
+	objectStore    *objectstore.Configuration
+	policies       *PolicyConfiguration
+	throttling     *throttling.Configuration
+	repository     kopia.Repository
+	opened         *openRepository
+}
+
+// SnapshotInfo is the information about a snapshot that
+// has been taken
+type SnapshotInfo struct {
+	// ID is the ID of the snapshot manifest
+	ID string
+
+	// Path is the path that has been backed up
+	Path string
+
+	// StartTime is when the snapshot started
+	StartTime time.Time
+
+	// EndTime is when the snapshot ended
+	EndTime time.Time
+
+	// Tags are the tags of the snapshot
+	Tags map[string]string
+
+	// Stats are the statistics of the snapshot
+	Stats snapshot.Stats
+
+	// UploadedBytes is the number of bytes written to the
+	// repository, after deduplication and compression
+	UploadedBytes int64
+
+	// Exclusions are the rules of the files which have
+	// not been included in the snapshot
+	Exclusions []string
+
+	// Files are the size and checksum of the files contained in
+	// the snapshot, keyed by their path relative to its root
+	Files map[string]FileChecksum
+
+	// PageChecksums is the outcome of the verification of the page
+	// checksums of the relation files, nil when it has been skipped
+	PageChecksums *pagechecksum.Result
 }
 
 // NewRepository creates a new repository in a certain
 // path, ensuring that the repository is initialized and
-// ready to accept backups
-func NewRepository(ctx context.Context, p string, path string, configFile string, cacheDirectory string) (*Repository, error) {
+// ready to accept backups. When the policy configuration is
+// not nil, the Kopia policies are reconciled before each snapshot,
+// and the snapshots are limited by the throttling configuration
+func NewRepository(
+	ctx context.Context,
+	p string,
+	path string,
+	configFile string,
+	cacheDirectory string,
+	objectStore *objectstore.Configuration,
+	policies *PolicyConfiguration,
+	throttlingConfiguration *throttling.Configuration,
+) (*Repository, error) {
 	result := &Repository{
-		provider:       p,
-		path:           path,
+		provider: p,
+		path:     path,
+		// The path of the repository starts with the cluster name, which
+		// is used as the host name of the snapshot sources
+		hostname:       strings.SplitN(strings.Trim(path, "/"), "/", 2)[0],
 		configFile:     configFile,
 		cacheDirectory: cacheDirectory,
+		objectStore:    objectStore,
+		policies:       policies,
+		throttling:     throttlingConfiguration,
 	}
 
 	if !provider.Validate(p) {
 		return nil, fmt.Errorf("provider not valid: %s", p)
 	}
 
+	if err := result.open(ctx); err != nil {
+		return nil, err
+	}
+
+	result.checkSplitter(ctx)
+
+	if err := result.reconcileRetention(ctx); err != nil {
+		_ = result.Close(ctx)
+		return nil, err
+	}
+
 	return result, nil
 }
 
-func (repo *Repository) initializeRepository(ctx context.Context) error {
-	logger := logging.FromContext(ctx)
+// Close releases the Kopia repository. It is kept open for the
+// following backups of the cluster, unless it has been replaced
+func (repo *Repository) Close(ctx context.Context) error {
+	openRepositoriesMutex.Lock()
+	defer openRepositoriesMutex.Unlock()
 
-	args := []string{
-		"kopia",
-		"Repository",
-		"create",
-		repo.provider,
-		fmt.Sprintf("--path=%s", repo.path),
-		fmt.Sprintf("--config-file=%s", repo.configFile),
-		fmt.Sprintf("--log-dir=%s/log", repo.cacheDirectory),
-		fmt.Sprintf("--cache-directory=%s", repo.cacheDirectory),
+	opened := repo.opened
+	if opened == nil {
+		return nil
 	}
+	repo.opened = nil
+	repo.repository = nil
 
-	cmd := exec.CommandContext(ctx, args[0], args[1:]...) // nolint:gosec
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		logger.Error(
-			err,
-			fmt.Sprintf("Error invoking kopia create %s command", repo.provider),
-			"args", args,
-			"output", string(output))
-		return err
+	opened.references--
+	if !opened.replaced || opened.references > 0 {
+		return nil
 	}
 
-	return repo.configureIgnoreFolders(ctx)
+	return opened.Close(ctx)
 }
 
-func (repo *Repository) configureIgnoreFolders(ctx context.Context) error {
-	if err := repo.addIgnoreFolder(ctx, path.Join(PGDataLocation, WALFolder)); err != nil {
+// open gets the open Kopia repository, connecting to the storage
+// and initializing the repository when needed
+func (repo *Repository) open(ctx context.Context) error {
+	openRepositoriesMutex.Lock()
+	defer openRepositoriesMutex.Unlock()
+
+	storageType := repo.getStorageType()
+	if result, ok := openRepositories[repo.configFile]; ok {
+		if result.storageType == storageType {
+			result.references++
+			repo.opened = result
+			repo.repository = result.Repository
+			return nil
+		}
+
+		// The repository is closed by the last backup using it,
+		// while the following ones open it again
+		result.replaced = true
+		delete(openRepositories, repo.configFile)
+		if result.references == 0 {
+			if err := result.Close(ctx); err != nil {
+				logging.FromContext(ctx).Error(err, "Error while closing Kopia repository")
+			}
+		}
+	}
+
+	if err := repo.removeStaleConfigFile(storageType); err != nil {
 		return err
 	}
 
-	if err := repo.addIgnoreFolder(ctx, path.Join(PGDataLocation, TablespacesFolder)); err != nil {
+	if _, err := os.Stat(repo.configFile); os.IsNotExist(err) {
+		if err := repo.connect(ctx); err != nil {
+			return err
+		}
+	}
+
+	result, err := kopia.Open(ctx, repo.configFile, getPassword(), nil)
+	if err != nil {
+		return fmt.Errorf("while opening Kopia repository: %w", err)
+	}
+
+	repo.opened = &openRepository{
+		Repository:  result,
+		storageType: storageType,
+		references:  1,
+	}
+	repo.repository = result
+	openRepositories[repo.configFile] = repo.opened
+	return nil
+}
+
+// removeStaleConfigFile removes the Kopia configuration file when it
+// has been written for a different storage type. Configuration files
+// written by older versions contain the web identity credentials,
+// which are now refreshed by the storage instead
+func (repo *Repository) removeStaleConfigFile(storageType string) error {
+	config, err := kopia.LoadConfigFromFile(repo.configFile)
+	if err != nil || config.Storage == nil || config.Storage.Type == storageType {
+		// A missing or invalid configuration file is handled
+		// when connecting or opening the repository
+		return nil
+	}
+
+	if err := os.Remove(repo.configFile); err != nil && !os.IsNotExist(err) {
 		return err
 	}
 
 	return nil
 }
 
-func (repo *Repository) addIgnoreFolder(ctx context.Context, folder string) error {
+// connect connects to the repository, writing the Kopia configuration
+// file, and initializes the repository if the storage is empty
+func (repo *Repository) connect(ctx context.Context) error {
 	logger := logging.FromContext(ctx)
 
-	args := []string{
-		"kopia",
-		"policy",
-		"set",
-		folder,
-		fmt.Sprintf("--log-dir=%s/log", repo.cacheDirectory),
-		"--add-ignore=.",
-		fmt.Sprintf("--config-file=%s", repo.configFile),
+	st, err := repo.newStorage(ctx, true)
+	if err != nil {
+		return fmt.Errorf("while connecting to %s storage: %w", repo.provider, err)
 	}
+	defer func() {
+		_ = st.Close(ctx)
+	}()
 
-	cmd := exec.CommandContext(ctx, args[0], args[1:]...) // nolint:gosec
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		logger.Error(
-			err,
-			"Error invoking kopia policy set command",
-			"args", args,
-			"output", string(output))
+	connectOptions := &kopia.ConnectOptions{
+		ClientOptions: kopia.ClientOptions{
+			Hostname: repo.hostname,
+			Username: snapshotUserName,
+		},
+		CachingOptions: content.CachingOptions{
+			CacheDirectory: repo.cacheDirectory,
+		},
+	}
+
+	err = kopia.Connect(ctx, repo.configFile, st, getPassword(), connectOptions)
+	if !errors.Is(err, kopia.ErrRepositoryNotInitialized) {
+		return err
+	}
+
+	logger.Info("Initializing Kopia repository", "provider", repo.provider, "path", repo.path)
+	if err := repo.initializeRepository(ctx, st); err != nil {
 		return err
 	}
 
+	return kopia.Connect(ctx, repo.configFile, st, getPassword(), connectOptions)
+}
+
+func (repo *Repository) initializeRepository(ctx context.Context, st blob.Storage) error {
+	options := &kopia.NewRepositoryOptions{}
+
+	// Kopia locks every blob it writes, including the manifests
+	// and the packs, and extends the locks during maintenance
+	retention := repo.getRetention()
+	options.RetentionMode = retention.RetentionMode
+	options.RetentionPeriod = retention.RetentionPeriod
+
+	if repo.policies != nil {
+		options.ObjectFormat.Splitter = repo.policies.Splitter
+	}
+
+	if err := kopia.Initialize(ctx, st, options, getPassword()); err != nil {
+		return fmt.Errorf("while initializing Kopia repository: %w", err)
+	}
+
 	return nil
 }
 
-// Snapshot takes a Kopia snapshot of a certain path, adding a set of tags
-func (repo *Repository) Snapshot(ctx context.Context, path string, tags map[string]string) error {
+// getRetention gets the object lock retention Kopia
+// needs to apply to the blobs of the repository
+func (repo *Repository) getRetention() format.BlobStorageConfiguration {
+	if repo.provider != provider.S3.String() || repo.objectStore == nil || repo.objectStore.ObjectLock == nil {
+		return format.BlobStorageConfiguration{}
+	}
+
+	return format.BlobStorageConfiguration{
+		RetentionMode:   blob.RetentionMode(repo.objectStore.ObjectLock.Mode),
+		RetentionPeriod: repo.objectStore.ObjectLock.Retention,
+	}
+}
+
+// reconcileRetention updates the object lock retention of the
+// repository when the configuration has been changed after it
+// was initialized. The new retention is applied to the blobs
+// written afterwards, and to the ones extended by the maintenance
+func (repo *Repository) reconcileRetention(ctx context.Context) error {
+	directRepository, ok := repo.repository.(kopia.DirectRepository)
+	if !ok {
+		return nil
+	}
+
+	actual, err := directRepository.FormatManager().BlobCfgBlob()
+	if err != nil {
+		return fmt.Errorf("while reading the retention of the Kopia repository: %w", err)
+	}
+
+	desired := repo.getRetention()
+	if actual == desired {
+		return nil
+	}
+
+	logging.FromContext(ctx).Info("Updating the object lock retention of the Kopia repository",
+		"actualMode", actual.RetentionMode,
+		"actualPeriod", actual.RetentionPeriod,
+		"desiredMode", desired.RetentionMode,
+		"desiredPeriod", desired.RetentionPeriod)
+
+	options := kopia.WriteSessionOptions{Purpose: "ReconcileRetention"}
+	return kopia.DirectWriteSession(ctx, directRepository, options, func(ctx context.Context, w kopia.DirectRepositoryWriter) error {
+		formatManager := w.FormatManager()
+
+		parameters, err := formatManager.GetMutableParameters()
+		if err != nil {
+			return err
+		}
+
+		requiredFeatures, err := formatManager.RequiredFeatures()
+		if err != nil {
+			return err
+		}
+
+		return formatManager.SetParameters(ctx, parameters, desired, requiredFeatures)
+	})
+}
+
+// SnapshotOptions are the options of a Kopia snapshot
+type SnapshotOptions struct {
+	// Tags are the tags added to the snapshot
+	Tags map[string]string
+
+	// Exclusions are the gitignore-style rules of the files that
+	// are not included in the snapshot, relative to its root
+	Exclusions []string
+
+	// Checkpoint makes the snapshot resumable, nil when
+	// the snapshot is not resumed after failures
+	Checkpoint *CheckpointOptions
+
+	// Progress receives the progress of the snapshot,
+	// nil when it is not tracked
+	Progress *progress.Tracker
+
+	// PageChecksums verifies the page checksums of the relation files
+	// while they are read, nil when they are not verified. The files
+	// reused from a checkpoint are not read, so they are not verified
+	PageChecksums *pagechecksum.Verifier
+}
+
+// Snapshot takes a Kopia snapshot of a certain path
+func (repo *Repository) Snapshot(ctx context.Context, path string, options SnapshotOptions) (*SnapshotInfo, error) {
 	logger := logging.FromContext(ctx)
 
-	args := []string{
-		"kopia",
-		"snapshot",
-		"create",
-		fmt.Sprintf("--log-dir=%s/log", repo.cacheDirectory),
-		fmt.Sprintf("--config-file=%s", repo.configFile),
-		path,
+	sourceInfo := repo.getSourceInfo(path)
+	source, err := localfs.NewEntry(path)
+	if err != nil {
+		return nil, fmt.Errorf("while reading %s: %w", path, err)
+	}
+
+	// The checksums of the files are computed while they are uploaded,
+	// so that they match the content of the snapshot
+	checksums := newChecksumCollector(options.PageChecksums)
+	if directory, ok := source.(fs.Directory); ok {
+		source = &checksumDirectory{Directory: directory, collector: checksums}
+	}
+
+	if err := repo.reconcilePolicies(ctx, sourceInfo); err != nil {
+		return nil, err
+	}
+
+	policyTree, err := repo.getPolicyTree(ctx, sourceInfo, options.Exclusions)
+	if err != nil {
+		return nil, err
+	}
+
+	previousManifests, err := repo.getPreviousManifests(ctx, sourceInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	// A snapshot resumed from a checkpoint reuses the files contained
+	// in it without reading them again
+	var checkpoint *snapshot.Manifest
+	if options.Checkpoint != nil {
+		if checkpoint, err = repo.getCheckpoint(ctx, sourceInfo, options.Checkpoint.Name); err != nil {
+			return nil, err
+		}
+		if checkpoint != nil {
+			logger.Info("Resuming snapshot from checkpoint", "path", path, "checkpointID", checkpoint.ID)
+			previousManifests = []*snapshot.Manifest{checkpoint}
+		}
+	}
+
+	stopSaving := saveCheckpoints(ctx, options.Checkpoint, checksums)
+	defer stopSaving()
+
+	stopThrottling := repo.startThrottling(ctx)
+	defer stopThrottling()
+
+	var result *snapshot.Manifest
+	uploadProgress := &snapshotProgress{
+		logger:  logger.WithValues("path", path),
+		path:    path,
+		tracker: options.Progress,
+	}
+	sessionOptions := kopia.WriteSessionOptions{Purpose: "Snapshot"}
+	err = kopia.WriteSession(ctx, repo.repository, sessionOptions, func(ctx context.Context, w kopia.RepositoryWriter) error {
+		uploader := snapshotfs.NewUploader(w)
+		uploader.Progress = uploadProgress
+
+		// Unchanged files are read anyway, to compute their checksum,
+		// but they are not uploaded again. The files of a checkpoint
+		// have already been read by the interrupted snapshot
+		if checkpoint == nil {
+			uploader.ForceHashPercentage = 100
+		}
+
+		if options.Checkpoint != nil {
+			uploader.CheckpointInterval = options.Checkpoint.Interval
+			uploader.CheckpointLabels = map[string]string{checkpointTag: options.Checkpoint.Name}
+		}
+
+		// The uploader stops at the next file when cancelled, and
+		// the incomplete snapshot is not saved
+		stopCancel := context.AfterFunc(ctx, uploader.Cancel)
+		defer stopCancel()
+
+		snapshotManifest, err := uploader.Upload(ctx, source, policyTree, sourceInfo, previousManifests...)
+		if err != nil {
+			return err
+		}
+		if len(snapshotManifest.IncompleteReason) > 0 {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("snapshot incomplete: %s", snapshotManifest.IncompleteReason)
+		}
+
+		snapshotManifest.Tags = getKopiaTags(options.Tags)
+		if _, err := snapshot.SaveSnapshot(ctx, w, snapshotManifest); err != nil {
+			return err
+		}
+
+		if err := repo.deleteCheckpoints(ctx, w, sourceInfo); err != nil {
+			return err
+		}
+
+		// The retention is only applied when configured, as
+		// the default policy of Kopia has one too
+		if repo.hasRetention(sourceInfo) {
+			if _, err := policy.ApplyRetentionPolicy(ctx, w, sourceInfo, true); err != nil {
+				return fmt.Errorf("while applying the retention policy: %w", err)
+			}
+		}
+
+		result = snapshotManifest
+		return nil
+	})
+	if err != nil {
+		logger.Error(err, "Error while taking Kopia snapshot", "path", path)
+		return nil, err
+	}
+
+	files := checksums.result
+	if checkpoint != nil {
+		if files, err = repo.getResumedChecksums(ctx, result, options.Checkpoint.Checksums, files); err != nil {
+			return nil, err
+		}
+	}
+
+	return &SnapshotInfo{
+		ID:            string(result.ID),
+		Path:          path,
+		StartTime:     result.StartTime.ToTime(),
+		EndTime:       result.EndTime.ToTime(),
+		Tags:          result.Tags,
+		Stats:         result.Stats,
+		UploadedBytes: uploadProgress.uploadedBytes.Load(),
+		Exclusions:    options.Exclusions,
+		Files:         files,
+		PageChecksums: checksums.getPageChecksums(),
+	}, nil
+}
+
+// DeleteSnapshot deletes a Kopia snapshot. The data that is not used
+// by other snapshots is removed by the repository maintenance
+func (repo *Repository) DeleteSnapshot(ctx context.Context, id string) error {
+	options := kopia.WriteSessionOptions{Purpose: "DeleteSnapshot"}
+	return kopia.WriteSession(ctx, repo.repository, options, func(ctx context.Context, w kopia.RepositoryWriter) error {
+		return w.DeleteManifest(ctx, manifest.ID(id))
+	})
+}
+
+// UpdatePins adds and removes pins from a set of Kopia snapshots.
+// Pinned snapshots are never removed by the retention policies
+func (repo *Repository) UpdatePins(ctx context.Context, ids []string, add []string, remove []string) error {
+	options := kopia.WriteSessionOptions{Purpose: "UpdatePins"}
+	return kopia.WriteSession(ctx, repo.repository, options, func(ctx context.Context, w kopia.RepositoryWriter) error {
+		for _, id := range ids {
+			snapshotManifest, err := snapshot.LoadSnapshot(ctx, w, manifest.ID(id))
+			if err != nil {
+				return fmt.Errorf("while loading snapshot %s: %w", id, err)
+			}
+
+			if !snapshotManifest.UpdatePins(add, remove) {
+				continue
+			}
+			if err := snapshot.UpdateSnapshot(ctx, w, snapshotManifest); err != nil {
+				return fmt.Errorf("while updating the pins of snapshot %s: %w", id, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// getPolicyTree gets the policy of a snapshot, adding a set of exclusions
+// to the policy defined for its source. The policies defined for the
+// subdirectories are not used, so that the content of the snapshot
+// only depends on the exclusions
+func (repo *Repository) getPolicyTree(
+	ctx context.Context,
+	sourceInfo snapshot.SourceInfo,
+	exclusions []string,
+) (*policy.Tree, error) {
+	effectivePolicy, _, _, err := policy.GetEffectivePolicy(ctx, repo.repository, sourceInfo)
+	if err != nil {
+		return nil, fmt.Errorf("while getting the policy of %s: %w", sourceInfo.Path, err)
+	}
+
+	effectivePolicy.FilesPolicy.IgnoreRules = append(effectivePolicy.FilesPolicy.IgnoreRules, exclusions...)
+
+	// Files are read sequentially, so that their checksum can be computed
+	// while they are uploaded. PostgreSQL data files are split into 1GB
+	// segments, so uploading them in parallel parts is not needed
+	sequentialUpload := policy.OptionalInt64(-1)
+	effectivePolicy.UploadPolicy.ParallelUploadAboveSize = &sequentialUpload
+	return policy.BuildTree(map[string]*policy.Policy{".": effectivePolicy}, policy.DefaultPolicy), nil
+}
+
+// getPreviousManifests gets the last complete snapshot of a source, which
+// is used to avoid hashing again the files that haven't been changed
+func (repo *Repository) getPreviousManifests(
+	ctx context.Context,
+	sourceInfo snapshot.SourceInfo,
+) ([]*snapshot.Manifest, error) {
+	manifests, err := snapshot.ListSnapshots(ctx, repo.repository, sourceInfo)
+	if err != nil {
+		return nil, fmt.Errorf("while listing previous snapshots: %w", err)
+	}
+
+	var result *snapshot.Manifest
+	for _, snapshotManifest := range manifests {
+		if len(snapshotManifest.IncompleteReason) > 0 {
+			continue
+		}
+		if result == nil || snapshotManifest.StartTime.After(result.StartTime) {
+			result = snapshotManifest
+		}
+	}
+
+	if result == nil {
+		return nil, nil
+	}
+	return []*snapshot.Manifest{result}, nil
+}
+
+// getSourceInfo gets the Kopia source of a path
+func (repo *Repository) getSourceInfo(path string) snapshot.SourceInfo {
+	return snapshot.SourceInfo{
+		Host:     repo.hostname,
+		UserName: snapshotUserName,
+		Path:     path,
+	}
+}
+
+// newStorage creates the Kopia storage where the
+// repository is kept
+func (repo *Repository) newStorage(ctx context.Context, isCreate bool) (blob.Storage, error) {
+	if repo.provider != provider.S3.String() {
+		return newBlobStorage(ctx, repo.path, nil, isCreate)
+	}
+
+	return newBlobStorage(ctx, repo.path, repo.objectStore, isCreate)
+}
+
+// newBlobStorage creates a Kopia storage kept inside a directory, or
+// under a prefix of a bucket when the object store is not nil
+func newBlobStorage(
+	ctx context.Context,
+	storagePath string,
+	objectStore *objectstore.Configuration,
+	isCreate bool,
+) (blob.Storage, error) {
+	if objectStore == nil {
+		return filesystem.New(ctx, &filesystem.Options{Path: storagePath}, isCreate)
+	}
+
+	options := &s3.Options{
+		BucketName: objectStore.Bucket,
+		Prefix:     fmt.Sprintf("%s/", strings.Trim(path.Join(objectStore.Prefix, storagePath), "/")),
+		Region:     objectStore.Region,
+		Endpoint:   "s3.amazonaws.com",
+	}
+
+	// The endpoint has already been validated as an URL
+	// when the configuration was loaded
+	if endpointURL, err := url.Parse(objectStore.Endpoint); err == nil && len(endpointURL.Host) > 0 {
+		options.Endpoint = endpointURL.Host
+		options.DoNotUseTLS = endpointURL.Scheme == "http"
 	}
 
-	tagsOption := ""
-	for k, v := range tags {
-		if len(tagsOption) > 0 {
-			tagsOption += ","
+	// Without web identity, Kopia reads the credentials
+	// from the standard AWS environment variables
+	if objectStore.WebIdentity != nil {
+		return newWebIdentityStorage(ctx, &webIdentityStorageOptions{
+			Options:     *options,
+			RoleARN:     objectStore.WebIdentity.RoleARN,
+			STSEndpoint: objectStore.WebIdentity.STSEndpoint,
+		}, isCreate)
+	}
+
+	return s3.New(ctx, options, isCreate)
+}
+
+// getStorageType gets the Kopia storage type of the repository
+func (repo *Repository) getStorageType() string {
+	switch {
+	case repo.provider != provider.S3.String():
+		return provider.Filesystem.String()
+	case repo.objectStore.WebIdentity != nil:
+		return webIdentityStorageType
+	default:
+		return provider.S3.String()
+	}
+}
+
+// getKopiaTags gets the tags of a snapshot as Kopia requires them,
+// with names starting with the tag prefix
+func getKopiaTags(tags map[string]string) map[string]string {
+	if tags == nil {
+		return nil
+	}
+
+	result := make(map[string]string, len(tags))
+	for name, value := range tags {
+		if !strings.HasPrefix(name, KopiaTagPrefix) {
+			name = KopiaTagPrefix + name
 		}
-		tagsOption += fmt.Sprintf("%s:%v", k, v)
+		result[name] = value
 	}
 
-	if len(tagsOption) > 0 {
-		args = append(args, "--tags="+tagsOption)
+	return result
+}
+
+// SyncTo replicates the content of the repository into another Kopia
+// storage, kept inside a directory or under a prefix of a bucket when
+// the object store is not nil, deleting the blobs which are not in the
+// repository anymore
+func (repo *Repository) SyncTo(
+	ctx context.Context,
+	storagePath string,
+	objectStore *objectstore.Configuration,
+) error {
+	logger := logging.FromContext(ctx)
+
+	directRepository, ok := repo.repository.(kopia.DirectRepository)
+	if !ok {
+		return fmt.Errorf("repository %s cannot be synchronized", repo.path)
 	}
 
-	cmd := exec.CommandContext(ctx, args[0], args[1:]...) // nolint:gosec
-	output, err := cmd.CombinedOutput()
+	destination, err := newBlobStorage(ctx, storagePath, objectStore, true)
 	if err != nil {
-		logger.Error(
-			err,
-			"Error invoking kopia snapshot create command",
-			"args", args,
-			"output", string(output))
+		return fmt.Errorf("while opening %s: %w", storagePath, err)
+	}
+	defer func() {
+		_ = destination.Close(ctx)
+	}()
+
+	if err := syncBlobs(ctx, directRepository.BlobReader(), destination); err != nil {
+		logger.Error(err, "Error while synchronizing Kopia repository", "path", storagePath)
 		return err
 	}
 
 	return nil
 }
+
+// getPassword gets the password of the Kopia repository
+func getPassword() string {
+	return os.Getenv(passwordEnvironmentVariable)
+}
@@ -0,0 +1,254 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/kopia/kopia/repo/blob"
+	"github.com/kopia/kopia/repo/blob/s3"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/pagechecksum"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/provider"
+)
+
+// newTestRepository opens a repository kept in a directory
+func newTestRepository(t *testing.T, directory string) *Repository {
+	t.Helper()
+
+	result, err := NewRepository(
+		context.Background(),
+		provider.Filesystem.String(),
+		path.Join(directory, "repository"),
+		path.Join(directory, "kopia.config"),
+		path.Join(directory, "cache"),
+		nil,
+		nil,
+		nil,
+	)
+	if err != nil {
+		t.Fatalf("unexpected error opening the repository: %v", err)
+	}
+
+	return result
+}
+
+func TestRepositoryReferences(t *testing.T) {
+	t.Setenv(passwordEnvironmentVariable, "password")
+	ctx := context.Background()
+	directory := t.TempDir()
+
+	first := newTestRepository(t, directory)
+	second := newTestRepository(t, directory)
+	if first.opened != second.opened || first.opened.references != 2 {
+		t.Fatalf("expected the repository to be shared, got %+v and %+v", first.opened, second.opened)
+	}
+
+	opened := first.opened
+	if err := first.Close(ctx); err != nil {
+		t.Fatalf("unexpected error closing the repository: %v", err)
+	}
+	if opened.references != 1 || first.repository != nil {
+		t.Fatalf("unexpected references %d after closing", opened.references)
+	}
+
+	// When the storage type changes, the repository is opened again,
+	// while the previous one is still used until it is released
+	opened.storageType = "previous"
+	third := newTestRepository(t, directory)
+	t.Cleanup(func() {
+		_ = third.Close(ctx)
+	})
+	if third.opened == opened || !opened.replaced {
+		t.Fatal("expected the repository to be replaced")
+	}
+	if _, err := second.Snapshot(ctx, t.TempDir(), SnapshotOptions{}); err != nil {
+		t.Fatalf("unexpected error using the replaced repository: %v", err)
+	}
+
+	if err := second.Close(ctx); err != nil {
+		t.Fatalf("unexpected error closing the replaced repository: %v", err)
+	}
+	if opened.references != 0 {
+		t.Fatalf("unexpected references %d after closing", opened.references)
+	}
+	if err := second.Close(ctx); err != nil {
+		t.Fatalf("closing a repository twice is not an error, got %v", err)
+	}
+}
+
+func TestSnapshotTags(t *testing.T) {
+	t.Setenv(passwordEnvironmentVariable, "password")
+	ctx := context.Background()
+
+	rep := newTestRepository(t, t.TempDir())
+	t.Cleanup(func() {
+		_ = rep.Close(ctx)
+	})
+
+	source := t.TempDir()
+	if err := os.WriteFile(path.Join(source, "file"), []byte("content"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshotInfo, err := rep.Snapshot(ctx, source, SnapshotOptions{
+		Tags: map[string]string{
+			"type":                 "base",
+			KopiaTagPrefix + "oid": "16384",
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error taking the snapshot: %v", err)
+	}
+
+	if len(snapshotInfo.Tags) != 2 ||
+		snapshotInfo.Tags[KopiaTagPrefix+"type"] != "base" ||
+		snapshotInfo.Tags[KopiaTagPrefix+"oid"] != "16384" {
+		t.Fatalf("unexpected snapshot tags %v", snapshotInfo.Tags)
+	}
+}
+
+func TestSnapshotPageChecksums(t *testing.T) {
+	t.Setenv(passwordEnvironmentVariable, "password")
+	ctx := context.Background()
+
+	rep := newTestRepository(t, t.TempDir())
+	t.Cleanup(func() {
+		_ = rep.Close(ctx)
+	})
+
+	// The second page of the relation has a wrong checksum
+	pages := make([][]byte, 2)
+	for i := range pages {
+		pages[i] = make([]byte, pagechecksum.DefaultBlockSize)
+		pages[i][100] = byte(i + 1)
+		binary.LittleEndian.PutUint16(pages[i][14:], 1024)
+		binary.LittleEndian.PutUint16(pages[i][8:], pagechecksum.Checksum(pages[i], 0))
+	}
+
+	source := t.TempDir()
+	if err := os.MkdirAll(path.Join(source, "base", "1"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string][]byte{
+		"base/1/16384": bytes.Join(pages, nil),
+		"PG_VERSION":   []byte("16\n"),
+	} {
+		if err := os.WriteFile(path.Join(source, name), content, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snapshotInfo, err := rep.Snapshot(ctx, source, SnapshotOptions{
+		PageChecksums: &pagechecksum.Verifier{
+			BlockSize:     pagechecksum.DefaultBlockSize,
+			SegmentBlocks: pagechecksum.DefaultSegmentBlocks,
+			StartLSN:      1 << 32,
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error taking the snapshot: %v", err)
+	}
+
+	// The relation files are verified while they are read
+	result := snapshotInfo.PageChecksums
+	if result == nil || result.VerifiedFiles != 1 || result.VerifiedPages != 1 || result.CorruptedPages != 1 {
+		t.Fatalf("unexpected verification %+v", result)
+	}
+	if result.Corruptions[0].Path != "base/1/16384" || result.Corruptions[0].Block != 1 {
+		t.Fatalf("unexpected corruptions %v", result.Corruptions)
+	}
+
+	// Without a verifier the page checksums are not verified
+	snapshotInfo, err = rep.Snapshot(ctx, source, SnapshotOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error taking the snapshot: %v", err)
+	}
+	if snapshotInfo.PageChecksums != nil {
+		t.Fatalf("unexpected verification %+v", snapshotInfo.PageChecksums)
+	}
+}
+
+func TestWebIdentityStorageConnectionInfo(t *testing.T) {
+	storage := &webIdentityStorage{
+		options: webIdentityStorageOptions{
+			Options: s3.Options{
+				BucketName: "backups",
+				Endpoint:   "s3.amazonaws.com",
+			},
+			RoleARN: "arn:aws:iam::123456789012:role/backup",
+		},
+		accessKeyID: "access-key",
+	}
+
+	content, err := json.Marshal(storage.ConnectionInfo())
+	if err != nil {
+		t.Fatalf("unexpected error encoding the connection info: %v", err)
+	}
+
+	// The temporary credentials are never written
+	// in the Kopia configuration file
+	if strings.Contains(string(content), "access-key") {
+		t.Fatalf("credentials found in the connection info: %s", content)
+	}
+
+	var decoded blob.ConnectionInfo
+	if err := json.Unmarshal(content, &decoded); err != nil {
+		t.Fatalf("unexpected error decoding the connection info: %v", err)
+	}
+	options, ok := decoded.Config.(*webIdentityStorageOptions)
+	if decoded.Type != webIdentityStorageType || !ok || options.RoleARN != storage.options.RoleARN {
+		t.Fatalf("unexpected connection info %+v", decoded)
+	}
+}
+
+func TestSyncTo(t *testing.T) {
+	t.Setenv(passwordEnvironmentVariable, "password")
+	ctx := context.Background()
+	directory := t.TempDir()
+
+	rep := newTestRepository(t, directory)
+	t.Cleanup(func() {
+		_ = rep.Close(ctx)
+	})
+
+	source := t.TempDir()
+	if err := os.WriteFile(path.Join(source, "file"), []byte("content"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	snapshotInfo, err := rep.Snapshot(ctx, source, SnapshotOptions{})
+	if err != nil {
+		t.Fatalf("unexpected error taking the snapshot: %v", err)
+	}
+
+	replicaPath := path.Join(directory, "replica")
+	if err := rep.SyncTo(ctx, replicaPath, nil); err != nil {
+		t.Fatalf("unexpected error synchronizing the repository: %v", err)
+	}
+
+	// The replica is a repository which can be used on its own
+	replica, err := NewRepository(
+		ctx,
+		provider.Filesystem.String(),
+		replicaPath,
+		path.Join(directory, "replica.config"),
+		path.Join(directory, "replica-cache"),
+		nil,
+		nil,
+		nil,
+	)
+	if err != nil {
+		t.Fatalf("unexpected error opening the replica: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = replica.Close(ctx)
+	})
+	if _, err := replica.ChecksumSnapshot(ctx, snapshotInfo.ID); err != nil {
+		t.Fatalf("unexpected error reading the replicated snapshot: %v", err)
+	}
+}
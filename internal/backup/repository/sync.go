@@ -0,0 +1,89 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/kopia/kopia/repo/blob"
+)
+
+// syncBlobs copies the blobs of a Kopia repository into another storage,
+// deleting the blobs that are not in the repository anymore. Blobs are
+// immutable, so the ones already in the destination are not copied again
+func syncBlobs(ctx context.Context, source blob.Reader, destination blob.Storage) error {
+	sourceBlobs, err := blob.ReadBlobMap(ctx, source)
+	if err != nil {
+		return fmt.Errorf("while listing the source blobs: %w", err)
+	}
+
+	destinationBlobs, err := blob.ReadBlobMap(ctx, destination)
+	if err != nil {
+		return fmt.Errorf("while listing the destination blobs: %w", err)
+	}
+
+	for id, metadata := range sourceBlobs {
+		// Blobs starting with a dot, like the storage configuration,
+		// belong to the storage and not to the repository
+		if strings.HasPrefix(string(id), ".") {
+			continue
+		}
+
+		if destinationMetadata, ok := destinationBlobs[id]; ok && destinationMetadata.Length == metadata.Length {
+			continue
+		}
+
+		var buffer blobBuffer
+		if err := source.GetBlob(ctx, id, 0, -1, &buffer); err != nil {
+			return fmt.Errorf("while reading blob %s: %w", id, err)
+		}
+
+		if err := destination.PutBlob(ctx, id, &buffer, blob.PutOptions{}); err != nil {
+			return fmt.Errorf("while writing blob %s: %w", id, err)
+		}
+	}
+
+	for id := range destinationBlobs {
+		if _, ok := sourceBlobs[id]; ok {
+			continue
+		}
+
+		if err := destination.DeleteBlob(ctx, id); err != nil {
+			return fmt.Errorf("while deleting blob %s: %w", id, err)
+		}
+	}
+
+	return nil
+}
+
+// blobBuffer is an in-memory blob, used both as the output
+// of a read and as the input of a write
+type blobBuffer struct {
+	bytes.Buffer
+}
+
+// Length implements the blob.OutputBuffer and blob.Bytes interfaces
+func (buffer *blobBuffer) Length() int {
+	return buffer.Len()
+}
+
+// WriteTo implements the blob.Bytes interface, without
+// consuming the content of the buffer
+func (buffer *blobBuffer) WriteTo(w io.Writer) (int64, error) {
+	return bytes.NewReader(buffer.Bytes()).WriteTo(w)
+}
+
+// Reader implements the blob.Bytes interface
+func (buffer *blobBuffer) Reader() io.ReadSeekCloser {
+	return readSeekNopCloser{bytes.NewReader(buffer.Bytes())}
+}
+
+type readSeekNopCloser struct {
+	io.ReadSeeker
+}
+
+func (readSeekNopCloser) Close() error {
+	return nil
+}
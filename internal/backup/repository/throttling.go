@@ -0,0 +1,71 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/cloudnative-pg/cnpg-i-machinery/pkg/logging"
+	kopia "github.com/kopia/kopia/repo"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/throttling"
+)
+
+// throttlingInterval is how often the bandwidth limits are updated
+// while a snapshot is being taken, to follow the throttling schedule
+const throttlingInterval = time.Minute
+
+// startThrottling applies the bandwidth limits of the base backups
+// to the repository, updating them until the returned function is
+// called. The repository is shared by every backup of the cluster,
+// so the limits are reset when throttling is not configured
+func (repo *Repository) startThrottling(ctx context.Context) func() {
+	directRepository, ok := repo.repository.(kopia.DirectRepository)
+	if !ok {
+		return func() {}
+	}
+
+	repo.applyThrottling(ctx, directRepository)
+	if repo.throttling == nil || len(repo.throttling.Schedule) == 0 {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		ticker := time.NewTicker(throttlingInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				repo.applyThrottling(ctx, directRepository)
+			}
+		}
+	}()
+
+	return cancel
+}
+
+// applyThrottling sets the current bandwidth limits of the base
+// backups, leaving the other Kopia limits untouched
+func (repo *Repository) applyThrottling(ctx context.Context, directRepository kopia.DirectRepository) {
+	current := repo.throttling.GetLimits(throttling.BudgetBackup, time.Now())
+
+	limits := directRepository.Throttler().Limits()
+	if limits.UploadBytesPerSecond == float64(current.Upload) &&
+		limits.DownloadBytesPerSecond == float64(current.Download) {
+		return
+	}
+
+	limits.UploadBytesPerSecond = float64(current.Upload)
+	limits.DownloadBytesPerSecond = float64(current.Download)
+	if err := directRepository.Throttler().SetLimits(limits); err != nil {
+		logging.FromContext(ctx).Error(err, "Error while setting the Kopia bandwidth limits")
+		return
+	}
+
+	logging.FromContext(ctx).Info("Updated the bandwidth limits of base backups",
+		"uploadBytesPerSecond", current.Upload,
+		"downloadBytesPerSecond", current.Download)
+}
@@ -0,0 +1,150 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/cloudnative-pg/cloudnative-pg/pkg/postgres"
+	"github.com/cloudnative-pg/cnpg-i-machinery/pkg/logging"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/executor"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/repository"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/storage"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/objectstore"
+)
+
+const (
+	// selfContainedParameter is the parameter of the backup
+	// configuration requesting the WAL files needed to reach
+	// consistency to be bundled in the backup
+	selfContainedParameter = "selfContained"
+
+	// bundledWALDirectory is where the WAL files are downloaded
+	// before being stored in the repository
+	bundledWALDirectory = "/controller/backup-wal"
+
+	// maxBundledSegments is the maximum number of WAL segments
+	// bundled in a backup, to guard against malformed WAL ranges
+	maxBundledSegments = 1 << 20
+)
+
+// isSelfContained checks if the WAL files of a backup
+// need to be bundled in it
+func isSelfContained(parameters map[string]string) (bool, error) {
+	value, ok := parameters[selfContainedParameter]
+	if !ok {
+		return false, nil
+	}
+
+	result, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, &objectstore.ParameterError{Name: selfContainedParameter, Message: "must be true or false"}
+	}
+
+	return result, nil
+}
+
+// bundleWAL stores in a snapshot the WAL segments from the begin to the
+// end WAL of a backup, together with the history files of its timeline,
+// so that the backup can reach consistency without the WAL archive. The
+// end WAL file needs to be archived already
+func bundleWAL(
+	ctx context.Context,
+	clusterName string,
+	parameters map[string]string,
+	rep *repository.Repository,
+	beginWal string,
+	endWal string,
+	walSegmentSize int64,
+) (*repository.SnapshotInfo, error) {
+	contextLogger := logging.FromContext(ctx)
+
+	walNames, err := getBundledWALNames(beginWal, endWal, walSegmentSize)
+	if err != nil {
+		return nil, err
+	}
+
+	destinations, err := storage.NewDestinationsFromParameters(parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.RemoveAll(bundledWALDirectory); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(bundledWALDirectory, 0o700); err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = os.RemoveAll(bundledWALDirectory)
+	}()
+
+	contextLogger.Info("Bundling WAL files in the backup", "beginWal", beginWal, "endWal", endWal)
+	for _, walName := range walNames {
+		err := downloadWAL(ctx, clusterName, destinations.Stores, walName)
+		switch {
+		case errors.Is(err, storage.ErrObjectNotFound) && !postgres.IsWALFile(walName):
+			// A timeline may have no history file, i.e. when
+			// the instance has been created from a backup
+			contextLogger.Info("History file not archived, skipping", "walName", walName)
+		case err != nil:
+			return nil, fmt.Errorf("while bundling WAL file %s: %w", walName, err)
+		}
+	}
+
+	return rep.Snapshot(ctx, bundledWALDirectory, repository.SnapshotOptions{
+		Tags: map[string]string{
+			executor.SnapshotTypeTag: executor.SnapshotTypeWAL,
+		},
+	})
+}
+
+// downloadWAL downloads a WAL file from the first destination containing it
+func downloadWAL(ctx context.Context, clusterName string, stores []storage.Store, walName string) error {
+	walKey := storage.GetWALFileKey(clusterName, walName)
+	for _, store := range stores {
+		err := store.Get(ctx, walKey, path.Join(bundledWALDirectory, walName))
+		if errors.Is(err, storage.ErrObjectNotFound) {
+			continue
+		}
+		return err
+	}
+
+	return storage.ErrObjectNotFound
+}
+
+// getBundledWALNames gets the names of the WAL segments from the begin
+// to the end WAL, both included, and of the history files of their timeline
+func getBundledWALNames(beginWal string, endWal string, walSegmentSize int64) ([]string, error) {
+	beginSegment, err := postgres.SegmentFromName(beginWal)
+	if err != nil {
+		return nil, fmt.Errorf("while parsing the begin WAL %s: %w", beginWal, err)
+	}
+	endSegment, err := postgres.SegmentFromName(endWal)
+	if err != nil {
+		return nil, fmt.Errorf("while parsing the end WAL %s: %w", endWal, err)
+	}
+	if beginSegment.Tli != endSegment.Tli {
+		return nil, fmt.Errorf("the begin WAL %s and the end WAL %s are on different timelines", beginWal, endWal)
+	}
+
+	var result []string
+	for timeline := int32(2); timeline <= beginSegment.Tli; timeline++ {
+		result = append(result, fmt.Sprintf("%08X.history", timeline))
+	}
+
+	segment := beginSegment
+	for i := 0; i < maxBundledSegments; i++ {
+		result = append(result, segment.Name())
+		if segment == endSegment {
+			return result, nil
+		}
+		segment = segment.NextSegments(2, nil, &walSegmentSize)[1]
+	}
+
+	return nil, fmt.Errorf("the WAL range from %s to %s is too long", beginWal, endWal)
+}
@@ -0,0 +1,74 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/cloudnative-pg/cnpg-i-machinery/pkg/logging"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/storage"
+)
+
+const (
+	// walArchivedPollInterval is how often the archive is checked
+	// while waiting for the end WAL of a standby backup
+	walArchivedPollInterval = 5 * time.Second
+
+	// walArchivedTimeout is the maximum time to wait for the end WAL
+	// of a standby backup. The primary switches WAL file at least
+	// every archive_timeout, which is 5 minutes by default
+	walArchivedTimeout = 15 * time.Minute
+)
+
+// waitForWALArchived waits for the primary to archive a WAL file in
+// any of the destinations. A backup taken from a standby is not
+// consistent until its end WAL file is archived
+func waitForWALArchived(
+	ctx context.Context,
+	clusterName string,
+	parameters map[string]string,
+	walName string,
+) error {
+	contextLogger := logging.FromContext(ctx)
+
+	destinations, err := storage.NewDestinationsFromParameters(parameters)
+	if err != nil {
+		return err
+	}
+
+	walKey := storage.GetWALFileKey(clusterName, walName)
+	contextLogger.Info("Waiting for the primary to archive the end WAL", "walName", walName)
+	return wait.PollUntilContextTimeout(
+		ctx,
+		walArchivedPollInterval,
+		walArchivedTimeout,
+		true,
+		func(ctx context.Context) (bool, error) {
+			for _, store := range destinations.Stores {
+				found, err := store.Exists(ctx, walKey)
+				if err != nil {
+					contextLogger.Error(err, "Error while checking WAL file", "walName", walName, "destination", store.Name())
+					continue
+				}
+				if found {
+					return true, nil
+				}
+			}
+
+			return false, nil
+		},
+	)
+}
+
+// getInstanceID gets the name of the instance where the
+// sidecar is running, which is the name of its pod
+func getInstanceID() string {
+	result, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+
+	return result
+}
@@ -0,0 +1,222 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/cloudnative-pg/cnpg-i-machinery/pkg/logging"
+)
+
+// catchUpInterval is the time between two runs of the
+// background reconciler catching up lagging destinations
+const catchUpInterval = 1 * time.Minute
+
+// CatchUpFunc copies the objects missing in the lagging destinations
+type CatchUpFunc func(ctx context.Context) error
+
+var (
+	// catchUpRequests are the pending catch up operations, by name
+	catchUpRequests      = make(map[string]CatchUpFunc)
+	catchUpRequestsMutex sync.Mutex
+	catchUpReconciler    sync.Once
+
+	// startupCatchUps are the names of the catch up operations which
+	// have been requested since the sidecar started
+	startupCatchUps = make(map[string]bool)
+)
+
+// RequestCatchUp schedules a catch up operation, to be executed by
+// the background reconciler until it succeeds. Requesting again an
+// operation which is already pending has no effect
+func RequestCatchUp(ctx context.Context, name string, catchUp CatchUpFunc) {
+	catchUpRequestsMutex.Lock()
+	catchUpRequests[name] = catchUp
+	catchUpRequestsMutex.Unlock()
+
+	catchUpReconciler.Do(func() {
+		// The reconciler outlives the request that started it, but
+		// keeps its logger
+		go runCatchUpReconciler(context.WithoutCancel(ctx))
+	})
+}
+
+// RequestStartupCatchUp schedules a catch up operation the first time
+// it is requested after the sidecar started. The pending operations are
+// only kept in memory, so the destinations are compared again after a
+// restart to catch up the ones which were lagging before it
+func RequestStartupCatchUp(ctx context.Context, name string, catchUp CatchUpFunc) {
+	catchUpRequestsMutex.Lock()
+	requested := startupCatchUps[name]
+	startupCatchUps[name] = true
+	catchUpRequestsMutex.Unlock()
+
+	if !requested {
+		RequestCatchUp(ctx, name, catchUp)
+	}
+}
+
+// runCatchUpReconciler periodically executes the pending
+// catch up operations
+func runCatchUpReconciler(ctx context.Context) {
+	ticker := time.NewTicker(catchUpInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		catchUpRequestsMutex.Lock()
+		pending := make(map[string]CatchUpFunc, len(catchUpRequests))
+		for name, catchUp := range catchUpRequests {
+			pending[name] = catchUp
+		}
+		catchUpRequestsMutex.Unlock()
+
+		for name, catchUp := range pending {
+			contextLogger := logging.FromContext(ctx).WithValues("catchUp", name)
+			if err := catchUp(ctx); err != nil {
+				contextLogger.Error(err, "Error while catching up lagging destinations, will retry")
+				continue
+			}
+
+			contextLogger.Info("Lagging destinations caught up")
+			catchUpRequestsMutex.Lock()
+			delete(catchUpRequests, name)
+			catchUpRequestsMutex.Unlock()
+		}
+	}
+}
+
+// CatchUp copies the objects under a certain prefix which are
+// missing in any of the destinations, taking them from a
+// destination where they are stored. Only the objects accepted by
+// the filter are copied, so that the ones removed on purpose from
+// some destinations are not copied back. A nil filter accepts
+// every object
+func (destinations *Destinations) CatchUp(
+	ctx context.Context,
+	prefix string,
+	options PutOptions,
+	filter func(key string) bool,
+) error {
+	contextLogger := logging.FromContext(ctx)
+
+	keys := make([]map[string]bool, len(destinations.Stores))
+	for i, store := range destinations.Stores {
+		storeKeys, err := store.List(ctx, prefix)
+		if err != nil {
+			return fmt.Errorf("while listing %s: %w", store.Name(), err)
+		}
+
+		keys[i] = make(map[string]bool, len(storeKeys))
+		for _, object := range storeKeys {
+			if filter == nil || filter(object.Key) {
+				keys[i][object.Key] = true
+			}
+		}
+	}
+
+	for source := range destinations.Stores {
+		for key := range keys[source] {
+			for target := range destinations.Stores {
+				if keys[target][key] {
+					continue
+				}
+
+				contextLogger.Info(
+					"Copying missing object",
+					"key", key,
+					"source", destinations.Stores[source].Name(),
+					"target", destinations.Stores[target].Name())
+				if err := copyObject(ctx, destinations.Stores[source], destinations.Stores[target], key, options); err != nil {
+					return err
+				}
+				keys[target][key] = true
+			}
+		}
+	}
+
+	return nil
+}
+
+// Mirror makes the objects under a prefix of a target store match the
+// ones of a source store, copying the objects which are missing in the
+// target or have been changed since they were copied, and removing the
+// ones which are not in the source anymore. The objects still locked
+// in the target are kept. The options of the copies depend on their key
+func Mirror(
+	ctx context.Context,
+	source Store,
+	target Store,
+	prefix string,
+	getOptions func(key string) PutOptions,
+) error {
+	contextLogger := logging.FromContext(ctx).WithValues("source", source.Name(), "target", target.Name())
+
+	sourceObjects, err := source.List(ctx, prefix)
+	if err != nil {
+		return fmt.Errorf("while listing %s: %w", source.Name(), err)
+	}
+	targetObjects, err := target.List(ctx, prefix)
+	if err != nil {
+		return fmt.Errorf("while listing %s: %w", target.Name(), err)
+	}
+
+	copied := make(map[string]ObjectInfo, len(targetObjects))
+	for _, object := range targetObjects {
+		copied[object.Key] = object
+	}
+
+	for _, object := range sourceObjects {
+		// Copies are written after their source, unless
+		// the source has been changed in the meantime
+		if targetObject, ok := copied[object.Key]; ok && !object.LastModified.After(targetObject.LastModified) {
+			delete(copied, object.Key)
+			continue
+		}
+		delete(copied, object.Key)
+
+		contextLogger.Info("Copying object", "key", object.Key)
+		if err := copyObject(ctx, source, target, object.Key, getOptions(object.Key)); err != nil {
+			return err
+		}
+	}
+
+	for key := range copied {
+		contextLogger.Info("Removing object not in the source anymore", "key", key)
+		err := target.Delete(ctx, key)
+		if errors.Is(err, ErrObjectLocked) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("while removing %s from %s: %w", key, target.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+// copyObject copies an object between two stores, using a
+// temporary file
+func copyObject(ctx context.Context, source Store, target Store, key string, options PutOptions) error {
+	temporaryDirectory, err := os.MkdirTemp("", "catchup")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.RemoveAll(temporaryDirectory)
+	}()
+
+	temporaryFile := path.Join(temporaryDirectory, path.Base(key))
+	if err := source.Get(ctx, key, temporaryFile); err != nil {
+		return fmt.Errorf("while reading %s from %s: %w", key, source.Name(), err)
+	}
+
+	if err := target.Put(ctx, key, temporaryFile, options); err != nil {
+		return fmt.Errorf("while writing %s to %s: %w", key, target.Name(), err)
+	}
+
+	return nil
+}
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/objectstore"
+)
+
+// writeTestFile writes a file inside a filesystem store,
+// modified at a certain time
+func writeTestFile(t *testing.T, store *filesystemStore, key string, content string, modified time.Time) {
+	t.Helper()
+
+	filePath := store.getPath(key)
+	if err := os.MkdirAll(path.Dir(filePath), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filePath, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filePath, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readTestFile reads a file inside a filesystem store
+func readTestFile(t *testing.T, store *filesystemStore, key string) string {
+	t.Helper()
+
+	content, err := os.ReadFile(store.getPath(key))
+	if err != nil {
+		t.Fatalf("unexpected error reading %s: %v", key, err)
+	}
+	return string(content)
+}
+
+// listTestKeys lists the keys of a store under a prefix
+func listTestKeys(t *testing.T, store Store, prefix string) []string {
+	t.Helper()
+
+	objects, err := store.List(context.Background(), prefix)
+	if err != nil {
+		t.Fatalf("unexpected error listing %s: %v", store.Name(), err)
+	}
+
+	keys := make([]string, 0, len(objects))
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+	return keys
+}
+
+func TestMirror(t *testing.T) {
+	source := &filesystemStore{root: t.TempDir()}
+	target := &filesystemStore{root: t.TempDir()}
+	now := time.Now()
+
+	writeTestFile(t, source, "cluster/catalog/unchanged.json", "unchanged", now.Add(-2*time.Hour))
+	writeTestFile(t, target, "cluster/catalog/unchanged.json", "copied", now.Add(-time.Hour))
+	writeTestFile(t, source, "cluster/catalog/changed.json", "changed", now)
+	writeTestFile(t, target, "cluster/catalog/changed.json", "stale", now.Add(-time.Hour))
+	writeTestFile(t, source, "cluster/catalog/missing.json", "missing", now)
+	writeTestFile(t, target, "cluster/catalog/deleted.json", "deleted", now)
+	writeTestFile(t, target, "cluster/locks/backup.json", "lock", now)
+
+	var optionKeys []string
+	err := Mirror(context.Background(), source, target, "cluster/catalog", func(key string) PutOptions {
+		optionKeys = append(optionKeys, key)
+		return NewPutOptions("cluster", "default", objectstore.ObjectTypeManifest)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error mirroring the store: %v", err)
+	}
+
+	expected := []string{"cluster/catalog/changed.json", "cluster/catalog/missing.json", "cluster/catalog/unchanged.json"}
+	if keys := listTestKeys(t, target, "cluster/catalog"); !slices.Equal(keys, expected) {
+		t.Fatalf("unexpected keys %v, expected %v", keys, expected)
+	}
+	if !slices.Equal(optionKeys, expected[:2]) {
+		t.Fatalf("unexpected copies %v", optionKeys)
+	}
+
+	// The copies older than their source are replaced
+	for key, content := range map[string]string{
+		"cluster/catalog/unchanged.json": "copied",
+		"cluster/catalog/changed.json":   "changed",
+		"cluster/catalog/missing.json":   "missing",
+	} {
+		if result := readTestFile(t, target, key); result != content {
+			t.Errorf("unexpected content %q of %s, expected %q", result, key, content)
+		}
+	}
+
+	// The objects outside the prefix are left alone
+	if keys := listTestKeys(t, target, "cluster/locks"); len(keys) != 1 {
+		t.Fatalf("unexpected locks %v", keys)
+	}
+}
+
+func TestCatchUpFilter(t *testing.T) {
+	first := &filesystemStore{root: t.TempDir()}
+	second := &filesystemStore{root: t.TempDir()}
+	now := time.Now()
+
+	writeTestFile(t, first, "cluster/wals/000000010000000000000001", "pruned", now)
+	writeTestFile(t, first, "cluster/wals/000000010000000000000002", "needed", now)
+	writeTestFile(t, second, "cluster/wals/000000010000000000000003", "needed", now)
+
+	destinations := &Destinations{Stores: []Store{first, second}, Policy: DestinationPolicyAny}
+	err := destinations.CatchUp(
+		context.Background(),
+		"cluster/wals",
+		NewPutOptions("cluster", "default", objectstore.ObjectTypeWAL),
+		func(key string) bool {
+			return !strings.HasSuffix(key, "1")
+		})
+	if err != nil {
+		t.Fatalf("unexpected error catching up: %v", err)
+	}
+
+	// The objects rejected by the filter are not copied back
+	expected := []string{"cluster/wals/000000010000000000000002", "cluster/wals/000000010000000000000003"}
+	if keys := listTestKeys(t, second, "cluster/wals"); !slices.Equal(keys, expected) {
+		t.Fatalf("unexpected keys %v, expected %v", keys, expected)
+	}
+	expected = append([]string{"cluster/wals/000000010000000000000001"}, expected...)
+	if keys := listTestKeys(t, first, "cluster/wals"); !slices.Equal(keys, expected) {
+		t.Fatalf("unexpected keys %v, expected %v", keys, expected)
+	}
+}
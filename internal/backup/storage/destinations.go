@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/objectstore"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/throttling"
+)
+
+const (
+	// DestinationsParameter is the comma separated list of
+	// destinations where WALs and backups are stored
+	DestinationsParameter = "destinations"
+
+	// DestinationPolicyParameter is the policy deciding when
+	// an archive operation on multiple destinations succeeds
+	DestinationPolicyParameter = "destinationPolicy"
+)
+
+// Destination is a place where WALs and backups are stored
+type Destination string
+
+const (
+	// DestinationPVC is the PVC mounted in the sidecar
+	DestinationPVC Destination = "pvc"
+
+	// DestinationS3 is the configured S3 bucket
+	DestinationS3 Destination = "s3"
+
+	// DestinationSecondary is the secondary S3 bucket, configured
+	// by the parameters having the "secondary" prefix
+	DestinationSecondary Destination = "secondary"
+)
+
+// DestinationPolicy decides when an archive operation
+// on multiple destinations succeeds
+type DestinationPolicy string
+
+const (
+	// DestinationPolicyAll requires every destination to
+	// store the object
+	DestinationPolicyAll DestinationPolicy = "all"
+
+	// DestinationPolicyAny requires at least one destination
+	// to store the object. The lagging destinations are
+	// caught up in background
+	DestinationPolicyAny DestinationPolicy = "any"
+)
+
+// Destinations is the set of destinations where
+// WALs and backups are stored
+type Destinations struct {
+	// Stores are the stores of the destinations, in the
+	// order they have been configured
+	Stores []Store
+
+	// Policy is the destination policy
+	Policy DestinationPolicy
+}
+
+// GetDestinationsFromParameters reads the list of configured
+// destinations from the plugin parameters. Without any explicit
+// configuration WALs are stored inside the PVC
+func GetDestinationsFromParameters(parameters map[string]string) ([]Destination, DestinationPolicy, error) {
+	policy := DestinationPolicyAll
+	if value := parameters[DestinationPolicyParameter]; len(value) > 0 {
+		policy = DestinationPolicy(value)
+		if policy != DestinationPolicyAll && policy != DestinationPolicyAny {
+			return nil, "", &objectstore.ParameterError{
+				Name:    DestinationPolicyParameter,
+				Message: fmt.Sprintf("must be %q or %q", DestinationPolicyAll, DestinationPolicyAny),
+			}
+		}
+	}
+
+	value := parameters[DestinationsParameter]
+	if len(value) == 0 {
+		return []Destination{DestinationPVC}, policy, nil
+	}
+
+	var result []Destination
+	for _, item := range strings.Split(value, ",") {
+		destination := Destination(strings.TrimSpace(item))
+		if err := destination.Validate(parameters); err != nil {
+			return nil, "", &objectstore.ParameterError{
+				Name:    DestinationsParameter,
+				Message: err.Error(),
+			}
+		}
+
+		for i := range result {
+			if result[i] == destination {
+				return nil, "", &objectstore.ParameterError{
+					Name:    DestinationsParameter,
+					Message: fmt.Sprintf("contains %q more than once", destination),
+				}
+			}
+		}
+
+		result = append(result, destination)
+	}
+
+	return result, policy, nil
+}
+
+// NewDestinationsFromParameters creates the stores of the
+// destinations configured in the plugin parameters
+func NewDestinationsFromParameters(parameters map[string]string) (*Destinations, error) {
+	destinations, policy, err := GetDestinationsFromParameters(parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Destinations{
+		Policy: policy,
+		Stores: make([]Store, 0, len(destinations)),
+	}
+	for _, destination := range destinations {
+		store, err := NewStore(destination, parameters)
+		if err != nil {
+			return nil, err
+		}
+		result.Stores = append(result.Stores, store)
+	}
+
+	return result, nil
+}
+
+// Validate checks if a destination is known and configured
+func (destination Destination) Validate(parameters map[string]string) error {
+	switch destination {
+	case DestinationPVC:
+		return nil
+
+	case DestinationS3:
+		if !objectstore.IsConfigured(parameters, "") {
+			return fmt.Errorf("contains %q, but the bucket is not configured", destination)
+		}
+		return nil
+
+	case DestinationSecondary:
+		if !objectstore.IsConfigured(parameters, objectstore.SecondaryPrefix) {
+			return fmt.Errorf("contains %q, but the secondary bucket is not configured", destination)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("contains the unknown destination %q", destination)
+	}
+}
+
+// NewStore creates the store of a certain destination. The transfers
+// to the buckets are limited by the bandwidth budget of the WAL files
+func NewStore(destination Destination, parameters map[string]string) (Store, error) {
+	throttlingConfiguration, err := throttling.NewConfigurationFromParameters(parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	switch destination {
+	case DestinationPVC:
+		return NewFilesystemStore(), nil
+
+	case DestinationS3:
+		configuration, err := objectstore.NewConfigurationFromParameters(parameters)
+		if err != nil {
+			return nil, err
+		}
+		return NewThrottledS3Store(string(destination), configuration, throttlingConfiguration, throttling.BudgetWAL)
+
+	case DestinationSecondary:
+		configuration, err := objectstore.NewConfigurationFromPrefixedParameters(
+			parameters,
+			objectstore.SecondaryPrefix)
+		if err != nil {
+			return nil, err
+		}
+		return NewThrottledS3Store(string(destination), configuration, throttlingConfiguration, throttling.BudgetWAL)
+
+	default:
+		return nil, fmt.Errorf("unknown destination: %s", destination)
+	}
+}
+
+// Contains checks if a destination is configured
+func (destinations *Destinations) Contains(destination Destination) bool {
+	for _, store := range destinations.Stores {
+		if store.Name() == string(destination) {
+			return true
+		}
+	}
+	return false
+}
+
+// Put copies a local file into every destination, succeeding
+// according to the destination policy. The names of the
+// destinations which failed to store the file are returned,
+// so that they can be caught up later
+func (destinations *Destinations) Put(
+	ctx context.Context,
+	key string,
+	sourcePath string,
+	options PutOptions,
+) ([]string, error) {
+	errs := make([]error, len(destinations.Stores))
+
+	var wg sync.WaitGroup
+	for i := range destinations.Stores {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = destinations.Stores[i].Put(ctx, key, sourcePath, options)
+		}(i)
+	}
+	wg.Wait()
+
+	var lagging []string
+	var failures []error
+	for i := range errs {
+		if errs[i] != nil {
+			lagging = append(lagging, destinations.Stores[i].Name())
+			failures = append(failures, fmt.Errorf("%s: %w", destinations.Stores[i].Name(), errs[i]))
+		}
+	}
+
+	if len(failures) == 0 {
+		return nil, nil
+	}
+
+	if destinations.Policy == DestinationPolicyAll || len(failures) == len(destinations.Stores) {
+		return lagging, errors.Join(failures...)
+	}
+
+	return lagging, nil
+}
@@ -0,0 +1,213 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5" // nolint:gosec
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/cloudnative-pg/cloudnative-pg/pkg/fileutils"
+)
+
+// filesystemStore is a store kept inside a local directory,
+// usually the PVC mounted in the sidecar
+type filesystemStore struct {
+	root string
+}
+
+// NewFilesystemStore creates a store kept inside the backup PVC
+func NewFilesystemStore() Store {
+	return &filesystemStore{root: basePath}
+}
+
+// Name implements the Store interface
+func (*filesystemStore) Name() string {
+	return string(DestinationPVC)
+}
+
+// Put implements the Store interface
+func (store *filesystemStore) Put(_ context.Context, key string, sourcePath string, _ PutOptions) error {
+	return fileutils.CopyFile(sourcePath, store.getPath(key))
+}
+
+// Get implements the Store interface
+func (store *filesystemStore) Get(_ context.Context, key string, destinationPath string) error {
+	err := fileutils.CopyFile(store.getPath(key), destinationPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrObjectNotFound
+	}
+	return err
+}
+
+// GetVersion implements the Store interface. The version
+// of a file is the MD5 of its content, like an S3 ETag
+func (store *filesystemStore) GetVersion(ctx context.Context, key string, destinationPath string) (string, error) {
+	unlock, err := lockDirectory(path.Dir(store.getPath(key)), syscall.LOCK_SH)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", ErrObjectNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	if err := store.Get(ctx, key, destinationPath); err != nil {
+		return "", err
+	}
+
+	return getFileVersion(destinationPath)
+}
+
+// PutIfVersion implements the Store interface. The conditional
+// writes and the reads of the versions are serialized by an
+// advisory lock on the directory containing the file
+func (store *filesystemStore) PutIfVersion(
+	_ context.Context,
+	key string,
+	sourcePath string,
+	version string,
+	_ PutOptions,
+) (string, error) {
+	filePath := store.getPath(key)
+	if err := os.MkdirAll(path.Dir(filePath), 0o700); err != nil {
+		return "", err
+	}
+
+	unlock, err := lockDirectory(path.Dir(filePath), syscall.LOCK_EX)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	current, err := getFileVersion(filePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		current, err = "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if current != version {
+		return "", ErrPreconditionFailed
+	}
+
+	if err := fileutils.CopyFile(sourcePath, filePath); err != nil {
+		return "", err
+	}
+
+	return getFileVersion(filePath)
+}
+
+// lockDirectory takes an advisory lock on a directory,
+// returning the function releasing it
+func lockDirectory(directoryPath string, how int) (func(), error) {
+	directory, err := os.Open(directoryPath) // nolint:gosec
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(directory.Fd()), how); err != nil {
+		_ = directory.Close()
+		return nil, err
+	}
+
+	return func() {
+		_ = directory.Close()
+	}, nil
+}
+
+// getFileVersion gets the version of a file, which is the MD5 of its content
+func getFileVersion(filePath string) (string, error) {
+	file, err := os.Open(filePath) // nolint:gosec
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	hash := md5.New() // nolint:gosec
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Exists implements the Store interface
+func (store *filesystemStore) Exists(_ context.Context, key string) (bool, error) {
+	return fileutils.FileExists(store.getPath(key))
+}
+
+// List implements the Store interface
+func (store *filesystemStore) List(_ context.Context, prefix string) ([]ObjectInfo, error) {
+	var result []ObjectInfo
+	err := filepath.WalkDir(store.getPath(prefix), func(filePath string, entry fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if entry.Type().IsRegular() {
+			key, err := filepath.Rel(store.root, filePath)
+			if err != nil {
+				return err
+			}
+
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+
+			result = append(result, ObjectInfo{
+				Key:          filepath.ToSlash(key),
+				LastModified: info.ModTime(),
+			})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+	return result, nil
+}
+
+// Delete implements the Store interface
+func (store *filesystemStore) Delete(_ context.Context, key string) error {
+	if err := os.Remove(store.getPath(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// DeleteMany implements the Store interface
+func (store *filesystemStore) DeleteMany(ctx context.Context, keys []string) error {
+	for _, key := range keys {
+		if err := store.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetStorageClass implements the Store interface
+func (*filesystemStore) SetStorageClass(context.Context, string, string) error {
+	return nil
+}
+
+func (store *filesystemStore) getPath(key string) string {
+	return path.Join(store.root, key)
+}
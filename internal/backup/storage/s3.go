@@ -0,0 +1,444 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5" // nolint:gosec
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cloudnative-pg/cnpg-i-machinery/pkg/logging"
+	"github.com/minio/minio-go/v7"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/objectstore"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/throttling"
+)
+
+// conditionalPutExpiry is the validity of the presigned
+// requests used for conditional writes
+const conditionalPutExpiry = 5 * time.Minute
+
+// s3Store is a store kept inside an S3 bucket
+type s3Store struct {
+	name           string
+	client         *minio.Client
+	httpClient     *http.Client
+	bucket         string
+	prefix         string
+	objectLock     *objectstore.ObjectLockConfiguration
+	storageClasses map[objectstore.ObjectType]string
+	throttling     *throttling.Configuration
+	budget         throttling.Budget
+}
+
+// NewS3Store creates a store kept inside the configured bucket
+func NewS3Store(name string, configuration *objectstore.Configuration) (Store, error) {
+	return NewThrottledS3Store(name, configuration, nil, "")
+}
+
+// NewThrottledS3Store creates a store kept inside the configured
+// bucket, whose transfers are limited by the limits of a budget
+func NewThrottledS3Store(
+	name string,
+	configuration *objectstore.Configuration,
+	throttlingConfiguration *throttling.Configuration,
+	budget throttling.Budget,
+) (Store, error) {
+	client, transport, err := configuration.NewClient()
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3Store{
+		name:           name,
+		client:         client,
+		httpClient:     &http.Client{Transport: transport},
+		bucket:         configuration.Bucket,
+		prefix:         configuration.Prefix,
+		objectLock:     configuration.ObjectLock,
+		storageClasses: configuration.StorageClasses,
+		throttling:     throttlingConfiguration,
+		budget:         budget,
+	}, nil
+}
+
+// Name implements the Store interface
+func (store *s3Store) Name() string {
+	return store.name
+}
+
+// Put implements the Store interface
+func (store *s3Store) Put(ctx context.Context, key string, sourcePath string, options PutOptions) error {
+	putOptions := store.getPutObjectOptions(options)
+
+	if !store.throttling.IsConfigured() {
+		_, err := store.client.FPutObject(ctx, store.bucket, store.getObjectName(key), sourcePath, putOptions)
+		return err
+	}
+
+	file, err := os.Open(sourcePath) // nolint:gosec
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	reader := store.throttling.NewReader(ctx, file, store.budget, throttling.DirectionUpload)
+	_, err = store.client.PutObject(ctx, store.bucket, store.getObjectName(key), reader, info.Size(), putOptions)
+	return err
+}
+
+// PutIfVersion implements the Store interface
+func (store *s3Store) PutIfVersion(
+	ctx context.Context,
+	key string,
+	sourcePath string,
+	version string,
+	options PutOptions,
+) (string, error) {
+	content, err := os.ReadFile(sourcePath) // nolint:gosec
+	if err != nil {
+		return "", err
+	}
+
+	headers := store.getPutObjectOptions(options).Header()
+	checksum := md5.Sum(content) // nolint:gosec
+	headers.Set("Content-Md5", base64.StdEncoding.EncodeToString(checksum[:]))
+	if len(version) == 0 {
+		headers.Set("If-None-Match", "*")
+	} else {
+		headers.Set("If-Match", "\""+version+"\"")
+	}
+
+	// The client quotes the value of the If-None-Match header of the
+	// uploads, which S3 rejects, so the request is presigned with
+	// the conditional headers and sent with the transport of the client
+	objectURL, err := store.client.PresignHeader(
+		ctx, http.MethodPut, store.bucket, store.getObjectName(key), conditionalPutExpiry, nil, headers)
+	if err != nil {
+		return "", err
+	}
+
+	var body io.Reader = bytes.NewReader(content)
+	if store.throttling.IsConfigured() {
+		body = store.throttling.NewReader(ctx, body, store.budget, throttling.DirectionUpload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, objectURL.String(), body)
+	if err != nil {
+		return "", err
+	}
+	req.Header = headers
+	req.ContentLength = int64(len(content))
+
+	resp, err := store.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return strings.Trim(resp.Header.Get("ETag"), "\""), nil
+	case http.StatusPreconditionFailed, http.StatusConflict, http.StatusNotFound:
+		// A conflict is reported when another conditional write of the
+		// same object is in progress, and a missing object when the
+		// object to be replaced has been deleted
+		return "", ErrPreconditionFailed
+	default:
+		errorResponse := minio.ErrorResponse{StatusCode: resp.StatusCode}
+		if err := xml.NewDecoder(resp.Body).Decode(&errorResponse); err != nil {
+			errorResponse.Message = resp.Status
+		}
+		return "", errorResponse
+	}
+}
+
+// getPutObjectOptions gets the options of the upload of an object
+func (store *s3Store) getPutObjectOptions(options PutOptions) minio.PutObjectOptions {
+	result := minio.PutObjectOptions{
+		StorageClass: store.storageClasses[options.Type],
+		UserTags:     options.Tags,
+	}
+
+	if store.objectLock != nil {
+		result.Mode = store.objectLock.Mode
+		result.RetainUntilDate = store.objectLock.GetRetainUntilDate()
+
+		// S3 requires an integrity check for uploads to buckets
+		// with object lock enabled
+		result.SendContentMd5 = true
+	}
+
+	return result
+}
+
+// Get implements the Store interface
+func (store *s3Store) Get(ctx context.Context, key string, destinationPath string) error {
+	if store.throttling.IsConfigured() {
+		_, err := store.download(ctx, key, destinationPath)
+		return err
+	}
+
+	return getError(
+		store.client.FGetObject(ctx, store.bucket, store.getObjectName(key), destinationPath, minio.GetObjectOptions{}))
+}
+
+// GetVersion implements the Store interface
+func (store *s3Store) GetVersion(ctx context.Context, key string, destinationPath string) (string, error) {
+	return store.download(ctx, key, destinationPath)
+}
+
+// download copies an object into a local file, limiting the bandwidth
+// when throttling is configured, and returns its ETag. The file is
+// removed when the copy fails
+func (store *s3Store) download(ctx context.Context, key string, destinationPath string) (string, error) {
+	object, err := store.client.GetObject(ctx, store.bucket, store.getObjectName(key), minio.GetObjectOptions{})
+	if err != nil {
+		return "", getError(err)
+	}
+	defer func() {
+		_ = object.Close()
+	}()
+
+	// The errors of the request are only returned when reading
+	info, err := object.Stat()
+	if err != nil {
+		return "", getError(err)
+	}
+
+	file, err := os.Create(destinationPath) // nolint:gosec
+	if err != nil {
+		return "", err
+	}
+
+	var reader io.Reader = object
+	if store.throttling.IsConfigured() {
+		reader = store.throttling.NewReader(ctx, object, store.budget, throttling.DirectionDownload)
+	}
+	_, err = io.Copy(file, reader)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(destinationPath)
+		return "", err
+	}
+
+	return info.ETag, nil
+}
+
+// Exists implements the Store interface
+func (store *s3Store) Exists(ctx context.Context, key string) (bool, error) {
+	_, err := store.client.StatObject(ctx, store.bucket, store.getObjectName(key), minio.StatObjectOptions{})
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// List implements the Store interface
+func (store *s3Store) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	objectPrefix := store.getObjectName(prefix)
+	if len(objectPrefix) > 0 && !strings.HasSuffix(objectPrefix, "/") {
+		objectPrefix += "/"
+	}
+
+	var result []ObjectInfo
+	for object := range store.client.ListObjects(ctx, store.bucket, minio.ListObjectsOptions{
+		Prefix:    objectPrefix,
+		Recursive: true,
+	}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		info := ObjectInfo{
+			Key:          strings.TrimPrefix(object.Key, store.getObjectName("")+"/"),
+			LastModified: object.LastModified,
+			StorageClass: object.StorageClass,
+		}
+
+		// Listing doesn't report the retention of the objects, and
+		// reading it would take a request for each of them. Objects
+		// uploaded with a longer retention are only estimated to be
+		// unlocked, and are kept when they are deleted
+		if store.objectLock != nil {
+			info.RetainUntilDate = object.LastModified.Add(store.objectLock.Retention)
+		}
+		result = append(result, info)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+	return result, nil
+}
+
+// Delete implements the Store interface. Objects whose object
+// lock retention has not expired are not deleted. The retention
+// is only read when the store locks the uploaded objects
+func (store *s3Store) Delete(ctx context.Context, key string) error {
+	objectName := store.getObjectName(key)
+
+	if store.objectLock != nil {
+		_, retainUntilDate, err := store.client.GetObjectRetention(ctx, store.bucket, objectName, "")
+		switch {
+		case err == nil:
+			if retainUntilDate != nil && retainUntilDate.After(time.Now()) {
+				return ErrObjectLocked
+			}
+		case isObjectLockNotConfigured(err):
+			// The lock configuration is reported as missing with a 404
+			// error too, so this needs to be checked first
+		case isNotFound(err):
+			return nil
+		default:
+			return err
+		}
+	}
+
+	return store.client.RemoveObject(ctx, store.bucket, objectName, minio.RemoveObjectOptions{})
+}
+
+// DeleteMany implements the Store interface, using
+// a request for every thousand objects
+func (store *s3Store) DeleteMany(ctx context.Context, keys []string) error {
+	objects := make(chan minio.ObjectInfo, len(keys))
+	for _, key := range keys {
+		objects <- minio.ObjectInfo{Key: store.getObjectName(key)}
+	}
+	close(objects)
+
+	var errs []error
+	locked := 0
+	for result := range store.client.RemoveObjects(ctx, store.bucket, objects, minio.RemoveObjectsOptions{}) {
+		switch {
+		case result.Err == nil, isNotFound(result.Err):
+		case store.objectLock != nil && isObjectLocked(result.Err):
+			locked++
+		default:
+			errs = append(errs, fmt.Errorf("%s: %w", result.ObjectName, result.Err))
+		}
+	}
+
+	if locked > 0 {
+		logging.FromContext(ctx).Info(
+			"Objects still locked by their retention kept",
+			"destination", store.name,
+			"locked", locked)
+	}
+
+	return errors.Join(errs...)
+}
+
+// SetStorageClass implements the Store interface, copying the
+// object over itself with the new storage class. The metadata and
+// the tags of the object are copied, while the object lock retention
+// is applied again, as it is not copied
+func (store *s3Store) SetStorageClass(ctx context.Context, key string, storageClass string) error {
+	objectName := store.getObjectName(key)
+
+	destination := minio.PutObjectOptions{
+		StorageClass: storageClass,
+	}
+	if store.objectLock != nil {
+		destination.Mode = store.objectLock.Mode
+		destination.RetainUntilDate = store.objectLock.GetRetainUntilDate()
+	}
+
+	// The low level copy sends the headers of the destination as they
+	// are, while the high level one ignores the storage class. The
+	// content type is kept from the source object
+	headers := make(map[string]string)
+	for name, values := range destination.Header() {
+		if name != "Content-Type" && len(values) > 0 {
+			headers[name] = values[0]
+		}
+	}
+
+	_, err := minio.Core{Client: store.client}.CopyObject(
+		ctx,
+		store.bucket,
+		objectName,
+		store.bucket,
+		objectName,
+		headers,
+		minio.CopySrcOptions{},
+		destination,
+	)
+	return err
+}
+
+// getObjectName gets the name of the object storing a certain key
+func (store *s3Store) getObjectName(key string) string {
+	return strings.TrimPrefix(path.Join(store.prefix, key), "/")
+}
+
+// getError gets the error of a request reading an object
+func getError(err error) error {
+	switch {
+	case isNotFound(err):
+		return ErrObjectNotFound
+	case isArchived(err):
+		return ErrObjectArchived
+	default:
+		return err
+	}
+}
+
+// isObjectLockNotConfigured checks if an error has been raised
+// because the object, or the bucket, has no object lock retention
+func isObjectLockNotConfigured(err error) bool {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchObjectLockConfiguration", "ObjectLockConfigurationNotFoundError":
+		return true
+	default:
+		return false
+	}
+}
+
+// isObjectLocked checks if an error has been raised because the
+// object lock retention of the object has not expired. S3 denies
+// the access to the object, whose reason is only in the message
+func isObjectLocked(err error) bool {
+	switch minio.ToErrorResponse(err).Code {
+	case "AccessDenied", "ObjectLocked":
+		return true
+	default:
+		return false
+	}
+}
+
+// isArchived checks if an error has been raised because the
+// object is in an archive storage class
+func isArchived(err error) bool {
+	return err != nil && minio.ToErrorResponse(err).Code == "InvalidObjectState"
+}
+
+func isNotFound(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	return minio.ToErrorResponse(err).StatusCode == http.StatusNotFound
+}
@@ -0,0 +1,338 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/storage/s3test"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/objectstore"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/throttling"
+)
+
+// newTestS3Store creates a store kept inside an in-memory
+// bucket, configured by a set of additional parameters
+func newTestS3Store(t *testing.T, objectLock bool, parameters map[string]string) (Store, *s3test.Server) {
+	t.Helper()
+
+	// Requests are not signed without credentials
+	for _, name := range []string{"AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY", "AWS_SECRET_ACCESS_KEY", "AWS_SECRET_KEY"} {
+		t.Setenv(name, "")
+	}
+
+	server := s3test.NewServer()
+	server.ObjectLock = objectLock
+	t.Cleanup(server.Close)
+
+	configuration, err := objectstore.NewConfigurationFromParameters(server.Parameters(parameters))
+	if err != nil {
+		t.Fatalf("unexpected error reading the configuration: %v", err)
+	}
+
+	store, err := NewS3Store(string(DestinationS3), configuration)
+	if err != nil {
+		t.Fatalf("unexpected error creating the store: %v", err)
+	}
+
+	return store, server
+}
+
+// putTestObject uploads an object with a certain content
+func putTestObject(t *testing.T, store Store, key string, content string) {
+	t.Helper()
+
+	sourcePath := path.Join(t.TempDir(), path.Base(key))
+	if err := os.WriteFile(sourcePath, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Put(context.Background(), key, sourcePath, NewPutOptions("cluster", "default", objectstore.ObjectTypeWAL)); err != nil {
+		t.Fatalf("unexpected error uploading %s: %v", key, err)
+	}
+}
+
+func TestS3StorePutGet(t *testing.T) {
+	store, server := newTestS3Store(t, false, nil)
+	ctx := context.Background()
+
+	putTestObject(t, store, "cluster/wals/000000010000000000000001", "content")
+
+	object, ok := server.GetObject("cluster/wals/000000010000000000000001")
+	if !ok {
+		t.Fatal("expected the object to be uploaded")
+	}
+	if object.Tags.Get(TagCluster) != "cluster" || object.Tags.Get(TagType) != string(objectstore.ObjectTypeWAL) {
+		t.Fatalf("unexpected tags %v", object.Tags)
+	}
+
+	destinationPath := path.Join(t.TempDir(), "wal")
+	if err := store.Get(ctx, "cluster/wals/000000010000000000000001", destinationPath); err != nil {
+		t.Fatalf("unexpected error downloading the object: %v", err)
+	}
+	if content, _ := os.ReadFile(destinationPath); string(content) != "content" {
+		t.Fatalf("unexpected content %q", content)
+	}
+
+	err := store.Get(ctx, "cluster/wals/000000010000000000000002", destinationPath)
+	if !errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("expected ErrObjectNotFound, got %v", err)
+	}
+}
+
+func TestS3StoreDeleteWithoutObjectLock(t *testing.T) {
+	store, server := newTestS3Store(t, false, nil)
+	putTestObject(t, store, "cluster/catalog/backup.json", "{}")
+	server.ResetRequests()
+
+	if err := store.Delete(context.Background(), "cluster/catalog/backup.json"); err != nil {
+		t.Fatalf("unexpected error deleting the object: %v", err)
+	}
+
+	// The bucket has no object lock configuration, and
+	// the retention of the object is not read
+	if requests := server.Requests("GetObjectRetention"); requests != 0 {
+		t.Fatalf("expected no retention requests, got %d", requests)
+	}
+	if _, ok := server.GetObject("cluster/catalog/backup.json"); ok {
+		t.Fatal("expected the object to be deleted")
+	}
+
+	if err := store.Delete(context.Background(), "cluster/catalog/missing.json"); err != nil {
+		t.Fatalf("deleting a missing object is not an error, got %v", err)
+	}
+}
+
+func TestS3StoreDeleteLocked(t *testing.T) {
+	store, server := newTestS3Store(t, true, map[string]string{
+		objectstore.ObjectLockModeParameter:      string(minio.Governance),
+		objectstore.ObjectLockRetentionParameter: "1d",
+	})
+	ctx := context.Background()
+
+	putTestObject(t, store, "cluster/catalog/locked.json", "{}")
+	if err := store.Delete(ctx, "cluster/catalog/locked.json"); !errors.Is(err, ErrObjectLocked) {
+		t.Fatalf("expected ErrObjectLocked, got %v", err)
+	}
+	if _, ok := server.GetObject("cluster/catalog/locked.json"); !ok {
+		t.Fatal("expected the locked object to be kept")
+	}
+
+	// Objects written before object lock was configured have no
+	// retention, and are reported as such with a 404 error
+	server.SetObject("cluster/catalog/unlocked.json", s3test.Object{Content: []byte("{}")})
+	if err := store.Delete(ctx, "cluster/catalog/unlocked.json"); err != nil {
+		t.Fatalf("unexpected error deleting an object without retention: %v", err)
+	}
+	if _, ok := server.GetObject("cluster/catalog/unlocked.json"); ok {
+		t.Fatal("expected the object without retention to be deleted")
+	}
+
+	if err := store.Delete(ctx, "cluster/catalog/missing.json"); err != nil {
+		t.Fatalf("deleting a missing object is not an error, got %v", err)
+	}
+}
+
+func TestS3StoreDeleteMany(t *testing.T) {
+	store, server := newTestS3Store(t, true, map[string]string{
+		objectstore.ObjectLockModeParameter:      string(minio.Governance),
+		objectstore.ObjectLockRetentionParameter: "1d",
+	})
+	ctx := context.Background()
+
+	keys := []string{"cluster/wals/a", "cluster/wals/b", "cluster/wals/c"}
+	for _, key := range keys {
+		putTestObject(t, store, key, key)
+	}
+	server.ResetRequests()
+
+	if err := store.DeleteMany(ctx, append(keys, "cluster/wals/missing")); err != nil {
+		t.Fatalf("unexpected error deleting the objects: %v", err)
+	}
+
+	if requests := server.Requests("DeleteObjects"); requests != 1 {
+		t.Fatalf("expected a single batch deletion, got %d", requests)
+	}
+	if requests := server.Requests("GetObjectRetention") + server.Requests("DeleteObject"); requests != 0 {
+		t.Fatalf("expected no requests for single objects, got %d", requests)
+	}
+	if remaining := server.Keys(); len(remaining) != 0 {
+		t.Fatalf("expected every object to be deleted, found %v", remaining)
+	}
+
+	if err := store.DeleteMany(ctx, nil); err != nil {
+		t.Fatalf("unexpected error deleting no objects: %v", err)
+	}
+}
+
+func TestS3StoreDeleteManyLocked(t *testing.T) {
+	store, server := newTestS3Store(t, true, map[string]string{
+		objectstore.ObjectLockModeParameter:      string(minio.Governance),
+		objectstore.ObjectLockRetentionParameter: "1d",
+	})
+	server.DenyLockedDeletions = true
+	ctx := context.Background()
+
+	// The object has been uploaded when the retention was
+	// longer, and is listed as unlocked while it is not
+	lastModified := time.Now().Add(-48 * time.Hour)
+	server.SetObject("cluster/wals/locked", s3test.Object{
+		Content:         []byte("locked"),
+		LastModified:    lastModified,
+		LockMode:        string(minio.Governance),
+		RetainUntilDate: lastModified.Add(7 * 24 * time.Hour),
+	})
+	server.SetObject("cluster/wals/unlocked", s3test.Object{Content: []byte("unlocked"), LastModified: lastModified})
+
+	objects, err := store.List(ctx, "cluster/wals")
+	if err != nil {
+		t.Fatalf("unexpected error listing the objects: %v", err)
+	}
+	if len(objects) != 2 || objects[0].IsLocked(time.Now()) {
+		t.Fatalf("expected the locked object to be listed as unlocked, got %+v", objects)
+	}
+
+	if err := store.DeleteMany(ctx, []string{"cluster/wals/locked", "cluster/wals/unlocked"}); err != nil {
+		t.Fatalf("expected the locked object to be skipped, got %v", err)
+	}
+	if remaining := server.Keys(); len(remaining) != 1 || remaining[0] != "cluster/wals/locked" {
+		t.Fatalf("expected only the locked object to be kept, found %v", remaining)
+	}
+}
+
+func TestS3StoreListRetention(t *testing.T) {
+	store, server := newTestS3Store(t, true, map[string]string{
+		objectstore.ObjectLockModeParameter:      string(minio.Compliance),
+		objectstore.ObjectLockRetentionParameter: "2d",
+	})
+
+	lastModified := time.Now().Add(-72 * time.Hour).Truncate(time.Millisecond)
+	server.SetObject("cluster/wals/old", s3test.Object{Content: []byte("old"), LastModified: lastModified})
+	putTestObject(t, store, "cluster/wals/new", "new")
+	server.SetObject("other/wals/new", s3test.Object{Content: []byte("other")})
+	server.ResetRequests()
+
+	objects, err := store.List(context.Background(), "cluster/wals")
+	if err != nil {
+		t.Fatalf("unexpected error listing the objects: %v", err)
+	}
+	if len(objects) != 2 || objects[0].Key != "cluster/wals/new" || objects[1].Key != "cluster/wals/old" {
+		t.Fatalf("unexpected objects %+v", objects)
+	}
+
+	now := time.Now()
+	if !objects[0].IsLocked(now) {
+		t.Fatal("expected the new object to be locked")
+	}
+	if objects[1].IsLocked(now) {
+		t.Fatalf("expected the old object to be unlocked, locked until %s", objects[1].RetainUntilDate)
+	}
+	if !objects[1].RetainUntilDate.Equal(lastModified.Add(48 * time.Hour)) {
+		t.Fatalf("unexpected retention %s", objects[1].RetainUntilDate)
+	}
+	if requests := server.Requests("GetObjectRetention"); requests != 0 {
+		t.Fatalf("expected the retention to be computed without requests, got %d", requests)
+	}
+}
+
+func TestIsObjectLockNotConfigured(t *testing.T) {
+	tests := []struct {
+		code     string
+		expected bool
+	}{
+		{code: "NoSuchObjectLockConfiguration", expected: true},
+		{code: "ObjectLockConfigurationNotFoundError", expected: true},
+		{code: "InvalidRequest", expected: false},
+		{code: "AccessDenied", expected: false},
+	}
+
+	for _, test := range tests {
+		err := minio.ErrorResponse{Code: test.code}
+		if result := isObjectLockNotConfigured(err); result != test.expected {
+			t.Errorf("isObjectLockNotConfigured(%s) = %v, expected %v", test.code, result, test.expected)
+		}
+	}
+}
+
+func TestS3StoreSetStorageClass(t *testing.T) {
+	store, server := newTestS3Store(t, true, map[string]string{
+		objectstore.ObjectLockModeParameter:      string(minio.Governance),
+		objectstore.ObjectLockRetentionParameter: "1d",
+	})
+
+	putTestObject(t, store, "cluster/wals/000000010000000000000001", "content")
+	original, _ := server.GetObject("cluster/wals/000000010000000000000001")
+
+	if err := store.SetStorageClass(context.Background(), "cluster/wals/000000010000000000000001", "GLACIER"); err != nil {
+		t.Fatalf("unexpected error setting the storage class: %v", err)
+	}
+
+	// The storage class is changed, while the metadata
+	// and the tags of the object are copied
+	object, _ := server.GetObject("cluster/wals/000000010000000000000001")
+	if object.StorageClass != "GLACIER" {
+		t.Fatalf("unexpected storage class %q", object.StorageClass)
+	}
+	if object.ContentType != original.ContentType {
+		t.Fatalf("unexpected content type %q, expected %q", object.ContentType, original.ContentType)
+	}
+	if object.Tags.Encode() != original.Tags.Encode() {
+		t.Fatalf("unexpected tags %v, expected %v", object.Tags, original.Tags)
+	}
+	if object.LockMode != string(minio.Governance) || object.RetainUntilDate.IsZero() {
+		t.Fatalf("expected the retention to be applied, got %q until %s", object.LockMode, object.RetainUntilDate)
+	}
+
+	err := store.Get(context.Background(), "cluster/wals/000000010000000000000001", path.Join(t.TempDir(), "wal"))
+	if !errors.Is(err, ErrObjectArchived) {
+		t.Fatalf("expected ErrObjectArchived, got %v", err)
+	}
+}
+
+func TestS3StoreConditionalWrites(t *testing.T) {
+	store, server := newTestS3Store(t, true, map[string]string{
+		objectstore.ObjectLockModeParameter:      "GOVERNANCE",
+		objectstore.ObjectLockRetentionParameter: "1d",
+	})
+
+	// Conditional writes are presigned, which needs credentials
+	t.Setenv("AWS_ACCESS_KEY_ID", "access-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret-key")
+
+	checkConditionalWrites(t, store, "cluster/locks/backup.json")
+
+	// The conditional writes are locked and tagged like the other uploads
+	object, _ := server.GetObject("cluster/locks/backup.json")
+	if object.LockMode != "GOVERNANCE" || object.Tags.Get(TagCluster) != "cluster" {
+		t.Fatalf("unexpected object lock mode %q and tags %v", object.LockMode, object.Tags)
+	}
+}
+
+func TestS3StoreThrottledConditionalWrites(t *testing.T) {
+	_, server := newTestS3Store(t, false, nil)
+
+	// Conditional writes are presigned, which needs credentials
+	t.Setenv("AWS_ACCESS_KEY_ID", "access-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret-key")
+
+	parameters := server.Parameters(map[string]string{throttling.BackupUploadLimitParameter: "1Mi"})
+	configuration, err := objectstore.NewConfigurationFromParameters(parameters)
+	if err != nil {
+		t.Fatalf("unexpected error reading the configuration: %v", err)
+	}
+	throttlingConfiguration, err := throttling.NewConfigurationFromParameters(parameters)
+	if err != nil {
+		t.Fatalf("unexpected error reading the throttling configuration: %v", err)
+	}
+
+	store, err := NewThrottledS3Store(string(DestinationS3), configuration, throttlingConfiguration, throttling.BudgetBackup)
+	if err != nil {
+		t.Fatalf("unexpected error creating the store: %v", err)
+	}
+
+	checkConditionalWrites(t, store, "cluster/locks/backup.json")
+}
@@ -0,0 +1,555 @@
+// Package s3test provides an in-memory S3 server, implementing the
+// subset of the API used by the stores, to be used in tests
+package s3test
+
+import (
+	"crypto/md5" // nolint:gosec
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/objectstore"
+)
+
+const (
+	// Bucket is the name of the bucket served by the server
+	Bucket = "backups"
+
+	// Region is the region of the bucket
+	Region = "us-east-1"
+
+	// defaultStorageClass is the storage class of the
+	// objects uploaded without an explicit one
+	defaultStorageClass = "STANDARD"
+)
+
+// archiveStorageClasses are the storage classes whose
+// objects cannot be read without being rehydrated
+var archiveStorageClasses = map[string]bool{
+	"GLACIER":      true,
+	"DEEP_ARCHIVE": true,
+}
+
+// Object is an object stored in the bucket
+type Object struct {
+	// Content is the content of the object
+	Content []byte
+
+	// ETag is the MD5 of the content
+	ETag string
+
+	// LastModified is when the object has been written
+	LastModified time.Time
+
+	// StorageClass is the storage class of the object
+	StorageClass string
+
+	// Tags are the tags of the object
+	Tags url.Values
+
+	// ContentType is the content type of the object
+	ContentType string
+
+	// LockMode is the object lock retention mode, empty
+	// when the object is not locked
+	LockMode string
+
+	// RetainUntilDate is when the object lock retention expires
+	RetainUntilDate time.Time
+}
+
+// Server is an in-memory S3 server with a single bucket
+type Server struct {
+	*httptest.Server
+
+	// ObjectLock enables object lock on the bucket
+	ObjectLock bool
+
+	// DenyLockedDeletions rejects the batch deletions of the objects
+	// whose retention has not expired, as some S3 compatible stores
+	// do instead of adding a delete marker
+	DenyLockedDeletions bool
+
+	mutex    sync.Mutex
+	objects  map[string]*Object
+	requests map[string]int
+}
+
+// NewServer starts an in-memory S3 server, which
+// needs to be closed when it is not used anymore
+func NewServer() *Server {
+	result := &Server{
+		objects:  make(map[string]*Object),
+		requests: make(map[string]int),
+	}
+	result.Server = httptest.NewServer(http.HandlerFunc(result.serveHTTP))
+	return result
+}
+
+// Parameters gets the plugin parameters configuring the
+// bucket of the server, together with a set of additional ones
+func (server *Server) Parameters(additional map[string]string) map[string]string {
+	result := map[string]string{
+		objectstore.BucketParameter:   Bucket,
+		objectstore.EndpointParameter: server.URL,
+		objectstore.RegionParameter:   Region,
+	}
+	for key, value := range additional {
+		result[key] = value
+	}
+
+	return result
+}
+
+// SetObject stores an object, computing its ETag
+func (server *Server) SetObject(key string, object Object) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	object.ETag = getETag(object.Content)
+	if len(object.StorageClass) == 0 {
+		object.StorageClass = defaultStorageClass
+	}
+	if object.LastModified.IsZero() {
+		object.LastModified = time.Now()
+	}
+	server.objects[key] = &object
+}
+
+// GetObject gets a copy of a stored object
+func (server *Server) GetObject(key string) (Object, bool) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	object, ok := server.objects[key]
+	if !ok {
+		return Object{}, false
+	}
+	return *object, true
+}
+
+// Keys gets the keys of the stored objects, sorted
+func (server *Server) Keys() []string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	result := make([]string, 0, len(server.objects))
+	for key := range server.objects {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Requests gets the number of requests received for an
+// operation, named like in the S3 API, i.e. "GetObjectRetention"
+func (server *Server) Requests(operation string) int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return server.requests[operation]
+}
+
+// ResetRequests resets the number of requests received
+func (server *Server) ResetRequests() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.requests = make(map[string]int)
+}
+
+func (server *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != Bucket {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+
+	// The parameters of the presigned requests are not operations
+	query := r.URL.Query()
+	for name := range query {
+		if strings.HasPrefix(name, "X-Amz-") {
+			query.Del(name)
+		}
+	}
+
+	switch {
+	case len(key) == 0 && r.Method == http.MethodGet && query.Has("list-type"):
+		server.listObjects(w, query)
+	case len(key) == 0 && r.Method == http.MethodPost && query.Has("delete"):
+		server.deleteObjects(w, r)
+	case len(key) == 0:
+		writeError(w, http.StatusNotImplemented, "NotImplemented", "Bucket operation not implemented")
+	case r.Method == http.MethodGet && query.Has("retention"):
+		server.getObjectRetention(w, key)
+	case r.Method == http.MethodPut && len(r.Header.Get("X-Amz-Copy-Source")) > 0:
+		server.copyObject(w, r, key)
+	case r.Method == http.MethodPut && len(query) == 0:
+		server.putObject(w, r, key)
+	case r.Method == http.MethodGet && len(query) == 0:
+		server.getObject(w, r, key, true)
+	case r.Method == http.MethodHead:
+		server.getObject(w, r, key, false)
+	case r.Method == http.MethodDelete:
+		server.deleteObject(w, key)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented", "Object operation not implemented")
+	}
+}
+
+func (server *Server) putObject(w http.ResponseWriter, r *http.Request, key string) {
+	server.requests["PutObject"]++
+
+	content, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+
+	existing, exists := server.objects[key]
+	if ifNoneMatch := r.Header.Get("If-None-Match"); len(ifNoneMatch) > 0 {
+		if ifNoneMatch != "*" {
+			writeError(w, http.StatusNotImplemented, "NotImplemented",
+				"A header you provided implies functionality that is not implemented")
+			return
+		}
+		if exists {
+			writeError(w, http.StatusPreconditionFailed, "PreconditionFailed",
+				"At least one of the pre-conditions you specified did not hold")
+			return
+		}
+	}
+	if ifMatch := r.Header.Get("If-Match"); len(ifMatch) > 0 {
+		if !exists {
+			writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		if strings.Trim(ifMatch, "\"") != existing.ETag {
+			writeError(w, http.StatusPreconditionFailed, "PreconditionFailed",
+				"At least one of the pre-conditions you specified did not hold")
+			return
+		}
+	}
+
+	object := &Object{
+		Content:      content,
+		ETag:         getETag(content),
+		LastModified: time.Now(),
+		StorageClass: defaultStorageClass,
+		ContentType:  r.Header.Get("Content-Type"),
+	}
+	if err := server.setHeaders(object, r.Header); err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequest", err.Error())
+		return
+	}
+	server.objects[key] = object
+
+	w.Header().Set("ETag", "\""+object.ETag+"\"")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (server *Server) copyObject(w http.ResponseWriter, r *http.Request, key string) {
+	server.requests["CopyObject"]++
+
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", err.Error())
+		return
+	}
+	sourceBucket, sourceKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+	sourceObject, ok := server.objects[sourceKey]
+	if sourceBucket != Bucket || !ok {
+		writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+
+	object := *sourceObject
+	object.LastModified = time.Now()
+	object.LockMode = ""
+	object.RetainUntilDate = time.Time{}
+	if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+		object.ContentType = r.Header.Get("Content-Type")
+	}
+	if storageClass := r.Header.Get("X-Amz-Storage-Class"); len(storageClass) > 0 {
+		object.StorageClass = storageClass
+	}
+
+	// Copying an object over itself is only allowed
+	// when something other than its content changes
+	if sourceKey == key && object.StorageClass == sourceObject.StorageClass &&
+		r.Header.Get("X-Amz-Metadata-Directive") != "REPLACE" {
+		writeError(w, http.StatusBadRequest, "InvalidRequest",
+			"This copy request is illegal because it is trying to copy an object to itself "+
+				"without changing the object's metadata, storage class, website redirect "+
+				"location or encryption attributes.")
+		return
+	}
+
+	if err := server.setHeaders(&object, r.Header); err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequest", err.Error())
+		return
+	}
+	server.objects[key] = &object
+
+	writeXML(w, http.StatusOK, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		ETag         string   `xml:"ETag"`
+		LastModified string   `xml:"LastModified"`
+	}{
+		ETag:         "\"" + object.ETag + "\"",
+		LastModified: object.LastModified.UTC().Format(time.RFC3339),
+	})
+}
+
+// setHeaders applies to an object the storage class,
+// the tags and the retention of a write request
+func (server *Server) setHeaders(object *Object, header http.Header) error {
+	if storageClass := header.Get("X-Amz-Storage-Class"); len(storageClass) > 0 {
+		object.StorageClass = storageClass
+	}
+
+	if tagging := header.Get("X-Amz-Tagging"); len(tagging) > 0 {
+		tags, err := url.ParseQuery(tagging)
+		if err != nil {
+			return err
+		}
+		object.Tags = tags
+	}
+
+	if lockMode := header.Get("X-Amz-Object-Lock-Mode"); len(lockMode) > 0 {
+		if !server.ObjectLock {
+			return fmt.Errorf("bucket is missing Object Lock Configuration")
+		}
+
+		retainUntilDate, err := time.Parse(time.RFC3339, header.Get("X-Amz-Object-Lock-Retain-Until-Date"))
+		if err != nil {
+			return err
+		}
+		object.LockMode = lockMode
+		object.RetainUntilDate = retainUntilDate
+	}
+
+	return nil
+}
+
+func (server *Server) getObject(w http.ResponseWriter, r *http.Request, key string, withContent bool) {
+	if withContent {
+		server.requests["GetObject"]++
+	} else {
+		server.requests["HeadObject"]++
+	}
+
+	object, ok := server.objects[key]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+
+	if withContent && archiveStorageClasses[object.StorageClass] {
+		writeError(w, http.StatusForbidden, "InvalidObjectState",
+			"The operation is not valid for the object's storage class")
+		return
+	}
+
+	content := object.Content
+	status := http.StatusOK
+	if rangeHeader := r.Header.Get("Range"); withContent && len(rangeHeader) > 0 {
+		start, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rangeHeader, "bytes="), "-"))
+		if err != nil || start > len(content) {
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable")
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(content)-1, len(content)))
+		content = content[start:]
+		status = http.StatusPartialContent
+	}
+
+	w.Header().Set("ETag", "\""+object.ETag+"\"")
+	w.Header().Set("Last-Modified", object.LastModified.UTC().Format(http.TimeFormat))
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	w.Header().Set("Accept-Ranges", "bytes")
+	if len(object.ContentType) > 0 {
+		w.Header().Set("Content-Type", object.ContentType)
+	}
+	if object.StorageClass != defaultStorageClass {
+		w.Header().Set("X-Amz-Storage-Class", object.StorageClass)
+	}
+	w.WriteHeader(status)
+	if withContent {
+		_, _ = w.Write(content)
+	}
+}
+
+func (server *Server) getObjectRetention(w http.ResponseWriter, key string) {
+	server.requests["GetObjectRetention"]++
+
+	if !server.ObjectLock {
+		writeError(w, http.StatusBadRequest, "InvalidRequest", "Bucket is missing Object Lock Configuration")
+		return
+	}
+
+	object, ok := server.objects[key]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+		return
+	}
+	if len(object.LockMode) == 0 {
+		writeError(w, http.StatusNotFound, "NoSuchObjectLockConfiguration",
+			"The specified object does not have a ObjectLock configuration")
+		return
+	}
+
+	writeXML(w, http.StatusOK, struct {
+		XMLName         xml.Name `xml:"Retention"`
+		Mode            string   `xml:"Mode"`
+		RetainUntilDate string   `xml:"RetainUntilDate"`
+	}{
+		Mode:            object.LockMode,
+		RetainUntilDate: object.RetainUntilDate.UTC().Format(time.RFC3339),
+	})
+}
+
+func (server *Server) deleteObject(w http.ResponseWriter, key string) {
+	server.requests["DeleteObject"]++
+
+	// Deleting a locked object without a version only
+	// adds a delete marker, hiding the object
+	delete(server.objects, key)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (server *Server) deleteObjects(w http.ResponseWriter, r *http.Request) {
+	server.requests["DeleteObjects"]++
+
+	var request struct {
+		Objects []struct {
+			Key string `xml:"Key"`
+		} `xml:"Object"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+
+	type deleted struct {
+		Key string `xml:"Key"`
+	}
+	type deleteError struct {
+		Key     string `xml:"Key"`
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	result := struct {
+		XMLName xml.Name      `xml:"DeleteResult"`
+		Deleted []deleted     `xml:"Deleted"`
+		Errors  []deleteError `xml:"Error"`
+	}{}
+	for _, object := range request.Objects {
+		if stored, ok := server.objects[object.Key]; ok && server.DenyLockedDeletions &&
+			stored.RetainUntilDate.After(time.Now()) {
+			result.Errors = append(result.Errors, deleteError{
+				Key:     object.Key,
+				Code:    "AccessDenied",
+				Message: "Access Denied because object protected by object lock.",
+			})
+			continue
+		}
+		delete(server.objects, object.Key)
+		result.Deleted = append(result.Deleted, deleted{Key: object.Key})
+	}
+
+	writeXML(w, http.StatusOK, result)
+}
+
+func (server *Server) listObjects(w http.ResponseWriter, query url.Values) {
+	server.requests["ListObjects"]++
+
+	type content struct {
+		Key          string `xml:"Key"`
+		LastModified string `xml:"LastModified"`
+		ETag         string `xml:"ETag"`
+		Size         int    `xml:"Size"`
+		StorageClass string `xml:"StorageClass"`
+	}
+	result := struct {
+		XMLName     xml.Name  `xml:"ListBucketResult"`
+		Name        string    `xml:"Name"`
+		Prefix      string    `xml:"Prefix"`
+		KeyCount    int       `xml:"KeyCount"`
+		MaxKeys     int       `xml:"MaxKeys"`
+		IsTruncated bool      `xml:"IsTruncated"`
+		Contents    []content `xml:"Contents"`
+	}{
+		Name:    Bucket,
+		Prefix:  query.Get("prefix"),
+		MaxKeys: 1000,
+	}
+
+	keys := make([]string, 0, len(server.objects))
+	for key := range server.objects {
+		if strings.HasPrefix(key, result.Prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		object := server.objects[key]
+		result.Contents = append(result.Contents, content{
+			Key:          key,
+			LastModified: object.LastModified.UTC().Format("2006-01-02T15:04:05.000Z"),
+			ETag:         "\"" + object.ETag + "\"",
+			Size:         len(object.Content),
+			StorageClass: object.StorageClass,
+		})
+	}
+	result.KeyCount = len(result.Contents)
+
+	writeXML(w, http.StatusOK, result)
+}
+
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	writeXML(w, status, struct {
+		XMLName   xml.Name `xml:"Error"`
+		Code      string   `xml:"Code"`
+		Message   string   `xml:"Message"`
+		RequestID string   `xml:"RequestId"`
+	}{
+		Code:      code,
+		Message:   message,
+		RequestID: "s3test",
+	})
+}
+
+func writeXML(w http.ResponseWriter, status int, value interface{}) {
+	content, err := xml.Marshal(value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Content-Length", strconv.Itoa(len(xml.Header)+len(content)))
+	w.WriteHeader(status)
+	if status != http.StatusNoContent {
+		_, _ = io.WriteString(w, xml.Header)
+		_, _ = w.Write(content)
+	}
+}
+
+func getETag(content []byte) string {
+	sum := md5.Sum(content) // nolint:gosec
+	return hex.EncodeToString(sum[:])
+}
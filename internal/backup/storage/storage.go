@@ -3,9 +3,14 @@ package storage
 import "path"
 
 const (
-	basePath      = "/backup"
-	walsDirectory = "wals"
-	baseDirectory = "base"
+	basePath           = "/backup"
+	walsDirectory      = "wals"
+	baseDirectory      = "base"
+	catalogDirectory   = "catalog"
+	locksDirectory     = "locks"
+	manifestsDirectory = "manifests"
+	stateDirectory     = ".backup-state"
+	progressFile       = "backup-progress.json"
 )
 
 func getWalPrefix(walName string) string {
@@ -18,15 +23,81 @@ func getClusterPath(clusterName string) string {
 	return path.Join(basePath, clusterName)
 }
 
-// GetWALPath gets the path where the WALs relative
-// to a cluster are stored
-func GetWALPath(clusterName string) string {
+// GetWALKey gets the key prefix under which the WALs
+// relative to a cluster are stored
+func GetWALKey(clusterName string) string {
 	return path.Join(
-		getClusterPath(clusterName),
+		clusterName,
 		walsDirectory,
 	)
 }
 
+// GetWALFileKey gets the key under which a certain
+// WAL file is stored
+func GetWALFileKey(clusterName string, walName string) string {
+	return path.Join(
+		GetWALKey(clusterName),
+		getWalPrefix(walName),
+		walName,
+	)
+}
+
+// GetBaseKey gets the key prefix under which the base
+// backups relative to a cluster are stored
+func GetBaseKey(clusterName string) string {
+	return path.Join(
+		clusterName,
+		baseDirectory,
+	)
+}
+
+// GetCatalogKey gets the key prefix under which the
+// catalog of the backups of a cluster is stored
+func GetCatalogKey(clusterName string) string {
+	return path.Join(
+		clusterName,
+		catalogDirectory,
+	)
+}
+
+// GetCatalogEntryKey gets the key under which the catalog
+// entry of a certain backup is stored
+func GetCatalogEntryKey(clusterName string, backupName string) string {
+	return path.Join(
+		GetCatalogKey(clusterName),
+		backupName+".json",
+	)
+}
+
+// GetManifestsKey gets the key prefix under which the
+// backup manifests of a cluster are stored
+func GetManifestsKey(clusterName string) string {
+	return path.Join(
+		clusterName,
+		manifestsDirectory,
+	)
+}
+
+// GetBackupManifestKey gets the key under which the
+// backup manifest of a certain backup is stored
+func GetBackupManifestKey(clusterName string, backupName string) string {
+	return path.Join(
+		GetManifestsKey(clusterName),
+		backupName,
+		"backup_manifest",
+	)
+}
+
+// GetLockKey gets the key under which a lock
+// on the archive of a cluster is stored
+func GetLockKey(clusterName string, lockName string) string {
+	return path.Join(
+		clusterName,
+		locksDirectory,
+		lockName+".json",
+	)
+}
+
 // GetKopiaConfigFilePath gets the path where the
 // kopia configuration file will be written
 func GetKopiaConfigFilePath(clusterName string) string {
@@ -45,21 +116,38 @@ func GetKopiaCacheDirectory(clusterName string) string {
 	)
 }
 
-// GetBasePath gets the path where the WALs relative
-// to a cluster are stored
-func GetBasePath(clusterName string) string {
+// GetBackupStateDirectory gets the path where the progress
+// of the backups being taken is recorded inside the PVC
+func GetBackupStateDirectory(clusterName string) string {
 	return path.Join(
 		getClusterPath(clusterName),
-		baseDirectory,
+		stateDirectory,
 	)
 }
 
-// GetWALFilePath gets the path where a certain WAL file
-// should be stored
-func GetWALFilePath(clusterName string, walName string) string {
+// GetBackupStatePath gets the path of the file where the
+// progress of a certain backup is recorded inside the PVC
+func GetBackupStatePath(clusterName string, backupName string) string {
 	return path.Join(
-		GetWALPath(clusterName),
-		getWalPrefix(walName),
-		walName,
+		GetBackupStateDirectory(clusterName),
+		backupName+".json",
+	)
+}
+
+// GetBackupProgressPath gets the path of the status file where
+// the progress of the last backup is reported inside the PVC
+func GetBackupProgressPath(clusterName string) string {
+	return path.Join(
+		getClusterPath(clusterName),
+		progressFile,
+	)
+}
+
+// GetBasePath gets the path where the base backups
+// relative to a cluster are stored inside the PVC
+func GetBasePath(clusterName string) string {
+	return path.Join(
+		basePath,
+		GetBaseKey(clusterName),
 	)
 }
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/objectstore"
+)
+
+var (
+	// ErrObjectNotFound is raised when an object is not in a store
+	ErrObjectNotFound = errors.New("object not found")
+
+	// ErrObjectLocked is raised when deleting an object whose
+	// object lock retention has not expired yet
+	ErrObjectLocked = errors.New("object locked")
+
+	// ErrObjectArchived is raised when reading an object that has
+	// been moved to an archive storage class and needs to be
+	// rehydrated before being read
+	ErrObjectArchived = errors.New("object archived, needs rehydration")
+
+	// ErrPreconditionFailed is raised by a conditional write when
+	// the object has been changed since it has been read
+	ErrPreconditionFailed = errors.New("precondition failed")
+)
+
+// Store is a place where the archived objects are kept. Objects
+// are identified by a key, which is a slash separated path
+// relative to the root of the store
+type Store interface {
+	// Name gets the name of the destination this store implements
+	Name() string
+
+	// Put copies a local file into the store
+	Put(ctx context.Context, key string, sourcePath string, options PutOptions) error
+
+	// Get copies an object from the store into a local file
+	Get(ctx context.Context, key string, destinationPath string) error
+
+	// GetVersion copies an object from the store into a local file,
+	// returning the version of its content, i.e. its ETag
+	GetVersion(ctx context.Context, key string, destinationPath string) (string, error)
+
+	// PutIfVersion copies a local file into the store only if the
+	// object still has a certain version, or doesn't exist when the
+	// version is empty, raising ErrPreconditionFailed otherwise. It
+	// returns the version of the object which has been written
+	PutIfVersion(
+		ctx context.Context,
+		key string,
+		sourcePath string,
+		version string,
+		options PutOptions,
+	) (string, error)
+
+	// Exists checks if an object is in the store
+	Exists(ctx context.Context, key string) (bool, error)
+
+	// List gets the list of the objects whose key starts
+	// with a prefix, sorted by key
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+
+	// Delete removes an object from the store. Deleting an object
+	// which doesn't exist is not an error
+	Delete(ctx context.Context, key string) error
+
+	// DeleteMany removes a set of objects from the store, in as few
+	// requests as possible. Their object lock retention is not checked,
+	// and the callers skip the listed objects which are still locked.
+	// The objects the store refuses to delete as they are still locked
+	// are kept without an error, as their retention may be longer than
+	// the listed one. Deleting objects which don't exist is not an error
+	DeleteMany(ctx context.Context, keys []string) error
+
+	// SetStorageClass moves an object to a different storage
+	// class. Stores not supporting storage classes ignore it
+	SetStorageClass(ctx context.Context, key string, storageClass string) error
+}
+
+// PutOptions are the options of an object being stored
+type PutOptions struct {
+	// Type is the type of the object, selecting its storage class
+	Type objectstore.ObjectType
+
+	// Tags are the tags applied to the object
+	Tags map[string]string
+}
+
+// ObjectInfo is the information about a stored object
+type ObjectInfo struct {
+	// Key is the key of the object
+	Key string
+
+	// LastModified is when the object has been written
+	LastModified time.Time
+
+	// StorageClass is the storage class of the object, empty when
+	// the store doesn't support storage classes
+	StorageClass string
+
+	// RetainUntilDate is when the object lock retention of the object
+	// expires, zero when the store doesn't lock the objects. It is
+	// computed from the retention the store applies to the uploads,
+	// which may have been different when the object was written
+	RetainUntilDate time.Time
+}
+
+// IsLocked checks if the object lock retention of
+// an object has not expired at a certain time
+func (info *ObjectInfo) IsLocked(now time.Time) bool {
+	return info.RetainUntilDate.After(now)
+}
+
+const (
+	// TagCluster is the tag containing the name of the cluster
+	TagCluster = "cluster"
+
+	// TagNamespace is the tag containing the namespace of the cluster
+	TagNamespace = "namespace"
+
+	// TagBackup is the tag containing the name of the backup
+	TagBackup = "backup"
+
+	// TagType is the tag containing the type of the object
+	TagType = "type"
+)
+
+// NewPutOptions creates the options of an object belonging to
+// a cluster, tagging it with the cluster name, namespace and type
+func NewPutOptions(clusterName string, namespace string, objectType objectstore.ObjectType) PutOptions {
+	return PutOptions{
+		Type: objectType,
+		Tags: map[string]string{
+			TagCluster:   clusterName,
+			TagNamespace: namespace,
+			TagType:      string(objectType),
+		},
+	}
+}
+
+// WithBackupName adds the name of the backup the object belongs to
+func (options PutOptions) WithBackupName(backupName string) PutOptions {
+	tags := make(map[string]string, len(options.Tags)+1)
+	for key, value := range options.Tags {
+		tags[key] = value
+	}
+	tags[TagBackup] = backupName
+
+	return PutOptions{
+		Type: options.Type,
+		Tags: tags,
+	}
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/objectstore"
+)
+
+// checkConditionalWrites checks that the conditional writes of
+// a store only succeed when the object has the expected version
+func checkConditionalWrites(t *testing.T, store Store, key string) {
+	t.Helper()
+	ctx := context.Background()
+	directory := t.TempDir()
+	options := NewPutOptions("cluster", "default", objectstore.ObjectTypeManifest)
+
+	putIfVersion := func(content string, version string) (string, error) {
+		sourcePath := path.Join(directory, "source")
+		if err := os.WriteFile(sourcePath, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return store.PutIfVersion(ctx, key, sourcePath, version, options)
+	}
+
+	if _, err := store.GetVersion(ctx, key, path.Join(directory, "missing")); !errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("expected ErrObjectNotFound, got %v", err)
+	}
+
+	// An empty version creates the object only if it doesn't exist
+	first, err := putIfVersion("first", "")
+	if err != nil {
+		t.Fatalf("unexpected error creating the object: %v", err)
+	}
+	if _, err := putIfVersion("concurrent", ""); !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("expected the object not to be created twice, got %v", err)
+	}
+
+	destinationPath := path.Join(directory, "destination")
+	version, err := store.GetVersion(ctx, key, destinationPath)
+	if err != nil {
+		t.Fatalf("unexpected error reading the object: %v", err)
+	}
+	if content, _ := os.ReadFile(destinationPath); string(content) != "first" || version != first {
+		t.Fatalf("unexpected content %q with version %q, expected version %q", content, version, first)
+	}
+
+	// The object is only replaced when it has not changed since it has been read
+	second, err := putIfVersion("second", first)
+	if err != nil {
+		t.Fatalf("unexpected error replacing the object: %v", err)
+	}
+	if second == first {
+		t.Fatal("expected the version to change")
+	}
+	if _, err := putIfVersion("stale", first); !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("expected the stale version to be rejected, got %v", err)
+	}
+
+	if version, err := store.GetVersion(ctx, key, destinationPath); err != nil || version != second {
+		t.Fatalf("unexpected version %q, expected %q: %v", version, second, err)
+	}
+	if content, _ := os.ReadFile(destinationPath); string(content) != "second" {
+		t.Fatalf("unexpected content %q", content)
+	}
+}
+
+func TestFilesystemStoreConditionalWrites(t *testing.T) {
+	checkConditionalWrites(t, &filesystemStore{root: t.TempDir()}, "cluster/locks/backup.json")
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/provider"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/objectstore"
+)
+
+// BackupTarget is the destination keeping the Kopia repository, the
+// catalog, the manifests and the locks of the backups of a cluster
+type BackupTarget struct {
+	// Destination is the destination where the backups are kept
+	Destination Destination
+
+	// Store is the store of the destination
+	Store Store
+
+	// ObjectStore is the configuration of the bucket of
+	// the destination, nil when it is the PVC
+	ObjectStore *objectstore.Configuration
+}
+
+// GetBackupDestination gets the destination where the backups are
+// kept. The bucket is preferred when it is a destination, otherwise
+// the first configured destination is used. The backups are
+// replicated into every other destination
+func GetBackupDestination(destinations []Destination) Destination {
+	if slices.Contains(destinations, DestinationS3) {
+		return DestinationS3
+	}
+
+	return destinations[0]
+}
+
+// NewBackupTargetFromParameters creates the backup target
+// from the destinations configured in the plugin parameters
+func NewBackupTargetFromParameters(parameters map[string]string) (*BackupTarget, error) {
+	destinations, _, err := GetDestinationsFromParameters(parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewBackupTarget(GetBackupDestination(destinations), parameters)
+}
+
+// NewBackupReplicasFromParameters creates the backup targets where the
+// backups are replicated, i.e. every configured destination but the
+// one where the backups are kept
+func NewBackupReplicasFromParameters(parameters map[string]string) ([]*BackupTarget, error) {
+	destinations, _, err := GetDestinationsFromParameters(parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	backupDestination := GetBackupDestination(destinations)
+	var result []*BackupTarget
+	for _, destination := range destinations {
+		if destination == backupDestination {
+			continue
+		}
+
+		replica, err := NewBackupTarget(destination, parameters)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, replica)
+	}
+
+	return result, nil
+}
+
+// NewBackupTarget creates the backup target kept in a destination
+func NewBackupTarget(destination Destination, parameters map[string]string) (*BackupTarget, error) {
+	var err error
+	result := &BackupTarget{
+		Destination: destination,
+	}
+	switch result.Destination {
+	case DestinationPVC:
+		result.Store = NewFilesystemStore()
+		return result, nil
+
+	case DestinationS3:
+		result.ObjectStore, err = objectstore.NewConfigurationFromParameters(parameters)
+
+	case DestinationSecondary:
+		result.ObjectStore, err = objectstore.NewConfigurationFromPrefixedParameters(
+			parameters,
+			objectstore.SecondaryPrefix)
+
+	default:
+		return nil, fmt.Errorf("unknown destination: %s", result.Destination)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Store, err = NewS3Store(string(result.Destination), result.ObjectStore); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// GetRepositoryProvider gets the Kopia provider of the repository
+func (target *BackupTarget) GetRepositoryProvider() string {
+	if target.ObjectStore == nil {
+		return provider.Filesystem.String()
+	}
+
+	return provider.S3.String()
+}
+
+// GetRepositoryPath gets the path of the Kopia repository of a
+// cluster, which is a key prefix inside the bucket or a directory
+// inside the PVC
+func (target *BackupTarget) GetRepositoryPath(clusterName string) string {
+	if target.ObjectStore == nil {
+		return GetBasePath(clusterName)
+	}
+
+	return GetBaseKey(clusterName)
+}
@@ -0,0 +1,192 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"time"
+
+	"github.com/cloudnative-pg/cloudnative-pg/pkg/postgres"
+	"github.com/cloudnative-pg/cnpg-i-machinery/pkg/logging"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/catalog"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/storage"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/objectstore"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/wal"
+)
+
+const (
+	// kopiaStorageConfigKey is the name of the blob where Kopia
+	// reads the storage options of the repository
+	kopiaStorageConfigKey = ".storageconfig"
+
+	// kopiaDataPackPrefix is the prefix of the Kopia blobs
+	// containing file data
+	kopiaDataPackPrefix = "p"
+
+	// kopiaMetadataPackPrefix is the prefix of the Kopia blobs
+	// containing directory listings and snapshot manifests
+	kopiaMetadataPackPrefix = "q"
+)
+
+// kopiaStorageConfig is the content of the Kopia storage
+// options blob, used to choose the storage class of each blob
+type kopiaStorageConfig struct {
+	BlobOptions []kopiaBlobOption `json:"blobOptions"`
+}
+
+type kopiaBlobOption struct {
+	Prefix       string `json:"prefix"`
+	StorageClass string `json:"storageClass"`
+}
+
+// writeKopiaStorageConfig instructs Kopia to upload the data packs and
+// the metadata packs with the storage classes of the base backups and
+// of the manifests
+func writeKopiaStorageConfig(
+	ctx context.Context,
+	clusterName string,
+	namespace string,
+	objectStore *objectstore.Configuration,
+	store storage.Store,
+) error {
+	config := kopiaStorageConfig{}
+	for prefix, objectType := range map[string]objectstore.ObjectType{
+		kopiaDataPackPrefix:     objectstore.ObjectTypeBase,
+		kopiaMetadataPackPrefix: objectstore.ObjectTypeManifest,
+	} {
+		if storageClass := objectStore.StorageClasses[objectType]; len(storageClass) > 0 {
+			config.BlobOptions = append(config.BlobOptions, kopiaBlobOption{
+				Prefix:       prefix,
+				StorageClass: storageClass,
+			})
+		}
+	}
+
+	if len(config.BlobOptions) == 0 {
+		return nil
+	}
+
+	content, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	temporaryDirectory, err := os.MkdirTemp("", "storageconfig")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.RemoveAll(temporaryDirectory)
+	}()
+
+	temporaryFile := path.Join(temporaryDirectory, kopiaStorageConfigKey)
+	if err := os.WriteFile(temporaryFile, content, 0o600); err != nil {
+		return err
+	}
+
+	return store.Put(
+		ctx,
+		path.Join(storage.GetBaseKey(clusterName), kopiaStorageConfigKey),
+		temporaryFile,
+		storage.NewPutOptions(clusterName, namespace, objectstore.ObjectTypeManifest),
+	)
+}
+
+// archiveOldObjects moves the WAL files older than the configured
+// threshold to the archive storage class, and marks the backups needing
+// them to reach consistency as archived in the catalog.
+//
+// The Kopia packs are never archived, as they are shared between the
+// snapshots of every backup and Kopia needs them to be readable to
+// maintain the repository. The WAL files needed by the backups taken
+// after the threshold, and the following ones, are kept readable too,
+// so that those backups can be restored without rehydration
+func archiveOldObjects(
+	ctx context.Context,
+	clusterName string,
+	objectStore *objectstore.Configuration,
+	store storage.Store,
+	backupCatalog *catalog.Catalog,
+) error {
+	if objectStore.ArchiveTier == nil {
+		return nil
+	}
+
+	contextLogger := logging.FromContext(ctx)
+	threshold := objectStore.ArchiveTier.GetThreshold()
+	storageClass := objectStore.ArchiveTier.StorageClass
+
+	backups, err := backupCatalog.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	firstReadableWAL := getFirstReadableWAL(backups, threshold)
+	if len(firstReadableWAL) == 0 {
+		// Every backup has been taken before the threshold, and
+		// archiving their WAL files would leave no backup which
+		// can be restored without rehydration
+		contextLogger.V(4).Info("No backup taken after the archive threshold, nothing to archive")
+		return nil
+	}
+
+	objects, err := store.List(ctx, storage.GetWALKey(clusterName))
+	if err != nil {
+		return err
+	}
+
+	for _, object := range objects {
+		walName := path.Base(object.Key)
+		if !postgres.IsWALFile(walName) ||
+			wal.IsWALNeeded(walName, firstReadableWAL) ||
+			object.StorageClass == storageClass ||
+			!object.LastModified.Before(threshold) {
+			continue
+		}
+
+		contextLogger.V(4).Info("Moving WAL file to the archive tier", "key", object.Key)
+		if err := store.SetStorageClass(ctx, object.Key, storageClass); err != nil {
+			return err
+		}
+	}
+
+	for i := range backups {
+		if backups[i].Tier == catalog.TierArchive ||
+			!backups[i].StoppedAt.Before(threshold) ||
+			len(backups[i].EndWal) == 0 ||
+			wal.IsWALNeeded(backups[i].EndWal, firstReadableWAL) {
+			continue
+		}
+
+		contextLogger.Info("Marking backup as archived", "backupName", backups[i].BackupName)
+		archivedAt := time.Now()
+		backups[i].Tier = catalog.TierArchive
+		backups[i].ArchivedAt = &archivedAt
+		if err := backupCatalog.Put(ctx, &backups[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getFirstReadableWAL gets the first WAL file needed by the completed
+// backups taken after the threshold, which is empty when there is none
+func getFirstReadableWAL(backups []catalog.BackupInfo, threshold time.Time) string {
+	result := ""
+	for i := range backups {
+		if backups[i].Phase != catalog.PhaseCompleted ||
+			backups[i].StoppedAt.Before(threshold) ||
+			len(backups[i].BeginWal) == 0 {
+			continue
+		}
+
+		if len(result) == 0 || !wal.IsWALNeeded(backups[i].BeginWal, result) {
+			result = backups[i].BeginWal
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,111 @@
+package backup
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/catalog"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/storage"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/storage/s3test"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/objectstore"
+)
+
+func TestArchiveOldObjects(t *testing.T) {
+	store, objectStore, server := newTestS3Store(t, map[string]string{
+		objectstore.ArchiveStorageClassParameter: "GLACIER",
+		objectstore.ArchiveAfterParameter:        "30d",
+	})
+
+	ctx := context.Background()
+	old := time.Now().Add(-60 * 24 * time.Hour)
+	recent := time.Now().Add(-24 * time.Hour)
+
+	backupCatalog := catalog.New("cluster", "default", store)
+	for _, backupInfo := range []catalog.BackupInfo{
+		{
+			BackupName: "old",
+			Phase:      catalog.PhaseCompleted,
+			Online:     true,
+			StoppedAt:  old,
+			BeginWal:   "000000010000000000000002",
+			EndWal:     "000000010000000000000003",
+			Tier:       catalog.TierStandard,
+		},
+		{
+			BackupName: "recent",
+			Phase:      catalog.PhaseCompleted,
+			Online:     true,
+			StoppedAt:  recent,
+			BeginWal:   "000000010000000000000006",
+			EndWal:     "000000010000000000000007",
+			Tier:       catalog.TierStandard,
+		},
+	} {
+		if err := backupCatalog.Put(ctx, &backupInfo); err != nil {
+			t.Fatalf("unexpected error writing the catalog: %v", err)
+		}
+	}
+
+	// The WAL files needed by the recent backup are old too, as
+	// they have been written before the threshold
+	objects := map[string]time.Time{
+		storage.GetWALFileKey("cluster", "000000010000000000000002"): old,
+		storage.GetWALFileKey("cluster", "000000010000000000000005"): old,
+		storage.GetWALFileKey("cluster", "000000010000000000000006"): old,
+		storage.GetWALFileKey("cluster", "000000010000000000000007"): recent,
+		storage.GetWALFileKey("cluster", "00000002.history"):         old,
+		storage.GetBaseKey("cluster") + "/p0123456789":               old,
+	}
+	for key, lastModified := range objects {
+		server.SetObject(key, s3test.Object{Content: []byte(key), LastModified: lastModified})
+	}
+
+	if err := archiveOldObjects(ctx, "cluster", objectStore, store, backupCatalog); err != nil {
+		t.Fatalf("unexpected error archiving the objects: %v", err)
+	}
+
+	archived := map[string]bool{
+		storage.GetWALFileKey("cluster", "000000010000000000000002"): true,
+		storage.GetWALFileKey("cluster", "000000010000000000000005"): true,
+	}
+	for key := range objects {
+		object, _ := server.GetObject(key)
+		if isArchived := object.StorageClass == "GLACIER"; isArchived != archived[key] {
+			t.Errorf("unexpected storage class %q of %s", object.StorageClass, key)
+		}
+	}
+
+	for backupName, needsRehydration := range map[string]bool{"old": true, "recent": false} {
+		backupInfo, err := backupCatalog.Get(ctx, backupName)
+		if err != nil {
+			t.Fatalf("unexpected error reading the catalog: %v", err)
+		}
+		if backupInfo.NeedsRehydration() != needsRehydration {
+			t.Errorf("unexpected tier %q of backup %s", backupInfo.Tier, backupName)
+		}
+	}
+}
+
+func TestArchiveOldObjectsWithoutRecentBackups(t *testing.T) {
+	backups := []catalog.BackupInfo{
+		{
+			BackupName: "old",
+			Phase:      catalog.PhaseCompleted,
+			StoppedAt:  time.Now().Add(-60 * 24 * time.Hour),
+			BeginWal:   "000000010000000000000002",
+		},
+		{
+			BackupName: "aborted",
+			Phase:      catalog.PhaseAborted,
+			StoppedAt:  time.Now(),
+			BeginWal:   "000000010000000000000004",
+		},
+	}
+
+	// Archiving the WAL files of the old backup would leave
+	// no backup which can be restored without rehydration
+	if result := getFirstReadableWAL(backups, time.Now().Add(-30*24*time.Hour)); len(result) != 0 {
+		t.Fatalf("expected no WAL file, got %s", result)
+	}
+}
@@ -0,0 +1,60 @@
+package verify
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+// NewCmd creates the command verifying a backup against its manifest.
+// It is meant to be run inside the sidecar, where the Kopia password
+// is available
+func NewCmd() *cobra.Command {
+	var (
+		clusterName string
+		namespace   string
+		backupName  string
+		parameters  map[string]string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "verify",
+		Short: "Verify a backup against its manifest",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			result, err := Backup(cmd.Context(), clusterName, namespace, backupName, parameters)
+			if err != nil {
+				return err
+			}
+
+			for _, skippedFile := range result.SkippedFiles {
+				cmd.Printf("%s is not stored in the object store, skipped\n", skippedFile)
+			}
+			for _, problem := range result.Problems {
+				cmd.Println(problem)
+			}
+			if result.NeedsRehydration {
+				cmd.Printf("the WAL files needed to recover backup %s are in the archive tier, "+
+					"and need to be rehydrated before restoring it\n", backupName)
+			}
+
+			if !result.Succeeded() {
+				return fmt.Errorf("backup %s failed verification with %d problems", backupName, len(result.Problems))
+			}
+
+			cmd.Printf("backup %s successfully verified, %d files checked\n", backupName, result.VerifiedFiles)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&clusterName, "cluster-name", "", "The name of the cluster")
+	cmd.Flags().StringVar(&namespace, "namespace", "", "The namespace of the cluster")
+	cmd.Flags().StringVar(&backupName, "backup-name", "", "The name of the backup to be verified")
+	cmd.Flags().StringToStringVar(&parameters, "parameters", nil,
+		"The plugin parameters configuring the object store, i.e. bucket=backups,region=us-east-1")
+	for _, name := range []string{"cluster-name", "namespace", "backup-name", "parameters"} {
+		_ = cmd.MarkFlagRequired(name)
+	}
+
+	return cmd
+}
@@ -0,0 +1,185 @@
+// Package verify checks the content of a backup against its
+// manifest, with the same guarantees as pg_verifybackup
+package verify
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"sort"
+
+	"github.com/cloudnative-pg/cnpg-i-machinery/pkg/logging"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/catalog"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/executor"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/manifest"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/repository"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/storage"
+)
+
+// Result is the outcome of the verification of a backup
+type Result struct {
+	// VerifiedFiles is the number of files whose size
+	// and checksum match the manifest
+	VerifiedFiles int
+
+	// SkippedFiles are the files of the manifest which
+	// are not stored in the object store
+	SkippedFiles []string
+
+	// Problems are the differences found between
+	// the backup and its manifest
+	Problems []string
+
+	// NeedsRehydration is true when the WAL files needed to recover
+	// the backup are in the archive tier, and need to be rehydrated
+	// before the backup can be restored
+	NeedsRehydration bool
+}
+
+// Succeeded is true when no problem has been found
+func (result *Result) Succeeded() bool {
+	return len(result.Problems) == 0
+}
+
+func (result *Result) addProblem(format string, args ...any) {
+	result.Problems = append(result.Problems, fmt.Sprintf(format, args...))
+}
+
+// Backup reads the snapshots of a backup from the repository,
+// checking that every file matches the backup manifest, and that
+// the WAL files needed to recover it are archived
+func Backup(
+	ctx context.Context,
+	clusterName string,
+	namespace string,
+	backupName string,
+	parameters map[string]string,
+) (*Result, error) {
+	contextLogger := logging.FromContext(ctx)
+
+	target, err := storage.NewBackupTargetFromParameters(parameters)
+	if err != nil {
+		return nil, err
+	}
+	store := target.Store
+
+	backupInfo, err := catalog.New(clusterName, namespace, store).Get(ctx, backupName)
+	if err != nil {
+		return nil, fmt.Errorf("while reading the catalog entry of %s: %w", backupName, err)
+	}
+
+	if len(backupInfo.Manifest) == 0 {
+		return nil, fmt.Errorf("backup %s has no manifest", backupName)
+	}
+
+	backupManifest, err := manifest.Get(ctx, store, clusterName, backupName)
+	if err != nil {
+		return nil, fmt.Errorf("while reading the manifest of %s: %w", backupName, err)
+	}
+
+	rep, err := repository.NewRepository(
+		ctx,
+		target.GetRepositoryProvider(),
+		target.GetRepositoryPath(clusterName),
+		storage.GetKopiaConfigFilePath(clusterName),
+		storage.GetKopiaCacheDirectory(clusterName),
+		target.ObjectStore,
+		nil,
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rep.Close(ctx)
+	}()
+
+	files := make(map[string]repository.FileChecksum)
+	for _, snapshotInfo := range backupInfo.Snapshots {
+		contextLogger.Info("Reading snapshot", "snapshotID", snapshotInfo.ID, "path", snapshotInfo.Path)
+		snapshotFiles, err := rep.ChecksumSnapshot(ctx, snapshotInfo.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		prefix := executor.GetSnapshotPathPrefix(snapshotInfo.Tags)
+		for relativePath, file := range snapshotFiles {
+			files[path.Join(prefix, relativePath)] = file
+		}
+	}
+
+	result := compareFiles(backupManifest, files)
+	result.NeedsRehydration = backupInfo.NeedsRehydration()
+
+	if backupInfo.Online {
+		if err := checkWALArchived(ctx, store, clusterName, backupInfo, result); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// externalFiles are the files returned by pg_backup_stop. Backups
+// taken before they were stored in the repository only handed them
+// to CloudNativePG together with the backup result
+var externalFiles = []string{"backup_label", "tablespace_map"}
+
+// compareFiles compares the files contained in the
+// snapshots of a backup with its manifest
+func compareFiles(backupManifest *manifest.Manifest, files map[string]repository.FileChecksum) *Result {
+	result := &Result{}
+
+	expectedFiles := make(map[string]bool, len(backupManifest.Files))
+	for _, expected := range backupManifest.Files {
+		expectedFiles[expected.Path] = true
+
+		actual, found := files[expected.Path]
+		switch {
+		case !found && slices.Contains(externalFiles, expected.Path):
+			result.SkippedFiles = append(result.SkippedFiles, expected.Path)
+		case !found:
+			result.addProblem("%s is in the manifest but not in the backup", expected.Path)
+		case actual.Size != expected.Size:
+			result.addProblem("%s has size %d in the backup, but %d in the manifest",
+				expected.Path, actual.Size, expected.Size)
+		case actual.Checksum != expected.Checksum:
+			result.addProblem("%s has a checksum mismatch", expected.Path)
+		default:
+			result.VerifiedFiles++
+		}
+	}
+
+	for filePath := range files {
+		if !expectedFiles[filePath] {
+			result.addProblem("%s is in the backup but not in the manifest", filePath)
+		}
+	}
+
+	sort.Strings(result.Problems)
+	return result
+}
+
+// checkWALArchived checks that the first and the last WAL
+// files needed to recover an online backup are archived
+func checkWALArchived(
+	ctx context.Context,
+	store storage.Store,
+	clusterName string,
+	backupInfo *catalog.BackupInfo,
+	result *Result,
+) error {
+	for _, walName := range []string{backupInfo.BeginWal, backupInfo.EndWal} {
+		found, err := store.Exists(ctx, storage.GetWALFileKey(clusterName, walName))
+		if err != nil {
+			return fmt.Errorf("while checking WAL file %s: %w", walName, err)
+		}
+		if !found {
+			result.addProblem("WAL file %s, needed to recover the backup, is not archived", walName)
+		}
+	}
+
+	return nil
+}
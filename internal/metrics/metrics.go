@@ -0,0 +1,89 @@
+// Package metrics contains the Prometheus metrics exposed
+// by the sidecar
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/cloudnative-pg/cnpg-i-machinery/pkg/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "cnpg_objstore_backup"
+
+var registry = prometheus.NewRegistry()
+
+var (
+	// WALRestoreTotal counts the WAL restore attempts, by
+	// source and result
+	WALRestoreTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "wal_restore_total",
+			Help:      "Number of WAL restore attempts, by source and result",
+		},
+		[]string{"source", "result"},
+	)
+
+	// WALRestoreDuration measures the time spent restoring
+	// WAL files, by source
+	WALRestoreDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "wal_restore_duration_seconds",
+			Help:      "Time spent restoring a WAL file, by source",
+		},
+		[]string{"source"},
+	)
+
+	// KopiaPolicyDriftTotal counts the Kopia policy settings found
+	// different from the configuration, by policy source and setting
+	KopiaPolicyDriftTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "kopia_policy_drift_total",
+			Help:      "Number of Kopia policy settings found different from the configuration",
+		},
+		[]string{"source", "field"},
+	)
+)
+
+func init() {
+	registry.MustRegister(
+		WALRestoreTotal,
+		WALRestoreDuration,
+		KopiaPolicyDriftTotal,
+	)
+}
+
+// Serve exposes the metrics via HTTP until the context is cancelled
+func Serve(ctx context.Context, address string) error {
+	contextLogger := logging.FromContext(ctx)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	server := &http.Server{
+		Addr:              address,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		if err := server.Shutdown(context.Background()); err != nil {
+			contextLogger.Error(err, "while shutting down the metrics server")
+		}
+	}()
+
+	contextLogger.Info("Starting metrics server", "address", address)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,43 @@
+package objectstore
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/minio/minio-go/v7"
+)
+
+const defaultEndpoint = "s3.amazonaws.com"
+
+// NewClient creates a new S3 client for the configured
+// endpoint, using the configured credentials. The transport of
+// the client is returned too, so that the requests which are not
+// sent by the client are sent the same way
+func (configuration *Configuration) NewClient() (*minio.Client, http.RoundTripper, error) {
+	endpoint := defaultEndpoint
+	secure := true
+
+	// The endpoint has already been validated as an URL
+	// when the configuration was loaded
+	if endpointURL, err := url.Parse(configuration.Endpoint); err == nil && len(endpointURL.Host) > 0 {
+		endpoint = endpointURL.Host
+		secure = endpointURL.Scheme != "http"
+	}
+
+	transport, err := minio.DefaultTransport(secure)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:     configuration.GetCredentials(),
+		Secure:    secure,
+		Region:    configuration.Region,
+		Transport: transport,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return client, transport, nil
+}
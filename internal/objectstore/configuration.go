@@ -0,0 +1,374 @@
+// Package objectstore contains the configuration and the credentials
+// needed to access the object store where backups are stored
+package objectstore
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+const (
+	// BucketParameter is the name of the bucket where data is stored
+	BucketParameter = "bucket"
+
+	// EndpointParameter is the URL of the S3 endpoint, when
+	// not using AWS
+	EndpointParameter = "endpoint"
+
+	// RegionParameter is the region of the bucket
+	RegionParameter = "region"
+
+	// PrefixParameter is the prefix inside the bucket under
+	// which every object is stored
+	PrefixParameter = "prefix"
+
+	// RoleARNParameter is the ARN of the role to be assumed
+	// via AssumeRoleWithWebIdentity
+	RoleARNParameter = "roleARN"
+
+	// STSEndpointParameter overrides the STS endpoint used to
+	// exchange the service account token for credentials
+	STSEndpointParameter = "stsEndpoint"
+
+	// WebIdentityAudienceParameter is the audience of the projected
+	// service account token
+	WebIdentityAudienceParameter = "webIdentityAudience"
+
+	// WebIdentityExpirationParameter is the requested validity of
+	// the projected service account token, in seconds
+	WebIdentityExpirationParameter = "webIdentityExpirationSeconds"
+
+	// ObjectLockModeParameter is the object lock retention mode
+	// applied to every uploaded object, GOVERNANCE or COMPLIANCE
+	ObjectLockModeParameter = "objectLockMode"
+
+	// ObjectLockRetentionParameter is how long uploaded objects
+	// are locked, i.e. "30d" or "720h"
+	ObjectLockRetentionParameter = "objectLockRetention"
+)
+
+const (
+	// SecondaryPrefix is the prefix of the parameters configuring
+	// the secondary bucket, i.e. "secondaryBucket"
+	SecondaryPrefix = "secondary"
+
+	// SourcePrefix is the prefix of the parameters configuring the
+	// bucket containing the archive of the source cluster, i.e.
+	// "sourceBucket"
+	SourcePrefix = "source"
+)
+
+const (
+	defaultSTSEndpoint           = "https://sts.amazonaws.com"
+	defaultWebIdentityAudience   = "sts.amazonaws.com"
+	defaultWebIdentityExpiration = 3600
+
+	// minWebIdentityExpiration is the minimum validity that
+	// Kubernetes accepts for a projected service account token
+	minWebIdentityExpiration = 600
+)
+
+// configurationPrefixes are the prefixes of every object
+// store that can be configured
+var configurationPrefixes = []string{"", SecondaryPrefix, SourcePrefix}
+
+// Configuration is the object store configuration, as
+// read from the plugin parameters
+type Configuration struct {
+	// Bucket is the bucket where data is stored
+	Bucket string
+
+	// Endpoint is the URL of the S3 endpoint. When empty, AWS is used
+	Endpoint string
+
+	// Region is the region of the bucket
+	Region string
+
+	// Prefix is the prefix inside the bucket under which
+	// every object is stored
+	Prefix string
+
+	// WebIdentity is the web identity configuration, nil
+	// when credentials are taken from the environment
+	WebIdentity *WebIdentityConfiguration
+
+	// ObjectLock is the object lock configuration, nil when
+	// uploaded objects are not locked
+	ObjectLock *ObjectLockConfiguration
+
+	// StorageClasses are the storage classes of the uploaded
+	// objects, by type. The bucket default is used for the
+	// missing types
+	StorageClasses map[ObjectType]string
+
+	// ArchiveTier is the configuration of the archive tier, nil
+	// when old objects are kept in their original storage class
+	ArchiveTier *ArchiveTierConfiguration
+}
+
+// WebIdentityConfiguration is the configuration needed to
+// assume a role using the projected service account token
+type WebIdentityConfiguration struct {
+	// RoleARN is the ARN of the role to be assumed
+	RoleARN string
+
+	// STSEndpoint is the URL of the STS service
+	STSEndpoint string
+}
+
+// ObjectLockConfiguration is the object lock retention applied
+// to every uploaded object
+type ObjectLockConfiguration struct {
+	// Mode is the retention mode
+	Mode minio.RetentionMode
+
+	// Retention is how long uploaded objects are locked
+	Retention time.Duration
+}
+
+// GetRetainUntilDate gets the date until which an object
+// uploaded now is locked
+func (configuration *ObjectLockConfiguration) GetRetainUntilDate() time.Time {
+	return time.Now().Add(configuration.Retention).UTC()
+}
+
+// WebIdentityTokenConfiguration is the configuration of the projected
+// service account token, shared by every configured object store
+type WebIdentityTokenConfiguration struct {
+	// Audience is the audience of the projected service account token
+	Audience string
+
+	// ExpirationSeconds is the requested validity of the projected
+	// service account token
+	ExpirationSeconds int64
+}
+
+// ParameterError is raised when a plugin parameter is not valid
+type ParameterError struct {
+	// Name is the name of the wrong parameter
+	Name string
+
+	// Message is the reason why the parameter is not valid
+	Message string
+}
+
+// Error implements the error interface
+func (e *ParameterError) Error() string {
+	return fmt.Sprintf("parameter %s %s", e.Name, e.Message)
+}
+
+// NewConfigurationFromParameters reads the object store
+// configuration from the plugin parameters
+func NewConfigurationFromParameters(parameters map[string]string) (*Configuration, error) {
+	return NewConfigurationFromPrefixedParameters(parameters, "")
+}
+
+// NewConfigurationFromPrefixedParameters reads the configuration of an
+// additional object store from the plugin parameters having a certain
+// prefix. With the "secondary" prefix, the bucket is read from the
+// "secondaryBucket" parameter
+func NewConfigurationFromPrefixedParameters(parameters map[string]string, prefix string) (*Configuration, error) {
+	result := &Configuration{
+		Bucket:   parameters[GetParameterName(prefix, BucketParameter)],
+		Endpoint: parameters[GetParameterName(prefix, EndpointParameter)],
+		Region:   parameters[GetParameterName(prefix, RegionParameter)],
+		Prefix:   parameters[GetParameterName(prefix, PrefixParameter)],
+	}
+
+	if len(result.Bucket) == 0 {
+		return nil, &ParameterError{Name: GetParameterName(prefix, BucketParameter), Message: "cannot be empty"}
+	}
+
+	if len(result.Endpoint) > 0 {
+		if err := validateURL(result.Endpoint); err != nil {
+			return nil, &ParameterError{Name: GetParameterName(prefix, EndpointParameter), Message: err.Error()}
+		}
+	}
+
+	webIdentity, err := newWebIdentityConfigurationFromParameters(parameters, prefix)
+	if err != nil {
+		return nil, err
+	}
+	result.WebIdentity = webIdentity
+
+	objectLock, err := newObjectLockConfigurationFromParameters(parameters, prefix)
+	if err != nil {
+		return nil, err
+	}
+	result.ObjectLock = objectLock
+
+	result.StorageClasses = newStorageClassesFromParameters(parameters, prefix)
+	archiveTier, err := newArchiveTierConfigurationFromParameters(parameters, prefix)
+	if err != nil {
+		return nil, err
+	}
+	result.ArchiveTier = archiveTier
+
+	return result, nil
+}
+
+// IsConfigured checks if the plugin parameters contain the
+// configuration of the object store having a certain prefix
+func IsConfigured(parameters map[string]string, prefix string) bool {
+	return len(parameters[GetParameterName(prefix, BucketParameter)]) > 0
+}
+
+// GetParameterName gets the name of a parameter for the
+// object store having a certain prefix
+func GetParameterName(prefix string, name string) string {
+	if len(prefix) == 0 {
+		return name
+	}
+
+	return prefix + strings.ToUpper(name[:1]) + name[1:]
+}
+
+func newWebIdentityConfigurationFromParameters(
+	parameters map[string]string,
+	prefix string,
+) (*WebIdentityConfiguration, error) {
+	roleARNParameter := GetParameterName(prefix, RoleARNParameter)
+	stsEndpointParameter := GetParameterName(prefix, STSEndpointParameter)
+
+	roleARN := parameters[roleARNParameter]
+	if len(roleARN) == 0 {
+		if len(parameters[stsEndpointParameter]) > 0 {
+			return nil, &ParameterError{Name: stsEndpointParameter, Message: "requires " + roleARNParameter}
+		}
+		return nil, nil
+	}
+
+	result := &WebIdentityConfiguration{
+		RoleARN:     roleARN,
+		STSEndpoint: parameters[stsEndpointParameter],
+	}
+
+	if len(result.STSEndpoint) == 0 {
+		result.STSEndpoint = defaultSTSEndpoint
+		if region := parameters[GetParameterName(prefix, RegionParameter)]; len(region) > 0 {
+			result.STSEndpoint = fmt.Sprintf("https://sts.%s.amazonaws.com", region)
+		}
+	} else if err := validateURL(result.STSEndpoint); err != nil {
+		return nil, &ParameterError{Name: stsEndpointParameter, Message: err.Error()}
+	}
+
+	return result, nil
+}
+
+func newObjectLockConfigurationFromParameters(
+	parameters map[string]string,
+	prefix string,
+) (*ObjectLockConfiguration, error) {
+	modeParameter := GetParameterName(prefix, ObjectLockModeParameter)
+	retentionParameter := GetParameterName(prefix, ObjectLockRetentionParameter)
+
+	mode := minio.RetentionMode(strings.ToUpper(parameters[modeParameter]))
+	retention := parameters[retentionParameter]
+	if len(mode) == 0 && len(retention) == 0 {
+		return nil, nil
+	}
+
+	if !mode.IsValid() {
+		return nil, &ParameterError{
+			Name:    modeParameter,
+			Message: fmt.Sprintf("must be %s or %s", minio.Governance, minio.Compliance),
+		}
+	}
+
+	retentionPeriod, err := parseRetentionPeriod(retention)
+	if err != nil || retentionPeriod <= 0 {
+		return nil, &ParameterError{
+			Name:    retentionParameter,
+			Message: "must be a positive duration, i.e. \"30d\" or \"720h\"",
+		}
+	}
+
+	return &ObjectLockConfiguration{
+		Mode:      mode,
+		Retention: retentionPeriod,
+	}, nil
+}
+
+// parseRetentionPeriod parses a duration, accepting days
+// expressed with the "d" suffix in addition to the Go format
+func parseRetentionPeriod(value string) (time.Duration, error) {
+	if days, found := strings.CutSuffix(value, "d"); found {
+		count, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(count) * 24 * time.Hour, nil
+	}
+
+	return time.ParseDuration(value)
+}
+
+// NewWebIdentityTokenConfigurationFromParameters reads the configuration
+// of the projected service account token. The result is nil when no
+// object store is using web identity
+func NewWebIdentityTokenConfigurationFromParameters(
+	parameters map[string]string,
+) (*WebIdentityTokenConfiguration, error) {
+	used := false
+	for _, prefix := range configurationPrefixes {
+		if len(parameters[GetParameterName(prefix, RoleARNParameter)]) > 0 {
+			used = true
+		}
+	}
+
+	if !used {
+		for _, name := range []string{WebIdentityAudienceParameter, WebIdentityExpirationParameter} {
+			if len(parameters[name]) > 0 {
+				return nil, &ParameterError{Name: name, Message: "requires " + RoleARNParameter}
+			}
+		}
+		return nil, nil
+	}
+
+	result := &WebIdentityTokenConfiguration{
+		Audience:          parameters[WebIdentityAudienceParameter],
+		ExpirationSeconds: defaultWebIdentityExpiration,
+	}
+
+	if len(result.Audience) == 0 {
+		result.Audience = defaultWebIdentityAudience
+	}
+
+	if value := parameters[WebIdentityExpirationParameter]; len(value) > 0 {
+		expiration, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, &ParameterError{Name: WebIdentityExpirationParameter, Message: "is not a valid integer"}
+		}
+		if expiration < minWebIdentityExpiration {
+			return nil, &ParameterError{
+				Name:    WebIdentityExpirationParameter,
+				Message: fmt.Sprintf("must be at least %d", minWebIdentityExpiration),
+			}
+		}
+		result.ExpirationSeconds = expiration
+	}
+
+	return result, nil
+}
+
+func validateURL(value string) error {
+	parsedURL, err := url.Parse(value)
+	if err != nil {
+		return fmt.Errorf("is not a valid URL: %w", err)
+	}
+
+	if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
+		return fmt.Errorf("must be an http or https URL")
+	}
+
+	if len(parsedURL.Host) == 0 {
+		return fmt.Errorf("must contain a host")
+	}
+
+	return nil
+}
@@ -0,0 +1,88 @@
+package objectstore
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const (
+	// WebIdentityTokenVolumeName is the name of the projected volume
+	// containing the service account token
+	WebIdentityTokenVolumeName = "objstore-web-identity-token"
+
+	// WebIdentityTokenDirectory is the directory where the projected
+	// service account token is mounted inside the sidecar
+	WebIdentityTokenDirectory = "/var/run/secrets/objstore-backup/serviceaccount"
+
+	// WebIdentityTokenFileName is the name of the file containing
+	// the projected service account token
+	WebIdentityTokenFileName = "token"
+)
+
+var (
+	// webIdentityCredentials caches the credentials obtained via
+	// web identity, to avoid calling STS for every request. The
+	// cached credentials are refreshed before they expire
+	webIdentityCredentials      = make(map[WebIdentityConfiguration]*credentials.Credentials)
+	webIdentityCredentialsMutex sync.Mutex
+)
+
+// GetCredentials gets the credentials to be used to access the
+// object store. When web identity is not configured, credentials
+// are read from the standard AWS environment variables
+func (configuration *Configuration) GetCredentials() *credentials.Credentials {
+	if configuration.WebIdentity == nil {
+		return credentials.NewEnvAWS()
+	}
+
+	webIdentityCredentialsMutex.Lock()
+	defer webIdentityCredentialsMutex.Unlock()
+
+	if result, ok := webIdentityCredentials[*configuration.WebIdentity]; ok {
+		return result
+	}
+
+	result := newWebIdentityCredentials(configuration.WebIdentity, readWebIdentityToken, time.Now)
+	webIdentityCredentials[*configuration.WebIdentity] = result
+	return result
+}
+
+// newWebIdentityCredentials creates the credentials exchanging the
+// token returned by readToken for temporary ones via STS. Retrieve
+// refreshes them when 80% of their validity has elapsed, according
+// to the now clock, so we never use expired ones
+func newWebIdentityCredentials(
+	configuration *WebIdentityConfiguration,
+	readToken func() (*credentials.WebIdentityToken, error),
+	now func() time.Time,
+) *credentials.Credentials {
+	return credentials.New(&credentials.STSWebIdentity{
+		Expiry: credentials.Expiry{
+			CurrentTime: now,
+		},
+		Client: &http.Client{
+			Transport: http.DefaultTransport,
+		},
+		STSEndpoint:         configuration.STSEndpoint,
+		RoleARN:             configuration.RoleARN,
+		GetWebIDTokenExpiry: readToken,
+	})
+}
+
+// readWebIdentityToken reads the projected service account token.
+// The token is read every time as the kubelet rotates it
+func readWebIdentityToken() (*credentials.WebIdentityToken, error) {
+	token, err := os.ReadFile(path.Join(WebIdentityTokenDirectory, WebIdentityTokenFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	return &credentials.WebIdentityToken{
+		Token: string(token),
+	}, nil
+}
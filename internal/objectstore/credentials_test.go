@@ -0,0 +1,149 @@
+package objectstore
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// stsResponseTemplate is the response of AssumeRoleWithWebIdentity,
+// filled with the access key and the expiration of the credentials
+const stsResponseTemplate = `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>%s</AccessKeyId>
+      <SecretAccessKey>secret</SecretAccessKey>
+      <SessionToken>session</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`
+
+// fakeClock is a clock which is moved forward by the tests
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (clock *fakeClock) Now() time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+
+	return clock.now
+}
+
+func (clock *fakeClock) Add(duration time.Duration) {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+
+	clock.now = clock.now.Add(duration)
+}
+
+// newSTSServer creates a fake STS endpoint issuing credentials valid
+// for the given duration from the time of the clock, with a different
+// access key at every call
+func newSTSServer(t *testing.T, clock *fakeClock, validity time.Duration, calls *atomic.Int32) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.Form.Get("Action") != "AssumeRoleWithWebIdentity" || r.Form.Get("WebIdentityToken") != "token" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		if r.Form.Get("RoleArn") != "arn:aws:iam::123456789012:role/backup" {
+			http.Error(w, "unexpected role", http.StatusForbidden)
+			return
+		}
+
+		call := calls.Add(1)
+		expiration := clock.Now().Add(validity).UTC().Format(time.RFC3339Nano)
+		_, _ = fmt.Fprintf(w, stsResponseTemplate, fmt.Sprintf("key-%d", call), expiration)
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestWebIdentityCredentialsRefresh(t *testing.T) {
+	var calls atomic.Int32
+	clock := &fakeClock{now: time.Now()}
+	server := newSTSServer(t, clock, time.Hour, &calls)
+
+	tokenReads := 0
+	readToken := func() (*credentials.WebIdentityToken, error) {
+		tokenReads++
+		return &credentials.WebIdentityToken{Token: "token"}, nil
+	}
+
+	result := newWebIdentityCredentials(&WebIdentityConfiguration{
+		RoleARN:     "arn:aws:iam::123456789012:role/backup",
+		STSEndpoint: server.URL,
+	}, readToken, clock.Now)
+
+	value, err := result.Get()
+	if err != nil {
+		t.Fatalf("unexpected error getting the credentials: %v", err)
+	}
+	if value.AccessKeyID != "key-1" || value.SessionToken != "session" {
+		t.Fatalf("unexpected credentials %q/%q", value.AccessKeyID, value.SessionToken)
+	}
+
+	// The cached credentials are used while they are valid
+	if value, err = result.Get(); err != nil {
+		t.Fatalf("unexpected error getting the cached credentials: %v", err)
+	}
+	if value.AccessKeyID != "key-1" || calls.Load() != 1 {
+		t.Fatalf("expected the cached credentials, got %q after %d STS calls", value.AccessKeyID, calls.Load())
+	}
+
+	// Credentials are refreshed when 80% of their validity has elapsed,
+	// well before expiring, reading the token again as the kubelet
+	// rotates it
+	clock.Add(47 * time.Minute)
+	if result.IsExpired() {
+		t.Fatal("expected the credentials to be valid before 80% of their validity")
+	}
+	clock.Add(2 * time.Minute)
+	if !result.IsExpired() {
+		t.Fatal("expected the credentials to be refreshed after 80% of their validity")
+	}
+	if value, err = result.Get(); err != nil {
+		t.Fatalf("unexpected error refreshing the credentials: %v", err)
+	}
+	if value.AccessKeyID != "key-2" || calls.Load() != 2 {
+		t.Fatalf("expected refreshed credentials, got %q after %d STS calls", value.AccessKeyID, calls.Load())
+	}
+	if tokenReads != 2 {
+		t.Fatalf("expected the token to be read at every refresh, read %d times", tokenReads)
+	}
+}
+
+func TestWebIdentityCredentialsError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = fmt.Fprint(w, `<ErrorResponse><Error><Code>AccessDenied</Code>`+
+			`<Message>Not authorized</Message></Error></ErrorResponse>`)
+	}))
+	defer server.Close()
+
+	result := newWebIdentityCredentials(&WebIdentityConfiguration{
+		RoleARN:     "arn:aws:iam::123456789012:role/backup",
+		STSEndpoint: server.URL,
+	}, func() (*credentials.WebIdentityToken, error) {
+		return &credentials.WebIdentityToken{Token: "token"}, nil
+	}, time.Now)
+
+	if _, err := result.Get(); err == nil {
+		t.Fatal("expected an error when STS denies the request")
+	}
+}
@@ -0,0 +1,102 @@
+package objectstore
+
+import (
+	"time"
+)
+
+const (
+	// WALStorageClassParameter is the storage class of the archived WALs
+	WALStorageClassParameter = "walStorageClass"
+
+	// BaseStorageClassParameter is the storage class of the data
+	// contained in base backups
+	BaseStorageClassParameter = "baseStorageClass"
+
+	// ManifestStorageClassParameter is the storage class of the
+	// backup manifests and of the catalog
+	ManifestStorageClassParameter = "manifestStorageClass"
+
+	// ArchiveStorageClassParameter is the storage class WAL files
+	// are moved to when they get older than ArchiveAfterParameter
+	ArchiveStorageClassParameter = "archiveStorageClass"
+
+	// ArchiveAfterParameter is the age after which the WALs not needed
+	// by newer backups are moved to the archive storage class, i.e. "90d"
+	ArchiveAfterParameter = "archiveAfter"
+)
+
+// ObjectType is the type of an object stored in the bucket
+type ObjectType string
+
+const (
+	// ObjectTypeWAL is an archived WAL file
+	ObjectTypeWAL ObjectType = "wal"
+
+	// ObjectTypeBase is the data of a base backup
+	ObjectTypeBase ObjectType = "base"
+
+	// ObjectTypeManifest is a backup manifest, or a catalog entry
+	ObjectTypeManifest ObjectType = "manifest"
+)
+
+// ArchiveTierConfiguration is the configuration of the archive
+// tier, where old WALs are moved
+type ArchiveTierConfiguration struct {
+	// StorageClass is the storage class of the archive tier
+	StorageClass string
+
+	// After is the age after which objects are archived
+	After time.Duration
+}
+
+// GetThreshold gets the time before which objects are archived
+func (configuration *ArchiveTierConfiguration) GetThreshold() time.Time {
+	return time.Now().Add(-configuration.After)
+}
+
+func newStorageClassesFromParameters(parameters map[string]string, prefix string) map[ObjectType]string {
+	result := make(map[ObjectType]string)
+	for objectType, name := range map[ObjectType]string{
+		ObjectTypeWAL:      WALStorageClassParameter,
+		ObjectTypeBase:     BaseStorageClassParameter,
+		ObjectTypeManifest: ManifestStorageClassParameter,
+	} {
+		if value := parameters[GetParameterName(prefix, name)]; len(value) > 0 {
+			result[objectType] = value
+		}
+	}
+
+	return result
+}
+
+func newArchiveTierConfigurationFromParameters(
+	parameters map[string]string,
+	prefix string,
+) (*ArchiveTierConfiguration, error) {
+	storageClassParameter := GetParameterName(prefix, ArchiveStorageClassParameter)
+	afterParameter := GetParameterName(prefix, ArchiveAfterParameter)
+
+	storageClass := parameters[storageClassParameter]
+	after := parameters[afterParameter]
+	switch {
+	case len(storageClass) == 0 && len(after) == 0:
+		return nil, nil
+	case len(storageClass) == 0:
+		return nil, &ParameterError{Name: storageClassParameter, Message: "is required by " + afterParameter}
+	case len(after) == 0:
+		return nil, &ParameterError{Name: afterParameter, Message: "is required by " + storageClassParameter}
+	}
+
+	afterPeriod, err := parseRetentionPeriod(after)
+	if err != nil || afterPeriod <= 0 {
+		return nil, &ParameterError{
+			Name:    afterParameter,
+			Message: "must be a positive duration, i.e. \"90d\" or \"2160h\"",
+		}
+	}
+
+	return &ArchiveTierConfiguration{
+		StorageClass: storageClass,
+		After:        afterPeriod,
+	}, nil
+}
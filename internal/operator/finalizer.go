@@ -0,0 +1,300 @@
+package operator
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	apiv1 "github.com/cloudnative-pg/cloudnative-pg/api/v1"
+	"github.com/cloudnative-pg/cnpg-i-machinery/pkg/logging"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/deletion"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/lock"
+	"github.com/dougkirkley/plugin-objstore-backup/pkg/metadata"
+)
+
+const (
+	// BackupFinalizer is the finalizer added to the Backup objects of
+	// the clusters using this plugin, removing the backup from the
+	// object store before the object is deleted
+	BackupFinalizer = "objstore-backup.dougkirkley/delete"
+
+	// pluginCommand is the path of the plugin inside the sidecar
+	pluginCommand = "/app/bin/plugin-pvc-backup"
+
+	// deletionRetryInterval is how long to wait before deleting a
+	// backup again when the primary instance is not available, or
+	// when another backup holds the lock of the cluster
+	deletionRetryInterval = time.Minute
+
+	// protectedBackupRetryInterval is how long to wait before deleting
+	// a backup again when it is pinned or required by the recovery
+	// window, which stops being the case as new backups are taken
+	protectedBackupRetryInterval = time.Hour
+)
+
+// commandRunner runs a command inside a container of a pod,
+// returning what it has written
+type commandRunner func(ctx context.Context, pod *corev1.Pod, container string, command []string) (string, error)
+
+// BackupReconciler deletes from the object store the backups whose
+// Backup object is deleted. CNPG-I has no backup deletion RPC, so the
+// deletion command is run inside the sidecar of the primary instance,
+// where the Kopia password and the PVC are available. Backups which
+// are pinned or required by the recovery window are kept, together
+// with their Backup object, until they can be deleted
+type BackupReconciler struct {
+	client.Client
+
+	// runCommand runs the deletion command inside the sidecar
+	runCommand commandRunner
+}
+
+// StartBackupReconciler runs the reconciler of the Backup
+// objects until the context is cancelled
+func StartBackupReconciler(ctx context.Context) error {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		return err
+	}
+	if err := apiv1.AddToScheme(scheme); err != nil {
+		return err
+	}
+
+	config, err := ctrl.GetConfig()
+	if err != nil {
+		return err
+	}
+
+	mgr, err := ctrl.NewManager(config, ctrl.Options{
+		Scheme: scheme,
+		Logger: logging.FromContext(ctx),
+		// The metrics are served by the plugin itself
+		Metrics: metricsserver.Options{BindAddress: "0"},
+	})
+	if err != nil {
+		return err
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+
+	reconciler := &BackupReconciler{
+		Client: mgr.GetClient(),
+		runCommand: func(ctx context.Context, pod *corev1.Pod, container string, command []string) (string, error) {
+			return execInContainer(ctx, config, clientset, pod, container, command)
+		},
+	}
+	if err := ctrl.NewControllerManagedBy(mgr).For(&apiv1.Backup{}).Complete(reconciler); err != nil {
+		return err
+	}
+
+	return mgr.Start(ctx)
+}
+
+// Reconcile adds the finalizer to the Backup objects of the clusters
+// using this plugin, and deletes the backups whose object is deleted
+func (reconciler *BackupReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	contextLogger := logging.FromContext(ctx).WithValues("backupName", req.Name, "namespace", req.Namespace)
+
+	var backup apiv1.Backup
+	if err := reconciler.Get(ctx, req.NamespacedName, &backup); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	// Volume snapshots are not taken by this plugin
+	if backup.Spec.Method == apiv1.BackupMethodVolumeSnapshot {
+		return ctrl.Result{}, nil
+	}
+
+	cluster, parameters, err := reconciler.getCluster(ctx, &backup)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if backup.DeletionTimestamp.IsZero() {
+		if cluster == nil || controllerutil.ContainsFinalizer(&backup, BackupFinalizer) {
+			return ctrl.Result{}, nil
+		}
+		controllerutil.AddFinalizer(&backup, BackupFinalizer)
+		return ctrl.Result{}, reconciler.Update(ctx, &backup)
+	}
+
+	if !controllerutil.ContainsFinalizer(&backup, BackupFinalizer) {
+		return ctrl.Result{}, nil
+	}
+
+	// Without the cluster, or the plugin, there is no
+	// sidecar able to reach the object store
+	if cluster == nil {
+		contextLogger.Info("Cluster not using this plugin anymore, the backup is left in the object store")
+		return ctrl.Result{}, reconciler.removeFinalizer(ctx, &backup)
+	}
+
+	var pod corev1.Pod
+	if len(cluster.Status.CurrentPrimary) > 0 {
+		err = reconciler.Get(ctx, types.NamespacedName{Namespace: cluster.Namespace, Name: cluster.Status.CurrentPrimary}, &pod)
+	}
+	if len(cluster.Status.CurrentPrimary) == 0 || apierrs.IsNotFound(err) {
+		contextLogger.Info("Primary instance not available, waiting before deleting the backup")
+		return ctrl.Result{RequeueAfter: deletionRetryInterval}, nil
+	}
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	command, err := getDeletionCommand(&backup, cluster, parameters)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// The errors are matched by their message, as
+	// they are written by the deletion command
+	output, err := reconciler.runCommand(ctx, &pod, sidecarContainerName, command)
+	switch {
+	case err == nil:
+		contextLogger.Info("Backup deleted from the object store", "output", strings.TrimSpace(output))
+	case strings.Contains(output, deletion.ErrBackupRequired.Error()),
+		strings.Contains(output, deletion.ErrBackupPinned.Error()):
+		contextLogger.Info("Backup protected, waiting before deleting it", "reason", strings.TrimSpace(output))
+		return ctrl.Result{RequeueAfter: protectedBackupRetryInterval}, nil
+	case strings.Contains(output, lock.ErrLockHeld.Error()):
+		contextLogger.Info("Cluster locked by another backup, waiting before deleting the backup")
+		return ctrl.Result{RequeueAfter: deletionRetryInterval}, nil
+	default:
+		return ctrl.Result{}, fmt.Errorf("while deleting backup %s: %w", backup.Name, err)
+	}
+
+	return ctrl.Result{}, reconciler.removeFinalizer(ctx, &backup)
+}
+
+// getCluster gets the cluster of a backup together with the parameters
+// of this plugin. The cluster is nil when it doesn't exist, or it
+// doesn't use this plugin
+func (reconciler *BackupReconciler) getCluster(
+	ctx context.Context,
+	backup *apiv1.Backup,
+) (*apiv1.Cluster, map[string]string, error) {
+	var cluster apiv1.Cluster
+	err := reconciler.Get(ctx, types.NamespacedName{Namespace: backup.Namespace, Name: backup.Spec.Cluster.Name}, &cluster)
+	if err != nil {
+		return nil, nil, client.IgnoreNotFound(err)
+	}
+
+	for i := range cluster.Spec.Plugins {
+		if cluster.Spec.Plugins[i].Name == metadata.Data.Name {
+			return &cluster, cluster.Spec.Plugins[i].Parameters, nil
+		}
+	}
+
+	return nil, nil, nil
+}
+
+// removeFinalizer lets a Backup object be deleted
+func (reconciler *BackupReconciler) removeFinalizer(ctx context.Context, backup *apiv1.Backup) error {
+	controllerutil.RemoveFinalizer(backup, BackupFinalizer)
+	return reconciler.Update(ctx, backup)
+}
+
+// getDeletionCommand gets the command deleting a backup. Backups
+// which are not in the catalog, as they failed before being recorded,
+// have nothing to delete
+func getDeletionCommand(backup *apiv1.Backup, cluster *apiv1.Cluster, parameters map[string]string) ([]string, error) {
+	command := []string{
+		pluginCommand,
+		"delete",
+		"--cluster-name", cluster.Name,
+		"--namespace", cluster.Namespace,
+		"--backup-name", backup.Name,
+		"--ignore-not-found",
+	}
+
+	if cluster.Spec.Backup != nil && len(cluster.Spec.Backup.RetentionPolicy) > 0 {
+		command = append(command, "--recovery-window", cluster.Spec.Backup.RetentionPolicy)
+	}
+
+	// The parameters are parsed as a CSV record, so the
+	// values containing commas need to be quoted
+	names := make([]string, 0, len(parameters))
+	for name := range parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	record := make([]string, 0, len(names))
+	for _, name := range names {
+		record = append(record, name+"="+parameters[name])
+	}
+
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	if err := writer.Write(record); err != nil {
+		return nil, err
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return nil, err
+	}
+
+	return append(command, "--parameters", strings.TrimSuffix(buffer.String(), "\n")), nil
+}
+
+// execInContainer runs a command inside a container of a pod
+func execInContainer(
+	ctx context.Context,
+	config *rest.Config,
+	clientset kubernetes.Interface,
+	pod *corev1.Pod,
+	container string,
+	command []string,
+) (string, error) {
+	req := clientset.CoreV1().RESTClient().
+		Post().
+		Namespace(pod.Namespace).
+		Resource("pods").
+		Name(pod.Name).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: container,
+			Command:   command,
+			Stdout:    true,
+			Stderr:    true,
+		}, clientgoscheme.ParameterCodec)
+
+	executor, err := remotecommand.NewSPDYExecutor(config, http.MethodPost, req.URL())
+	if err != nil {
+		return "", err
+	}
+
+	// The streams are copied concurrently
+	var stdout, stderr bytes.Buffer
+	err = executor.StreamWithContext(ctx, remotecommand.StreamOptions{
+		Stdout: &stdout,
+		Stderr: &stderr,
+	})
+	output := stdout.String() + stderr.String()
+	if err != nil {
+		return output, fmt.Errorf("%w: %s", err, strings.TrimSpace(output))
+	}
+
+	return output, nil
+}
@@ -0,0 +1,233 @@
+package operator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	apiv1 "github.com/cloudnative-pg/cloudnative-pg/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/deletion"
+	"github.com/dougkirkley/plugin-objstore-backup/pkg/metadata"
+)
+
+// fakeSidecar records the commands run inside the sidecar,
+// answering with a certain output and error
+type fakeSidecar struct {
+	commands [][]string
+	output   string
+	err      error
+}
+
+func (sidecar *fakeSidecar) run(_ context.Context, pod *corev1.Pod, container string, command []string) (string, error) {
+	if pod.Name != "cluster-1" || container != sidecarContainerName {
+		return "", fmt.Errorf("unexpected container %s of pod %s", container, pod.Name)
+	}
+	sidecar.commands = append(sidecar.commands, command)
+	return sidecar.output, sidecar.err
+}
+
+// newTestReconciler creates a reconciler of a backup of a cluster
+// using this plugin, whose primary instance is running
+func newTestReconciler(t *testing.T, sidecar *fakeSidecar, backup *apiv1.Backup) *BackupReconciler {
+	t.Helper()
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := apiv1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	cluster := &apiv1.Cluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster", Namespace: "default"},
+		Spec: apiv1.ClusterSpec{
+			Backup: &apiv1.BackupConfiguration{RetentionPolicy: "30d"},
+			Plugins: apiv1.PluginConfigurationList{
+				{
+					Name:       metadata.Data.Name,
+					Parameters: map[string]string{"bucket": "backups", "tags": "a=1,b=2"},
+				},
+			},
+		},
+		Status: apiv1.ClusterStatus{CurrentPrimary: "cluster-1"},
+	}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "cluster-1", Namespace: "default"}}
+
+	return &BackupReconciler{
+		Client:     fake.NewClientBuilder().WithScheme(scheme).WithObjects(cluster, pod, backup).Build(),
+		runCommand: sidecar.run,
+	}
+}
+
+func newTestBackup(finalizers ...string) *apiv1.Backup {
+	return &apiv1.Backup{
+		ObjectMeta: metav1.ObjectMeta{Name: "backup", Namespace: "default", Finalizers: finalizers},
+		Spec:       apiv1.BackupSpec{Cluster: apiv1.LocalObjectReference{Name: "cluster"}},
+	}
+}
+
+// reconcileBackup reconciles the test backup, deleting it first when needed
+func reconcileBackup(t *testing.T, reconciler *BackupReconciler, deleted bool) ctrl.Result {
+	t.Helper()
+	ctx := context.Background()
+	key := types.NamespacedName{Namespace: "default", Name: "backup"}
+
+	if deleted {
+		var backup apiv1.Backup
+		if err := reconciler.Get(ctx, key, &backup); err != nil {
+			t.Fatal(err)
+		}
+		if err := reconciler.Delete(ctx, &backup); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+	if err != nil {
+		t.Fatalf("unexpected error reconciling the backup: %v", err)
+	}
+	return result
+}
+
+// getFinalizers gets the finalizers of the test backup, nil when it has been deleted
+func getFinalizers(t *testing.T, reconciler *BackupReconciler) []string {
+	t.Helper()
+
+	var backup apiv1.Backup
+	err := reconciler.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: "backup"}, &backup)
+	if err != nil {
+		if client.IgnoreNotFound(err) != nil {
+			t.Fatal(err)
+		}
+		return nil
+	}
+	return backup.Finalizers
+}
+
+func TestBackupFinalizerAdded(t *testing.T) {
+	sidecar := &fakeSidecar{}
+	reconciler := newTestReconciler(t, sidecar, newTestBackup())
+
+	reconcileBackup(t, reconciler, false)
+	if finalizers := getFinalizers(t, reconciler); !slices.Contains(finalizers, BackupFinalizer) {
+		t.Fatalf("expected the finalizer to be added, got %v", finalizers)
+	}
+	if len(sidecar.commands) != 0 {
+		t.Fatalf("unexpected commands %v", sidecar.commands)
+	}
+}
+
+func TestBackupDeleted(t *testing.T) {
+	sidecar := &fakeSidecar{}
+	reconciler := newTestReconciler(t, sidecar, newTestBackup(BackupFinalizer))
+
+	reconcileBackup(t, reconciler, true)
+	if finalizers := getFinalizers(t, reconciler); finalizers != nil {
+		t.Fatalf("expected the backup to be deleted, got finalizers %v", finalizers)
+	}
+
+	expected := []string{
+		pluginCommand,
+		"delete",
+		"--cluster-name", "cluster",
+		"--namespace", "default",
+		"--backup-name", "backup",
+		"--ignore-not-found",
+		"--recovery-window", "30d",
+		"--parameters", `bucket=backups,"tags=a=1,b=2"`,
+	}
+	if len(sidecar.commands) != 1 || !slices.Equal(sidecar.commands[0], expected) {
+		t.Fatalf("unexpected commands %q", sidecar.commands)
+	}
+}
+
+func TestBackupDeletionRetried(t *testing.T) {
+	for _, test := range []struct {
+		output       string
+		requeueAfter time.Duration
+	}{
+		{output: fmt.Sprintf("%v: backup is the only completed backup", deletion.ErrBackupRequired),
+			requeueAfter: protectedBackupRetryInterval},
+		{output: fmt.Sprintf("%v: backup is pinned", deletion.ErrBackupPinned),
+			requeueAfter: protectedBackupRetryInterval},
+		{output: "lock held by another backup", requeueAfter: deletionRetryInterval},
+	} {
+		sidecar := &fakeSidecar{output: test.output, err: errors.New("command terminated with exit code 1")}
+		reconciler := newTestReconciler(t, sidecar, newTestBackup(BackupFinalizer))
+
+		result := reconcileBackup(t, reconciler, true)
+		if result.RequeueAfter != test.requeueAfter {
+			t.Errorf("expected %q to be retried after %v, got %v", test.output, test.requeueAfter, result.RequeueAfter)
+		}
+		if finalizers := getFinalizers(t, reconciler); !slices.Contains(finalizers, BackupFinalizer) {
+			t.Errorf("expected the backup to be kept after %q, got %v", test.output, finalizers)
+		}
+	}
+}
+
+func TestBackupDeletionFailed(t *testing.T) {
+	sidecar := &fakeSidecar{output: "connection refused", err: errors.New("command terminated with exit code 1")}
+	reconciler := newTestReconciler(t, sidecar, newTestBackup(BackupFinalizer))
+
+	var backup apiv1.Backup
+	key := types.NamespacedName{Namespace: "default", Name: "backup"}
+	if err := reconciler.Get(context.Background(), key, &backup); err != nil {
+		t.Fatal(err)
+	}
+	if err := reconciler.Delete(context.Background(), &backup); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := reconciler.Reconcile(context.Background(), ctrl.Request{NamespacedName: key}); err == nil {
+		t.Fatal("expected the failed deletion to be reported")
+	}
+	if finalizers := getFinalizers(t, reconciler); !slices.Contains(finalizers, BackupFinalizer) {
+		t.Fatalf("expected the backup to be kept, got %v", finalizers)
+	}
+}
+
+func TestBackupOfClusterWithoutPlugin(t *testing.T) {
+	sidecar := &fakeSidecar{}
+	reconciler := newTestReconciler(t, sidecar, newTestBackup(BackupFinalizer))
+
+	var cluster apiv1.Cluster
+	if err := reconciler.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: "cluster"}, &cluster); err != nil {
+		t.Fatal(err)
+	}
+	if err := reconciler.Delete(context.Background(), &cluster); err != nil {
+		t.Fatal(err)
+	}
+
+	// The backup is not kept forever when nothing can delete it
+	reconcileBackup(t, reconciler, true)
+	if finalizers := getFinalizers(t, reconciler); finalizers != nil {
+		t.Fatalf("expected the backup to be deleted, got finalizers %v", finalizers)
+	}
+	if len(sidecar.commands) != 0 {
+		t.Fatalf("unexpected commands %v", sidecar.commands)
+	}
+
+	// Backups of clusters not using the plugin get no finalizer
+	backup := newTestBackup()
+	if err := reconciler.Create(context.Background(), backup); err != nil {
+		t.Fatal(err)
+	}
+	reconcileBackup(t, reconciler, false)
+	if controllerutil.ContainsFinalizer(backup, BackupFinalizer) || len(getFinalizers(t, reconciler)) != 0 {
+		t.Fatalf("unexpected finalizers %v", getFinalizers(t, reconciler))
+	}
+}
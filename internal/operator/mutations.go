@@ -7,6 +7,8 @@ import (
 	"github.com/cloudnative-pg/cnpg-i/pkg/operator"
 	corev1 "k8s.io/api/core/v1"
 
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/hooks"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/objectstore"
 	"github.com/dougkirkley/plugin-objstore-backup/pkg/metadata"
 )
 
@@ -57,6 +59,11 @@ func (Operator) MutatePod(
 		return nil, err
 	}
 
+	webIdentityToken, err := objectstore.NewWebIdentityTokenConfigurationFromParameters(helper.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
 	mutatedPod := helper.GetPod().DeepCopy()
 	helper.InjectPluginVolume(mutatedPod)
 
@@ -64,7 +71,7 @@ func (Operator) MutatePod(
 	if len(mutatedPod.Spec.Containers) > 0 {
 		mutatedPod.Spec.Containers = append(
 			mutatedPod.Spec.Containers,
-			getSidecarContainer(mutatedPod, helper.Parameters))
+			getSidecarContainer(mutatedPod, helper.Parameters, webIdentityToken))
 	}
 
 	// Inject backup volume
@@ -72,6 +79,20 @@ func (Operator) MutatePod(
 		mutatedPod.Spec.Volumes = append(
 			mutatedPod.Spec.Volumes,
 			getBackupVolume(helper.Parameters))
+
+		// Inject the service account token used for web identity
+		if webIdentityToken != nil {
+			mutatedPod.Spec.Volumes = append(
+				mutatedPod.Spec.Volumes,
+				getWebIdentityTokenVolume(webIdentityToken))
+		}
+
+		// Inject the ConfigMap containing the backup hooks
+		if len(helper.Parameters[hooks.ConfigMapParameter]) > 0 {
+			mutatedPod.Spec.Volumes = append(
+				mutatedPod.Spec.Volumes,
+				getHooksVolume(helper.Parameters))
+		}
 	}
 
 	patch, err := helper.CreatePodJSONPatch(*mutatedPod)
@@ -17,16 +17,33 @@ limitations under the License.
 package operator
 
 import (
+	"fmt"
 	"strings"
 
 	corev1 "k8s.io/api/core/v1"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/hooks"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/objectstore"
 )
 
-const pgPath = "/var/lib/postgresql"
+const (
+	pgPath = "/var/lib/postgresql"
+
+	// metricsPort is the port where the sidecar exposes its metrics
+	metricsPort = 9188
+
+	// sidecarContainerName is the name of the container
+	// injected into the pods of the instances
+	sidecarContainerName = "plugin-objstore-backup"
+)
 
-func getSidecarContainer(pgPod *corev1.Pod, parameters map[string]string) corev1.Container {
+func getSidecarContainer(
+	pgPod *corev1.Pod,
+	parameters map[string]string,
+	webIdentityToken *objectstore.WebIdentityTokenConfiguration,
+) corev1.Container {
 	result := corev1.Container{
-		Name: "plugin-objstore-backup",
+		Name: sidecarContainerName,
 		VolumeMounts: []corev1.VolumeMount{
 			{
 				Name:      "scratch-data",
@@ -41,6 +58,16 @@ func getSidecarContainer(pgPod *corev1.Pod, parameters map[string]string) corev1
 				MountPath: "/backup",
 			},
 		},
+		Args: []string{
+			fmt.Sprintf("--metrics-bind-address=:%d", metricsPort),
+		},
+		Ports: []corev1.ContainerPort{
+			{
+				Name:          "plugin-metrics",
+				ContainerPort: metricsPort,
+				Protocol:      corev1.ProtocolTCP,
+			},
+		},
 		Image:           parameters["image"],
 		ImagePullPolicy: corev1.PullPolicy(parameters[imagePullPolicyParameter]),
 		Env: []corev1.EnvVar{
@@ -58,6 +85,22 @@ func getSidecarContainer(pgPod *corev1.Pod, parameters map[string]string) corev1
 		},
 	}
 
+	if webIdentityToken != nil {
+		result.VolumeMounts = append(result.VolumeMounts, corev1.VolumeMount{
+			Name:      objectstore.WebIdentityTokenVolumeName,
+			MountPath: objectstore.WebIdentityTokenDirectory,
+			ReadOnly:  true,
+		})
+	}
+
+	if len(parameters[hooks.ConfigMapParameter]) > 0 {
+		result.VolumeMounts = append(result.VolumeMounts, corev1.VolumeMount{
+			Name:      hooks.ConfigMapVolumeName,
+			MountPath: hooks.ConfigMapDirectory,
+			ReadOnly:  true,
+		})
+	}
+
 	volumeMounts := pgPod.Spec.Containers[0].VolumeMounts
 	for i := range volumeMounts {
 		if strings.HasPrefix(volumeMounts[i].MountPath, pgPath) {
@@ -78,3 +121,46 @@ func getBackupVolume(parameters map[string]string) corev1.Volume {
 		},
 	}
 }
+
+// getWebIdentityTokenVolume gets the projected volume containing the
+// service account token used to assume the object store role
+func getWebIdentityTokenVolume(webIdentityToken *objectstore.WebIdentityTokenConfiguration) corev1.Volume {
+	expirationSeconds := webIdentityToken.ExpirationSeconds
+	return corev1.Volume{
+		Name: objectstore.WebIdentityTokenVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			Projected: &corev1.ProjectedVolumeSource{
+				Sources: []corev1.VolumeProjection{
+					{
+						ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+							Audience:          webIdentityToken.Audience,
+							ExpirationSeconds: &expirationSeconds,
+							Path:              objectstore.WebIdentityTokenFileName,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// getHooksVolume gets the volume containing the ConfigMap
+// with the definitions of the backup hooks
+func getHooksVolume(parameters map[string]string) corev1.Volume {
+	return corev1.Volume{
+		Name: hooks.ConfigMapVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{
+					Name: parameters[hooks.ConfigMapParameter],
+				},
+				Items: []corev1.KeyToPath{
+					{
+						Key:  hooks.ConfigMapKey,
+						Path: hooks.ConfigMapKey,
+					},
+				},
+			},
+		},
+	}
+}
@@ -18,11 +18,20 @@ package operator
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	"github.com/cloudnative-pg/cnpg-i-machinery/pkg/pluginhelper"
 	"github.com/cloudnative-pg/cnpg-i/pkg/operator"
 
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/executor"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/hooks"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/pagechecksum"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/repository"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/storage"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/objectstore"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/throttling"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/wal"
 	"github.com/dougkirkley/plugin-objstore-backup/pkg/metadata"
 )
 
@@ -106,5 +115,70 @@ func validateParameters(helper *pluginhelper.Data) []*operator.ValidationError {
 			helper.ValidationErrorForParameter(secretKeyParameter, "cannot be empty"))
 	}
 
+	// Without a bucket, WALs and backups are stored inside the PVC
+	for _, prefix := range []string{"", objectstore.SecondaryPrefix, objectstore.SourcePrefix} {
+		if objectstore.IsConfigured(helper.Parameters, prefix) {
+			_, err := objectstore.NewConfigurationFromPrefixedParameters(helper.Parameters, prefix)
+			if err != nil {
+				result = append(result, validationErrorFor(helper, err)...)
+			}
+		}
+	}
+
+	if _, err := objectstore.NewWebIdentityTokenConfigurationFromParameters(helper.Parameters); err != nil {
+		result = append(result, validationErrorFor(helper, err)...)
+	}
+
+	if _, _, err := storage.GetDestinationsFromParameters(helper.Parameters); err != nil {
+		result = append(result, validationErrorFor(helper, err)...)
+	}
+
+	if err := wal.ValidateRestoreParameters(helper.Parameters); err != nil {
+		result = append(result, validationErrorFor(helper, err)...)
+	}
+
+	if err := hooks.ValidateParameters(helper.Parameters); err != nil {
+		result = append(result, validationErrorFor(helper, err)...)
+	}
+
+	if _, err := executor.GetExclusionsFromParameters(helper.Parameters); err != nil {
+		result = append(result, validationErrorFor(helper, err)...)
+	}
+
+	if _, err := executor.GetParallelismFromParameters(helper.Parameters); err != nil {
+		result = append(result, validationErrorFor(helper, err)...)
+	}
+
+	if _, err := pagechecksum.NewOptionsFromParameters(helper.Parameters); err != nil {
+		result = append(result, validationErrorFor(helper, err)...)
+	}
+
+	if _, err := repository.NewPolicyConfigurationFromParameters(helper.Parameters); err != nil {
+		result = append(result, validationErrorFor(helper, err)...)
+	}
+
+	if _, err := throttling.NewConfigurationFromParameters(helper.Parameters); err != nil {
+		result = append(result, validationErrorFor(helper, err)...)
+	}
+
 	return result
 }
+
+// validationErrorFor converts the error raised while parsing
+// the plugin parameters into a validation error. The errors which
+// are not about a single parameter are reported on the plugins
+func validationErrorFor(helper *pluginhelper.Data, err error) []*operator.ValidationError {
+	var parameterError *objectstore.ParameterError
+	if !errors.As(err, &parameterError) {
+		return []*operator.ValidationError{
+			{
+				PathComponents: []string{"spec", "plugins"},
+				Message:        err.Error(),
+			},
+		}
+	}
+
+	return []*operator.ValidationError{
+		helper.ValidationErrorForParameter(parameterError.Name, parameterError.Message),
+	}
+}
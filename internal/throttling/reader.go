@@ -0,0 +1,101 @@
+package throttling
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// limiters are the rate limiters of each budget and direction. They
+// are shared by every transfer of the sidecar, so that concurrent
+// transfers divide the same bandwidth
+var (
+	limiters      = make(map[Budget]map[Direction]*rate.Limiter)
+	limitersMutex sync.Mutex
+)
+
+// getLimiter gets the shared rate limiter of a budget and
+// direction, updating its rate to the current limit
+func getLimiter(budget Budget, direction Direction, limit int64) *rate.Limiter {
+	limitersMutex.Lock()
+	defer limitersMutex.Unlock()
+
+	if limiters[budget] == nil {
+		limiters[budget] = make(map[Direction]*rate.Limiter)
+	}
+	limiter := limiters[budget][direction]
+	if limiter == nil {
+		limiter = rate.NewLimiter(rate.Inf, 0)
+		limiters[budget][direction] = limiter
+	}
+
+	newLimit := rate.Limit(limit)
+	if limit == 0 {
+		newLimit = rate.Inf
+	}
+	if limiter.Limit() != newLimit {
+		// The burst allows a second worth of transfer, which is
+		// also the maximum size of a single read
+		limiter.SetLimit(newLimit)
+		limiter.SetBurst(int(limit))
+	}
+
+	return limiter
+}
+
+// reader is a reader whose bandwidth is limited
+type reader struct {
+	io.Reader
+
+	ctx           context.Context
+	configuration *Configuration
+	budget        Budget
+	direction     Direction
+}
+
+// NewReader wraps a reader, limiting its bandwidth according to the
+// limits of a budget. The limits are checked at every read, so that
+// long transfers follow the windows of the schedule
+func (configuration *Configuration) NewReader(
+	ctx context.Context,
+	source io.Reader,
+	budget Budget,
+	direction Direction,
+) io.Reader {
+	if !configuration.IsConfigured() {
+		return source
+	}
+
+	return &reader{
+		Reader:        source,
+		ctx:           ctx,
+		configuration: configuration,
+		budget:        budget,
+		direction:     direction,
+	}
+}
+
+// Read implements io.Reader
+func (reader *reader) Read(p []byte) (int, error) {
+	limit := reader.configuration.GetLimits(reader.budget, time.Now()).Get(reader.direction)
+	if limit == 0 {
+		return reader.Reader.Read(p)
+	}
+
+	limiter := getLimiter(reader.budget, reader.direction, limit)
+	if len(p) > limiter.Burst() {
+		p = p[:limiter.Burst()]
+	}
+
+	n, err := reader.Reader.Read(p)
+	if n > 0 {
+		if waitErr := limiter.WaitN(reader.ctx, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+
+	return n, err
+}
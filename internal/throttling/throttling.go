@@ -0,0 +1,329 @@
+// Package throttling limits the bandwidth used by the transfers
+// to the object stores, according to a time-window schedule
+package throttling
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/objectstore"
+)
+
+const (
+	// BackupUploadLimitParameter is the upload bandwidth, per second,
+	// of the base backups, as a quantity, i.e. "50Mi"
+	BackupUploadLimitParameter = "backupUploadLimit"
+
+	// BackupDownloadLimitParameter is the download bandwidth,
+	// per second, of the base backups
+	BackupDownloadLimitParameter = "backupDownloadLimit"
+
+	// WALUploadLimitParameter is the upload bandwidth, per second,
+	// of the WAL files being archived
+	WALUploadLimitParameter = "walUploadLimit"
+
+	// WALDownloadLimitParameter is the download bandwidth,
+	// per second, of the WAL files being restored
+	WALDownloadLimitParameter = "walDownloadLimit"
+
+	// ScheduleParameter is a JSON list of time windows overriding the
+	// limits, i.e. [{"days": ["mon", "fri"], "start": "08:00",
+	// "end": "18:00", "backupUploadLimit": "10Mi"}]. Times are in UTC,
+	// and the first window containing the current time is used
+	ScheduleParameter = "throttlingSchedule"
+)
+
+// Budget is a bandwidth budget. Every budget has its own limits,
+// so that the transfers of a budget never slow down the other ones
+type Budget string
+
+const (
+	// BudgetBackup is the budget of the base backups
+	BudgetBackup Budget = "backup"
+
+	// BudgetWAL is the budget of the WAL files. WAL archiving
+	// is never slowed down by the base backups
+	BudgetWAL Budget = "wal"
+)
+
+// Direction is the direction of a transfer
+type Direction string
+
+const (
+	// DirectionUpload is a transfer to an object store
+	DirectionUpload Direction = "upload"
+
+	// DirectionDownload is a transfer from an object store
+	DirectionDownload Direction = "download"
+)
+
+// Limits are the bandwidth limits of a budget, in bytes
+// per second. Zero means unlimited
+type Limits struct {
+	// Upload is the upload bandwidth
+	Upload int64
+
+	// Download is the download bandwidth
+	Download int64
+}
+
+// Get gets the limit of a direction
+func (limits Limits) Get(direction Direction) int64 {
+	if direction == DirectionUpload {
+		return limits.Upload
+	}
+	return limits.Download
+}
+
+// Window is a time window with its own limits
+type Window struct {
+	// Days are the days of the week of the window,
+	// empty for every day
+	Days []time.Weekday
+
+	// Start is the beginning of the window, as
+	// the time elapsed since midnight
+	Start time.Duration
+
+	// End is the end of the window, as the time elapsed since
+	// midnight. When before the start, the window ends the next day
+	End time.Duration
+
+	// Limits are the limits of the budgets during the window, in
+	// bytes per second. The limits which are not set use the default
+	Limits map[Budget]map[Direction]int64
+}
+
+// Configuration is the throttling configuration,
+// as read from the plugin parameters
+type Configuration struct {
+	// Limits are the default limits of the budgets,
+	// in bytes per second. Missing limits are unlimited
+	Limits map[Budget]map[Direction]int64
+
+	// Schedule are the windows overriding the default limits
+	Schedule []Window
+}
+
+// windowDocument is the JSON representation of a window
+type windowDocument struct {
+	Days                []string `json:"days,omitempty"`
+	Start               string   `json:"start"`
+	End                 string   `json:"end"`
+	BackupUploadLimit   string   `json:"backupUploadLimit,omitempty"`
+	BackupDownloadLimit string   `json:"backupDownloadLimit,omitempty"`
+	WALUploadLimit      string   `json:"walUploadLimit,omitempty"`
+	WALDownloadLimit    string   `json:"walDownloadLimit,omitempty"`
+}
+
+// limitParameters are the parameters of the limit
+// of each budget and direction
+var limitParameters = map[Budget]map[Direction]string{
+	BudgetBackup: {
+		DirectionUpload:   BackupUploadLimitParameter,
+		DirectionDownload: BackupDownloadLimitParameter,
+	},
+	BudgetWAL: {
+		DirectionUpload:   WALUploadLimitParameter,
+		DirectionDownload: WALDownloadLimitParameter,
+	},
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// NewConfigurationFromParameters reads the throttling
+// configuration from the plugin parameters
+func NewConfigurationFromParameters(parameters map[string]string) (*Configuration, error) {
+	result := &Configuration{}
+
+	var err error
+	result.Limits, err = parseLimits(func(name string) string {
+		return parameters[name]
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	value := parameters[ScheduleParameter]
+	if len(value) == 0 {
+		return result, nil
+	}
+
+	var documents []windowDocument
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&documents); err != nil {
+		return nil, &objectstore.ParameterError{
+			Name:    ScheduleParameter,
+			Message: fmt.Sprintf("is not a valid JSON list of time windows: %v", err),
+		}
+	}
+
+	for i := range documents {
+		window, err := documents[i].toWindow()
+		if err != nil {
+			return nil, &objectstore.ParameterError{
+				Name:    ScheduleParameter,
+				Message: fmt.Sprintf("contains an invalid window at position %d: %v", i, err),
+			}
+		}
+		result.Schedule = append(result.Schedule, *window)
+	}
+
+	return result, nil
+}
+
+// IsConfigured is true when any limit is configured
+func (configuration *Configuration) IsConfigured() bool {
+	return configuration != nil && (len(configuration.Limits) > 0 || len(configuration.Schedule) > 0)
+}
+
+// GetLimits gets the limits of a budget at a certain time. The first
+// window containing it overrides the limits it sets
+func (configuration *Configuration) GetLimits(budget Budget, now time.Time) Limits {
+	if configuration == nil {
+		return Limits{}
+	}
+
+	limits := map[Direction]int64{
+		DirectionUpload:   configuration.Limits[budget][DirectionUpload],
+		DirectionDownload: configuration.Limits[budget][DirectionDownload],
+	}
+	for i := range configuration.Schedule {
+		if configuration.Schedule[i].Contains(now) {
+			for direction, value := range configuration.Schedule[i].Limits[budget] {
+				limits[direction] = value
+			}
+			break
+		}
+	}
+
+	return Limits{
+		Upload:   limits[DirectionUpload],
+		Download: limits[DirectionDownload],
+	}
+}
+
+// Contains checks if a time is inside the window
+func (window *Window) Contains(now time.Time) bool {
+	now = now.UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	elapsed := now.Sub(midnight)
+
+	day := now.Weekday()
+	switch {
+	case window.Start <= window.End:
+		if elapsed < window.Start || elapsed >= window.End {
+			return false
+		}
+	case elapsed >= window.Start:
+		// Before midnight, in a window ending the next day
+	case elapsed < window.End:
+		// After midnight, in a window started the previous day
+		day = (day + 6) % 7
+	default:
+		return false
+	}
+
+	if len(window.Days) == 0 {
+		return true
+	}
+	for _, windowDay := range window.Days {
+		if windowDay == day {
+			return true
+		}
+	}
+	return false
+}
+
+// toWindow validates a window read from the
+// schedule, converting it to a Window
+func (document *windowDocument) toWindow() (*Window, error) {
+	result := &Window{}
+
+	for _, day := range document.Days {
+		weekday, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			return nil, fmt.Errorf("unknown day %q, expected one of sun, mon, tue, wed, thu, fri, sat", day)
+		}
+		result.Days = append(result.Days, weekday)
+	}
+
+	var err error
+	if result.Start, err = parseTimeOfDay(document.Start); err != nil {
+		return nil, fmt.Errorf("malformed start: %w", err)
+	}
+	if result.End, err = parseTimeOfDay(document.End); err != nil {
+		return nil, fmt.Errorf("malformed end: %w", err)
+	}
+	if result.Start == result.End {
+		return nil, fmt.Errorf("the window is empty")
+	}
+
+	values := map[string]string{
+		BackupUploadLimitParameter:   document.BackupUploadLimit,
+		BackupDownloadLimitParameter: document.BackupDownloadLimit,
+		WALUploadLimitParameter:      document.WALUploadLimit,
+		WALDownloadLimitParameter:    document.WALDownloadLimit,
+	}
+	result.Limits, err = parseLimits(func(name string) string {
+		return values[name]
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// parseLimits reads the limits of every budget,
+// skipping the ones which are not set
+func parseLimits(getValue func(name string) string) (map[Budget]map[Direction]int64, error) {
+	result := make(map[Budget]map[Direction]int64)
+	for budget, parameters := range limitParameters {
+		for direction, name := range parameters {
+			value := getValue(name)
+			if len(value) == 0 {
+				continue
+			}
+
+			quantity, err := resource.ParseQuantity(value)
+			if err != nil || quantity.Sign() < 0 {
+				return nil, &objectstore.ParameterError{
+					Name:    name,
+					Message: "must be a non negative quantity of bytes per second, i.e. \"50Mi\"",
+				}
+			}
+
+			if result[budget] == nil {
+				result[budget] = make(map[Direction]int64)
+			}
+			result[budget][direction] = quantity.Value()
+		}
+	}
+
+	return result, nil
+}
+
+// parseTimeOfDay reads a time of the day in the "15:04" format,
+// returning the time elapsed since midnight
+func parseTimeOfDay(value string) (time.Duration, error) {
+	parsed, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not in the HH:MM format", value)
+	}
+
+	return time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute, nil
+}
@@ -0,0 +1,286 @@
+package wal
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"time"
+
+	"github.com/cloudnative-pg/cloudnative-pg/pkg/postgres"
+	"github.com/cloudnative-pg/cnpg-i-machinery/pkg/logging"
+	"github.com/cloudnative-pg/cnpg-i-machinery/pkg/pluginhelper"
+	"github.com/cloudnative-pg/cnpg-i/pkg/wal"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/catalog"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/storage"
+	"github.com/dougkirkley/plugin-objstore-backup/pkg/metadata"
+)
+
+// WALRange is a range of WAL files, including its extremes
+type WALRange struct {
+	// Begin is the first WAL file of the range
+	Begin string
+
+	// End is the last WAL file of the range
+	End string
+}
+
+// Contains checks if a WAL file is inside the range. The position
+// of the WAL file needs to be inside the range, on one of the
+// timelines of the range
+func (walRange WALRange) Contains(walName string) bool {
+	segment, err := postgres.SegmentFromName(walName)
+	if err != nil {
+		return false
+	}
+	begin, err := postgres.SegmentFromName(walRange.Begin)
+	if err != nil {
+		return false
+	}
+	end, err := postgres.SegmentFromName(walRange.End)
+	if err != nil {
+		return false
+	}
+
+	return segment.Tli >= begin.Tli && segment.Tli <= end.Tli &&
+		compareSegmentPositions(segment, begin) >= 0 &&
+		compareSegmentPositions(segment, end) <= 0
+}
+
+// compareSegmentPositions compares the position of two WAL segments,
+// regardless of their timeline. It is negative when the first one
+// precedes the second one, and positive when it follows it
+func compareSegmentPositions(first postgres.Segment, second postgres.Segment) int {
+	if first.Log != second.Log {
+		return int(first.Log) - int(second.Log)
+	}
+	return int(first.Seg) - int(second.Seg)
+}
+
+// isWALRequired checks if a WAL segment is needed by a backup whose
+// first required segment is a given one. The segments preceding it
+// on the same timeline or on a parent one are not needed, while
+// the ones of the following timelines always are
+func isWALRequired(segment postgres.Segment, firstRequired postgres.Segment) bool {
+	return segment.Tli > firstRequired.Tli || compareSegmentPositions(segment, firstRequired) >= 0
+}
+
+// IsWALNeeded checks if a WAL file is needed to recover a backup whose
+// first required WAL file is a given one. Malformed names are
+// considered needed, so that they are never removed or archived
+func IsWALNeeded(walName string, firstRequiredWAL string) bool {
+	segment, err := postgres.SegmentFromName(walName)
+	if err != nil {
+		return true
+	}
+	firstRequired, err := postgres.SegmentFromName(firstRequiredWAL)
+	if err != nil {
+		return true
+	}
+
+	return isWALRequired(segment, firstRequired)
+}
+
+// GetPinnedWALRanges gets the WAL files needed for consistency by
+// the backups which are pinned at a certain time
+func GetPinnedWALRanges(backups []catalog.BackupInfo, now time.Time) []WALRange {
+	var result []WALRange
+	for i := range backups {
+		if !backups[i].IsPinned(now) || len(backups[i].BeginWal) == 0 {
+			continue
+		}
+
+		result = append(result, WALRange{Begin: backups[i].BeginWal, End: backups[i].EndWal})
+	}
+
+	return result
+}
+
+// SetFirstRequired removes from every destination the WAL files
+// preceding the first one required by the existing backups.
+// WAL files whose object lock retention has not expired are kept,
+// and will be removed by a later invocation. The WAL files needed
+// by the pinned backups are kept too
+func (WAL) SetFirstRequired(
+	ctx context.Context,
+	request *wal.SetFirstRequiredRequest,
+) (*wal.SetFirstRequiredResult, error) {
+	contextLogger := logging.FromContext(ctx)
+
+	helper, err := pluginhelper.NewDataBuilder(metadata.Data.Name, request.ClusterDefinition).Build()
+	if err != nil {
+		contextLogger.Error(err, "Error while decoding cluster definition from CNPG")
+		return nil, err
+	}
+
+	destinations, err := storage.NewDestinationsFromParameters(helper.Parameters)
+	if err != nil {
+		contextLogger.Error(err, "Error while reading the destinations configuration")
+		return nil, err
+	}
+
+	clusterName := helper.GetCluster().Name
+	contextLogger = contextLogger.WithValues(
+		"clusterName", clusterName,
+		"firstRequiredWal", request.FirstRequiredWal,
+	)
+
+	pinnedRanges, err := getPinnedWALRanges(ctx, clusterName, helper.GetCluster().Namespace, helper.Parameters)
+	if err != nil {
+		contextLogger.Error(err, "Error while reading the pinned backups from the catalog")
+		return nil, err
+	}
+
+	if err := PruneWALs(ctx, destinations.Stores, clusterName, request.FirstRequiredWal, pinnedRanges); err != nil {
+		contextLogger.Error(err, "Error while removing WAL files")
+		return nil, err
+	}
+
+	return &wal.SetFirstRequiredResult{}, nil
+}
+
+// getPinnedWALRanges reads the WAL files needed by the
+// pinned backups from the catalog
+func getPinnedWALRanges(
+	ctx context.Context,
+	clusterName string,
+	namespace string,
+	parameters map[string]string,
+) ([]WALRange, error) {
+	target, err := storage.NewBackupTargetFromParameters(parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	backups, err := catalog.New(clusterName, namespace, target.Store).List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return GetPinnedWALRanges(backups, time.Now()), nil
+}
+
+// getCatchUpFilter gets the filter of the WAL files to be copied into
+// the lagging destinations, i.e. the ones still needed by the backups
+// in the catalog. The other ones may have been removed by the retention
+// policy from some destinations, and are not copied back
+func getCatchUpFilter(
+	ctx context.Context,
+	clusterName string,
+	namespace string,
+	parameters map[string]string,
+) (func(key string) bool, error) {
+	target, err := storage.NewBackupTargetFromParameters(parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	backups, err := catalog.New(clusterName, namespace, target.Store).List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The backups are sorted by start time, and the WAL files
+	// preceding the oldest completed one have been removed
+	firstRequiredWAL := ""
+	for i := range backups {
+		if backups[i].Phase == catalog.PhaseCompleted && len(backups[i].BeginWal) > 0 {
+			firstRequiredWAL = backups[i].BeginWal
+			break
+		}
+	}
+	pinnedRanges := GetPinnedWALRanges(backups, time.Now())
+
+	return func(key string) bool {
+		walName := path.Base(key)
+		if len(firstRequiredWAL) == 0 || !postgres.IsWALFile(walName) || IsWALNeeded(walName, firstRequiredWAL) {
+			return true
+		}
+
+		return slices.ContainsFunc(pinnedRanges, func(walRange WALRange) bool {
+			return walRange.Contains(walName)
+		})
+	}, nil
+}
+
+// PruneWALs removes from a set of stores the WAL files preceding
+// the first one required by the existing backups, except the ones
+// contained in the kept ranges
+func PruneWALs(
+	ctx context.Context,
+	stores []storage.Store,
+	clusterName string,
+	firstRequiredWAL string,
+	keptRanges []WALRange,
+) error {
+	for _, store := range stores {
+		if err := pruneWALs(ctx, store, clusterName, firstRequiredWAL, keptRanges); err != nil {
+			return fmt.Errorf("while removing WAL files from %s: %w", store.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+// pruneWALs removes from a store the WAL files preceding the first
+// required one, except the ones contained in the kept ranges.
+// History files are always kept. The WAL files are removed in
+// batches, and the locked ones are skipped
+func pruneWALs(
+	ctx context.Context,
+	store storage.Store,
+	clusterName string,
+	firstRequiredWAL string,
+	keptRanges []WALRange,
+) error {
+	contextLogger := logging.FromContext(ctx).WithValues("destination", store.Name())
+
+	firstRequired, err := postgres.SegmentFromName(firstRequiredWAL)
+	if err != nil {
+		return fmt.Errorf("malformed first required WAL %q: %w", firstRequiredWAL, err)
+	}
+
+	walObjects, err := store.List(ctx, storage.GetWALKey(clusterName))
+	if err != nil {
+		return err
+	}
+
+	var removable []string
+	locked := 0
+	pinned := 0
+	now := time.Now()
+	for _, walObject := range walObjects {
+		walName := path.Base(walObject.Key)
+		if !postgres.IsWALFile(walName) {
+			continue
+		}
+		segment, err := postgres.SegmentFromName(walName)
+		if err != nil || isWALRequired(segment, firstRequired) {
+			continue
+		}
+		if slices.ContainsFunc(keptRanges, func(walRange WALRange) bool {
+			return walRange.Contains(walName)
+		}) {
+			pinned++
+			continue
+		}
+		if walObject.IsLocked(now) {
+			locked++
+			continue
+		}
+
+		removable = append(removable, walObject.Key)
+	}
+
+	if err := store.DeleteMany(ctx, removable); err != nil {
+		return err
+	}
+
+	contextLogger.Info(
+		"Removed WAL files not required anymore",
+		"removed", len(removable),
+		"locked", locked,
+		"pinned", pinned)
+	return nil
+}
@@ -0,0 +1,169 @@
+package wal
+
+import (
+	"context"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/storage"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/storage/s3test"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/objectstore"
+)
+
+// newTestStore creates a store kept inside an in-memory bucket
+func newTestStore(t *testing.T, objectLock bool, parameters map[string]string) (storage.Store, *s3test.Server) {
+	t.Helper()
+
+	// Requests are not signed without credentials
+	for _, name := range []string{"AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY", "AWS_SECRET_ACCESS_KEY", "AWS_SECRET_KEY"} {
+		t.Setenv(name, "")
+	}
+
+	server := s3test.NewServer()
+	server.ObjectLock = objectLock
+	t.Cleanup(server.Close)
+
+	configuration, err := objectstore.NewConfigurationFromParameters(server.Parameters(parameters))
+	if err != nil {
+		t.Fatalf("unexpected error reading the configuration: %v", err)
+	}
+
+	store, err := storage.NewS3Store(string(storage.DestinationS3), configuration)
+	if err != nil {
+		t.Fatalf("unexpected error creating the store: %v", err)
+	}
+
+	return store, server
+}
+
+// setWALs stores a set of WAL files of a cluster, last
+// modified at a certain time
+func setWALs(server *s3test.Server, lastModified time.Time, walNames ...string) {
+	for _, walName := range walNames {
+		server.SetObject(storage.GetWALFileKey("cluster", walName), s3test.Object{
+			Content:      []byte(walName),
+			LastModified: lastModified,
+		})
+	}
+}
+
+// getWALs gets the sorted names of the WAL files of a cluster
+// which are stored
+func getWALs(server *s3test.Server) []string {
+	var result []string
+	for _, key := range server.Keys() {
+		if strings.HasPrefix(key, storage.GetWALKey("cluster")+"/") {
+			result = append(result, path.Base(key))
+		}
+	}
+	slices.Sort(result)
+	return result
+}
+
+func TestPruneWALsTimelines(t *testing.T) {
+	store, server := newTestStore(t, false, nil)
+
+	old := time.Now().Add(-time.Hour)
+	setWALs(server, old,
+		"0000000100000000000000FE",
+		"0000000100000001000000A0",
+		"000000010000000200000001",
+		"000000020000000100000010",
+		"000000020000000100000020",
+		"000000020000000100000021",
+		"000000030000000000000001",
+		"00000002.history",
+	)
+
+	err := PruneWALs(context.Background(), []storage.Store{store}, "cluster", "000000020000000100000020", nil)
+	if err != nil {
+		t.Fatalf("unexpected error pruning the WAL files: %v", err)
+	}
+
+	// The WAL files are compared by position, so that the ones of the
+	// parent timeline following the first required one are kept, as
+	// well as the ones of the following timelines
+	expected := []string{
+		"0000000100000001000000A0",
+		"000000010000000200000001",
+		"00000002.history",
+		"000000020000000100000020",
+		"000000020000000100000021",
+		"000000030000000000000001",
+	}
+	if remaining := getWALs(server); !slices.Equal(remaining, expected) {
+		t.Fatalf("unexpected remaining WAL files %v, expected %v", remaining, expected)
+	}
+}
+
+func TestPruneWALsPinnedAndLocked(t *testing.T) {
+	store, server := newTestStore(t, true, map[string]string{
+		objectstore.ObjectLockModeParameter:      string(minio.Governance),
+		objectstore.ObjectLockRetentionParameter: "1d",
+	})
+
+	setWALs(server, time.Now().Add(-48*time.Hour),
+		"000000010000000000000001",
+		"000000010000000000000002",
+		"000000010000000000000003",
+		"000000010000000000000004",
+		"000000010000000000000010",
+	)
+	setWALs(server, time.Now(), "000000010000000000000005")
+	server.ResetRequests()
+
+	keptRanges := []WALRange{{Begin: "000000010000000000000002", End: "000000010000000000000003"}}
+	err := PruneWALs(context.Background(), []storage.Store{store}, "cluster", "000000010000000000000010", keptRanges)
+	if err != nil {
+		t.Fatalf("unexpected error pruning the WAL files: %v", err)
+	}
+
+	expected := []string{
+		"000000010000000000000002",
+		"000000010000000000000003",
+		"000000010000000000000005",
+		"000000010000000000000010",
+	}
+	if remaining := getWALs(server); !slices.Equal(remaining, expected) {
+		t.Fatalf("unexpected remaining WAL files %v, expected %v", remaining, expected)
+	}
+
+	// The locked WAL files are found from the listing, and
+	// the other ones are removed with a single request
+	if requests := server.Requests("GetObjectRetention") + server.Requests("DeleteObject"); requests != 0 {
+		t.Fatalf("expected no requests for single WAL files, got %d", requests)
+	}
+	if requests := server.Requests("DeleteObjects"); requests != 1 {
+		t.Fatalf("expected a single batch deletion, got %d", requests)
+	}
+}
+
+func TestWALRangeContains(t *testing.T) {
+	walRange := WALRange{Begin: "0000000200000001000000FE", End: "000000020000000200000001"}
+
+	tests := []struct {
+		walName  string
+		expected bool
+	}{
+		{walName: "0000000200000001000000FD", expected: false},
+		{walName: "0000000200000001000000FE", expected: true},
+		{walName: "0000000200000001000000FF", expected: true},
+		{walName: "000000020000000200000000", expected: true},
+		{walName: "000000020000000200000001", expected: true},
+		{walName: "000000020000000200000002", expected: false},
+		{walName: "0000000100000001000000FF", expected: false},
+		{walName: "0000000300000001000000FF", expected: false},
+		{walName: "00000002.history", expected: false},
+	}
+
+	for _, test := range tests {
+		if result := walRange.Contains(test.walName); result != test.expected {
+			t.Errorf("Contains(%s) = %v, expected %v", test.walName, result, test.expected)
+		}
+	}
+}
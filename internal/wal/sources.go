@@ -0,0 +1,395 @@
+package wal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudnative-pg/cloudnative-pg/pkg/management/barman/spool"
+	"github.com/cloudnative-pg/cloudnative-pg/pkg/postgres"
+	"github.com/cloudnative-pg/cnpg-i-machinery/pkg/logging"
+
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/storage"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/objectstore"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/throttling"
+)
+
+const (
+	// restoreSourcesParameter is the comma separated list of the
+	// sources WALs are restored from, in order of preference
+	restoreSourcesParameter = "restoreSources"
+
+	// restoreTimeoutParameterSuffix is the suffix of the parameters
+	// setting the timeout of each restore source, i.e. "s3RestoreTimeout"
+	restoreTimeoutParameterSuffix = "RestoreTimeout"
+
+	// restorePrefetchParameter is the number of WAL files that are
+	// downloaded in the spool after the requested one
+	restorePrefetchParameter = "restorePrefetch"
+
+	// sourceClusterNameParameter is the name of the cluster whose
+	// archive is followed when restoring WALs, i.e. the primary
+	// cluster of a replica cluster
+	sourceClusterNameParameter = "sourceClusterName"
+)
+
+const (
+	// spoolSourceName is the name of the local spool source
+	spoolSourceName = "spool"
+
+	// sourceBucketSourceName is the name of the source reading
+	// from the bucket configured by the "source" prefixed parameters
+	sourceBucketSourceName = "source"
+
+	// spoolDirectory is where prefetched WAL files are kept
+	// until PostgreSQL requests them
+	spoolDirectory = "/controller/wal-restore-spool"
+
+	defaultRestoreTimeout = 1 * time.Minute
+)
+
+const (
+	restoreResultRestored = "restored"
+	restoreResultNotFound = "not_found"
+	restoreResultArchived = "archived"
+	restoreResultFailed   = "failed"
+)
+
+var (
+	// prefetching are the WAL files being downloaded in the spool
+	// by the background prefetches, which are never downloaded twice
+	prefetching      = make(map[string]bool)
+	prefetchingMutex sync.Mutex
+)
+
+// restoreSource is a place where WAL files can be restored from
+type restoreSource struct {
+	// name is the name of the source, used in logs and metrics
+	name string
+
+	// timeout is the maximum time a restore from this source can take
+	timeout time.Duration
+
+	// store is the store containing the WAL files, nil for the spool
+	store storage.Store
+}
+
+// restoreSources is the chain of sources WAL files are restored from
+type restoreSources struct {
+	// sources are the restore sources, in order of preference
+	sources []restoreSource
+
+	// clusterName is the name of the cluster whose archive
+	// WAL files are restored from
+	clusterName string
+
+	// prefetch is the number of WAL files to be downloaded
+	// in the spool after the requested one
+	prefetch int
+
+	// spool is the local spool of the prefetched WAL files
+	spool *spool.WALSpool
+}
+
+// newRestoreSourcesFromParameters creates the chain of restore sources
+// configured in the plugin parameters. Without an explicit configuration
+// WAL files are restored from the configured destinations, in order,
+// or from the source bucket when it is configured
+func newRestoreSourcesFromParameters(clusterName string, parameters map[string]string) (*restoreSources, error) {
+	result, err := getRestoreSourcesConfiguration(parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	result.clusterName = clusterName
+	if sourceClusterName := parameters[sourceClusterNameParameter]; len(sourceClusterName) > 0 {
+		result.clusterName = sourceClusterName
+	}
+
+	for i := range result.sources {
+		switch result.sources[i].name {
+		case spoolSourceName:
+			result.spool, err = spool.New(spoolDirectory)
+
+		case sourceBucketSourceName:
+			result.sources[i].store, err = newSourceBucketStore(parameters)
+
+		default:
+			result.sources[i].store, err = storage.NewStore(storage.Destination(result.sources[i].name), parameters)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// newSourceBucketStore creates the store reading from the bucket
+// containing the archive of the source cluster
+func newSourceBucketStore(parameters map[string]string) (storage.Store, error) {
+	configuration, err := objectstore.NewConfigurationFromPrefixedParameters(parameters, objectstore.SourcePrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	throttlingConfiguration, err := throttling.NewConfigurationFromParameters(parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	return storage.NewThrottledS3Store(
+		sourceBucketSourceName,
+		configuration,
+		throttlingConfiguration,
+		throttling.BudgetWAL)
+}
+
+// ValidateRestoreParameters checks the restore sources configuration
+// contained in the plugin parameters
+func ValidateRestoreParameters(parameters map[string]string) error {
+	_, err := getRestoreSourcesConfiguration(parameters)
+	return err
+}
+
+// getRestoreSourcesConfiguration reads the restore sources configuration
+// from the plugin parameters, without creating the stores
+func getRestoreSourcesConfiguration(parameters map[string]string) (*restoreSources, error) {
+	result := &restoreSources{}
+
+	if value := parameters[restorePrefetchParameter]; len(value) > 0 {
+		prefetch, err := strconv.Atoi(value)
+		if err != nil || prefetch < 0 {
+			return nil, &objectstore.ParameterError{
+				Name:    restorePrefetchParameter,
+				Message: "must be a non negative integer",
+			}
+		}
+		result.prefetch = prefetch
+	}
+
+	names, err := getRestoreSourceNames(parameters, result.prefetch > 0)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		source := restoreSource{
+			name:    name,
+			timeout: defaultRestoreTimeout,
+		}
+
+		timeoutParameter := name + restoreTimeoutParameterSuffix
+		if value := parameters[timeoutParameter]; len(value) > 0 {
+			source.timeout, err = time.ParseDuration(value)
+			if err != nil || source.timeout <= 0 {
+				return nil, &objectstore.ParameterError{
+					Name:    timeoutParameter,
+					Message: "must be a positive duration",
+				}
+			}
+		}
+
+		result.sources = append(result.sources, source)
+	}
+
+	return result, nil
+}
+
+// getRestoreSourceNames gets the names of the configured restore
+// sources. The spool is used first when prefetching is enabled
+func getRestoreSourceNames(parameters map[string]string, prefetch bool) ([]string, error) {
+	var result []string
+
+	sourceBucketConfigured := objectstore.IsConfigured(parameters, objectstore.SourcePrefix)
+	if sourceBucketConfigured && len(parameters[sourceClusterNameParameter]) == 0 {
+		return nil, &objectstore.ParameterError{
+			Name:    sourceClusterNameParameter,
+			Message: "cannot be empty when the source bucket is configured",
+		}
+	}
+
+	if value := parameters[restoreSourcesParameter]; len(value) > 0 {
+		for _, item := range strings.Split(value, ",") {
+			name := strings.TrimSpace(item)
+			switch name {
+			case spoolSourceName:
+			case sourceBucketSourceName:
+				if !sourceBucketConfigured {
+					return nil, &objectstore.ParameterError{
+						Name:    restoreSourcesParameter,
+						Message: fmt.Sprintf("contains %q, but the source bucket is not configured", name),
+					}
+				}
+			default:
+				if err := storage.Destination(name).Validate(parameters); err != nil {
+					return nil, &objectstore.ParameterError{Name: restoreSourcesParameter, Message: err.Error()}
+				}
+			}
+
+			if slices.Contains(result, name) {
+				return nil, &objectstore.ParameterError{
+					Name:    restoreSourcesParameter,
+					Message: fmt.Sprintf("contains %q more than once", name),
+				}
+			}
+
+			result = append(result, name)
+		}
+	} else if sourceBucketConfigured {
+		result = append(result, sourceBucketSourceName)
+	} else {
+		destinations, _, err := storage.GetDestinationsFromParameters(parameters)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, destination := range destinations {
+			result = append(result, string(destination))
+		}
+	}
+
+	if prefetch && !slices.Contains(result, spoolSourceName) {
+		result = append([]string{spoolSourceName}, result...)
+	}
+
+	return result, nil
+}
+
+// restore restores a WAL file from this source
+func (source *restoreSource) restore(
+	ctx context.Context,
+	walSpool *spool.WALSpool,
+	walKey string,
+	walName string,
+	destinationPath string,
+) error {
+	ctx, cancel := context.WithTimeout(ctx, source.timeout)
+	defer cancel()
+
+	if source.store == nil {
+		found, err := walSpool.Contains(walName)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return storage.ErrObjectNotFound
+		}
+		return walSpool.MoveOut(walName, destinationPath)
+	}
+
+	return source.store.Get(ctx, walKey, destinationPath)
+}
+
+// prefetch downloads a WAL file in the spool, using a temporary
+// file so that a partially downloaded WAL file is never used
+func (source *restoreSource) prefetch(
+	ctx context.Context,
+	walSpool *spool.WALSpool,
+	walKey string,
+	walName string,
+) error {
+	ctx, cancel := context.WithTimeout(ctx, source.timeout)
+	defer cancel()
+
+	found, err := walSpool.Contains(walName)
+	if err != nil || found {
+		return err
+	}
+
+	temporaryPath := walSpool.FileName(walName) + ".partial"
+	if err := source.store.Get(ctx, walKey, temporaryPath); err != nil {
+		_ = os.Remove(temporaryPath)
+		return err
+	}
+
+	return os.Rename(temporaryPath, walSpool.FileName(walName))
+}
+
+// startPrefetch downloads in background the WAL files following the
+// one that has just been restored, so that they are available in the
+// spool when PostgreSQL requests them. The prefetch outlives the
+// restore request, which returns without waiting for it
+func (sources *restoreSources) startPrefetch(
+	ctx context.Context,
+	source *restoreSource,
+	walName string,
+) {
+	if sources.prefetch == 0 || source.store == nil || !postgres.IsWALFile(walName) {
+		return
+	}
+
+	go sources.prefetchNext(context.WithoutCancel(ctx), source, walName)
+}
+
+// prefetchNext downloads in the spool the WAL files following
+// the one that has just been restored. The WAL files which are
+// already being downloaded by a previous prefetch are skipped
+func (sources *restoreSources) prefetchNext(
+	ctx context.Context,
+	source *restoreSource,
+	walName string,
+) {
+	contextLogger := logging.FromContext(ctx)
+
+	segment, err := postgres.SegmentFromName(walName)
+	if err != nil {
+		contextLogger.Error(err, "Error while parsing WAL name, skipping prefetch")
+		return
+	}
+
+	// The first segment is the one that has just been restored
+	nextSegments := segment.NextSegments(sources.prefetch+1, nil, nil)[1:]
+
+	var wg sync.WaitGroup
+	for i := range nextSegments {
+		nextWALName := nextSegments[i].Name()
+		if !startPrefetching(nextWALName) {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer stopPrefetching(nextWALName)
+
+			err := source.prefetch(ctx, sources.spool, storage.GetWALFileKey(sources.clusterName, nextWALName), nextWALName)
+			switch {
+			case err == nil:
+				contextLogger.V(4).Info("Prefetched WAL File", "walName", nextWALName, "source", source.name)
+			case errors.Is(err, storage.ErrObjectNotFound):
+				contextLogger.V(4).Info("WAL File to be prefetched not found", "walName", nextWALName)
+			default:
+				contextLogger.Error(err, "Error while prefetching WAL File", "walName", nextWALName)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// startPrefetching marks a WAL file as being downloaded in the
+// spool, and is false when it is already being downloaded
+func startPrefetching(walName string) bool {
+	prefetchingMutex.Lock()
+	defer prefetchingMutex.Unlock()
+
+	if prefetching[walName] {
+		return false
+	}
+	prefetching[walName] = true
+	return true
+}
+
+// stopPrefetching marks a WAL file as not being downloaded anymore
+func stopPrefetching(walName string) {
+	prefetchingMutex.Lock()
+	defer prefetchingMutex.Unlock()
+
+	delete(prefetching, walName)
+}
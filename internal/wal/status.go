@@ -2,9 +2,6 @@ package wal
 
 import (
 	"context"
-	"fmt"
-	"io/fs"
-	"os"
 	"path"
 
 	"github.com/cloudnative-pg/cnpg-i-machinery/pkg/logging"
@@ -15,13 +12,6 @@ import (
 	"github.com/dougkirkley/plugin-objstore-backup/pkg/metadata"
 )
 
-type walStatMode string
-
-const (
-	walStatModeFirst = "first"
-	walStatModeLast  = "last"
-)
-
 // Status gets the statistics of the WAL file archive
 func (WAL) Status(
 	ctx context.Context,
@@ -35,73 +25,32 @@ func (WAL) Status(
 		return nil, err
 	}
 
-	walPath := storage.GetWALPath(helper.GetCluster().Name)
-	contextLogger = contextLogger.WithValues(
-		"walPath", walPath,
-		"clusterName", helper.GetCluster().Name,
-	)
-
-	walDirEntries, err := os.ReadDir(walPath)
+	destinations, err := storage.NewDestinationsFromParameters(helper.Parameters)
 	if err != nil {
-		contextLogger.Error(err, "Error while reading WALs directory")
+		contextLogger.Error(err, "Error while reading the destinations configuration")
 		return nil, err
 	}
 
-	firstWal, err := getWALStat(helper.GetCluster().Name, walDirEntries, walStatModeFirst)
-	if err != nil {
-		contextLogger.Error(err, "Error while reading WALs directory (getting first WAL)")
-		return nil, err
-	}
+	// The statistics are relative to the first configured destination
+	store := destinations.Stores[0]
+	walKey := storage.GetWALKey(helper.GetCluster().Name)
+	contextLogger = contextLogger.WithValues(
+		"walKey", walKey,
+		"source", store.Name(),
+		"clusterName", helper.GetCluster().Name,
+	)
 
-	lastWal, err := getWALStat(helper.GetCluster().Name, walDirEntries, walStatModeLast)
+	walObjects, err := store.List(ctx, walKey)
 	if err != nil {
-		contextLogger.Error(err, "Error while reading WALs directory (getting first WAL)")
+		contextLogger.Error(err, "Error while listing WALs")
 		return nil, err
 	}
 
-	return &wal.WALStatusResult{
-		FirstWal: firstWal,
-		LastWal:  lastWal,
-	}, nil
-}
-
-func getWALStat(clusterName string, entries []fs.DirEntry, mode walStatMode) (string, error) {
-	entry, ok := getEntry(entries, mode)
-	if !ok {
-		return "", nil
+	result := &wal.WALStatusResult{}
+	if len(walObjects) > 0 {
+		result.FirstWal = path.Base(walObjects[0].Key)
+		result.LastWal = path.Base(walObjects[len(walObjects)-1].Key)
 	}
 
-	if !entry.IsDir() {
-		return "", fmt.Errorf("%s is not a directory", entry)
-	}
-
-	entryAbsolutePath := path.Join(storage.GetWALPath(clusterName), entry.Name())
-	subFolderEntries, err := os.ReadDir(entryAbsolutePath)
-	if err != nil {
-		return "", fmt.Errorf("while reading %s entries: %w", entry, err)
-	}
-
-	selectSubFolderEntry, ok := getEntry(subFolderEntries, mode)
-	if !ok {
-		return "", nil
-	}
-
-	return selectSubFolderEntry.Name(), nil
-}
-
-func getEntry(entries []fs.DirEntry, mode walStatMode) (fs.DirEntry, bool) {
-	if len(entries) == 0 {
-		return nil, false
-	}
-
-	switch mode {
-	case walStatModeFirst:
-		return entries[0], true
-
-	case walStatModeLast:
-		return entries[len(entries)-1], true
-
-	default:
-		return nil, false
-	}
+	return result, nil
 }
@@ -18,14 +18,18 @@ package wal
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"path"
+	"time"
 
-	"github.com/cloudnative-pg/cloudnative-pg/pkg/fileutils"
 	"github.com/cloudnative-pg/cnpg-i-machinery/pkg/logging"
 	"github.com/cloudnative-pg/cnpg-i-machinery/pkg/pluginhelper"
 	"github.com/cloudnative-pg/cnpg-i/pkg/wal"
 
 	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/storage"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/metrics"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/objectstore"
 	"github.com/dougkirkley/plugin-objstore-backup/pkg/metadata"
 )
 
@@ -42,25 +46,56 @@ func (WAL) Archive(
 		return nil, err
 	}
 
+	destinations, err := storage.NewDestinationsFromParameters(helper.Parameters)
+	if err != nil {
+		contextLogger.Error(err, "Error while reading the destinations configuration")
+		return nil, err
+	}
+
+	clusterName := helper.GetCluster().Name
+	putOptions := storage.NewPutOptions(clusterName, helper.GetCluster().Namespace, objectstore.ObjectTypeWAL)
 	walName := path.Base(request.SourceFileName)
-	destinationPath := storage.GetWALFilePath(helper.GetCluster().Name, walName)
+	walKey := storage.GetWALFileKey(clusterName, walName)
 
 	contextLogger = contextLogger.WithValues(
 		"sourceFileName", request.SourceFileName,
-		"destinationPath", destinationPath,
-		"clusterName", helper.GetCluster().Name,
+		"walKey", walKey,
+		"clusterName", clusterName,
 	)
 
 	contextLogger.Info("Archiving WAL File")
-	err = fileutils.CopyFile(request.SourceFileName, destinationPath)
+	lagging, err := destinations.Put(ctx, walKey, request.SourceFileName, putOptions)
 	if err != nil {
-		contextLogger.Error(err, "Error archiving WAL file")
+		contextLogger.Error(err, "Error archiving WAL file", "laggingDestinations", lagging)
+		return nil, err
+	}
+
+	walPrefix := storage.GetWALKey(clusterName)
+	catchUp := func(ctx context.Context) error {
+		filter, err := getCatchUpFilter(ctx, clusterName, helper.GetCluster().Namespace, helper.Parameters)
+		if err != nil {
+			return err
+		}
+		return destinations.CatchUp(ctx, walPrefix, putOptions, filter)
+	}
+	switch {
+	case len(lagging) > 0:
+		contextLogger.Info(
+			"WAL file not archived in every destination, scheduling catch up",
+			"laggingDestinations", lagging)
+		storage.RequestCatchUp(ctx, walPrefix, catchUp)
+
+	case len(destinations.Stores) > 1:
+		// The destinations lagging before a restart of the
+		// sidecar are caught up after the first archived WAL
+		storage.RequestStartupCatchUp(ctx, walPrefix, catchUp)
 	}
 
-	return &wal.WALArchiveResult{}, err
+	return &wal.WALArchiveResult{}, nil
 }
 
-// Restore copies WAL file from the archive to the data directory
+// Restore copies WAL file from the archive to the data directory,
+// trying every configured restore source in order
 func (WAL) Restore(
 	ctx context.Context,
 	request *wal.WALRestoreRequest,
@@ -73,19 +108,66 @@ func (WAL) Restore(
 		return nil, err
 	}
 
-	walFilePath := storage.GetWALFilePath(helper.GetCluster().Name, request.SourceWalName)
+	clusterName := helper.GetCluster().Name
+	sources, err := newRestoreSourcesFromParameters(clusterName, helper.Parameters)
+	if err != nil {
+		contextLogger.Error(err, "Error while reading the restore sources configuration")
+		return nil, err
+	}
+
+	walKey := storage.GetWALFileKey(sources.clusterName, request.SourceWalName)
 	contextLogger = contextLogger.WithValues(
-		"clusterName", helper.GetCluster().Name,
+		"clusterName", clusterName,
+		"sourceClusterName", sources.clusterName,
 		"walName", request.SourceWalName,
-		"walFilePath", walFilePath,
+		"walKey", walKey,
 		"destinationPath", request.DestinationFileName,
 	)
 
 	contextLogger.Info("Restoring WAL File")
-	err = fileutils.CopyFile(walFilePath, request.DestinationFileName)
-	if err != nil {
-		contextLogger.Info("Restored WAL File", "err", err)
+	var failures []error
+	for i := range sources.sources {
+		source := &sources.sources[i]
+		sourceLogger := contextLogger.WithValues("source", source.name)
+
+		startTime := time.Now()
+		err := source.restore(ctx, sources.spool, walKey, request.SourceWalName, request.DestinationFileName)
+		metrics.WALRestoreDuration.WithLabelValues(source.name).Observe(time.Since(startTime).Seconds())
+
+		switch {
+		case err == nil:
+			metrics.WALRestoreTotal.WithLabelValues(source.name, restoreResultRestored).Inc()
+			sourceLogger.Info("Restored WAL File", "elapsed", time.Since(startTime))
+			sources.startPrefetch(ctx, source, request.SourceWalName)
+			return &wal.WALRestoreResult{}, nil
+
+		case errors.Is(err, storage.ErrObjectNotFound):
+			metrics.WALRestoreTotal.WithLabelValues(source.name, restoreResultNotFound).Inc()
+			sourceLogger.V(4).Info("WAL File not found in source")
+
+		case errors.Is(err, storage.ErrObjectArchived):
+			metrics.WALRestoreTotal.WithLabelValues(source.name, restoreResultArchived).Inc()
+			sourceLogger.Error(err,
+				"WAL File is in the archive tier and needs to be rehydrated "+
+					"before being restored, trying the next source")
+			failures = append(failures, fmt.Errorf("%s: %w", source.name, err))
+
+		default:
+			metrics.WALRestoreTotal.WithLabelValues(source.name, restoreResultFailed).Inc()
+			sourceLogger.Error(err, "Error while restoring WAL File, trying the next source")
+			failures = append(failures, fmt.Errorf("%s: %w", source.name, err))
+		}
+	}
+
+	// PostgreSQL handles a missing WAL file as the end of the archive,
+	// so it is only reported when no source failed
+	if len(failures) > 0 {
+		err = fmt.Errorf("while restoring WAL file %s: %w", request.SourceWalName, errors.Join(failures...))
+		contextLogger.Error(err, "WAL File not restored")
+		return nil, err
 	}
 
-	return &wal.WALRestoreResult{}, err
+	err = fmt.Errorf("WAL file %s not found in any restore source", request.SourceWalName)
+	contextLogger.Info("WAL File not restored", "err", err)
+	return nil, err
 }
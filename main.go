@@ -4,14 +4,19 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/cloudnative-pg/cnpg-i-machinery/pkg/logging"
 	"github.com/cloudnative-pg/cnpg-i-machinery/pkg/pluginhelper"
 	"github.com/cloudnative-pg/cnpg-i/pkg/backup"
 	"github.com/cloudnative-pg/cnpg-i/pkg/operator"
 	"github.com/cloudnative-pg/cnpg-i/pkg/wal"
+	"github.com/spf13/cobra"
 	"google.golang.org/grpc"
 
 	backupImpl "github.com/dougkirkley/plugin-objstore-backup/internal/backup"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/deletion"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/backup/verify"
 	"github.com/dougkirkley/plugin-objstore-backup/internal/identity"
+	"github.com/dougkirkley/plugin-objstore-backup/internal/metrics"
 	operatorImpl "github.com/dougkirkley/plugin-objstore-backup/internal/operator"
 	walImpl "github.com/dougkirkley/plugin-objstore-backup/internal/wal"
 )
@@ -22,6 +27,44 @@ func main() {
 		wal.RegisterWALServer(server, walImpl.WAL{})
 		backup.RegisterBackupServer(server, backupImpl.BackupServer{})
 	})
+
+	cmd.Flags().String(
+		"metrics-bind-address",
+		"",
+		"The address the metrics server binds to, disabled when empty",
+	)
+	cmd.Flags().Bool(
+		"reconcile-backups",
+		false,
+		"Delete the backups from the object store when their Backup objects are deleted. "+
+			"Enabled in the plugin running beside the operator",
+	)
+
+	run := cmd.RunE
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		contextLogger := logging.FromContext(cmd.Context())
+		if address, _ := cmd.Flags().GetString("metrics-bind-address"); len(address) > 0 {
+			go func() {
+				if err := metrics.Serve(cmd.Context(), address); err != nil {
+					contextLogger.Error(err, "Error while serving metrics")
+				}
+			}()
+		}
+
+		if reconcile, _ := cmd.Flags().GetBool("reconcile-backups"); reconcile {
+			go func() {
+				if err := operatorImpl.StartBackupReconciler(cmd.Context()); err != nil {
+					contextLogger.Error(err, "Error while reconciling backups")
+				}
+			}()
+		}
+
+		return run(cmd, args)
+	}
+
+	cmd.AddCommand(verify.NewCmd())
+	cmd.AddCommand(deletion.NewCmd())
+
 	err := cmd.Execute()
 	if err != nil {
 		fmt.Println(err)